@@ -6,7 +6,10 @@
 
 GORACE="halt_on_error=1"
 BUILD_DIR=$HOME/influxdb-build
-GO_VERSION=go1.4
+GO_VERSION=go1.19
+
+# Build in GOPATH mode; the repo has no go.mod.
+export GO111MODULE=off
 
 # Executes the given statement, and exits if the command returns a non-zero code.
 function exit_if_fail {
@@ -23,7 +26,6 @@ function exit_if_fail {
 
 source $HOME/.gvm/scripts/gvm
 exit_if_fail gvm use $GO_VERSION
-exit_if_fail go get golang.org/x/tools/cmd/vet
 
 # Set up the build directory, and then GOPATH.
 exit_if_fail mkdir $BUILD_DIR
@@ -42,7 +44,7 @@ exit_if_fail git checkout $CIRCLE_BRANCH # 'go get' switches to master. Who knew
 exit_if_fail go build -v ./...
 
 # Run the tests.
-exit_if_fail go tool vet .
+exit_if_fail go vet ./...
 case $CIRCLE_NODE_INDEX in
     0)
         exit_if_fail go test -p 1 -v -timeout 300s ./...
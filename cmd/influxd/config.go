@@ -17,6 +17,7 @@ import (
 	"github.com/influxdb/influxdb/collectd"
 	"github.com/influxdb/influxdb/graphite"
 	"github.com/influxdb/influxdb/opentsdb"
+	"github.com/influxdb/influxdb/statsd"
 )
 
 const (
@@ -165,6 +166,7 @@ type Config struct {
 	Graphites []Graphite `toml:"graphite"`
 	Collectd  Collectd   `toml:"collectd"`
 	OpenTSDB  OpenTSDB   `toml:"opentsdb"`
+	StatsD    StatsD     `toml:"statsd"`
 
 	UDP struct {
 		Enabled     bool   `toml:"enabled"`
@@ -447,7 +449,7 @@ type Collectd struct {
 	TypesDB  string `toml:"typesdb"`
 }
 
-// ConnnectionString returns the connection string for this collectd config in the form host:port.
+// ConnectionString returns the connection string for this collectd config in the form host:port.
 func (c *Collectd) ConnectionString(defaultBindAddr string) string {
 	addr := c.BindAddress
 	// If no address specified, use default.
@@ -464,6 +466,34 @@ func (c *Collectd) ConnectionString(defaultBindAddr string) string {
 	return fmt.Sprintf("%s:%d", addr, port)
 }
 
+type StatsD struct {
+	BindAddress string `toml:"bind-address"`
+	Port        uint16 `toml:"port"`
+
+	Database        string    `toml:"database"`
+	RetentionPolicy string    `toml:"retention-policy"`
+	Enabled         bool      `toml:"enabled"`
+	FlushInterval   Duration  `toml:"flush-interval"`
+	Percentiles     []float64 `toml:"percentiles"`
+}
+
+// ConnectionString returns the connection string for this StatsD config in the form host:port.
+func (c *StatsD) ConnectionString(defaultBindAddr string) string {
+	addr := c.BindAddress
+	// If no address specified, use default.
+	if addr == "" {
+		addr = defaultBindAddr
+	}
+
+	port := c.Port
+	// If no port specified, use default.
+	if port == 0 {
+		port = statsd.DefaultPort
+	}
+
+	return fmt.Sprintf("%s:%d", addr, port)
+}
+
 type Graphite struct {
 	BindAddress string `toml:"bind-address"`
 	Port        uint16 `toml:"port"`
@@ -475,7 +505,7 @@ type Graphite struct {
 	NameSeparator string `toml:"name-separator"`
 }
 
-// ConnnectionString returns the connection string for this Graphite config in the form host:port.
+// ConnectionString returns the connection string for this Graphite config in the form host:port.
 func (g *Graphite) ConnectionString(defaultBindAddr string) string {
 
 	addr := g.BindAddress
@@ -94,6 +94,14 @@ port = 4242
 database = "opentsdb_database"
 retention-policy = "raw"
 
+# Configure StatsD server
+[statsd]
+enabled = true
+bind-address = "192.168.0.4"
+database = "statsd_database"
+flush-interval = "30s"
+percentiles = [90.0, 99.9]
+
 # Broker configuration
 [broker]
 # The broker port should be open between all servers in a cluster.
@@ -244,6 +252,19 @@ func TestParseConfig(t *testing.T) {
 		t.Errorf("collectd retention-policy mismatch: expected %v, got %v", "foo-db-type", c.OpenTSDB.RetentionPolicy)
 	}
 
+	switch {
+	case c.StatsD.Enabled != true:
+		t.Errorf("statsd enabled mismatch: expected: %v, got %v", true, c.StatsD.Enabled)
+	case c.StatsD.ConnectionString(c.BindAddress) != "192.168.0.4:8125":
+		t.Errorf("statsd connection string mismatch: expected %v, got  %v", "192.168.0.4:8125", c.StatsD.ConnectionString(c.BindAddress))
+	case c.StatsD.Database != "statsd_database":
+		t.Errorf("statsd database mismatch: expected %v, got %v", "statsd_database", c.StatsD.Database)
+	case time.Duration(c.StatsD.FlushInterval) != 30*time.Second:
+		t.Errorf("statsd flush-interval mismatch: expected %v, got %v", 30*time.Second, c.StatsD.FlushInterval)
+	case !reflect.DeepEqual(c.StatsD.Percentiles, []float64{90, 99.9}):
+		t.Errorf("statsd percentiles mismatch: expected %v, got %v", []float64{90, 99.9}, c.StatsD.Percentiles)
+	}
+
 	if c.Broker.Dir != "/tmp/influxdb/development/broker" {
 		t.Fatalf("broker dir mismatch: %v", c.Broker.Dir)
 	}
@@ -22,6 +22,7 @@ import (
 	"github.com/influxdb/influxdb/messaging"
 	"github.com/influxdb/influxdb/opentsdb"
 	"github.com/influxdb/influxdb/raft"
+	"github.com/influxdb/influxdb/statsd"
 	"github.com/influxdb/influxdb/udp"
 )
 
@@ -326,6 +327,23 @@ func (cmd *RunCommand) Open(config *Config, join string) *Node {
 			}
 		}
 
+		// Spin up the StatsD server
+		if cmd.config.StatsD.Enabled {
+			c := cmd.config.StatsD
+			ss := statsd.NewServer(s)
+			ss.Database = c.Database
+			ss.RetentionPolicy = c.RetentionPolicy
+			if c.FlushInterval > 0 {
+				ss.FlushInterval = time.Duration(c.FlushInterval)
+			}
+			if len(c.Percentiles) > 0 {
+				ss.Timers.Percentiles = c.Percentiles
+			}
+			if err := ss.ListenAndServe(c.ConnectionString(cmd.config.BindAddress)); err != nil {
+				log.Printf("failed to start StatsD Server: %v\n", err.Error())
+			}
+		}
+
 		// Start the server bound to a UDP listener
 		if cmd.config.UDP.Enabled {
 			log.Printf("Starting UDP listener on %s", cmd.config.APIAddrUDP())
@@ -384,9 +402,12 @@ func (cmd *RunCommand) Open(config *Config, join string) *Node {
 			}
 
 			os := opentsdb.NewServer(s, policy, db)
+			os.Publish("opentsdb")
 
 			log.Println("Starting OpenTSDB service on", laddr)
-			go os.ListenAndServe(laddr)
+			if err := os.ListenAndServe(laddr); err != nil {
+				log.Fatalf("failed to start OpenTSDB server: %s", err.Error())
+			}
 		}
 
 		// Start up self-monitoring if enabled.
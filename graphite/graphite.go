@@ -3,12 +3,21 @@ package graphite
 import (
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"math"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/client"
+	"github.com/influxdb/influxdb/internal/ingest"
 )
 
 const (
@@ -17,6 +26,17 @@ const (
 
 	// DefaultGraphiteNameSeparator represents the default Graphite field separator.
 	DefaultGraphiteNameSeparator = "."
+
+	// DefaultSelfMetricMeasurement is the default measurement of the
+	// heartbeat written every SelfMetricInterval.
+	DefaultSelfMetricMeasurement = "ingest.graphite.up"
+
+	// DefaultMaxSpillBytes is the default maximum size of a spill file.
+	DefaultMaxSpillBytes = ingest.DefaultMaxSpillBytes
+
+	// coarseTimestampLogEvery is how often points with coarse timestamps
+	// are logged by LogCoarseTimestamps.
+	coarseTimestampLogEvery = 1000
 )
 
 var (
@@ -29,12 +49,24 @@ var (
 
 	// ErrServerNotSpecified returned when Server is not specified.
 	ErrServerNotSpecified = errors.New("server not present")
+
+	// ErrDatabaseRequired is returned when starting a server without a
+	// database or a WriterRouter.
+	ErrDatabaseRequired = errors.New("database required")
+
+	// ErrCloseTimeout is returned by UDPServer.Close when CloseTimeout
+	// elapses before the pending points are written. Close stops waiting
+	// for the flush, which carries on in the background and may still
+	// write to the server's writer.
+	ErrCloseTimeout = errors.New("close timed out, flush of pending points abandoned")
+
+	// ErrNoData is returned when parsing a line whose value is "nan" or
+	// "null", which some emitters send when there is no data for an interval.
+	ErrNoData = errors.New("no data")
 )
 
 // SeriesWriter defines the interface for the destination of the data.
-type SeriesWriter interface {
-	WriteSeries(string, string, []influxdb.Point) (uint64, error)
-}
+type SeriesWriter = ingest.SeriesWriter
 
 // Server defines the interface all Graphite servers support.
 type Server interface {
@@ -53,48 +85,797 @@ func NewServer(protocol string, p *Parser, s SeriesWriter, db string) (Server, e
 	}
 }
 
+// TagValuePolicy determines how tag values longer than the configured limit are handled.
+type TagValuePolicy int
+
+const (
+	// TruncateTagValue truncates over-length tag values to the limit.
+	TruncateTagValue TagValuePolicy = iota
+
+	// DropTagValue drops any line containing an over-length tag value.
+	DropTagValue
+)
+
+// FieldOrder is the order of the value and timestamp tokens in a line.
+type FieldOrder int
+
+const (
+	// ValueTimestamp is the standard "name value timestamp" order.
+	ValueTimestamp FieldOrder = iota
+
+	// TimestampValue is the "name timestamp value" order. The timestamp must
+	// be a whole number of seconds.
+	TimestampValue
+)
+
+// QueueFullPolicy determines what happens to points written while the write queue is full.
+type QueueFullPolicy int
+
+const (
+	// DropWhenQueueFull drops the point, preserving the best-effort
+	// semantics of UDP.
+	DropWhenQueueFull QueueFullPolicy = iota
+
+	// BlockWhenQueueFull waits for space in the queue, applying backpressure
+	// to the reader.
+	BlockWhenQueueFull
+)
+
+// handler parses Graphite lines and writes the resulting points. It holds the
+// configuration shared by the TCP and UDP servers.
+type handler struct {
+	writer   SeriesWriter
+	parser   *Parser
+	database string
+
+	// SampleRate is the fraction of series, between 0 and 1, whose points are
+	// written. Series are selected by a hash of the series key so that every
+	// point of a selected series is written. Defaults to 1.
+	SampleRate float64
+
+	// MaxTrackedMeasurements is the number of measurements for which point
+	// counts are kept, evicting the least recently seen. Zero disables
+	// per-measurement counts.
+	MaxTrackedMeasurements int
+
+	// BatchSize is the number of points buffered before they are written.
+	// Zero disables batching.
+	BatchSize int
+
+	// BatchTimeout is the maximum time a partial batch is buffered before it
+	// is written. Zero means partial batches wait for Flush, Drain or Close.
+	BatchTimeout time.Duration
+
+	// MaxBatchBytes, if non-zero, writes a batch early once the estimated
+	// size of its points reaches this many bytes.
+	MaxBatchBytes int
+
+	// BreakerThreshold is the number of consecutive failed writes after which
+	// points are dropped, rather than written, for BreakerCooldown. A single
+	// write then tests whether writes succeed again. Zero disables the breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// MaxConcurrentWrites, if non-zero, is the maximum number of writes made
+	// to the writer at once, whether from connections, the queue or batch
+	// timeouts. Further writes wait for one to complete.
+	MaxConcurrentWrites int
+
+	// WriteRetries is the number of times a failed write is retried, waiting
+	// WriteRetryInterval between attempts.
+	WriteRetries       int
+	WriteRetryInterval time.Duration
+
+	// SpillPath, if set, is a file to which points are appended when their
+	// write still fails after retrying, so that they can be written later by
+	// ReplaySpill. Points are dropped once the file would grow beyond
+	// MaxSpillBytes.
+	SpillPath     string
+	MaxSpillBytes int64
+
+	// QueueSize is the number of points which may wait to be written by a
+	// separate goroutine, so that slow writes don't delay reading. Zero
+	// writes points as they are read.
+	QueueSize int
+
+	// QueueFullPolicy determines what happens to points when the queue is full.
+	QueueFullPolicy QueueFullPolicy
+
+	// WriterRouter, if set, selects the writer for each point, such as by
+	// tenant. Points for which it returns nil are written to the server's
+	// writer.
+	WriterRouter func(p influxdb.Point) SeriesWriter
+
+	// RetentionPolicyForMetric maps measurement names, exactly or by glob
+	// pattern as matched by path.Match, to the retention policy their points
+	// are written to. An exact match is preferred, then the first matching
+	// pattern in sorted order. Other points are written to the database's
+	// default retention policy. The patterns are sorted when the server
+	// starts, so the map must not be changed after that.
+	RetentionPolicyForMetric map[string]string
+
+	// TagFilters, keyed by tag key, drop parsed points whose tag values they
+	// do not allow, such as those tagged env=dev by a template. Dropped
+	// points are counted as "pointsFilteredByTag".
+	TagFilters map[string]TagFilter
+
+	// Processors are applied in order to each parsed point, and may drop,
+	// modify or split it, before it is written. Dropped points are counted as
+	// "pointsDroppedByProcessor".
+	Processors []influxdb.PointProcessor
+
+	// NewFramer, if set, returns the Framer used to read lines from a
+	// connection or datagram. Defaults to NewLineFramer.
+	NewFramer func(r io.Reader) Framer
+
+	// Precision, if set, is the precision to which timestamps are rounded
+	// before points are written: "n", "u", "ms", "s", "m" or "h".
+	Precision string
+
+	// SanitizeName replaces the characters of measurement names which are
+	// significant in line protocol or may corrupt storage, commas, spaces
+	// and control characters such as newlines, with "_" before points are
+	// written. NameSanitizer, if set, is used instead. Changed names are
+	// counted as "namesSanitized".
+	SanitizeName  bool
+	NameSanitizer func(name string) string
+
+	// MaxAbsValue, if non-zero, drops points with a numeric field whose
+	// absolute value exceeds it, which usually indicates a parse or unit
+	// bug. Dropped points are counted as "pointsValueOverLimit".
+	MaxAbsValue float64
+
+	// OverrideTimestampWithNow replaces the timestamp of every point with
+	// the time it is received, for senders whose clocks are unreliable.
+	OverrideTimestampWithNow bool
+
+	// WarnCoarseTimestamps counts points, as "coarseTimestamps", whose
+	// timestamp has no sub-second component, to help find senders which
+	// send whole seconds when fractions are expected. LogCoarseTimestamps
+	// also logs the first such point and every coarseTimestampLogEvery after
+	// it. Points are written either way.
+	WarnCoarseTimestamps bool
+	LogCoarseTimestamps  bool
+
+	// FlushInterval, if non-zero, writes only the most recent point of each
+	// series and field received in each interval, reducing the write volume
+	// of series sent more often than they are needed.
+	FlushInterval time.Duration
+
+	// AutoFlushInterval, if non-zero, calls Flush at this interval so that
+	// held, queued and buffered points are written even if no batch fills.
+	AutoFlushInterval time.Duration
+
+	// SelfMetricInterval, if non-zero, writes a heartbeat point with the
+	// field value=1 to SelfMetricMeasurement at this interval until the
+	// server is closed, so that its liveness can be monitored in the
+	// database it writes to.
+	SelfMetricInterval    time.Duration
+	SelfMetricMeasurement string
+
+	autoFlushEnd  chan struct{}
+	autoFlushDone chan struct{}
+
+	selfMetricEnd  chan struct{}
+	selfMetricDone chan struct{}
+
+	latest     *latestPoints
+	latestEnd  chan struct{}
+	latestDone chan struct{}
+
+	queue      chan influxdb.Point
+	queueFlush chan chan struct{}
+	queueDone  chan struct{}
+
+	shutdown *sync.Once // runs stop once, from flush
+
+	batch        *BufferedSeriesWriter
+	spill        *ingest.SpillWriter
+	stats        *influxdb.Stats
+	interval     *ingest.IntervalStats
+	coarse       *uint64 // coarse timestamps seen, accessed atomically
+	measurements *ingest.MeasurementCounts
+	policies     *ingest.MetricMatcher // RetentionPolicyForMetric, set by open
+
+	Logger *log.Logger
+}
+
+func newHandler(p *Parser, w SeriesWriter, db string) handler {
+	h := handler{
+		parser:                 p,
+		database:               db,
+		SampleRate:             1,
+		MaxTrackedMeasurements: DefaultMaxTrackedMeasurements,
+		MaxSpillBytes:          DefaultMaxSpillBytes,
+		SelfMetricMeasurement:  DefaultSelfMetricMeasurement,
+		stats:                  influxdb.NewStats("graphite"),
+		interval:               new(ingest.IntervalStats),
+		coarse:                 new(uint64),
+		shutdown:               new(sync.Once),
+		measurements:           ingest.NewMeasurementCounts(),
+		Logger:                 log.New(os.Stderr, "[graphite] ", log.LstdFlags),
+	}
+	h.spill = &ingest.SpillWriter{Writer: ingest.NewLimitWriter(&ingest.RoutingWriter{Writer: w}, h.stats), Stats: h.stats}
+	h.writer = &ingest.CircuitBreaker{
+		Writer: &ingest.StatsWriter{Writer: h.spill, Stats: h.stats, Logger: h.Logger},
+		Stats:  h.stats,
+	}
+	return h
+}
+
+// Stats returns a snapshot of the server's statistics, including the number
+// of points received for each tracked measurement.
+func (h *handler) Stats() *Stats {
+	return &Stats{Stats: h.stats.Snapshot(), Measurements: h.measurements.Snapshot()}
+}
+
+// SnapshotAndReset returns the server's statistics counted since the
+// previous call, so that successive snapshots hold the counts for each
+// interval between them. Gauges, such as activeConnections, are returned at
+// their current level. The totals returned by Stats and reported by the
+// Prometheus collector are not reset.
+func (h *handler) SnapshotAndReset() *influxdb.Stats {
+	return h.interval.Next(h.stats, ingest.GaugeStats...)
+}
+
+// ReplaySpill writes the points in the spill file and removes them from it.
+// It returns the number of points written. If a write fails, the points not
+// yet written are kept for a later replay and the error is returned.
+func (h *handler) ReplaySpill() (int, error) {
+	if h.SpillPath == "" {
+		return 0, nil
+	}
+	return h.spill.Replay(h.SpillPath)
+}
+
+// validate returns an error if the handler cannot be started as configured.
+func (h *handler) validate() error {
+	if h.database == "" && h.WriterRouter == nil {
+		return ErrDatabaseRequired
+	}
+	return nil
+}
+
+// open prepares the handler for writing once it has been configured.
+func (h *handler) open() {
+	h.policies = ingest.NewMetricMatcher(h.RetentionPolicyForMetric)
+	if cb, ok := h.writer.(*ingest.CircuitBreaker); ok {
+		cb.Config = func() (int, time.Duration) { return h.BreakerThreshold, h.BreakerCooldown }
+		if sw, ok := cb.Writer.(*ingest.StatsWriter); ok {
+			sw.Logger = h.Logger
+		}
+	}
+	h.spill.Config = func() ingest.SpillConfig {
+		return ingest.SpillConfig{Retries: h.WriteRetries, Interval: h.WriteRetryInterval, Path: h.SpillPath, MaxBytes: h.MaxSpillBytes}
+	}
+	if lw, ok := h.spill.Writer.(*ingest.LimitWriter); ok {
+		lw.Limit = func() int { return h.MaxConcurrentWrites }
+		if rw, ok := lw.Writer.(*ingest.RoutingWriter); ok {
+			rw.Route = h.WriterRouter
+		}
+	}
+	if h.BatchSize > 0 {
+		h.batch = NewBufferedSeriesWriter(h.writer, h.BatchSize, h.BatchTimeout)
+		h.batch.MaxBatchBytes = h.MaxBatchBytes
+		h.batch.Logger = h.Logger
+	}
+	if h.QueueSize > 0 {
+		h.queue = make(chan influxdb.Point, h.QueueSize)
+		h.queueFlush = make(chan chan struct{})
+		h.queueDone = make(chan struct{})
+		go h.processQueue(h.queue, h.queueFlush, h.queueDone)
+	}
+	if h.FlushInterval > 0 {
+		h.latest = newLatestPoints()
+		h.latestEnd = make(chan struct{})
+		h.latestDone = make(chan struct{})
+		go h.processLatest(h.latestEnd, h.latestDone)
+	}
+	if h.AutoFlushInterval > 0 {
+		h.autoFlushEnd = make(chan struct{})
+		h.autoFlushDone = make(chan struct{})
+		go h.processAutoFlush(h.autoFlushEnd, h.autoFlushDone)
+	}
+	if h.SelfMetricInterval > 0 {
+		h.selfMetricEnd = make(chan struct{})
+		h.selfMetricDone = make(chan struct{})
+		go h.processSelfMetric(h.selfMetricEnd, h.selfMetricDone)
+	}
+}
+
+// processSelfMetric writes a heartbeat every SelfMetricInterval until end is
+// closed, then closes done. Heartbeats are written directly to the writer,
+// rather than held or batched, so that they arrive on time.
+func (h *handler) processSelfMetric(end <-chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	t := time.NewTicker(h.SelfMetricInterval)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			p := influxdb.Point{
+				Name:      h.SelfMetricMeasurement,
+				Fields:    map[string]interface{}{"value": 1.0},
+				Timestamp: now,
+			}
+			if _, err := h.writer.WriteSeries(h.database, h.policies.Match(p.Name), []influxdb.Point{p}); err != nil {
+				h.Logger.Printf("failed to write heartbeat to database %q: %s\n", h.database, err)
+			}
+		case <-end:
+			return
+		}
+	}
+}
+
+// processAutoFlush calls Flush every AutoFlushInterval until end is closed,
+// then closes done.
+func (h *handler) processAutoFlush(end <-chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	t := time.NewTicker(h.AutoFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := h.Flush(); err != nil {
+				h.Logger.Printf("failed to write data points to database %q: %s\n", h.database, err)
+			}
+		case <-end:
+			return
+		}
+	}
+}
+
+// processLatest writes the most recent points every FlushInterval until
+// end is closed, then writes any remaining points and closes done.
+func (h *handler) processLatest(end <-chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	t := time.NewTicker(h.FlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			h.writeLatest()
+		case <-end:
+			h.writeLatest()
+			return
+		}
+	}
+}
+
+// writeLatest queues or writes the most recent point of each series.
+func (h *handler) writeLatest() {
+	for _, p := range h.latest.take() {
+		h.enqueue(p)
+	}
+}
+
+// processQueue writes points from queue until it is closed, then closes done.
+// A channel received from flush is closed once the points queued before it
+// have been written.
+func (h *handler) processQueue(queue <-chan influxdb.Point, flush <-chan chan struct{}, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case p, ok := <-queue:
+			if !ok {
+				return
+			}
+			h.write(p)
+		case c := <-flush:
+			for n := len(queue); n > 0; n-- {
+				if p, ok := <-queue; ok {
+					h.write(p)
+				}
+			}
+			close(c)
+		}
+	}
+}
+
+// Flush writes any held, queued and buffered points without waiting for
+// FlushInterval, BatchSize or BatchTimeout. The first write error is
+// returned. Flush must not be called concurrently with Drain or Close.
+func (h *handler) Flush() error {
+	if h.latest != nil {
+		h.writeLatest()
+	}
+
+	if h.queue != nil {
+		// The queue is no longer processed once the handler is flushed.
+		c := make(chan struct{})
+		select {
+		case h.queueFlush <- c:
+			<-c
+		case <-h.queueDone:
+		}
+	}
+
+	if h.batch == nil {
+		return nil
+	}
+	return h.batch.Flush()
+}
+
+// flush writes any held, queued and buffered points. No points may be
+// written once the handler has been flushed. The background goroutines are
+// stopped only by the first call; later calls, such as a Close after a Drain
+// which timed out, wait for it to finish rather than stopping them again.
+func (h *handler) flush() {
+	h.shutdown.Do(h.stop)
+}
+
+// stop stops the handler's background goroutines and writes any buffered
+// points. It must only be called once, by flush.
+func (h *handler) stop() {
+	if h.selfMetricEnd != nil {
+		close(h.selfMetricEnd)
+		<-h.selfMetricDone
+	}
+
+	if h.autoFlushEnd != nil {
+		close(h.autoFlushEnd)
+		<-h.autoFlushDone
+	}
+
+	if h.latestEnd != nil {
+		close(h.latestEnd)
+		<-h.latestDone
+	}
+
+	if h.queue != nil {
+		close(h.queue)
+		<-h.queueDone
+	}
+
+	if h.batch == nil {
+		return
+	}
+	if err := h.batch.Flush(); err != nil {
+		h.Logger.Printf("failed to write data points to database %q: %s\n", h.database, err)
+	}
+}
+
+// framer returns a Framer reading lines from r.
+func (h *handler) framer(r io.Reader) Framer {
+	if h.NewFramer != nil {
+		return h.NewFramer(r)
+	}
+	return NewLineFramer(r)
+}
+
+// handleLine parses a single line and writes the resulting points. Lines
+// without data are counted and skipped.
+func (h *handler) handleLine(line string) error {
+	points, err := h.parser.ParseAll(line)
+	if err == ErrNoData {
+		h.stats.Inc("linesNoData")
+		return nil
+	} else if err != nil {
+		h.stats.Inc("parseErrors")
+		return err
+	}
+	h.stats.Add("pointsReceived", int64(len(points)))
+	for _, p := range points {
+		if h.MaxAbsValue > 0 && ingest.ExceedsAbsValue(p.Fields, h.MaxAbsValue) {
+			h.stats.Inc("pointsValueOverLimit")
+			err = fmt.Errorf("value of %s exceeds maximum magnitude %g, skipping", p.Name, h.MaxAbsValue)
+			continue
+		}
+		if len(h.TagFilters) > 0 && !tagsAllowed(h.TagFilters, p.Tags) {
+			h.stats.Inc("pointsFilteredByTag")
+			continue
+		}
+		if len(h.Processors) == 0 {
+			h.writePoint(p)
+			continue
+		}
+		processed := influxdb.ProcessPoint(h.Processors, p)
+		if len(processed) == 0 {
+			h.stats.Inc("pointsDroppedByProcessor")
+		}
+		for _, p := range processed {
+			h.writePoint(p)
+		}
+	}
+	return err
+}
+
+// writePoint rounds, counts, samples and holds or queues a single point.
+func (h *handler) writePoint(p influxdb.Point) {
+	if h.OverrideTimestampWithNow {
+		p.Timestamp = time.Now()
+	}
+	if h.SanitizeName {
+		p.Name = h.sanitizeName(p.Name)
+	}
+	if h.WarnCoarseTimestamps && p.Timestamp.Nanosecond() == 0 {
+		h.stats.Inc("coarseTimestamps")
+		if n := atomic.AddUint64(h.coarse, 1); h.LogCoarseTimestamps && n%coarseTimestampLogEvery == 1 {
+			h.Logger.Printf("timestamp of %q has no sub-second component: %s (%d seen)", p.Name, p.Timestamp, n)
+		}
+	}
+	p.Timestamp = client.SetPrecision(p.Timestamp, h.Precision)
+	h.measurements.Inc(p.Name, h.MaxTrackedMeasurements)
+
+	if !ingest.Sampled(p, h.SampleRate) {
+		h.stats.Inc("pointsSampledOut")
+		return
+	}
+
+	if h.latest != nil {
+		if h.latest.add(p) {
+			h.stats.Inc("pointsAggregated")
+		}
+		return
+	}
+	h.enqueue(p)
+}
+
+// enqueue queues or writes a single point.
+func (h *handler) enqueue(p influxdb.Point) {
+	if h.queue == nil {
+		h.write(p)
+	} else if h.QueueFullPolicy == BlockWhenQueueFull {
+		h.queue <- p
+	} else {
+		select {
+		case h.queue <- p:
+		default:
+			h.stats.Inc("pointsDroppedQueueFull")
+		}
+	}
+}
+
+// write sends a single point to the batch or writer, logging any failure.
+func (h *handler) write(p influxdb.Point) {
+	var w SeriesWriter = h.writer
+	if h.batch != nil {
+		w = h.batch
+	}
+
+	_, e := w.WriteSeries(h.database, h.policies.Match(p.Name), []influxdb.Point{p})
+	if e != nil {
+		h.Logger.Printf("failed to write data point to database %q: %s\n", h.database, e)
+	}
+}
+
+// sanitizeName returns the measurement name sanitized by NameSanitizer, or by
+// ingest.SanitizeName if it is not set.
+func (h *handler) sanitizeName(name string) string {
+	sanitized := ingest.SanitizeName
+	if h.NameSanitizer != nil {
+		sanitized = h.NameSanitizer
+	}
+	if v := sanitized(name); v != name {
+		h.stats.Inc("namesSanitized")
+		return v
+	}
+	return name
+}
+
 // Parser encapulates a Graphite Parser.
 type Parser struct {
 	Separator   string
 	LastEnabled bool
+
+	// MaxTagValueLength is the maximum length of a tag value. Zero means no limit.
+	MaxTagValueLength int
+
+	// TagValuePolicy determines what happens to lines with over-length tag values.
+	TagValuePolicy TagValuePolicy
+
+	// LowercaseNames lowercases the whole metric name before it is decoded.
+	LowercaseNames bool
+
+	// NameTransform, if set, is applied to the whole metric name before it is
+	// decoded into a measurement and tags, and after LowercaseNames.
+	NameTransform func(string) string
+
+	// DropLeadingSegments and DropTrailingSegments are the number of
+	// separator-delimited segments removed from the start and end of the
+	// metric name before it is decoded.
+	DropLeadingSegments  int
+	DropTrailingSegments int
+
+	// StrictTemplates makes names which match no template, when templates
+	// have been added and there is no default template, a parse error rather
+	// than decoding them as key.value.key.value.name.
+	StrictTemplates bool
+
+	// FieldOrder is the order of the value and timestamp tokens.
+	FieldOrder FieldOrder
+
+	// AllowCarbonNowTimestamp parses a timestamp of -1, which carbon and
+	// some tools send to mean "now", as the time the line is parsed. It is
+	// otherwise rejected. A timestamp of 0 is always rejected.
+	AllowCarbonNowTimestamp bool
+
+	// RawLineField, if set, is the name of a string field holding the
+	// original line, for debugging.
+	RawLineField string
+
+	// DerivePoints, if set, returns additional points derived from each parsed
+	// point, such as a value split into several measurements. They are
+	// returned after the parsed point by ParseAll. DerivePoints must not
+	// modify the parsed point's tags or fields.
+	DerivePoints func(p influxdb.Point) []influxdb.Point
+
+	templates []*template
+	stats     *influxdb.Stats
 }
 
 // NewParser returns a GraphiteParser instance.
 func NewParser() *Parser {
-	return &Parser{Separator: DefaultGraphiteNameSeparator}
+	return &Parser{
+		Separator: DefaultGraphiteNameSeparator,
+		stats:     influxdb.NewStats("graphite"),
+	}
 }
 
-// Parse performs Graphite parsing of a single line.
+// Stats returns a snapshot of the parser's statistics.
+func (p *Parser) Stats() *influxdb.Stats {
+	return p.stats.Snapshot()
+}
+
+// Parse performs Graphite parsing of a single line, returning the first of
+// the points parsed by ParseAll.
 func (p *Parser) Parse(line string) (influxdb.Point, error) {
+	points, err := p.ParseAll(line)
+	if err != nil {
+		return influxdb.Point{}, err
+	}
+	return points[0], nil
+}
+
+// ParseAll performs Graphite parsing of a single line, returning the parsed
+// point followed by any derived by DerivePoints.
+func (p *Parser) ParseAll(line string) ([]influxdb.Point, error) {
+	point, err := p.parseOne(line)
+	if err != nil {
+		return nil, err
+	}
+
+	points := []influxdb.Point{point}
+	if p.DerivePoints != nil {
+		points = append(points, p.DerivePoints(point)...)
+	}
+	return points, nil
+}
+
+// parseOne parses a single line into a single point.
+func (p *Parser) parseOne(line string) (influxdb.Point, error) {
+	if p.simple() {
+		if point, ok := p.parseSimple(line); ok {
+			return point, nil
+		}
+	}
+	return p.parse(line)
+}
+
+// simple returns true if no options are set which affect how a line without
+// tags is parsed.
+func (p *Parser) simple() bool {
+	return len(p.templates) == 0 && p.DropLeadingSegments == 0 && p.DropTrailingSegments == 0 &&
+		!p.LowercaseNames && p.NameTransform == nil && p.FieldOrder == ValueTimestamp && p.RawLineField == ""
+}
+
+// parseSimple parses a line whose name has no tags without splitting it into
+// a slice of tokens or looking for tags. It returns false for any other line,
+// including invalid ones, which must be parsed by parse.
+//
+// A new point is returned rather than a reused one, as batches, queues and
+// writers keep the points they are given. Its tag map is allocated so that
+// processors may add tags, and its single-entry field map holds the value.
+func (p *Parser) parseSimple(line string) (influxdb.Point, bool) {
+	name, valueStr, timestampStr, ok := splitThree(line)
+	if !ok || strings.Contains(name, p.Separator) {
+		return influxdb.Point{}, false
+	}
+
+	v, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil || math.IsNaN(v) {
+		return influxdb.Point{}, false
+	}
+	unixTime, err := strconv.ParseFloat(timestampStr, 64)
+	if err != nil || unixTime == 0 || unixTime == -1 {
+		return influxdb.Point{}, false
+	}
+
+	return influxdb.Point{
+		Name:      name,
+		Tags:      make(map[string]string),
+		Fields:    map[string]interface{}{name: v},
+		Timestamp: time.Unix(int64(unixTime), int64((unixTime-math.Floor(unixTime))*float64(time.Second))),
+	}, true
+}
+
+// splitThree splits an ASCII line into exactly three whitespace-separated
+// tokens. It returns false for any other number of tokens or a non-ASCII line.
+func splitThree(line string) (a, b, c string, ok bool) {
+	var tokens [3]string
+	var n int
+	for i := 0; i < len(line); {
+		if line[i] >= utf8.RuneSelf {
+			return "", "", "", false
+		} else if isSpace(line[i]) {
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(line) && line[j] < utf8.RuneSelf && !isSpace(line[j]) {
+			j++
+		}
+		if n == len(tokens) {
+			return "", "", "", false
+		}
+		tokens[n] = line[i:j]
+		n++
+		i = j
+	}
+	return tokens[0], tokens[1], tokens[2], n == len(tokens)
+}
+
+// isSpace returns true if c is an ASCII whitespace character.
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\v' || c == '\f' || c == '\r'
+}
+
+// parse parses a line using every configured option.
+func (p *Parser) parse(line string) (influxdb.Point, error) {
 	// Break into 3 fields (name, value, timestamp).
 	fields := strings.Fields(line)
 	if len(fields) != 3 {
 		return influxdb.Point{}, fmt.Errorf("received %q which doesn't have three fields", line)
 	}
+	valueStr, timestampStr := fields[1], fields[2]
+	if p.FieldOrder == TimestampValue {
+		valueStr, timestampStr = fields[2], fields[1]
+		if _, err := strconv.ParseInt(timestampStr, 10, 64); err != nil {
+			return influxdb.Point{}, fmt.Errorf("received %q whose timestamp %q is not a whole number of seconds", line, timestampStr)
+		}
+	}
 
 	// decode the name and tags
-	name, tags, err := p.DecodeNameAndTags(fields[0])
+	name, tags, fieldName, err := p.decode(fields[0])
 	if err != nil {
 		return influxdb.Point{}, err
 	}
 
 	// Parse value.
-	v, err := strconv.ParseFloat(fields[1], 64)
+	if strings.EqualFold(valueStr, "null") {
+		return influxdb.Point{}, ErrNoData
+	}
+	v, err := strconv.ParseFloat(valueStr, 64)
 	if err != nil {
 		return influxdb.Point{}, err
+	} else if math.IsNaN(v) {
+		return influxdb.Point{}, ErrNoData
 	}
 
 	fieldValues := make(map[string]interface{})
-	fieldValues[name] = v
+	fieldValues[fieldName] = v
+	if p.RawLineField != "" {
+		fieldValues[p.RawLineField] = line
+	}
 
 	// Parse timestamp.
-	unixTime, err := strconv.ParseFloat(fields[2], 64)
+	unixTime, err := strconv.ParseFloat(timestampStr, 64)
 	if err != nil {
 		return influxdb.Point{}, err
 	}
 
 	// Check if we have fractional seconds
 	timestamp := time.Unix(int64(unixTime), int64((unixTime-math.Floor(unixTime))*float64(time.Second)))
+	switch {
+	case unixTime == -1 && p.AllowCarbonNowTimestamp:
+		timestamp = time.Now()
+	case unixTime == 0 || unixTime == -1:
+		return influxdb.Point{}, fmt.Errorf("received %q whose timestamp %q is not valid", line, timestampStr)
+	}
 
 	point := influxdb.Point{
 		Name:      name,
@@ -108,37 +889,89 @@ func (p *Parser) Parse(line string) (influxdb.Point, error) {
 
 // DecodeNameAndTags parses the name and tags of a single field of a Graphite datum.
 func (p *Parser) DecodeNameAndTags(field string) (string, map[string]string, error) {
+	name, tags, _, err := p.decode(field)
+	return name, tags, err
+}
+
+// decode parses the name, tags and field name of a single field of a Graphite
+// datum. The field name is the measurement name unless a template provides one.
+func (p *Parser) decode(field string) (string, map[string]string, string, error) {
 	var (
-		name string
-		tags = make(map[string]string)
+		name      string
+		fieldName string
+		tags      = make(map[string]string)
 	)
 
-	// decode the name and tags
-	values := strings.Split(field, p.Separator)
-	if len(values)%2 != 1 {
-		// There should always be an odd number of fields to map a point name and tags
-		// ex: region.us-west.hostname.server01.cpu -> tags -> region: us-west, hostname: server01, point name -> cpu
-		return name, tags, fmt.Errorf("received %q which doesn't conform to format of key.value.key.value.name or name", field)
+	// strip unwanted segments, such as an environment prefix
+	if p.DropLeadingSegments > 0 || p.DropTrailingSegments > 0 {
+		segments := strings.Split(field, p.Separator)
+		if p.DropLeadingSegments+p.DropTrailingSegments >= len(segments) {
+			return name, tags, fieldName, fmt.Errorf("no name specified for metric after dropping segments. %q", field)
+		}
+		field = strings.Join(segments[p.DropLeadingSegments:len(segments)-p.DropTrailingSegments], p.Separator)
+	}
+
+	// normalize the name before it is split
+	if p.LowercaseNames {
+		field = strings.ToLower(field)
+	}
+	if p.NameTransform != nil {
+		field = p.NameTransform(field)
 	}
 
-	if p.LastEnabled {
-		name = values[len(values)-1]
-		values = values[0 : len(values)-1]
+	// decode the name and tags
+	values := strings.Split(field, p.Separator)
+	if t := p.matchTemplate(values); t != nil {
+		name, tags, fieldName = t.apply(values, p.Separator)
+	} else if len(p.templates) > 0 && p.StrictTemplates {
+		p.stats.Inc("templateUnmatched")
+		return name, tags, fieldName, fmt.Errorf("received %q which matches no template", field)
 	} else {
-		name = values[0]
-		values = values[1:]
+		if len(values)%2 != 1 {
+			// There should always be an odd number of fields to map a point name and tags
+			// ex: region.us-west.hostname.server01.cpu -> tags -> region: us-west, hostname: server01, point name -> cpu
+			return name, tags, fieldName, fmt.Errorf("received %q which doesn't conform to format of key.value.key.value.name or name", field)
+		}
+
+		if p.LastEnabled {
+			name = values[len(values)-1]
+			values = values[0 : len(values)-1]
+		} else {
+			name = values[0]
+			values = values[1:]
+		}
+
+		// Grab the pairs and throw them in the map
+		for i := 0; i < len(values); i += 2 {
+			tags[values[i]] = values[i+1]
+		}
 	}
 
 	if name == "" {
-		return name, tags, fmt.Errorf("no name specified for metric. %q", field)
+		return name, tags, fieldName, fmt.Errorf("no name specified for metric. %q", field)
+	}
+	if fieldName == "" {
+		fieldName = name
 	}
 
-	// Grab the pairs and throw them in the map
-	for i := 0; i < len(values); i += 2 {
-		k := values[i]
-		v := values[i+1]
-		tags[k] = v
+	if p.MaxTagValueLength > 0 {
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if v := tags[k]; len(v) > p.MaxTagValueLength {
+				if p.TagValuePolicy == DropTagValue {
+					p.stats.Inc("tagValueTooLong")
+					return name, tags, fieldName, fmt.Errorf("tag value for %q exceeds maximum length of %d", k, p.MaxTagValueLength)
+				}
+				p.stats.Inc("tagValueTruncated")
+				tags[k] = v[:p.MaxTagValueLength]
+			}
+		}
 	}
 
-	return name, tags, nil
+	return name, tags, fieldName, nil
 }
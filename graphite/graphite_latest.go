@@ -0,0 +1,64 @@
+package graphite
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// latestPoints holds the most recently received point of each series until it
+// is taken for writing.
+type latestPoints struct {
+	mu     sync.Mutex
+	keys   []string
+	points map[string]influxdb.Point
+}
+
+func newLatestPoints() *latestPoints {
+	return &latestPoints{points: make(map[string]influxdb.Point)}
+}
+
+// add replaces any held point of the series and fields of p with p. It
+// returns true if a point was replaced.
+func (v *latestPoints) add(p influxdb.Point) bool {
+	k := latestKey(p)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	_, ok := v.points[k]
+	if !ok {
+		v.keys = append(v.keys, k)
+	}
+	v.points[k] = p
+	return ok
+}
+
+// take removes and returns the held points, ordered by series key.
+func (v *latestPoints) take() []influxdb.Point {
+	v.mu.Lock()
+	keys, points := v.keys, v.points
+	v.keys, v.points = nil, make(map[string]influxdb.Point)
+	v.mu.Unlock()
+
+	sort.Strings(keys)
+	a := make([]influxdb.Point, len(keys))
+	for i, k := range keys {
+		a[i] = points[k]
+	}
+	return a
+}
+
+// latestKey returns the series key of p followed by its sorted field keys,
+// so that points of one series with different fields, such as those named
+// by a "field" template, are held separately.
+func latestKey(p influxdb.Point) string {
+	fields := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	return ingest.SeriesKey(p) + " " + strings.Join(fields, ",")
+}
@@ -0,0 +1,13 @@
+package graphite
+
+import (
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// DefaultMaxTrackedMeasurements is the default number of measurements for
+// which point counts are kept.
+const DefaultMaxTrackedMeasurements = ingest.DefaultMaxTrackedMeasurements
+
+// Stats is a snapshot of the server's statistics. Measurements holds the
+// number of points received for each tracked measurement.
+type Stats = ingest.Stats
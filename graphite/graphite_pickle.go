@@ -0,0 +1,464 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxPickleFrameBytes is the largest pickle frame accepted, matching the
+// limit carbon applies to its pickle receiver.
+const maxPickleFrameBytes = 1 << 20
+
+// ErrPickleFrameTooLarge is returned when a pickle frame's length prefix
+// exceeds maxPickleFrameBytes.
+var ErrPickleFrameTooLarge = errors.New("pickle frame too large")
+
+// isPickleFrame returns true if b, the first byte of a connection, looks
+// like the start of a carbon pickle frame. A frame begins with a four byte
+// big-endian length whose first byte is zero for any acceptable frame, while
+// a plaintext line never begins with a NUL. One byte is enough to tell them
+// apart, so detection never waits for more than the client has sent.
+func isPickleFrame(b []byte) bool {
+	return len(b) > 0 && b[0] == 0
+}
+
+// readPickleFrame reads a single length-prefixed pickle frame from r.
+func readPickleFrame(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxPickleFrameBytes {
+		return nil, ErrPickleFrameTooLarge
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// pickleMetric is a single datum of a carbon pickle frame.
+type pickleMetric struct {
+	path      string
+	timestamp string
+	value     string
+}
+
+// line returns the datum as a plaintext line in the parser's field order.
+func (m pickleMetric) line(order FieldOrder) string {
+	if order == TimestampValue {
+		return m.path + " " + m.timestamp + " " + m.value
+	}
+	return m.path + " " + m.value + " " + m.timestamp
+}
+
+// decodePickle decodes a carbon pickle frame, a list of
+// (path, (timestamp, value)) tuples. Only the opcodes needed to represent
+// such data, in protocols 0 to 4, are supported; frames using any others,
+// such as those constructing objects, are rejected.
+func decodePickle(data []byte) ([]pickleMetric, error) {
+	v, err := unpickle(data)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := v.(*pickleList)
+	if !ok {
+		return nil, fmt.Errorf("pickle frame is %T, not a list", v)
+	}
+
+	metrics := make([]pickleMetric, 0, len(*list))
+	for _, item := range *list {
+		t, ok := item.(pickleTuple)
+		if !ok || len(t) != 2 {
+			return nil, fmt.Errorf("pickle datum %v is not a (path, (timestamp, value)) tuple", item)
+		}
+		path, ok := t[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("pickle datum path %v is not a string", t[0])
+		}
+		tv, ok := t[1].(pickleTuple)
+		if !ok || len(tv) != 2 {
+			return nil, fmt.Errorf("pickle datum %v is not a (path, (timestamp, value)) tuple", item)
+		}
+		ts, err := pickleNumber(tv[0])
+		if err != nil {
+			return nil, fmt.Errorf("pickle datum %s timestamp: %s", path, err)
+		}
+		value, err := pickleNumber(tv[1])
+		if err != nil {
+			return nil, fmt.Errorf("pickle datum %s value: %s", path, err)
+		}
+		metrics = append(metrics, pickleMetric{path: path, timestamp: ts, value: value})
+	}
+	return metrics, nil
+}
+
+// pickleNumber formats a decoded number, or a string holding one, as text.
+func pickleNumber(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case nil:
+		return "null", nil
+	case string:
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return "", fmt.Errorf("%q is not a number", v)
+		}
+		return v, nil
+	}
+	return "", fmt.Errorf("%v is not a number", v)
+}
+
+// pickleList is a decoded list. Lists are held by pointer so that those
+// referenced from the memo see later appends.
+type pickleList []interface{}
+
+// pickleTuple is a decoded tuple.
+type pickleTuple []interface{}
+
+// unpickler holds the state of a restricted pickle decoder.
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	marks []int
+	memo  map[int]interface{}
+}
+
+// unpickle decodes a single pickled value from data.
+func unpickle(data []byte) (interface{}, error) {
+	u := &unpickler{data: data, memo: make(map[int]interface{})}
+	for {
+		op, err := u.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case 0x80: // PROTO
+			_, err = u.read(1)
+		case 0x95: // FRAME
+			_, err = u.read(8)
+		case '.': // STOP
+			v, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			return v, nil
+
+		case '(': // MARK
+			u.marks = append(u.marks, len(u.stack))
+		case ']': // EMPTY_LIST
+			u.push(&pickleList{})
+		case 'l': // LIST
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				l := pickleList(items)
+				u.push(&l)
+			}
+		case 'a': // APPEND
+			var v interface{}
+			if v, err = u.pop(); err == nil {
+				err = u.appendTop(v)
+			}
+		case 'e': // APPENDS
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				err = u.appendTop(items...)
+			}
+		case ')': // EMPTY_TUPLE
+			u.push(pickleTuple{})
+		case 't': // TUPLE
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(pickleTuple(items))
+			}
+		case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+			n := int(op-0x85) + 1
+			if len(u.stack) < n {
+				return nil, errors.New("pickle stack underflow")
+			}
+			t := make(pickleTuple, n)
+			copy(t, u.stack[len(u.stack)-n:])
+			u.stack = u.stack[:len(u.stack)-n]
+			u.push(t)
+
+		case 'S': // STRING
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var s string
+				if s, err = unquotePickleString(line); err == nil {
+					u.push(s)
+				}
+			}
+		case 'V': // UNICODE
+			var line string
+			if line, err = u.readLine(); err == nil {
+				u.push(line)
+			}
+		case 'U', 'C', 0x8c: // SHORT_BINSTRING, SHORT_BINBYTES, SHORT_BINUNICODE
+			err = u.readString(1)
+		case 'T', 'B', 'X': // BINSTRING, BINBYTES, BINUNICODE
+			err = u.readString(4)
+		case 0x8d, 0x8e: // BINUNICODE8, BINBYTES8
+			err = u.readString(8)
+
+		case 'I': // INT
+			var line string
+			if line, err = u.readLine(); err == nil {
+				switch line {
+				case "00":
+					u.push(false)
+				case "01":
+					u.push(true)
+				default:
+					var n int64
+					if n, err = strconv.ParseInt(line, 10, 64); err == nil {
+						u.push(n)
+					}
+				}
+			}
+		case 'L': // LONG
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var n int64
+				if n, err = strconv.ParseInt(strings.TrimSuffix(line, "L"), 10, 64); err == nil {
+					u.push(n)
+				}
+			}
+		case 'J': // BININT
+			var b []byte
+			if b, err = u.read(4); err == nil {
+				u.push(int64(int32(binary.LittleEndian.Uint32(b))))
+			}
+		case 'K': // BININT1
+			var b []byte
+			if b, err = u.read(1); err == nil {
+				u.push(int64(b[0]))
+			}
+		case 'M': // BININT2
+			var b []byte
+			if b, err = u.read(2); err == nil {
+				u.push(int64(binary.LittleEndian.Uint16(b)))
+			}
+		case 0x8a: // LONG1
+			var b []byte
+			if b, err = u.read(1); err == nil {
+				if b, err = u.read(int(b[0])); err == nil {
+					var n int64
+					if n, err = decodeLong(b); err == nil {
+						u.push(n)
+					}
+				}
+			}
+		case 'F': // FLOAT
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var f float64
+				if f, err = strconv.ParseFloat(line, 64); err == nil {
+					u.push(f)
+				}
+			}
+		case 'G': // BINFLOAT
+			var b []byte
+			if b, err = u.read(8); err == nil {
+				u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+			}
+		case 'N': // NONE
+			u.push(nil)
+		case 0x88: // NEWTRUE
+			u.push(true)
+		case 0x89: // NEWFALSE
+			u.push(false)
+
+		case 'p': // PUT
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var n int
+				if n, err = strconv.Atoi(line); err == nil {
+					err = u.put(n)
+				}
+			}
+		case 'q': // BINPUT
+			var b []byte
+			if b, err = u.read(1); err == nil {
+				err = u.put(int(b[0]))
+			}
+		case 'r': // LONG_BINPUT
+			var b []byte
+			if b, err = u.read(4); err == nil {
+				err = u.put(int(binary.LittleEndian.Uint32(b)))
+			}
+		case 0x94: // MEMOIZE
+			err = u.put(len(u.memo))
+		case 'g': // GET
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var n int
+				if n, err = strconv.Atoi(line); err == nil {
+					err = u.get(n)
+				}
+			}
+		case 'h': // BINGET
+			var b []byte
+			if b, err = u.read(1); err == nil {
+				err = u.get(int(b[0]))
+			}
+		case 'j': // LONG_BINGET
+			var b []byte
+			if b, err = u.read(4); err == nil {
+				err = u.get(int(binary.LittleEndian.Uint32(b)))
+			}
+
+		default:
+			return nil, fmt.Errorf("unsupported pickle opcode 0x%02x", op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (u *unpickler) readByte() (byte, error) {
+	if u.pos >= len(u.data) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	u.pos++
+	return u.data[u.pos-1], nil
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || len(u.data)-u.pos < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	u.pos += n
+	return u.data[u.pos-n : u.pos], nil
+}
+
+// readLine reads up to the next newline, which is discarded.
+func (u *unpickler) readLine() (string, error) {
+	i := bytes.IndexByte(u.data[u.pos:], '\n')
+	if i < 0 {
+		return "", io.ErrUnexpectedEOF
+	}
+	line := string(u.data[u.pos : u.pos+i])
+	u.pos += i + 1
+	return line, nil
+}
+
+// readString reads a string prefixed by its little-endian length of size bytes.
+func (u *unpickler) readString(size int) error {
+	b, err := u.read(size)
+	if err != nil {
+		return err
+	}
+	var n uint64
+	for i := size - 1; i >= 0; i-- {
+		n = n<<8 | uint64(b[i])
+	}
+	if n > uint64(len(u.data)) {
+		return io.ErrUnexpectedEOF
+	}
+	if b, err = u.read(int(n)); err != nil {
+		return err
+	}
+	u.push(string(b))
+	return nil
+}
+
+func (u *unpickler) push(v interface{}) { u.stack = append(u.stack, v) }
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errors.New("pickle stack underflow")
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+// popMark pops and returns the values pushed since the last MARK.
+func (u *unpickler) popMark() ([]interface{}, error) {
+	if len(u.marks) == 0 {
+		return nil, errors.New("pickle mark not found")
+	}
+	m := u.marks[len(u.marks)-1]
+	u.marks = u.marks[:len(u.marks)-1]
+	items := append([]interface{}(nil), u.stack[m:]...)
+	u.stack = u.stack[:m]
+	return items, nil
+}
+
+// appendTop appends values to the list at the top of the stack.
+func (u *unpickler) appendTop(values ...interface{}) error {
+	if len(u.stack) == 0 {
+		return errors.New("pickle stack underflow")
+	}
+	l, ok := u.stack[len(u.stack)-1].(*pickleList)
+	if !ok {
+		return errors.New("pickle append to non-list")
+	}
+	*l = append(*l, values...)
+	return nil
+}
+
+func (u *unpickler) put(n int) error {
+	if len(u.stack) == 0 {
+		return errors.New("pickle stack underflow")
+	}
+	u.memo[n] = u.stack[len(u.stack)-1]
+	return nil
+}
+
+func (u *unpickler) get(n int) error {
+	v, ok := u.memo[n]
+	if !ok {
+		return fmt.Errorf("pickle memo %d not found", n)
+	}
+	u.push(v)
+	return nil
+}
+
+// decodeLong decodes a little-endian two's complement integer of up to 8 bytes.
+func decodeLong(b []byte) (int64, error) {
+	if len(b) > 8 {
+		return 0, errors.New("pickle integer out of range")
+	} else if len(b) == 0 {
+		return 0, nil
+	}
+	var n uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		n = n<<8 | uint64(b[i])
+	}
+	if shift := uint(64 - 8*len(b)); shift > 0 {
+		return int64(n<<shift) >> shift, nil
+	}
+	return int64(n), nil
+}
+
+// unquotePickleString decodes the quoted repr of a protocol 0 STRING.
+func unquotePickleString(s string) (string, error) {
+	if len(s) < 2 || s[0] != s[len(s)-1] || (s[0] != '\'' && s[0] != '"') {
+		return "", fmt.Errorf("pickle string %q is not quoted", s)
+	}
+	s = s[1 : len(s)-1]
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	return strconv.Unquote(`"` + strings.Replace(s, `"`, `\"`, -1) + `"`)
+}
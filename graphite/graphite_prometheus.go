@@ -0,0 +1,33 @@
+//go:build prometheus
+// +build prometheus
+
+package graphite
+
+import (
+	"github.com/influxdb/influxdb/internal/ingest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// promMetrics maps statistics to Prometheus metrics. Statistics with a reason
+// are reported as the "reason" label of a shared metric.
+var promMetrics = []ingest.PromMetric{
+	{Stat: "pointsReceived", Name: "graphite_points_received_total", Help: "Points parsed from received lines.", Type: prometheus.CounterValue},
+	{Stat: "parseErrors", Name: "graphite_parse_errors_total", Help: "Received lines which could not be parsed.", Type: prometheus.CounterValue},
+	{Stat: "linesNoData", Name: "graphite_lines_no_data_total", Help: "Received lines with a nan or null value.", Type: prometheus.CounterValue},
+	{Stat: "pointsWritten", Name: "graphite_points_written_total", Help: "Points written.", Type: prometheus.CounterValue},
+	{Stat: "pointsWriteFailed", Name: "graphite_points_write_failed_total", Help: "Points which failed to write.", Type: prometheus.CounterValue},
+	{Stat: "pointsSampledOut", Name: "graphite_points_dropped_total", Help: "Points dropped rather than written.", Reason: "sampled_out", Type: prometheus.CounterValue},
+	{Stat: "pointsValueOverLimit", Name: "graphite_points_dropped_total", Help: "Points dropped rather than written.", Reason: "value_over_limit", Type: prometheus.CounterValue},
+	{Stat: "pointsFilteredByTag", Name: "graphite_points_dropped_total", Help: "Points dropped rather than written.", Reason: "tag_filter", Type: prometheus.CounterValue},
+	{Stat: "pointsDroppedByProcessor", Name: "graphite_points_dropped_total", Help: "Points dropped rather than written.", Reason: "processor", Type: prometheus.CounterValue},
+	{Stat: "pointsAggregated", Name: "graphite_points_dropped_total", Help: "Points dropped rather than written.", Reason: "superseded", Type: prometheus.CounterValue},
+	{Stat: "pointsDroppedQueueFull", Name: "graphite_points_dropped_total", Help: "Points dropped rather than written.", Reason: "queue_full", Type: prometheus.CounterValue},
+	{Stat: "pointsDroppedBreakerOpen", Name: "graphite_points_dropped_total", Help: "Points dropped rather than written.", Reason: "breaker_open", Type: prometheus.CounterValue},
+	{Stat: "activeConnections", Name: "graphite_active_connections", Help: "Open TCP connections.", Type: prometheus.GaugeValue},
+	{Stat: "writesInFlight", Name: "graphite_writes_in_flight", Help: "Writes in progress.", Type: prometheus.GaugeValue},
+}
+
+// Collector returns a prometheus.Collector reporting the server's statistics.
+func (h *handler) Collector() prometheus.Collector {
+	return ingest.NewStatsCollector(promMetrics, h.stats, h.parser.stats)
+}
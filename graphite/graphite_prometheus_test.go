@@ -0,0 +1,56 @@
+//go:build prometheus
+// +build prometheus
+
+package graphite
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHandler_Collector(t *testing.T) {
+	h := newHandler(NewParser(), &testWriter{}, "graphite")
+	h.SampleRate = 0
+	h.open()
+
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(h.Collector()); err != nil {
+		t.Fatal(err)
+	}
+
+	h.handleLine("cpu 1 1419972457")
+	h.handleLine("cpu 2")
+
+	// Counters are monotonic, so they are not reset by interval snapshots.
+	h.SnapshotAndReset()
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			name := mf.GetName()
+			for _, l := range m.GetLabel() {
+				name += "," + l.GetName() + "=" + l.GetValue()
+			}
+			values[name] = m.GetCounter().GetValue() + m.GetGauge().GetValue()
+		}
+	}
+
+	for name, exp := range map[string]float64{
+		"graphite_points_received_total":                   1,
+		"graphite_parse_errors_total":                      1,
+		"graphite_points_written_total":                    0,
+		"graphite_points_dropped_total,reason=sampled_out": 1,
+		"graphite_active_connections":                      0,
+	} {
+		if v, ok := values[name]; !ok {
+			t.Fatalf("missing metric %s", name)
+		} else if v != exp {
+			t.Fatalf("unexpected %s.  expected %v, got %v", name, exp, v)
+		}
+	}
+}
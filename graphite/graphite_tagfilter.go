@@ -0,0 +1,48 @@
+package graphite
+
+import "regexp"
+
+// TagFilter selects points by the value of a tag, such as one extracted by a
+// template. A point without the tag is treated as having an empty value.
+type TagFilter struct {
+	// Allow, if non-empty, keeps only points whose value is in the set.
+	Allow map[string]struct{}
+
+	// Deny drops points whose value is in the set.
+	Deny map[string]struct{}
+
+	// AllowRegexp, if set, keeps only points whose value matches it.
+	AllowRegexp *regexp.Regexp
+
+	// DenyRegexp, if set, drops points whose value matches it.
+	DenyRegexp *regexp.Regexp
+}
+
+// allows returns true if a point with the tag value v is kept by the filter.
+func (f *TagFilter) allows(v string) bool {
+	if len(f.Allow) > 0 {
+		if _, ok := f.Allow[v]; !ok {
+			return false
+		}
+	}
+	if _, ok := f.Deny[v]; ok {
+		return false
+	}
+	if f.AllowRegexp != nil && !f.AllowRegexp.MatchString(v) {
+		return false
+	}
+	if f.DenyRegexp != nil && f.DenyRegexp.MatchString(v) {
+		return false
+	}
+	return true
+}
+
+// tagsAllowed returns true if tags are kept by every filter, keyed by tag key.
+func tagsAllowed(filters map[string]TagFilter, tags map[string]string) bool {
+	for k, f := range filters {
+		if !f.allows(tags[k]) {
+			return false
+		}
+	}
+	return true
+}
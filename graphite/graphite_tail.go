@@ -0,0 +1,59 @@
+package graphite
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// DefaultTailPollInterval is the default time to wait for new data at the end of a file.
+const DefaultTailPollInterval = 250 * time.Millisecond
+
+// FileTailer replays Graphite lines from a file, such as a log of received
+// metrics, through a Parser and into a SeriesWriter.
+type FileTailer struct {
+	handler
+
+	path   string
+	offset int64
+
+	// PollInterval is the time to wait for new data once the end of the file is reached.
+	PollInterval time.Duration
+}
+
+// NewFileTailer returns a new instance of a FileTailer which starts reading
+// path at the given byte offset.
+func NewFileTailer(path string, offset int64, p *Parser, w SeriesWriter, db string) *FileTailer {
+	return &FileTailer{
+		handler:      newHandler(p, w, db),
+		path:         path,
+		offset:       offset,
+		PollInterval: DefaultTailPollInterval,
+	}
+}
+
+// Offset returns the byte offset just past the last complete line read. It can
+// be passed to NewFileTailer to resume tailing.
+func (t *FileTailer) Offset() int64 {
+	return atomic.LoadInt64(&t.offset)
+}
+
+// Tail processes complete lines from the file, waiting for more to be appended,
+// until ctx is done, then writes any held, queued or batched points. If the
+// starting offset is in the middle of a line, that line is skipped. Tail may
+// only be called once.
+func (t *FileTailer) Tail(ctx context.Context) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	t.open()
+	defer t.flush()
+
+	return ingest.TailFile(ctx, t.path, &t.offset, t.PollInterval, func(line string) {
+		if err := t.handleLine(line); err != nil {
+			t.Logger.Printf("unable to parse data: %s", err)
+		}
+	})
+}
@@ -2,30 +2,39 @@ package graphite
 
 import (
 	"bufio"
-	"log"
+	"context"
+	"errors"
+	"io"
 	"net"
-	"os"
 	"strings"
-
-	"github.com/influxdb/influxdb"
+	"sync"
+	"time"
 )
 
 // TCPServer processes Graphite data received over TCP connections.
 type TCPServer struct {
-	writer   SeriesWriter
-	parser   *Parser
-	database string
+	handler
+
+	// AutoDetectProtocol accepts carbon's pickle protocol as well as
+	// plaintext on the same port. Connections whose first bytes look like a
+	// length-prefixed pickle frame are read as pickle, counted as
+	// "connectionsPickle", and others as plaintext lines.
+	AutoDetectProtocol bool
+
+	mu       sync.Mutex
+	ln       net.Listener
+	conns    map[net.Conn]struct{}
+	draining bool
 
-	Logger *log.Logger
+	wg     sync.WaitGroup
+	connWg sync.WaitGroup
 }
 
 // NewTCPServer returns a new instance of a TCPServer.
 func NewTCPServer(p *Parser, w SeriesWriter, db string) *TCPServer {
 	return &TCPServer{
-		parser:   p,
-		writer:   w,
-		database: db,
-		Logger:   log.New(os.Stderr, "[graphite] ", log.LstdFlags),
+		handler: newHandler(p, w, db),
+		conns:   make(map[net.Conn]struct{}),
 	}
 }
 
@@ -34,16 +43,26 @@ func NewTCPServer(p *Parser, w SeriesWriter, db string) *TCPServer {
 func (t *TCPServer) ListenAndServe(iface string) error {
 	if iface == "" { // Make sure we have an address
 		return ErrBindAddressRequired
+	} else if err := t.validate(); err != nil {
+		return err
 	}
 
 	ln, err := net.Listen("tcp", iface)
 	if err != nil {
 		return err
 	}
+	t.ln = ln
+	t.open()
+
+	t.wg.Add(1)
 	go func() {
+		defer t.wg.Done()
 		for {
 			conn, err := ln.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				t.Logger.Println("error accepting TCP connection", err.Error())
 				continue
 			}
@@ -53,14 +72,80 @@ func (t *TCPServer) ListenAndServe(iface string) error {
 	return nil
 }
 
+// Drain stops the server accepting new connections and reading from existing
+// ones, then writes any buffered points. It returns early with the context's
+// error if ctx is done first. Drain is intended to be called before Close
+// when shutting down.
+func (t *TCPServer) Drain(ctx context.Context) error {
+	t.mu.Lock()
+	t.draining = true
+	if t.ln != nil {
+		t.ln.Close()
+	}
+	for conn := range t.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.connWg.Wait()
+		t.flush()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close shuts down the server's listener and connections, and writes any
+// buffered points.
+func (t *TCPServer) Close() error {
+	t.mu.Lock()
+	if t.ln == nil {
+		t.mu.Unlock()
+		return ErrServerClosed
+	}
+	t.draining = true
+	t.ln.Close()
+	t.ln = nil
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+
+	t.wg.Wait()
+	t.connWg.Wait()
+	t.flush()
+	return nil
+}
+
 // handleConnection services an individual TCP connection.
 func (t *TCPServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
+	if !t.trackConn(conn) {
+		return
+	}
+	defer t.untrackConn(conn)
 
-	reader := bufio.NewReader(conn)
+	var r io.Reader = conn
+	if t.AutoDetectProtocol {
+		br := bufio.NewReader(conn)
+		if b, _ := br.Peek(1); isPickleFrame(b) {
+			t.stats.Inc("connectionsPickle")
+			t.handlePickle(br)
+			return
+		}
+		r = br
+	}
+
+	framer := t.framer(r)
 	for {
-		// Read up to the next newline.
-		buf, err := reader.ReadBytes('\n')
+		buf, err := framer.ReadLine()
 		if err != nil {
 			return
 		}
@@ -68,17 +153,61 @@ func (t *TCPServer) handleConnection(conn net.Conn) {
 		// Trim the buffer, even though there should be no padding
 		line := strings.TrimSpace(string(buf))
 
-		// Parse it.
-		point, err := t.parser.Parse(line)
-		if err != nil {
+		// Parse it and send the data to the writer.
+		if err := t.handleLine(line); err != nil {
 			t.Logger.Printf("unable to parse data: %s", err)
 			continue
 		}
+	}
+}
 
-		// Send the data to the writer.
-		_, e := t.writer.WriteSeries(t.database, "", []influxdb.Point{point})
-		if e != nil {
-			t.Logger.Printf("failed to write data point to database %q: %s\n", t.database, e)
+// handlePickle reads pickle frames from r until it is closed, writing each
+// datum as if it were received as a plaintext line. A frame which cannot be
+// decoded is counted as "pickleDecodeErrors" and skipped.
+func (t *TCPServer) handlePickle(r io.Reader) {
+	for {
+		buf, err := readPickleFrame(r)
+		if err == ErrPickleFrameTooLarge {
+			t.Logger.Printf("closing pickle connection: %s", err)
+			return
+		} else if err != nil {
+			return
 		}
+
+		metrics, err := decodePickle(buf)
+		if err != nil {
+			t.stats.Inc("pickleDecodeErrors")
+			t.Logger.Printf("unable to decode pickle data: %s", err)
+			continue
+		}
+		for _, m := range metrics {
+			if err := t.handleLine(m.line(t.parser.FieldOrder)); err != nil {
+				t.Logger.Printf("unable to parse data: %s", err)
+			}
+		}
+	}
+}
+
+// trackConn registers an active connection. It returns false if the server
+// is shutting down and the connection should not be served.
+func (t *TCPServer) trackConn(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		return false
 	}
+	t.conns[conn] = struct{}{}
+	t.connWg.Add(1)
+	t.stats.Add("activeConnections", 1)
+	return true
+}
+
+// untrackConn removes a connection registered with trackConn.
+func (t *TCPServer) untrackConn(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+	t.stats.Add("activeConnections", -1)
+	t.connWg.Done()
 }
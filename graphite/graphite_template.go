@@ -0,0 +1,206 @@
+package graphite
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// template maps the segments of a Graphite metric name to a measurement,
+// field and tags. Each template segment is one of:
+//
+//	measurement   the segment is part of the measurement name
+//	measurement*  this and all remaining segments are part of the measurement name
+//	field         the segment is part of the field name
+//	(empty)       the segment is ignored
+//	anything else the segment is the value of a tag with that key
+//
+// A template only applies to names whose leading segments match its filter.
+// A template without a filter is the default template.
+type template struct {
+	filter   []string
+	segments []string
+}
+
+// parseTemplate parses a template definition of the form "[filter] template".
+func parseTemplate(def, separator string) (*template, error) {
+	parts := strings.Fields(def)
+	if len(parts) == 0 || len(parts) > 2 {
+		return nil, fmt.Errorf("invalid template %q: expected [filter] template", def)
+	}
+
+	t := &template{}
+	if len(parts) == 2 {
+		t.filter = strings.Split(parts[0], separator)
+		for _, f := range t.filter {
+			if _, err := path.Match(f, ""); err != nil {
+				return nil, fmt.Errorf("invalid template filter %q: %s", parts[0], err)
+			}
+		}
+	}
+	t.segments = strings.Split(parts[len(parts)-1], separator)
+
+	var hasMeasurement bool
+	for _, s := range t.segments {
+		if s == "measurement" || s == "measurement*" {
+			hasMeasurement = true
+		}
+	}
+	if !hasMeasurement {
+		return nil, fmt.Errorf("invalid template %q: no measurement specified", def)
+	}
+	return t, nil
+}
+
+// matches returns true if the leading segments of name match the filter.
+func (t *template) matches(segments []string) bool {
+	if len(t.filter) > len(segments) {
+		return false
+	}
+	for i, f := range t.filter {
+		if ok, _ := path.Match(f, segments[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the measurement, tags and field of a name split into segments.
+// field is empty if the template has no field segments.
+func (t *template) apply(segments []string, separator string) (string, map[string]string, string) {
+	var (
+		measurement []string
+		field       []string
+		tags        = make(map[string]string)
+	)
+
+	for i := 0; i < len(segments) && i < len(t.segments); i++ {
+		switch tag := t.segments[i]; tag {
+		case "":
+		case "measurement":
+			measurement = append(measurement, segments[i])
+		case "measurement*":
+			measurement = append(measurement, segments[i:]...)
+			i = len(segments)
+		case "field":
+			field = append(field, segments[i])
+		default:
+			tags[tag] = segments[i]
+		}
+	}
+
+	return strings.Join(measurement, separator), tags, strings.Join(field, separator)
+}
+
+// AddTemplate adds a template, of the form "[filter] template", used to
+// decode metric names. When several templates match a name, the one with the
+// longest filter is used, then the first added. Names which no template matches are decoded as
+// key.value.key.value.name unless StrictTemplates is set.
+func (p *Parser) AddTemplate(def string) error {
+	t, err := parseTemplate(def, p.Separator)
+	if err != nil {
+		return err
+	}
+	p.templates = append(p.templates, t)
+	return nil
+}
+
+// AddCarbonTemplates adds templates defined in the style of a carbon
+// configuration file, so that existing carbon templates can be reused. Each
+// section defines a template:
+//
+//	[servers]
+//	pattern = ^servers\.
+//	template = .host.measurement*
+//
+// pattern is a regular expression which must be a prefix of whole segments,
+// each either literal or one of ".*", ".+", "[^.]+" and "[^.]*", which match
+// any segment; a pattern of ".*", or none, makes the default template. Blank
+// lines and lines beginning with "#" or ";" are ignored.
+func (p *Parser) AddCarbonTemplates(config string) error {
+	type section struct {
+		name, pattern, template string
+		line                    int
+	}
+
+	var sections []*section
+	for i, line := range strings.Split(config, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			sections = append(sections, &section{name: line[1 : len(line)-1], line: i + 1})
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("line %d: expected [section] or key = value: %q", i+1, line)
+		} else if len(sections) == 0 {
+			return fmt.Errorf("line %d: %q is outside a section", i+1, line)
+		}
+		sec, value := sections[len(sections)-1], strings.TrimSpace(kv[1])
+		switch key := strings.TrimSpace(kv[0]); key {
+		case "pattern":
+			sec.pattern = value
+		case "template":
+			sec.template = value
+		default:
+			return fmt.Errorf("line %d: unknown key %q", i+1, key)
+		}
+	}
+
+	for _, sec := range sections {
+		if sec.template == "" {
+			return fmt.Errorf("line %d: section [%s] has no template", sec.line, sec.name)
+		}
+		filter, err := patternFilter(sec.pattern, p.Separator)
+		if err != nil {
+			return fmt.Errorf("line %d: section [%s]: %s", sec.line, sec.name, err)
+		}
+		if err := p.AddTemplate(strings.TrimSpace(filter + " " + sec.template)); err != nil {
+			return fmt.Errorf("line %d: section [%s]: %s", sec.line, sec.name, err)
+		}
+	}
+	return nil
+}
+
+// patternFilter converts a carbon regular expression pattern to a template
+// filter. Only patterns matching a prefix of whole segments are supported.
+func patternFilter(pattern, separator string) (string, error) {
+	s := strings.TrimPrefix(pattern, "^")
+	for _, suffix := range []string{".*", regexp.QuoteMeta(separator)} {
+		s = strings.TrimSuffix(s, suffix)
+	}
+	if s == "" {
+		return "", nil
+	}
+
+	segments := strings.Split(s, regexp.QuoteMeta(separator))
+	for i, seg := range segments {
+		switch {
+		case seg == ".*" || seg == ".+" || seg == "[^.]+" || seg == "[^.]*":
+			segments[i] = "*"
+		case seg == "" || regexp.QuoteMeta(seg) != seg || strings.ContainsAny(seg, "*?["):
+			return "", fmt.Errorf("unsupported pattern %q: segments must be literal or match any segment", pattern)
+		}
+	}
+	return strings.Join(segments, separator), nil
+}
+
+// matchTemplate returns the most specific template matching segments, or nil.
+func (p *Parser) matchTemplate(segments []string) *template {
+	var match *template
+	for _, t := range p.templates {
+		if !t.matches(segments) {
+			continue
+		}
+		if match == nil || len(t.filter) > len(match.filter) {
+			match = t
+		}
+	}
+	return match
+}
@@ -1,11 +1,24 @@
 package graphite_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/influxdb/influxdb"
 	"github.com/influxdb/influxdb/graphite"
+	"github.com/influxdb/influxdb/test"
 )
 
 func Test_DecodeNameAndTags(t *testing.T) {
@@ -161,6 +174,41 @@ func Test_DecodeMetric(t *testing.T) {
 			value:     50.554,
 			timestamp: testTime,
 		},
+		{
+			test:      "metric with negative value",
+			line:      `cpu -42.5 ` + strTime,
+			name:      "cpu",
+			value:     -42.5,
+			timestamp: testTime,
+		},
+		{
+			test:      "metric with zero value",
+			line:      `cpu 0 ` + strTime,
+			name:      "cpu",
+			value:     0,
+			timestamp: testTime,
+		},
+		{
+			test:      "metric with scientific notation value",
+			line:      `cpu 1.5e3 ` + strTime,
+			name:      "cpu",
+			value:     1500,
+			timestamp: testTime,
+		},
+		{
+			test:      "metric with negative scientific notation value",
+			line:      `cpu -1.5e3 ` + strTime,
+			name:      "cpu",
+			value:     -1500,
+			timestamp: testTime,
+		},
+		{
+			test:      "metric with negative exponent value",
+			line:      `cpu 2.5E-2 ` + strTime,
+			name:      "cpu",
+			value:     0.025,
+			timestamp: testTime,
+		},
 		{
 			test: "missing metric",
 			line: `50.554 1419972457825`,
@@ -212,7 +260,7 @@ func Test_DecodeMetric(t *testing.T) {
 			t.Fatalf("tags len mismatch.  expected %d, got %d", len(test.tags), len(point.Tags))
 		}
 		f := point.Fields[point.Name].(float64)
-		if point.Fields[point.Name] != f {
+		if f != test.value {
 			t.Fatalf("floatValue value mismatch.  expected %v, got %v", test.value, f)
 		}
 		if point.Timestamp.UnixNano()/1000000 != test.timestamp.UnixNano()/1000000 {
@@ -221,7 +269,816 @@ func Test_DecodeMetric(t *testing.T) {
 	}
 }
 
+func Test_DecodeNameAndTags_NameTransform(t *testing.T) {
+	var tests = []struct {
+		test      string
+		str       string
+		lowercase bool
+		transform func(string) string
+		name      string
+		tags      map[string]string
+	}{
+		{test: "mixed case is preserved by default", str: "Apache.Host.Server01", name: "Apache", tags: map[string]string{"Host": "Server01"}},
+		{test: "lowercase names", str: "Apache.Host.Server01", lowercase: true, name: "apache", tags: map[string]string{"host": "server01"}},
+		{test: "custom transform", str: "prod_cpu.host.server01", transform: func(s string) string { return strings.TrimPrefix(s, "prod_") }, name: "cpu", tags: map[string]string{"host": "server01"}},
+		{test: "transform after lowercase", str: "PROD_cpu", lowercase: true, transform: func(s string) string { return strings.TrimPrefix(s, "prod_") }, name: "cpu"},
+	}
+
+	for _, test := range tests {
+		t.Logf("testing %q...", test.test)
+
+		p := graphite.NewParser()
+		p.LowercaseNames = test.lowercase
+		p.NameTransform = test.transform
+
+		name, tags, err := p.DecodeNameAndTags(test.str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != test.name {
+			t.Fatalf("name parse failer.  expected %v, got %v", test.name, name)
+		}
+		if len(tags) != len(test.tags) {
+			t.Fatalf("unexpected number of tags.  expected %d, got %d", len(test.tags), len(tags))
+		}
+		for k, v := range test.tags {
+			if tags[k] != v {
+				t.Fatalf("unexpected tag value for tags[%s].  expected %q, got %q", k, v, tags[k])
+			}
+		}
+	}
+}
+
+func Test_DecodeNameAndTags_DropSegments(t *testing.T) {
+	var tests = []struct {
+		test     string
+		str      string
+		leading  int
+		trailing int
+		name     string
+		tags     map[string]string
+		err      string
+	}{
+		{test: "drop leading segments", str: "prod.dc1.cpu.host.server01", leading: 2, name: "cpu", tags: map[string]string{"host": "server01"}},
+		{test: "drop trailing segments", str: "cpu.host.server01.sum.5m", trailing: 2, name: "cpu", tags: map[string]string{"host": "server01"}},
+		{test: "drop both", str: "prod.cpu.host.server01.sum", leading: 1, trailing: 1, name: "cpu", tags: map[string]string{"host": "server01"}},
+		{test: "drop all segments", str: "prod.dc1", leading: 2, err: `no name specified for metric after dropping segments. "prod.dc1"`},
+		{test: "drop more segments than exist", str: "prod.dc1", leading: 2, trailing: 1, err: `no name specified for metric after dropping segments. "prod.dc1"`},
+	}
+
+	for _, test := range tests {
+		t.Logf("testing %q...", test.test)
+
+		p := graphite.NewParser()
+		p.DropLeadingSegments = test.leading
+		p.DropTrailingSegments = test.trailing
+
+		name, tags, err := p.DecodeNameAndTags(test.str)
+		if errstr(err) != test.err {
+			t.Fatalf("err does not match.  expected %v, got %v", test.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if name != test.name {
+			t.Fatalf("name parse failer.  expected %v, got %v", test.name, name)
+		}
+		if len(tags) != len(test.tags) {
+			t.Fatalf("unexpected number of tags.  expected %d, got %d", len(test.tags), len(tags))
+		}
+		for k, v := range test.tags {
+			if tags[k] != v {
+				t.Fatalf("unexpected tag value for tags[%s].  expected %q, got %q", k, v, tags[k])
+			}
+		}
+	}
+}
+
+func Test_Parse_Templates(t *testing.T) {
+	p := graphite.NewParser()
+	for _, def := range []string{
+		"servers.* .host.measurement*",
+		"servers.*.cpu .host.measurement.field",
+		"stats.* .measurement.field",
+	} {
+		if err := p.AddTemplate(def); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		line  string
+		name  string
+		tags  map[string]string
+		field string
+	}{
+		{line: "servers.localhost.mem.free 1 1419972457", name: "mem.free", tags: map[string]string{"host": "localhost"}, field: "mem.free"},
+		{line: "servers.localhost.cpu.idle 1 1419972457", name: "cpu", tags: map[string]string{"host": "localhost"}, field: "idle"},
+		{line: "stats.requests.p99 1 1419972457", name: "requests", tags: map[string]string{}, field: "p99"},
+		{line: "cpu.host.server01 1 1419972457", name: "cpu", tags: map[string]string{"host": "server01"}, field: "cpu"},
+	}
+
+	for i, test := range tests {
+		point, err := p.Parse(test.line)
+		if err != nil {
+			t.Fatalf("%d. %s", i, err)
+		}
+		if point.Name != test.name {
+			t.Fatalf("%d. name parse failer.  expected %v, got %v", i, test.name, point.Name)
+		}
+		if !reflect.DeepEqual(point.Tags, test.tags) {
+			t.Fatalf("%d. unexpected tags.  expected %v, got %v", i, test.tags, point.Tags)
+		}
+		if _, ok := point.Fields[test.field]; !ok || len(point.Fields) != 1 {
+			t.Fatalf("%d. unexpected fields.  expected %q, got %v", i, test.field, point.Fields)
+		}
+	}
+}
+
+func Test_AddCarbonTemplates(t *testing.T) {
+	p := graphite.NewParser()
+	if err := p.AddCarbonTemplates(`
+# Templates copied from carbon.
+[servers]
+pattern = ^servers\.
+template = .host.measurement*
+
+[timers]
+pattern = ^stats\.[^.]+\.timers\.
+template = .region..measurement*
+
+; Everything else.
+[default]
+pattern = .*
+template = measurement*
+`); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		line string
+		name string
+		tags map[string]string
+	}{
+		{line: "servers.web01.cpu.load 1 1419972457", name: "cpu.load", tags: map[string]string{"host": "web01"}},
+		{line: "stats.us.timers.api 1 1419972457", name: "api", tags: map[string]string{"region": "us"}},
+		{line: "stats.us.counters.api 1 1419972457", name: "stats.us.counters.api", tags: map[string]string{}},
+	}
+	for i, test := range tests {
+		point, err := p.Parse(test.line)
+		if err != nil {
+			t.Fatalf("%d. %s", i, err)
+		} else if point.Name != test.name || !reflect.DeepEqual(point.Tags, test.tags) {
+			t.Fatalf("%d. unexpected point.  expected %s %v, got %s %v", i, test.name, test.tags, point.Name, point.Tags)
+		}
+	}
+}
+
+func Test_AddCarbonTemplates_Invalid(t *testing.T) {
+	var tests = []struct {
+		config string
+		err    string
+	}{
+		{config: "pattern = ^servers\\.", err: `line 1: "pattern = ^servers\\." is outside a section`},
+		{config: "[servers]\npattern ^servers", err: `line 2: expected [section] or key = value: "pattern ^servers"`},
+		{config: "[servers]\nretentions = 60s:1d", err: `line 2: unknown key "retentions"`},
+		{config: "[servers]\ntags = dc=1", err: `line 2: unknown key "tags"`},
+		{config: "[servers]\npattern = ^servers\\.", err: "line 1: section [servers] has no template"},
+		{config: "[servers]\npattern = ^(web|db)\\.\ntemplate = .host.measurement*", err: `line 1: section [servers]: unsupported pattern "^(web|db)\\.": segments must be literal or match any segment`},
+		{config: "[servers]\npattern = ^servers\\.\ntemplate = .host", err: `line 1: section [servers]: invalid template "servers .host": no measurement specified`},
+	}
+	for i, test := range tests {
+		if err := graphite.NewParser().AddCarbonTemplates(test.config); err == nil || err.Error() != test.err {
+			t.Fatalf("%d. unexpected error.  expected %q, got %v", i, test.err, err)
+		}
+	}
+}
+
+func Test_Parse_FieldOrder(t *testing.T) {
+	var tests = []struct {
+		order graphite.FieldOrder
+		line  string
+		value float64
+		err   string
+	}{
+		{order: graphite.ValueTimestamp, line: "cpu 42.5 1419972457", value: 42.5},
+		{order: graphite.TimestampValue, line: "cpu 1419972457 42.5", value: 42.5},
+		{order: graphite.TimestampValue, line: "cpu 42.5 1419972457", err: `received "cpu 42.5 1419972457" whose timestamp "42.5" is not a whole number of seconds`},
+	}
+
+	for i, test := range tests {
+		p := graphite.NewParser()
+		p.FieldOrder = test.order
+
+		point, err := p.Parse(test.line)
+		if errstr(err) != test.err {
+			t.Fatalf("%d. err does not match.  expected %v, got %v", i, test.err, err)
+		} else if err != nil {
+			continue
+		}
+		if v := point.Fields["cpu"]; v != test.value {
+			t.Fatalf("%d. unexpected value.  expected %v, got %v", i, test.value, v)
+		} else if ts := point.Timestamp.Unix(); ts != 1419972457 {
+			t.Fatalf("%d. unexpected timestamp.  expected 1419972457, got %d", i, ts)
+		}
+	}
+}
+
+func Test_Parse_RawLineField(t *testing.T) {
+	line := "cpu.host.server01 42.5 1419972457"
+
+	p := graphite.NewParser()
+	if point, err := p.Parse(line); err != nil {
+		t.Fatal(err)
+	} else if len(point.Fields) != 1 {
+		t.Fatalf("unexpected fields: %v", point.Fields)
+	}
+
+	p.RawLineField = "raw"
+	point, err := p.Parse(line)
+	if err != nil {
+		t.Fatal(err)
+	} else if raw := point.Fields["raw"]; raw != line {
+		t.Fatalf("unexpected raw field.  expected %q, got %v", line, raw)
+	} else if v := point.Fields["cpu"]; v != 42.5 {
+		t.Fatalf("unexpected value.  expected 42.5, got %v", v)
+	}
+}
+
+func Test_ParseAll_DerivePoints(t *testing.T) {
+	p := graphite.NewParser()
+	if err := p.AddTemplate("servers.* .host.measurement.field"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Also write each value of the cpu measurement to an aggregate without the host tag.
+	p.DerivePoints = func(pt influxdb.Point) []influxdb.Point {
+		if pt.Name != "cpu" {
+			return nil
+		}
+		return []influxdb.Point{{Name: "cpu_all", Tags: map[string]string{}, Fields: pt.Fields, Timestamp: pt.Timestamp}}
+	}
+
+	points, err := p.ParseAll("servers.server01.cpu.load 42.5 1419972457")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(points) != 2 {
+		t.Fatalf("unexpected number of points.  expected 2, got %d", len(points))
+	}
+	for i, exp := range []struct {
+		name string
+		tags map[string]string
+	}{
+		{name: "cpu", tags: map[string]string{"host": "server01"}},
+		{name: "cpu_all", tags: map[string]string{}},
+	} {
+		if points[i].Name != exp.name || !reflect.DeepEqual(points[i].Tags, exp.tags) {
+			t.Fatalf("%d. unexpected point.  expected %s %v, got %s %v", i, exp.name, exp.tags, points[i].Name, points[i].Tags)
+		} else if v := points[i].Fields["load"]; v != 42.5 {
+			t.Fatalf("%d. unexpected value.  expected 42.5, got %v", i, v)
+		}
+	}
+
+	// Parse returns only the parsed point.
+	if point, err := p.Parse("servers.server01.cpu.load 42.5 1419972457"); err != nil {
+		t.Fatal(err)
+	} else if point.Name != "cpu" {
+		t.Fatalf("unexpected name.  expected cpu, got %s", point.Name)
+	}
+}
+
+func Test_Parse_NoData(t *testing.T) {
+	p := graphite.NewParser()
+	for _, line := range []string{"metric nan 100", "metric null 100", "metric NaN 100", "servers.host.metric NULL 100"} {
+		if _, err := p.Parse(line); err != graphite.ErrNoData {
+			t.Fatalf("%q: unexpected error.  expected %v, got %v", line, graphite.ErrNoData, err)
+		}
+	}
+}
+
+func Test_Parse_CarbonNowTimestamp(t *testing.T) {
+	var tests = []struct {
+		line  string
+		allow bool
+		now   bool
+		err   string
+	}{
+		{line: "cpu 1 1419972457"},
+		{line: "cpu 1 1419972457", allow: true},
+		{line: "cpu 1 -1", err: `received "cpu 1 -1" whose timestamp "-1" is not valid`},
+		{line: "cpu 1 -1", allow: true, now: true},
+		{line: "servers.host.cpu 1 -1", allow: true, now: true},
+		{line: "cpu 1 0", err: `received "cpu 1 0" whose timestamp "0" is not valid`},
+		{line: "cpu 1 0", allow: true, err: `received "cpu 1 0" whose timestamp "0" is not valid`},
+	}
+
+	for i, test := range tests {
+		p := graphite.NewParser()
+		p.AllowCarbonNowTimestamp = test.allow
+
+		before := time.Now()
+		point, err := p.Parse(test.line)
+		if errstr(err) != test.err {
+			t.Fatalf("%d. unexpected error.  expected %q, got %v", i, test.err, err)
+		} else if err != nil {
+			continue
+		}
+		if test.now && (point.Timestamp.Before(before) || point.Timestamp.After(time.Now())) {
+			t.Fatalf("%d. expected the current time, got %s", i, point.Timestamp)
+		} else if !test.now && !point.Timestamp.Equal(time.Unix(1419972457, 0)) {
+			t.Fatalf("%d. unexpected timestamp: %s", i, point.Timestamp)
+		}
+	}
+}
+
+func Test_AddTemplate_Invalid(t *testing.T) {
+	for _, def := range []string{
+		"",
+		"servers.* .host.measurement* dc=1",
+		"servers.* .host",
+		"servers.[ .host.measurement",
+	} {
+		if err := graphite.NewParser().AddTemplate(def); err == nil {
+			t.Fatalf("expected error for template %q", def)
+		}
+	}
+}
+
+func Test_DecodeNameAndTags_StrictTemplates(t *testing.T) {
+	var tests = []struct {
+		test   string
+		strict bool
+		name   string
+		err    string
+	}{
+		{test: "lenient falls back to raw name", name: "cpu"},
+		{test: "strict rejects unmatched name", strict: true, err: `received "cpu.host.server01" which matches no template`},
+	}
+
+	for _, test := range tests {
+		t.Logf("testing %q...", test.test)
+
+		p := graphite.NewParser()
+		p.StrictTemplates = test.strict
+		if err := p.AddTemplate("servers.* .host.measurement*"); err != nil {
+			t.Fatal(err)
+		}
+
+		name, _, err := p.DecodeNameAndTags("cpu.host.server01")
+		if errstr(err) != test.err {
+			t.Fatalf("err does not match.  expected %v, got %v", test.err, err)
+		}
+		if name != test.name {
+			t.Fatalf("name parse failer.  expected %v, got %v", test.name, name)
+		}
+
+		var exp int64
+		if test.strict {
+			exp = 1
+		}
+		if n := p.Stats().Get("templateUnmatched"); n != exp {
+			t.Fatalf("unexpected templateUnmatched count.  expected %d, got %d", exp, n)
+		}
+
+		// A default template matches every name.
+		if err := p.AddTemplate("measurement.host"); err != nil {
+			t.Fatal(err)
+		}
+		if name, _, err := p.DecodeNameAndTags("cpu.server01"); err != nil || name != "cpu" {
+			t.Fatalf("unexpected default template result: %q, %v", name, err)
+		}
+	}
+}
+
+func Test_DecodeNameAndTags_MaxTagValueLength(t *testing.T) {
+	var tests = []struct {
+		test   string
+		policy graphite.TagValuePolicy
+		tags   map[string]string
+		stat   string
+		err    string
+	}{
+		{test: "truncate", policy: graphite.TruncateTagValue, tags: map[string]string{"host": "serv", "region": "us"}, stat: "tagValueTruncated"},
+		{test: "drop", policy: graphite.DropTagValue, tags: map[string]string{}, stat: "tagValueTooLong", err: `tag value for "host" exceeds maximum length of 4`},
+	}
+
+	for _, test := range tests {
+		t.Logf("testing %q...", test.test)
+
+		p := graphite.NewParser()
+		p.MaxTagValueLength = 4
+		p.TagValuePolicy = test.policy
+
+		_, tags, err := p.DecodeNameAndTags("cpu.host.server01.region.us")
+		if errstr(err) != test.err {
+			t.Fatalf("err does not match.  expected %v, got %v", test.err, err)
+		}
+		if err == nil && len(tags) != len(test.tags) {
+			t.Fatalf("unexpected number of tags.  expected %d, got %d", len(test.tags), len(tags))
+		}
+		for k, v := range test.tags {
+			if tags[k] != v {
+				t.Fatalf("unexpected tag value for tags[%s].  expected %q, got %q", k, v, tags[k])
+			}
+		}
+		if n := p.Stats().Get(test.stat); n != 1 {
+			t.Fatalf("unexpected %s count.  expected 1, got %d", test.stat, n)
+		}
+	}
+}
+
+func TestServer_DatabaseRequired(t *testing.T) {
+	router := func(p influxdb.Point) graphite.SeriesWriter { return nil }
+
+	tcp := graphite.NewTCPServer(graphite.NewParser(), &testWriter{}, "")
+	if err := tcp.ListenAndServe("127.0.0.1:0"); err != graphite.ErrDatabaseRequired {
+		t.Fatalf("unexpected TCP error.  expected %v, got %v", graphite.ErrDatabaseRequired, err)
+	}
+	tcp.WriterRouter = router
+	if err := tcp.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatalf("unexpected TCP error with router: %s", err)
+	}
+	tcp.Close()
+
+	udp := graphite.NewUDPServer(graphite.NewParser(), &testWriter{}, "")
+	if err := udp.ListenAndServe("127.0.0.1:0"); err != graphite.ErrDatabaseRequired {
+		t.Fatalf("unexpected UDP error.  expected %v, got %v", graphite.ErrDatabaseRequired, err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := udp.ServePacket(conn); err != graphite.ErrDatabaseRequired {
+		t.Fatalf("unexpected ServePacket error.  expected %v, got %v", graphite.ErrDatabaseRequired, err)
+	}
+	udp.WriterRouter = router
+	if err := udp.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatalf("unexpected UDP error with router: %s", err)
+	}
+	udp.Close()
+}
+
+func TestUDPServer_Addr(t *testing.T) {
+	w := &testWriter{}
+	s := graphite.NewUDPServer(graphite.NewParser(), w, "graphite")
+	if addr := s.Addr(); addr != nil {
+		t.Fatalf("expected no address before serving, got %s", addr)
+	}
+	if err := s.ListenAndServe(":0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	addr, ok := s.Addr().(*net.UDPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("expected a bound port, got %v", s.Addr())
+	}
+
+	// The connection is usable as soon as ListenAndServe returns.
+	client, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(addr.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("cpu 1 1419972457\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WaitPoints(1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPServer_LogRejectedDatagramBytes(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	w := &testWriter{}
+	s := graphite.NewUDPServer(graphite.NewParser(), w, "graphite")
+	s.Logger = log.New(&logs, "", 0)
+	s.LogRejectedDatagramBytes = 32
+	go s.ServePacket(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// A pickle datagram sent to the plaintext port, then a valid datagram.
+	client.Write([]byte("\x00\x00\x00\x3a(lp0\n(S'servers.web01.cpu'\np1\n(I1419972457\nF0.5\ntp2\ntp3\na."))
+	client.Write([]byte("cpu 1 1419972457\n"))
+	if _, err := w.WaitPoints(1); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	var dump []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.HasPrefix(line, "000000") {
+			dump = append(dump, line)
+		}
+	}
+	if !strings.Contains(logs.String(), "rejected UDP datagram of 62 bytes") {
+		t.Fatalf("expected rejected datagram to be logged, got %q", logs.String())
+	} else if len(dump) != 2 || !strings.HasPrefix(dump[0], "00000000  00 00 00 3a 28 6c 70 30") {
+		t.Fatalf("expected a 32 byte preview, got %q", dump)
+	} else if n := s.Stats().Get("datagramsRejected"); n != 1 {
+		t.Fatalf("unexpected datagramsRejected: %d", n)
+	}
+}
+
+func TestUDPServer_ServePacket(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &testWriter{}
+	s := graphite.NewUDPServer(graphite.NewParser(), w, "graphite")
+	done := make(chan error)
+	go func() { done <- s.ServePacket(conn) }()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("cpu.host.server01 50 1419972457\nmem.host.server01 60 1419972457"))
+
+	points, err := w.WaitPoints(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if points[0].Name != "cpu" || points[1].Name != "mem" {
+		t.Fatalf("unexpected points: %v", points)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error from ServePacket: %s", err)
+	}
+}
+
+// Ensure Addr may be called while ServePacket is starting.
+func TestUDPServer_ServePacket_Addr(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := graphite.NewUDPServer(graphite.NewParser(), &testWriter{}, "graphite")
+	done := make(chan error)
+	go func() { done <- s.ServePacket(conn) }()
+
+	timeout := time.After(time.Second)
+	for s.Addr() == nil {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for the server to serve")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if addr := s.Addr().String(); addr != conn.LocalAddr().String() {
+		t.Fatalf("unexpected address.  expected %s, got %s", conn.LocalAddr(), addr)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-done; err != nil {
+		t.Fatalf("unexpected error from ServePacket: %s", err)
+	}
+}
+
+func TestUDPServer_NewFramer(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &testWriter{}
+	s := graphite.NewUDPServer(graphite.NewParser(), w, "graphite")
+	s.NewFramer = func(r io.Reader) graphite.Framer { return &lengthFramer{r: r} }
+	go s.ServePacket(conn)
+	defer s.Close()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var buf bytes.Buffer
+	for _, line := range []string{"cpu.host.server01 50 1419972457", "mem.host.server01 60 1419972457"} {
+		binary.Write(&buf, binary.BigEndian, uint16(len(line)))
+		buf.WriteString(line)
+	}
+	client.Write(buf.Bytes())
+
+	points, err := w.WaitPoints(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if points[0].Name != "cpu" || points[1].Name != "mem" {
+		t.Fatalf("unexpected points: %v", points)
+	}
+}
+
+// lengthFramer reads lines prefixed by their length as a big endian uint16.
+type lengthFramer struct {
+	r io.Reader
+}
+
+func (f *lengthFramer) ReadLine() ([]byte, error) {
+	var n uint16
+	if err := binary.Read(f.r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	line := make([]byte, n)
+	if _, err := io.ReadFull(f.r, line); err != nil {
+		return nil, err
+	}
+	return line, nil
+}
+
+func TestUDPServer_BufferSize(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &testWriter{}
+	s := graphite.NewUDPServer(graphite.NewParser(), w, "graphite")
+	s.BufferSize = 40
+	go s.ServePacket(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// The second line is cut by the buffer size and must not be written.
+	client.Write([]byte("cpu.host.server01 50 1419972457\nmem.host.server01 60 1419972457\n"))
+	client.Write([]byte("disk.host.server01 70 1419972457\n"))
+
+	points, err := w.WaitPoints(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if points[0].Name != "cpu" || points[1].Name != "disk" {
+		t.Fatalf("unexpected points: %v", points)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Stats().Get("datagramsTruncated"); n != 1 {
+		t.Fatalf("unexpected datagramsTruncated.  expected 1, got %d", n)
+	}
+}
+
+func TestUDPServer_DedupWindow(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &testWriter{}
+	s := graphite.NewUDPServer(graphite.NewParser(), w, "graphite")
+	s.DedupWindow = time.Minute
+	go s.ServePacket(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	datagram := []byte("cpu.host.server01 50 1419972457\nmem.host.server01 60 1419972457\n")
+	client.Write(datagram)
+	client.Write(datagram)
+	client.Write([]byte("disk.host.server01 70 1419972457\n"))
+
+	if _, err := w.WaitPoints(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if points := w.Points(); len(points) != 3 {
+		t.Fatalf("unexpected number of points.  expected 3, got %d", len(points))
+	} else if n := s.Stats().Get("datagramsDuplicate"); n != 1 {
+		t.Fatalf("unexpected datagramsDuplicate.  expected 1, got %d", n)
+	}
+}
+
+func TestFileTailer_Tail(t *testing.T) {
+	f, err := ioutil.TempFile("", "graphite-tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// The tailer starts in the middle of the first line, so it is skipped.
+	f.WriteString("skipped 1 1419972457\ncpu 2 1419972457\n")
+
+	w := &testWriter{}
+	tailer := graphite.NewFileTailer(f.Name(), 3, graphite.NewParser(), w, "graphite")
+	tailer.PollInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- tailer.Tail(ctx) }()
+
+	if _, err := w.WaitPoints(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lines are only processed once they are complete.
+	f.WriteString("mem 3 ")
+	time.Sleep(50 * time.Millisecond)
+	if n := len(w.Points()); n != 1 {
+		t.Fatalf("partial line was processed.  expected 1 point, got %d", n)
+	}
+	f.WriteString("1419972457\n")
+
+	points, err := w.WaitPoints(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if points[0].Name != "cpu" || points[1].Name != "mem" {
+		t.Fatalf("unexpected points: %v", points)
+	}
+	if fi, _ := f.Stat(); tailer.Offset() != fi.Size() {
+		t.Fatalf("unexpected offset.  expected %d, got %d", fi.Size(), tailer.Offset())
+	}
+}
+
+// Ensure the tailer applies the handler options, routing and batching points,
+// and writes the batched points once tailing stops.
+func TestFileTailer_Tail_Options(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "graphite-tail")
+	if err := ioutil.WriteFile(path, []byte("cpu 1 1419972457\nmem 2 1419972457\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, routed := &testWriter{}, &testWriter{}
+	tailer := graphite.NewFileTailer(path, 0, graphite.NewParser(), w, "")
+	tailer.PollInterval = time.Millisecond
+	tailer.WriterRouter = func(p influxdb.Point) graphite.SeriesWriter { return routed }
+	tailer.BatchSize = 10
+	tailer.BatchTimeout = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- tailer.Tail(ctx) }()
+
+	for tailer.Offset() != 34 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(routed.Points()); n != 0 {
+		t.Fatalf("points written before the batch filled: %d", n)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := len(w.Points()); n != 0 {
+		t.Fatalf("unexpected points written to the default writer: %d", n)
+	} else if calls := routed.Calls(); len(calls) != 1 || len(calls[0].Points) != 2 {
+		t.Fatalf("unexpected routed writes: %v", calls)
+	}
+}
+
+// Ensure the tailer requires a database or a router.
+func TestFileTailer_Tail_DatabaseRequired(t *testing.T) {
+	tailer := graphite.NewFileTailer("unused", 0, graphite.NewParser(), &testWriter{}, "")
+	if err := tailer.Tail(context.Background()); err != graphite.ErrDatabaseRequired {
+		t.Fatalf("unexpected error.  expected %v, got %v", graphite.ErrDatabaseRequired, err)
+	}
+}
+
 // Test Helpers
+
+// testWriter records all points written to it.
+type testWriter = test.MemWriter
+
 func errstr(err error) string {
 	if err != nil {
 		return err.Error()
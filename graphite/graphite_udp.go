@@ -1,34 +1,72 @@
 package graphite
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"math/rand"
 	"net"
-	"os"
-	"strings"
-
-	"github.com/influxdb/influxdb"
+	"sync"
+	"time"
 )
 
 const (
-	udpBufferSize = 65536
+	// DefaultUDPBufferSize is the default maximum size of a UDP datagram.
+	DefaultUDPBufferSize = 65536
+
+	// maxDedupDatagrams is the maximum number of datagram hashes kept for
+	// DedupWindow.
+	maxDedupDatagrams = 10000
+
+	// rejectedDatagramLogEvery is how often, after the first, rejected
+	// datagrams are logged with LogRejectedDatagramBytes.
+	rejectedDatagramLogEvery = 100
+
+	// udpMinBackoff and udpMaxBackoff bound the wait after a failed read.
+	udpMinBackoff = 5 * time.Millisecond
+	udpMaxBackoff = time.Second
 )
 
 // UDPServer processes Graphite data received via UDP.
 type UDPServer struct {
-	writer   SeriesWriter
-	parser   *Parser
-	database string
+	handler
+
+	// CloseTimeout is the maximum time Close waits for datagrams being
+	// processed and points being written, after which it returns
+	// ErrCloseTimeout. Zero waits indefinitely.
+	CloseTimeout time.Duration
 
-	Logger *log.Logger
+	// BufferSize is the maximum size of a datagram. Only the complete lines
+	// within the first BufferSize bytes of a larger datagram are processed.
+	BufferSize int
+
+	// DedupWindow, if non-zero, drops datagrams identical to one received
+	// within the window, such as those duplicated by the network.
+	DedupWindow time.Duration
+
+	// LogRejectedDatagramBytes, if non-zero, logs a hex dump of up to this
+	// many bytes of datagrams in which no line could be parsed, such as
+	// pickle data sent to the plaintext port. Such datagrams are counted as
+	// "datagramsRejected"; the first and every rejectedDatagramLogEvery after
+	// it are logged.
+	LogRejectedDatagramBytes int
+
+	wg   sync.WaitGroup
+	once sync.Once
+	done chan struct{}
+
+	mu   sync.Mutex // guards conn
+	conn net.PacketConn
 }
 
 // NewUDPServer returns a new instance of a UDPServer
 func NewUDPServer(p *Parser, w SeriesWriter, db string) *UDPServer {
 	u := UDPServer{
-		parser:   p,
-		writer:   w,
-		database: db,
-		Logger:   log.New(os.Stderr, "[graphite] ", log.LstdFlags),
+		handler:    newHandler(p, w, db),
+		BufferSize: DefaultUDPBufferSize,
+		done:       make(chan struct{}),
 	}
 	return &u
 }
@@ -38,6 +76,8 @@ func NewUDPServer(p *Parser, w SeriesWriter, db string) *UDPServer {
 func (u *UDPServer) ListenAndServe(iface string) error {
 	if iface == "" { // Make sure we have an address
 		return ErrBindAddressRequired
+	} else if err := u.validate(); err != nil {
+		return err
 	}
 
 	addr, err := net.ResolveUDPAddr("udp", iface)
@@ -50,26 +90,227 @@ func (u *UDPServer) ListenAndServe(iface string) error {
 		return err
 	}
 
-	buf := make([]byte, udpBufferSize)
+	u.start(conn)
+	go u.serve(conn)
+	return nil
+}
+
+// ServePacket processes Graphite data read from conn until the server is
+// closed, at which point conn is closed and ServePacket returns nil. This
+// allows an already bound socket, such as one passed in by socket
+// activation, to be used.
+func (u *UDPServer) ServePacket(conn net.PacketConn) error {
+	if err := u.validate(); err != nil {
+		return err
+	}
+	u.start(conn)
+	u.serve(conn)
+	return nil
+}
+
+// start prepares the server to read from conn.
+func (u *UDPServer) start(conn net.PacketConn) {
+	u.mu.Lock()
+	u.conn = conn
+	u.mu.Unlock()
+	u.open()
+	u.wg.Add(1)
+}
+
+// Addr returns the address the server is bound to, or nil if it is not
+// serving. The connection is bound before ListenAndServe returns, so Addr may
+// be called immediately afterwards, such as to find the port chosen for ":0".
+func (u *UDPServer) Addr() net.Addr {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn == nil {
+		return nil
+	}
+	return u.conn.LocalAddr()
+}
+
+// Drain stops the server reading datagrams, then writes any buffered points.
+// It returns early with the context's error if ctx is done first. Drain is
+// intended to be called before Close when shutting down.
+func (u *UDPServer) Drain(ctx context.Context) error {
+	u.once.Do(func() { close(u.done) })
+	u.mu.Lock()
+	if u.conn != nil {
+		u.conn.SetReadDeadline(time.Now())
+	}
+	u.mu.Unlock()
+
+	done := make(chan struct{})
 	go func() {
+		u.wg.Wait()
+		u.flush()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close shuts down the server's listener, waits for processing to stop and
+// writes any buffered points. If CloseTimeout is set and elapses first, Close
+// logs how many points are pending and returns ErrCloseTimeout without
+// waiting further. Those points are still written in the background, so the
+// writer must stay usable until they are.
+func (u *UDPServer) Close() error {
+	u.mu.Lock()
+	conn := u.conn
+	u.conn = nil
+	u.mu.Unlock()
+	if conn == nil {
+		return ErrServerClosed
+	}
+
+	u.once.Do(func() { close(u.done) })
+	conn.Close()
+
+	queue := u.queue
+	done := make(chan struct{})
+	go func() {
+		u.wg.Wait()
+		u.flush()
+		close(done)
+	}()
+
+	if u.CloseTimeout > 0 {
+		select {
+		case <-done:
+		case <-time.After(u.CloseTimeout):
+			u.Logger.Printf("closed with %d points pending after %s", len(queue)+u.batch.Buffered(), u.CloseTimeout)
+			return ErrCloseTimeout
+		}
+	} else {
+		<-done
+	}
+	return nil
+}
+
+// serve reads datagrams from conn until the connection is closed. Transient
+// read errors are retried with a jittered, bounded backoff.
+func (u *UDPServer) serve(conn net.PacketConn) {
+	defer u.wg.Done()
+
+	// Read one byte more than the buffer size to detect larger datagrams.
+	buf := make([]byte, u.BufferSize+1)
+	dedup := newDatagramHashes()
+	backoff := udpMinBackoff
+	var rejected uint64
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if u.closed() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// Wait between half and all of the current backoff before retrying.
+			u.Logger.Printf("failed to read UDP datagram: %s", err)
+			select {
+			case <-u.done:
+				return
+			case <-time.After(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))):
+			}
+			if backoff *= 2; backoff > udpMaxBackoff {
+				backoff = udpMaxBackoff
+			}
+			continue
+		}
+		backoff = udpMinBackoff
+
+		if u.DedupWindow > 0 && dedup.seen(buf[:n], time.Now(), u.DedupWindow) {
+			u.stats.Inc("datagramsDuplicate")
+			continue
+		}
+
+		// Drop the partial last line of a truncated datagram.
+		data := buf[:n]
+		if n > u.BufferSize {
+			u.stats.Inc("datagramsTruncated")
+			u.Logger.Printf("received UDP datagram larger than %d bytes, dropping the last partial line", u.BufferSize)
+			data = data[:bytes.LastIndexByte(data[:u.BufferSize], '\n')+1]
+		}
+
+		var parsed, failed int
+		framer := u.framer(bytes.NewReader(data))
 		for {
-			n, _, err := conn.ReadFromUDP(buf)
+			line, err := framer.ReadLine()
 			if err != nil {
-				return
+				break
 			}
-			for _, line := range strings.Split(string(buf[:n]), "\n") {
-				point, err := u.parser.Parse(line)
-				if err != nil {
-					continue
-				}
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			if err := u.handleLine(string(line)); err != nil {
+				failed++
+			} else {
+				parsed++
+			}
+		}
 
-				// Send the data to the writer.
-				_, e := u.writer.WriteSeries(u.database, "", []influxdb.Point{point})
-				if e != nil {
-					u.Logger.Printf("failed to write data point: %s\n", e)
+		if u.LogRejectedDatagramBytes > 0 && failed > 0 && parsed == 0 {
+			u.stats.Inc("datagramsRejected")
+			if rejected++; rejected%rejectedDatagramLogEvery == 1 {
+				preview := data
+				if len(preview) > u.LogRejectedDatagramBytes {
+					preview = preview[:u.LogRejectedDatagramBytes]
 				}
+				u.Logger.Printf("rejected UDP datagram of %d bytes, no line could be parsed (%d rejected):\n%s", n, rejected, hex.Dump(preview))
 			}
 		}
-	}()
-	return nil
+	}
+}
+
+// closed returns true if the server has been closed.
+func (u *UDPServer) closed() bool {
+	select {
+	case <-u.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// datagramHashes holds the hashes of recently received datagrams.
+type datagramHashes struct {
+	m     map[uint64]time.Time
+	queue []datagramHash
+}
+
+// datagramHash is the hash of a datagram and the time it was received.
+type datagramHash struct {
+	sum uint64
+	t   time.Time
+}
+
+func newDatagramHashes() *datagramHashes {
+	return &datagramHashes{m: make(map[uint64]time.Time)}
+}
+
+// seen returns true if a datagram identical to b was received within window
+// of now. Otherwise b is recorded as received at now.
+func (d *datagramHashes) seen(b []byte, now time.Time, window time.Duration) bool {
+	// Expire hashes outside the window, or beyond the limit, oldest first.
+	for len(d.queue) > 0 && (now.Sub(d.queue[0].t) >= window || len(d.queue) >= maxDedupDatagrams) {
+		if e := d.queue[0]; d.m[e.sum].Equal(e.t) {
+			delete(d.m, e.sum)
+		}
+		d.queue = d.queue[1:]
+	}
+
+	h := fnv.New64a()
+	h.Write(b)
+	sum := h.Sum64()
+	if _, ok := d.m[sum]; ok {
+		return true
+	}
+	d.m[sum] = now
+	d.queue = append(d.queue, datagramHash{sum: sum, t: now})
+	return false
 }
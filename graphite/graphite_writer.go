@@ -0,0 +1,9 @@
+package graphite
+
+import (
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// PartialWriteError may be returned by a SeriesWriter when only some of the
+// points in a write failed. Any other error fails the whole write.
+type PartialWriteError = ingest.PartialWriteError
@@ -0,0 +1,1211 @@
+package graphite
+
+// This file is run within the "graphite" package and allows for internal unit tests.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/internal/ingest"
+	"github.com/influxdb/influxdb/test"
+)
+
+// Ensure the UDP server keeps reading after a transient read error.
+func TestUDPServer_serve_TemporaryError(t *testing.T) {
+	w := &testWriter{}
+	u := NewUDPServer(NewParser(), w, "graphite")
+
+	conn := newTestPacketConn(
+		&net.OpError{Op: "read", Net: "udp", Err: syscall.ECONNREFUSED},
+		[]byte("cpu 50 1419972457"),
+	)
+	go u.ServePacket(conn)
+
+	timeout := time.After(time.Second)
+	for len(w.Points()) == 0 {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for point after temporary error")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if err := u.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure Close waits for pending points up to the close timeout.
+func TestUDPServer_Close_Timeout(t *testing.T) {
+	for _, slow := range []bool{false, true} {
+		w := &blockingWriter{entered: make(chan struct{}, 3), release: make(chan struct{})}
+		if !slow {
+			close(w.release)
+		}
+
+		var buf bytes.Buffer
+		u := NewUDPServer(NewParser(), w, "graphite")
+		u.QueueSize = 10
+		u.CloseTimeout = 50 * time.Millisecond
+		u.Logger = log.New(&buf, "", 0)
+
+		conn := newTestPacketConn([]byte("cpu 1 1419972457\ncpu 2 1419972458\ncpu 3 1419972459"))
+		go u.ServePacket(conn)
+		<-w.entered
+
+		start := time.Now()
+		err := u.Close()
+		elapsed := time.Since(start)
+
+		if !slow {
+			if err != nil {
+				t.Fatal(err)
+			} else if n := len(w.Points()); n != 3 {
+				t.Fatalf("unexpected number of points written.  expected 3, got %d", n)
+			} else if buf.Len() != 0 {
+				t.Fatalf("unexpected log output: %s", buf.String())
+			}
+			continue
+		}
+
+		if err != ErrCloseTimeout {
+			t.Fatalf("unexpected error.  expected %v, got %v", ErrCloseTimeout, err)
+		} else if elapsed < u.CloseTimeout || elapsed > time.Second {
+			t.Fatalf("unexpected Close duration: %s", elapsed)
+		} else if exp := "closed with 2 points pending after 50ms\n"; buf.String() != exp {
+			t.Fatalf("unexpected log output.  expected %q, got %q", exp, buf.String())
+		}
+		close(w.release)
+	}
+}
+
+// Ensure Close after a Drain which timed out waits for the flush the Drain
+// started, rather than flushing a second time.
+func TestUDPServer_Drain_Timeout_Close(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &blockingWriter{entered: make(chan struct{}, 3), release: make(chan struct{})}
+	u := NewUDPServer(NewParser(), w, "graphite")
+	u.QueueSize = 10
+	go u.ServePacket(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("cpu 1 1419972457\ncpu 2 1419972458\ncpu 3 1419972459"))
+	<-w.entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := u.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected Drain error.  expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- u.Close() }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned before the flush finished: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(w.release)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	} else if n := len(w.Points()); n != 3 {
+		t.Fatalf("unexpected number of points written.  expected 3, got %d", n)
+	}
+}
+
+// Ensure Flush returns once the handler has been flushed and its queue is
+// no longer processed, rather than waiting on the queue forever.
+func TestHandler_Flush_AfterShutdown(t *testing.T) {
+	w := &testWriter{}
+	h := newHandler(NewParser(), w, "graphite")
+	h.QueueSize = 10
+	h.open()
+	if err := h.handleLine("cpu 1 1419972457"); err != nil {
+		t.Fatal(err)
+	}
+	h.flush()
+
+	done := make(chan error)
+	go func() { done <- h.Flush() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Flush blocked after the handler was flushed")
+	}
+
+	// A second shutdown flush does nothing.
+	h.flush()
+	if n := len(w.Points()); n != 1 {
+		t.Fatalf("unexpected number of points written.  expected 1, got %d", n)
+	}
+}
+
+// Ensure the sample rate selects a consistent subset of series.
+func TestHandler_SampleRate(t *testing.T) {
+	w := &testWriter{}
+	h := newHandler(NewParser(), w, "graphite")
+	h.SampleRate = 0.25
+
+	// Send each series twice so per-series consistency can be checked.
+	for i := 0; i < 2000; i++ {
+		if err := h.handleLine(fmt.Sprintf("cpu.host.server%d %d 1419972457", i%1000, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, p := range w.Points() {
+		counts[p.Tags["host"]]++
+	}
+	if len(counts) < 200 || len(counts) > 300 {
+		t.Fatalf("unexpected number of sampled series.  expected ~250, got %d", len(counts))
+	}
+	for host, n := range counts {
+		if n != 2 {
+			t.Fatalf("series %s was not consistently sampled.  expected 2 points, got %d", host, n)
+		}
+	}
+	if n := h.Stats().Get("pointsSampledOut"); n != int64(2000-2*len(counts)) {
+		t.Fatalf("unexpected pointsSampledOut count.  expected %d, got %d", 2000-2*len(counts), n)
+	}
+}
+
+// Ensure points are counted per measurement, evicting the least recently seen.
+func TestHandler_Stats_Measurements(t *testing.T) {
+	h := newHandler(NewParser(), &testWriter{}, "graphite")
+	h.MaxTrackedMeasurements = 2
+
+	for _, line := range []string{
+		"cpu 1 1419972457",
+		"mem 1 1419972457",
+		"cpu 1 1419972458",
+		"cpu 1 1419972459",
+		"disk 1 1419972457",
+	} {
+		if err := h.handleLine(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if exp, got := map[string]uint64{"cpu": 3, "disk": 1}, h.Stats().Measurements; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("unexpected measurement stats.  expected %v, got %v", exp, got)
+	}
+}
+
+// Ensure partial write errors only count the failed points as failed.
+func TestHandler_PartialWriteError(t *testing.T) {
+	var tests = []struct {
+		err     error
+		written int64
+		failed  int64
+	}{
+		{written: 3},
+		{err: &PartialWriteError{Failed: map[int]error{1: errors.New("field type conflict")}}, written: 2, failed: 1},
+		{err: errors.New("write failed"), failed: 3},
+	}
+
+	for i, test := range tests {
+		h := newHandler(NewParser(), &errWriter{err: test.err}, "graphite")
+		h.BatchSize = 3
+		h.open()
+
+		for _, line := range []string{"cpu 1 1419972457", "cpu 2 1419972458", "cpu 3 1419972459"} {
+			if err := h.handleLine(line); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if n := h.Stats().Get("pointsWritten"); n != test.written {
+			t.Fatalf("%d. unexpected pointsWritten count.  expected %d, got %d", i, test.written, n)
+		}
+		if n := h.Stats().Get("pointsWriteFailed"); n != test.failed {
+			t.Fatalf("%d. unexpected pointsWriteFailed count.  expected %d, got %d", i, test.failed, n)
+		}
+	}
+}
+
+// Ensure points are dropped or block when the write queue is full.
+func TestHandler_QueueFullPolicy(t *testing.T) {
+	for _, policy := range []QueueFullPolicy{DropWhenQueueFull, BlockWhenQueueFull} {
+		w := &blockingWriter{entered: make(chan struct{}, 3), release: make(chan struct{})}
+		h := newHandler(NewParser(), w, "graphite")
+		h.QueueSize = 1
+		h.QueueFullPolicy = policy
+		h.open()
+
+		// The first point is taken by the writer, which blocks, and the second fills the queue.
+		h.handleLine("cpu 1 1419972457")
+		<-w.entered
+		h.handleLine("cpu 2 1419972458")
+
+		written := make(chan struct{})
+		go func() {
+			h.handleLine("cpu 3 1419972459")
+			close(written)
+		}()
+
+		select {
+		case <-written:
+			if policy == BlockWhenQueueFull {
+				t.Fatal("write did not block on full queue")
+			}
+		case <-time.After(50 * time.Millisecond):
+			if policy == DropWhenQueueFull {
+				t.Fatal("write blocked on full queue")
+			}
+		}
+
+		close(w.release)
+		<-written
+		h.flush()
+
+		exp, dropped := 3, int64(0)
+		if policy == DropWhenQueueFull {
+			exp, dropped = 2, 1
+		}
+		if n := len(w.Points()); n != exp {
+			t.Fatalf("%d. unexpected number of points written.  expected %d, got %d", policy, exp, n)
+		}
+		if n := h.Stats().Get("pointsDroppedQueueFull"); n != dropped {
+			t.Fatalf("%d. unexpected pointsDroppedQueueFull count.  expected %d, got %d", policy, dropped, n)
+		}
+	}
+}
+
+// Ensure the circuit breaker opens after consecutive failures and closes once writes succeed.
+func TestHandler_CircuitBreaker(t *testing.T) {
+	w := &errWriter{err: errors.New("database unavailable")}
+	h := newHandler(NewParser(), w, "graphite")
+	h.BreakerThreshold = 2
+	h.BreakerCooldown = 50 * time.Millisecond
+	h.open()
+
+	check := func(step string, state, trips, dropped, failed int64) {
+		if n := h.Stats().Get("breakerState"); n != state {
+			t.Fatalf("%s: unexpected breakerState.  expected %d, got %d", step, state, n)
+		} else if n := h.Stats().Get("breakerTrips"); n != trips {
+			t.Fatalf("%s: unexpected breakerTrips.  expected %d, got %d", step, trips, n)
+		} else if n := h.Stats().Get("pointsDroppedBreakerOpen"); n != dropped {
+			t.Fatalf("%s: unexpected pointsDroppedBreakerOpen.  expected %d, got %d", step, dropped, n)
+		} else if n := h.Stats().Get("pointsWriteFailed"); n != failed {
+			t.Fatalf("%s: unexpected pointsWriteFailed.  expected %d, got %d", step, failed, n)
+		}
+	}
+
+	h.handleLine("cpu 1 1419972457")
+	h.handleLine("cpu 2 1419972458")
+	check("open", ingest.BreakerOpen, 1, 0, 2)
+	h.handleLine("cpu 3 1419972459")
+	check("dropped", ingest.BreakerOpen, 1, 1, 2)
+
+	// The half-open write fails and reopens the breaker.
+	time.Sleep(60 * time.Millisecond)
+	h.handleLine("cpu 4 1419972460")
+	check("reopen", ingest.BreakerOpen, 2, 1, 3)
+
+	// The half-open write succeeds and closes the breaker.
+	time.Sleep(60 * time.Millisecond)
+	w.err = nil
+	h.handleLine("cpu 5 1419972461")
+	check("closed", ingest.BreakerClosed, 2, 1, 3)
+	if n := h.Stats().Get("pointsWritten"); n != 1 {
+		t.Fatalf("unexpected pointsWritten.  expected 1, got %d", n)
+	}
+}
+
+// Ensure points are written to the writer selected by WriterRouter.
+func TestHandler_WriterRouter(t *testing.T) {
+	def, acme, globex := &testWriter{}, &testWriter{}, &testWriter{}
+	h := newHandler(NewParser(), def, "graphite")
+	h.WriterRouter = func(p influxdb.Point) SeriesWriter {
+		switch p.Tags["tenant"] {
+		case "acme":
+			return acme
+		case "globex":
+			return globex
+		}
+		return nil
+	}
+	h.open()
+
+	h.handleLine("cpu.tenant.acme 1 1419972457")
+	h.handleLine("cpu.tenant.globex 2 1419972457")
+	h.handleLine("mem.tenant.acme 3 1419972457")
+	h.handleLine("cpu 4 1419972457")
+	h.flush()
+
+	for _, tt := range []struct {
+		name  string
+		w     *testWriter
+		names []string
+	}{
+		{"acme", acme, []string{"cpu", "mem"}},
+		{"globex", globex, []string{"cpu"}},
+		{"default", def, []string{"cpu"}},
+	} {
+		var names []string
+		for _, p := range tt.w.Points() {
+			names = append(names, p.Name)
+		}
+		if !reflect.DeepEqual(names, tt.names) {
+			t.Fatalf("%s: unexpected names.  expected %v, got %v", tt.name, tt.names, names)
+		}
+	}
+	if n := h.Stats().Get("pointsWritten"); n != 4 {
+		t.Fatalf("unexpected pointsWritten.  expected 4, got %d", n)
+	}
+}
+
+// Ensure batches are written early once they reach the byte limit.
+func TestHandler_MaxBatchBytes(t *testing.T) {
+	w := &testWriter{}
+	p := NewParser()
+	p.LastEnabled = true
+	h := newHandler(p, w, "graphite")
+	h.BatchSize = 100
+	h.MaxBatchBytes = 1000
+	h.open()
+
+	// Each point carries a tag value of about 300 bytes.
+	for i := 0; i < 5; i++ {
+		if err := h.handleLine(fmt.Sprintf("host.%s.cpu %d 1419972457", strings.Repeat("x", 300), i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if calls := w.Calls(); len(calls) != 1 || len(calls[0].Points) != 4 {
+		t.Fatalf("expected a single write of 4 points, got %v", calls)
+	}
+	if n := h.batch.Buffered(); n != 1 {
+		t.Fatalf("unexpected number of buffered points.  expected 1, got %d", n)
+	}
+}
+
+// Ensure draining the TCP server writes buffered points.
+func TestTCPServer_Drain(t *testing.T) {
+	w := &testWriter{}
+	s := NewTCPServer(NewParser(), w, "graphite")
+	s.BatchSize = 10
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("cpu 1 1419972457\ncpu 2 1419972458\ncpu 3 1419972459\n"))
+
+	timeout := time.After(time.Second)
+	for s.batch.Buffered() != 3 {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for points to be buffered")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if n := len(w.Points()); n != 0 {
+		t.Fatalf("points written before batch was full.  expected 0, got %d", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(w.Points()); n != 3 {
+		t.Fatalf("unexpected number of points after drain.  expected 3, got %d", n)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure plaintext and pickle connections are both accepted on one listener.
+func TestTCPServer_AutoDetectProtocol(t *testing.T) {
+	w := &testWriter{}
+	s := NewTCPServer(NewParser(), w, "graphite")
+	s.AutoDetectProtocol = true
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.Write([]byte("disk 3 1419972459\n"))
+
+	pickle, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pickle.Close()
+	frame := "\x80\x02]q\x00(X\x03\x00\x00\x00cpuq\x01Ji\x0f\xa3TG?\xe0\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x03\x00\x00\x00memq\x04GA\xd5(\xc3\xda\xa0\x00\x00M\x00\x04\x86q\x05\x86q\x06e."
+	pickle.Write([]byte{0, 0, 0, byte(len(frame))})
+	pickle.Write([]byte(frame))
+
+	points, err := w.WaitPoints(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, p := range points {
+		values[p.Name] = p.Fields[p.Name].(float64)
+	}
+	if exp := map[string]float64{"disk": 3, "cpu": 0.5, "mem": 1024}; !reflect.DeepEqual(values, exp) {
+		t.Fatalf("unexpected values.  expected %v, got %v", exp, values)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.stats.Get("connectionsPickle"); n != 1 {
+		t.Fatalf("unexpected connectionsPickle.  expected 1, got %d", n)
+	}
+}
+
+func Test_decodePickle(t *testing.T) {
+	exp := []pickleMetric{
+		{path: "cpu", timestamp: "1419972457", value: "0.5"},
+		{path: "mem", timestamp: "1419972458.5", value: "1024"},
+	}
+	for proto, data := range map[int]string{
+		0: "(lp0\n(Vcpu\np1\n(I1419972457\nF0.5\ntp2\ntp3\na(Vmem\np4\n(F1419972458.5\nI1024\ntp5\ntp6\na.",
+		2: "\x80\x02]q\x00(X\x03\x00\x00\x00cpuq\x01Ji\x0f\xa3TG?\xe0\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x03\x00\x00\x00memq\x04GA\xd5(\xc3\xda\xa0\x00\x00M\x00\x04\x86q\x05\x86q\x06e.",
+		4: "\x80\x04\x953\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x03cpu\x94Ji\x0f\xa3TG?\xe0\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x03mem\x94GA\xd5(\xc3\xda\xa0\x00\x00M\x00\x04\x86\x94\x86\x94e.",
+	} {
+		if !isPickleFrame(append([]byte{0, 0, 0, byte(len(data))}, data...)) {
+			t.Fatalf("protocol %d frame not detected as pickle", proto)
+		}
+		metrics, err := decodePickle([]byte(data))
+		if err != nil {
+			t.Fatalf("protocol %d: %s", proto, err)
+		}
+		if !reflect.DeepEqual(metrics, exp) {
+			t.Fatalf("protocol %d: unexpected metrics.  expected %v, got %v", proto, exp, metrics)
+		}
+	}
+
+	if isPickleFrame([]byte("cpu 1 1419972457\n")) {
+		t.Fatal("plaintext line detected as pickle")
+	}
+
+	// Only the first byte is needed to detect a frame.
+	if !isPickleFrame([]byte{0}) {
+		t.Fatal("frame length prefix not detected as pickle")
+	} else if isPickleFrame([]byte("c")) || isPickleFrame(nil) {
+		t.Fatal("plaintext prefix detected as pickle")
+	}
+
+	// Frames constructing anything but lists, tuples, strings and numbers are rejected.
+	if _, err := decodePickle([]byte("\x80\x02}q\x00X\x01\x00\x00\x00aq\x01K\x01s.")); err == nil {
+		t.Fatal("expected error decoding a dict")
+	}
+	if _, err := decodePickle([]byte("cos\nsystem\n(S'true'\ntR.")); err == nil {
+		t.Fatal("expected error decoding a global")
+	}
+}
+
+func TestHandler_SelfMetricInterval(t *testing.T) {
+	w := &testWriter{}
+	h := newHandler(NewParser(), w, "graphite")
+	h.SelfMetricInterval = 50 * time.Millisecond
+	h.SelfMetricMeasurement = "graphite.up"
+	h.open()
+
+	points, err := w.WaitPoints(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.flush()
+	for i, p := range points {
+		if p.Name != "graphite.up" || p.Fields["value"] != 1.0 {
+			t.Fatalf("unexpected heartbeat: %v", p)
+		}
+		if i > 0 {
+			if d := p.Timestamp.Sub(points[i-1].Timestamp); d < 40*time.Millisecond {
+				t.Fatalf("heartbeats written %s apart, expected %s", d, h.SelfMetricInterval)
+			}
+		}
+	}
+
+	// No heartbeats are written once the handler is flushed.
+	n := len(w.Points())
+	time.Sleep(3 * h.SelfMetricInterval)
+	if len(w.Points()) != n {
+		t.Fatal("heartbeat written after close")
+	}
+}
+
+// testWriter records all points written to it.
+type testWriter = test.MemWriter
+
+// blockingWriter signals entered on each write, then blocks until release is closed.
+type blockingWriter struct {
+	testWriter
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	w.entered <- struct{}{}
+	<-w.release
+	return w.testWriter.WriteSeries(database, retentionPolicy, points)
+}
+
+// concurrencyWriter records the maximum number of concurrent writes.
+type concurrencyWriter struct {
+	mu       sync.Mutex
+	n, max   int
+	duration time.Duration
+}
+
+func (w *concurrencyWriter) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	w.mu.Lock()
+	if w.n++; w.n > w.max {
+		w.max = w.n
+	}
+	w.mu.Unlock()
+
+	time.Sleep(w.duration)
+
+	w.mu.Lock()
+	w.n--
+	w.mu.Unlock()
+	return 0, nil
+}
+
+// errWriter returns err from every write.
+type errWriter struct {
+	err error
+}
+
+func (w *errWriter) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	return 0, w.err
+}
+
+// testPacketConn is a net.PacketConn which returns a fixed sequence of reads.
+// Each read is either an error or a datagram. Once the sequence is exhausted
+// reads block until the conn is closed.
+type testPacketConn struct {
+	reads  []interface{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newTestPacketConn(reads ...interface{}) *testPacketConn {
+	return &testPacketConn{reads: reads, closed: make(chan struct{})}
+}
+
+func (c *testPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(c.reads) == 0 {
+		<-c.closed
+		return 0, nil, net.ErrClosed
+	}
+
+	r := c.reads[0]
+	c.reads = c.reads[1:]
+	if err, ok := r.(error); ok {
+		return 0, nil, err
+	}
+	return copy(b, r.([]byte)), c.LocalAddr(), nil
+}
+
+func (c *testPacketConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *testPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) { return len(b), nil }
+func (c *testPacketConn) LocalAddr() net.Addr                          { return &net.UDPAddr{} }
+func (c *testPacketConn) SetDeadline(t time.Time) error                { return nil }
+func (c *testPacketConn) SetReadDeadline(t time.Time) error            { return nil }
+func (c *testPacketConn) SetWriteDeadline(t time.Time) error           { return nil }
+
+// Ensure the fast and general paths parse a simple line identically.
+func TestParser_parseSimple(t *testing.T) {
+	p := NewParser()
+	for _, line := range []string{"cpu 50 1419972457", " cpu\t50.5   1419972457.825 "} {
+		fast, ok := p.parseSimple(line)
+		if !ok {
+			t.Fatalf("expected fast path for %q", line)
+		}
+		general, err := p.parse(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fast.Name != general.Name || !reflect.DeepEqual(fast.Fields, general.Fields) ||
+			!fast.Timestamp.Equal(general.Timestamp) || !reflect.DeepEqual(fast.Tags, general.Tags) {
+			t.Fatalf("unexpected point for %q.  expected %v, got %v", line, general, fast)
+		} else if fast.Tags == nil {
+			t.Fatalf("expected a tag map for %q, so that processors may add tags", line)
+		}
+	}
+
+	for _, line := range []string{"cpu.host.a 50 1419972457", "cpu 50", "cpu 50 1419972457 x", "cpu x 1419972457", "cpu\u00a050 1419972457"} {
+		if _, ok := p.parseSimple(line); ok {
+			t.Fatalf("unexpected fast path for %q", line)
+		}
+	}
+}
+
+// parseSimpleAllocs is the number of allocations made by Parse for a line
+// taking the fast path: the tag and field maps, the boxed value and the
+// slice returned by ParseAll. The general path makes two more.
+const parseSimpleAllocs = 5
+
+// Ensure the fast path does not regress to the allocations of the general path.
+func TestParser_Parse_Allocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("race detector allocates")
+	}
+	p := NewParser()
+	line := "cpu_load 50 1419972457"
+	if n := testing.AllocsPerRun(100, func() {
+		if _, err := p.Parse(line); err != nil {
+			t.Fatal(err)
+		}
+	}); n > parseSimpleAllocs {
+		t.Fatalf("Parse allocations regressed.  expected at most %d, got %v", parseSimpleAllocs, n)
+	}
+}
+
+func BenchmarkParser_Parse(b *testing.B) {
+	p := NewParser()
+	line := "servers.localhost.cpu.loadavg.10 50 1419972457"
+	simple := "cpu_load 50 1419972457"
+	fast := func(line string) (influxdb.Point, error) {
+		point, ok := p.parseSimple(line)
+		if !ok {
+			return point, fmt.Errorf("no fast path for %q", line)
+		}
+		return point, nil
+	}
+	for _, bm := range []struct {
+		name  string
+		line  string
+		parse func(string) (influxdb.Point, error)
+	}{
+		{"fast", simple, fast},
+		{"general", simple, p.parse},
+		{"tags", line, p.Parse},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bm.line)))
+			for i := 0; i < b.N; i++ {
+				if _, err := bm.parse(bm.line); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Ensure only the most recent point of each series is written per FlushInterval.
+func TestHandler_FlushInterval(t *testing.T) {
+	w := &testWriter{}
+	h := newHandler(NewParser(), w, "graphite")
+	h.FlushInterval = time.Hour
+	h.open()
+
+	for i := 1; i <= 100; i++ {
+		h.handleLine(fmt.Sprintf("cpu.host.a %d 1419972457", i))
+	}
+	h.handleLine("cpu.host.b 7 1419972457")
+
+	// End the first window.
+	h.writeLatest()
+	points := w.Points()
+	if len(points) != 2 {
+		t.Fatalf("unexpected number of points.  expected 2, got %d", len(points))
+	} else if v := points[0].Fields["cpu"]; points[0].Tags["host"] != "a" || v != float64(100) {
+		t.Fatalf("unexpected point: %v", points[0])
+	} else if n := h.Stats().Get("pointsAggregated"); n != 99 {
+		t.Fatalf("unexpected pointsAggregated.  expected 99, got %d", n)
+	}
+
+	// Points held when the handler is flushed are written.
+	h.handleLine("cpu.host.a 101 1419972458")
+	h.flush()
+	if points := w.Points(); len(points) != 3 {
+		t.Fatalf("unexpected number of points.  expected 3, got %d", len(points))
+	}
+}
+
+// Ensure points of one series with different fields are held separately.
+func TestHandler_FlushInterval_Fields(t *testing.T) {
+	p := NewParser()
+	if err := p.AddTemplate("measurement.field"); err != nil {
+		t.Fatal(err)
+	}
+	w := &testWriter{}
+	h := newHandler(p, w, "graphite")
+	h.FlushInterval = time.Hour
+	h.open()
+
+	h.handleLine("cpu.user 1 1419972457")
+	h.handleLine("cpu.system 2 1419972457")
+	h.handleLine("cpu.user 3 1419972458")
+	h.writeLatest()
+
+	fields := make(map[string]interface{})
+	for _, p := range w.Points() {
+		if p.Name != "cpu" {
+			t.Fatalf("unexpected measurement: %s", p.Name)
+		}
+		for k, v := range p.Fields {
+			fields[k] = v
+		}
+	}
+	if exp := map[string]interface{}{"user": 3.0, "system": 2.0}; !reflect.DeepEqual(fields, exp) {
+		t.Fatalf("unexpected fields.  expected %v, got %v", exp, fields)
+	} else if n := h.Stats().Get("pointsAggregated"); n != 1 {
+		t.Fatalf("unexpected pointsAggregated.  expected 1, got %d", n)
+	}
+	h.flush()
+}
+
+// Ensure held points are written when each FlushInterval elapses.
+func TestHandler_FlushInterval_Ticker(t *testing.T) {
+	w := &testWriter{}
+	h := newHandler(NewParser(), w, "graphite")
+	h.FlushInterval = 10 * time.Millisecond
+	h.open()
+	defer h.flush()
+
+	h.handleLine("cpu 1 1419972457")
+	h.handleLine("cpu 2 1419972457")
+	if _, err := w.WaitPoints(1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure timestamps are rounded to the configured precision before points are written.
+func TestHandler_Precision(t *testing.T) {
+	ts := time.Unix(1419972457, 987654321)
+	var tests = []struct {
+		precision string
+		exp       time.Time
+	}{
+		{"", ts},
+		{"n", ts},
+		{"u", time.Unix(1419972457, 987654000)},
+		{"ms", time.Unix(1419972457, 988000000)},
+		{"s", time.Unix(1419972458, 0)},
+	}
+
+	for _, tt := range tests {
+		w := &testWriter{}
+		h := newHandler(NewParser(), w, "graphite")
+		h.Precision = tt.precision
+		h.open()
+
+		h.writePoint(influxdb.Point{Name: "cpu", Timestamp: ts, Fields: map[string]interface{}{"cpu": 1.0}})
+		if points := w.Points(); len(points) != 1 || !points[0].Timestamp.Equal(tt.exp) {
+			t.Fatalf("%q: unexpected points.  expected timestamp %v, got %v", tt.precision, tt.exp, points)
+		}
+	}
+}
+
+// Ensure every point parsed from a line is written.
+func TestHandler_DerivePoints(t *testing.T) {
+	p := NewParser()
+	p.DerivePoints = func(pt influxdb.Point) []influxdb.Point {
+		return []influxdb.Point{{Name: pt.Name + "_copy", Fields: pt.Fields, Timestamp: pt.Timestamp}}
+	}
+	w := &testWriter{}
+	h := newHandler(p, w, "graphite")
+	h.open()
+
+	if err := h.handleLine("cpu 1 1419972457"); err != nil {
+		t.Fatal(err)
+	}
+	if points := w.Points(); len(points) != 2 || points[0].Name != "cpu" || points[1].Name != "cpu_copy" {
+		t.Fatalf("unexpected points: %v", points)
+	} else if n := h.Stats().Get("pointsReceived"); n != 2 {
+		t.Fatalf("unexpected pointsReceived.  expected 2, got %d", n)
+	}
+}
+
+func TestHandler_TagFilters(t *testing.T) {
+	var tests = []struct {
+		filter TagFilter
+		exp    []string
+	}{
+		{filter: TagFilter{Allow: map[string]struct{}{"prod": {}}}, exp: []string{"prod"}},
+		{filter: TagFilter{Deny: map[string]struct{}{"dev": {}}}, exp: []string{"prod", "staging"}},
+		{filter: TagFilter{AllowRegexp: regexp.MustCompile(`^(prod|staging)$`)}, exp: []string{"prod", "staging"}},
+		{filter: TagFilter{DenyRegexp: regexp.MustCompile(`^(dev|staging)$`)}, exp: []string{"prod"}},
+	}
+
+	for i, test := range tests {
+		p := NewParser()
+		if err := p.AddTemplate("env.measurement*"); err != nil {
+			t.Fatal(err)
+		}
+		w := &testWriter{}
+		h := newHandler(p, w, "graphite")
+		h.TagFilters = map[string]TagFilter{"env": test.filter}
+		h.open()
+
+		for _, line := range []string{"prod.cpu 1 1419972457", "dev.cpu 2 1419972457", "staging.cpu 3 1419972457"} {
+			if err := h.handleLine(line); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var envs []string
+		for _, p := range w.Points() {
+			envs = append(envs, p.Tags["env"])
+		}
+		if !reflect.DeepEqual(envs, test.exp) {
+			t.Fatalf("%d. unexpected points.  expected %v, got %v", i, test.exp, envs)
+		} else if n := h.Stats().Get("pointsFilteredByTag"); n != int64(3-len(test.exp)) {
+			t.Fatalf("%d. unexpected pointsFilteredByTag: %d", i, n)
+		}
+	}
+}
+
+func TestHandler_RetentionPolicyForMetric(t *testing.T) {
+	w := &testWriter{}
+	h := newHandler(NewParser(), w, "graphite")
+	h.RetentionPolicyForMetric = map[string]string{
+		"cpu":     "short",
+		"cpu*":    "medium",
+		"stats_*": "long",
+	}
+	h.BatchSize = 10
+	h.open()
+
+	for _, line := range []string{"cpu 1 1419972457", "cpu_total 2 1419972457", "stats_requests 3 1419972457", "mem 4 1419972457"} {
+		if err := h.handleLine(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.flush()
+
+	// Batches are written per retention policy.
+	rps := make(map[string][]string)
+	for _, c := range w.Calls() {
+		for _, p := range c.Points {
+			rps[c.RetentionPolicy] = append(rps[c.RetentionPolicy], p.Name)
+		}
+	}
+	exp := map[string][]string{"short": {"cpu"}, "medium": {"cpu_total"}, "long": {"stats_requests"}, "": {"mem"}}
+	if !reflect.DeepEqual(rps, exp) {
+		t.Fatalf("unexpected retention policies.  expected %v, got %v", exp, rps)
+	}
+}
+
+func TestHandler_SnapshotAndReset(t *testing.T) {
+	h := newHandler(NewParser(), &testWriter{}, "graphite")
+	h.open()
+	h.stats.Add("activeConnections", 1)
+	h.handleLine("cpu 1 1419972457")
+	h.handleLine("mem 2 1419972457")
+
+	snap := h.SnapshotAndReset()
+	if n := snap.Get("pointsReceived"); n != 2 {
+		t.Fatalf("unexpected pointsReceived in snapshot.  expected 2, got %d", n)
+	} else if n := snap.Get("activeConnections"); n != 1 {
+		t.Fatalf("unexpected activeConnections in snapshot.  expected 1, got %d", n)
+	}
+
+	// The next snapshot holds only the counts since the last, while the
+	// totals are kept.
+	h.handleLine("disk 3 1419972457")
+	h.stats.Add("activeConnections", -1)
+	snap = h.SnapshotAndReset()
+	if n := snap.Get("pointsReceived"); n != 1 {
+		t.Fatalf("unexpected pointsReceived in second snapshot.  expected 1, got %d", n)
+	} else if n := snap.Get("activeConnections"); n != 0 {
+		t.Fatalf("unexpected activeConnections in second snapshot.  expected 0, got %d", n)
+	} else if n := h.Stats().Get("pointsReceived"); n != 3 {
+		t.Fatalf("unexpected pointsReceived total.  expected 3, got %d", n)
+	}
+}
+
+func TestHandler_SanitizeName(t *testing.T) {
+	var tests = []struct {
+		sanitize bool
+		exp      string
+		changed  int64
+	}{
+		{exp: "cpu,load\x07"},
+		{sanitize: true, exp: "cpu_load_", changed: 1},
+	}
+
+	for i, test := range tests {
+		w := &testWriter{}
+		h := newHandler(NewParser(), w, "graphite")
+		h.SanitizeName = test.sanitize
+		h.open()
+
+		if err := h.handleLine("cpu,load\x07 1 1419972457"); err != nil {
+			t.Fatal(err)
+		} else if name := w.Points()[0].Name; name != test.exp {
+			t.Fatalf("%d. unexpected name.  expected %q, got %q", i, test.exp, name)
+		} else if n := h.Stats().Get("namesSanitized"); n != test.changed {
+			t.Fatalf("%d. unexpected namesSanitized.  expected %d, got %d", i, test.changed, n)
+		}
+	}
+}
+
+func TestHandler_MaxAbsValue(t *testing.T) {
+	w := &testWriter{}
+	h := newHandler(NewParser(), w, "graphite")
+	h.MaxAbsValue = 1e12
+	h.open()
+
+	if err := h.handleLine("cpu 1e308 1419972457"); err == nil || err.Error() != "value of cpu exceeds maximum magnitude 1e+12, skipping" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := h.handleLine("cpu 1 1419972457"); err != nil {
+		t.Fatal(err)
+	}
+	if points := w.Points(); len(points) != 1 || points[0].Fields["cpu"] != 1.0 {
+		t.Fatalf("expected only the value within the limit to be written, got %v", points)
+	} else if n := h.Stats().Get("pointsValueOverLimit"); n != 1 {
+		t.Fatalf("unexpected pointsValueOverLimit.  expected 1, got %d", n)
+	}
+}
+
+func TestHandler_Processors(t *testing.T) {
+	w := &testWriter{}
+	h := newHandler(NewParser(), w, "graphite")
+	h.Processors = []influxdb.PointProcessor{
+		// Drop debug points.
+		influxdb.PointProcessorFunc(func(p influxdb.Point) ([]influxdb.Point, bool) {
+			return []influxdb.Point{p}, p.Name != "debug"
+		}),
+		// Tag every point.
+		influxdb.PointProcessorFunc(func(p influxdb.Point) ([]influxdb.Point, bool) {
+			p.Tags = map[string]string{"env": "prod"}
+			return []influxdb.Point{p}, true
+		}),
+		// Also write cpu points as a total.
+		influxdb.PointProcessorFunc(func(p influxdb.Point) ([]influxdb.Point, bool) {
+			if p.Name != "cpu" {
+				return []influxdb.Point{p}, true
+			}
+			total := p
+			total.Name = "cpu_total"
+			return []influxdb.Point{p, total}, true
+		}),
+	}
+	h.open()
+
+	for _, line := range []string{"debug 1 1419972457", "cpu 2 1419972457", "mem 3 1419972457"} {
+		if err := h.handleLine(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	for _, p := range w.Points() {
+		if p.Tags["env"] != "prod" {
+			t.Fatalf("expected point %s to be tagged, got %v", p.Name, p.Tags)
+		}
+		names = append(names, p.Name)
+	}
+	if exp := []string{"cpu", "cpu_total", "mem"}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("unexpected points.  expected %v, got %v", exp, names)
+	} else if n := h.Stats().Get("pointsDroppedByProcessor"); n != 1 {
+		t.Fatalf("unexpected pointsDroppedByProcessor: %d", n)
+	}
+}
+
+// Ensure Flush writes held, queued and buffered points.
+func TestHandler_Flush(t *testing.T) {
+	w := &testWriter{}
+	h := newHandler(NewParser(), w, "graphite")
+	h.BatchSize = 100
+	h.QueueSize = 10
+	h.FlushInterval = time.Hour
+	h.open()
+	defer h.flush()
+
+	h.handleLine("cpu 1 1419972457")
+	h.handleLine("mem 2 1419972457")
+	if points := w.Points(); len(points) != 0 {
+		t.Fatalf("unexpected points before flush: %v", points)
+	}
+
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if points := w.Points(); len(points) != 2 {
+		t.Fatalf("unexpected number of points.  expected 2, got %d", len(points))
+	}
+}
+
+// Ensure points are flushed every AutoFlushInterval.
+func TestHandler_AutoFlushInterval(t *testing.T) {
+	w := &testWriter{}
+	h := newHandler(NewParser(), w, "graphite")
+	h.BatchSize = 100
+	h.AutoFlushInterval = 10 * time.Millisecond
+	h.open()
+	defer h.flush()
+
+	h.handleLine("cpu 1 1419972457")
+	for deadline := time.Now().Add(time.Second); len(w.Points()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for points to be flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Ensure points which fail to write are spilled and can be replayed.
+func TestHandler_SpillPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphite-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := &errWriter{err: errors.New("database unavailable")}
+	h := newHandler(NewParser(), w, "graphite")
+	h.SpillPath = filepath.Join(dir, "spill")
+	h.open()
+
+	h.handleLine("cpu.host.a 1 1419972457")
+	if n := h.Stats().Get("pointsSpilled"); n != 1 {
+		t.Fatalf("unexpected pointsSpilled.  expected 1, got %d", n)
+	}
+
+	// A failed replay keeps the points.
+	if _, err := h.ReplaySpill(); err == nil {
+		t.Fatal("expected replay error")
+	}
+
+	// Once MaxSpillBytes is reached further points are not spilled.
+	h.MaxSpillBytes = 1
+	h.handleLine("cpu.host.b 2 1419972457")
+	if n := h.Stats().Get("pointsSpillFailed"); n != 1 {
+		t.Fatalf("unexpected pointsSpillFailed.  expected 1, got %d", n)
+	}
+
+	w.err = nil
+	if n, err := h.ReplaySpill(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("unexpected number of replayed points.  expected 1, got %d", n)
+	}
+}
+
+// Ensure no more than MaxConcurrentWrites writes are made at once.
+func TestHandler_MaxConcurrentWrites(t *testing.T) {
+	w := &concurrencyWriter{duration: 5 * time.Millisecond}
+	h := newHandler(NewParser(), w, "graphite")
+	h.MaxConcurrentWrites = 2
+	h.open()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.handleLine("cpu 1 1419972457")
+		}()
+	}
+	wg.Wait()
+
+	if w.max != 2 {
+		t.Fatalf("unexpected maximum concurrent writes.  expected 2, got %d", w.max)
+	} else if n := h.Stats().Get("writesInFlight"); n != 0 {
+		t.Fatalf("unexpected writesInFlight.  expected 0, got %d", n)
+	}
+}
+
+// Ensure lines without data are counted and skipped rather than errors.
+func TestHandler_NoData(t *testing.T) {
+	w := &testWriter{}
+	h := newHandler(NewParser(), w, "graphite")
+	h.open()
+
+	for _, line := range []string{"metric nan 100", "metric null 100"} {
+		if err := h.handleLine(line); err != nil {
+			t.Fatalf("%q: unexpected error: %s", line, err)
+		}
+	}
+	if points := w.Points(); len(points) != 0 {
+		t.Fatalf("unexpected points: %v", points)
+	} else if n := h.Stats().Get("linesNoData"); n != 2 {
+		t.Fatalf("unexpected linesNoData.  expected 2, got %d", n)
+	} else if n := h.Stats().Get("parseErrors"); n != 0 {
+		t.Fatalf("unexpected parseErrors.  expected 0, got %d", n)
+	}
+}
+
+// Ensure points with whole-second timestamps are counted but still written.
+func TestHandler_OverrideTimestampWithNow(t *testing.T) {
+	sent := time.Unix(1419972457, 0)
+	for _, override := range []bool{false, true} {
+		w := &testWriter{}
+		h := newHandler(NewParser(), w, "graphite")
+		h.OverrideTimestampWithNow = override
+		h.open()
+
+		before := time.Now()
+		if err := h.handleLine("cpu 1 1419972457"); err != nil {
+			t.Fatal(err)
+		}
+		after := time.Now()
+
+		ts := w.Points()[0].Timestamp
+		if !override && !ts.Equal(sent) {
+			t.Fatalf("expected sent timestamp %s by default, got %s", sent, ts)
+		} else if override && (ts.Before(before) || ts.After(after)) {
+			t.Fatalf("expected timestamp between %s and %s, got %s", before, after, ts)
+		}
+	}
+}
+
+func TestHandler_WarnCoarseTimestamps(t *testing.T) {
+	w := &testWriter{}
+	h := newHandler(NewParser(), w, "graphite")
+	h.WarnCoarseTimestamps = true
+	h.open()
+
+	h.handleLine("cpu 1 1419972457")
+	h.handleLine("cpu 1 1419972457.5")
+	if n := h.Stats().Get("coarseTimestamps"); n != 1 {
+		t.Fatalf("unexpected coarseTimestamps.  expected 1, got %d", n)
+	} else if points := w.Points(); len(points) != 2 {
+		t.Fatalf("unexpected number of points.  expected 2, got %d", len(points))
+	}
+}
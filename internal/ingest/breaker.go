@@ -0,0 +1,105 @@
+package ingest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/influxdb/influxdb"
+)
+
+// Circuit breaker states, as reported by the "breakerState" statistic.
+const (
+	BreakerClosed = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+// CircuitBreaker stops writing to a persistently failing writer. After
+// threshold consecutive failed writes the breaker opens and points are
+// dropped for the cooldown. The next write then tests the writer: if it
+// succeeds the breaker closes, otherwise it opens again.
+type CircuitBreaker struct {
+	Writer SeriesWriter
+	Stats  *influxdb.Stats
+
+	// Config returns the failure threshold and cooldown. A nil Config or a
+	// threshold of zero disables the breaker.
+	Config func() (threshold int, cooldown time.Duration)
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// WriteSeries writes points unless the breaker is open, in which case they are
+// dropped and counted.
+func (b *CircuitBreaker) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	var threshold int
+	var cooldown time.Duration
+	if b.Config != nil {
+		threshold, cooldown = b.Config()
+	}
+	if threshold <= 0 {
+		return b.Writer.WriteSeries(database, retentionPolicy, points)
+	}
+
+	if !b.allow(cooldown) {
+		b.Stats.Add("pointsDroppedBreakerOpen", int64(len(points)))
+		return 0, nil
+	}
+
+	index, err := b.Writer.WriteSeries(database, retentionPolicy, points)
+	b.record(err == nil || IsPartialWriteError(err), threshold)
+	return index, err
+}
+
+// allow returns true if a write should be attempted.
+func (b *CircuitBreaker) allow(cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < cooldown {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		// Only a single write tests the writer.
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of a write.
+func (b *CircuitBreaker) record(ok bool, threshold int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if ok {
+		b.failures = 0
+		b.setState(BreakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= threshold {
+		b.failures = 0
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+		b.Stats.Inc("breakerTrips")
+	}
+}
+
+// setState sets the breaker state. Must be called with the lock held.
+func (b *CircuitBreaker) setState(state int) {
+	b.state = state
+	b.Stats.Set("breakerState", int64(state))
+}
@@ -0,0 +1,42 @@
+package ingest_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// Ensure the breaker opens after the threshold of failures, drops points for
+// the cooldown and closes once a probe succeeds.
+func TestCircuitBreaker(t *testing.T) {
+	err := errors.New("unavailable")
+	b := &ingest.CircuitBreaker{
+		Writer: writerFunc(func(string, string, []influxdb.Point) (uint64, error) { return 0, err }),
+		Stats:  influxdb.NewStats("test"),
+		Config: func() (int, time.Duration) { return 2, 20 * time.Millisecond },
+	}
+
+	b.WriteSeries("db", "", points("a"))
+	b.WriteSeries("db", "", points("b"))
+	if n := b.Stats.Get("breakerState"); n != ingest.BreakerOpen {
+		t.Fatalf("breakerState: exp open, got %d", n)
+	}
+	if _, e := b.WriteSeries("db", "", points("c")); e != nil {
+		t.Fatalf("unexpected error while open: %s", e)
+	} else if n := b.Stats.Get("pointsDroppedBreakerOpen"); n != 1 {
+		t.Fatalf("pointsDroppedBreakerOpen: exp 1, got %d", n)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	err = nil
+	if _, e := b.WriteSeries("db", "", points("d")); e != nil {
+		t.Fatal(e)
+	} else if n := b.Stats.Get("breakerState"); n != ingest.BreakerClosed {
+		t.Fatalf("breakerState: exp closed, got %d", n)
+	} else if n := b.Stats.Get("breakerTrips"); n != 1 {
+		t.Fatalf("breakerTrips: exp 1, got %d", n)
+	}
+}
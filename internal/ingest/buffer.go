@@ -0,0 +1,175 @@
+package ingest
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/influxdb/influxdb"
+)
+
+// BufferedSeriesWriter buffers points and writes them to an underlying
+// SeriesWriter in batches, grouped by database and retention policy. A batch
+// is written once it holds the configured number of points, or once the
+// timeout has elapsed since its first point was buffered.
+type BufferedSeriesWriter struct {
+	mu      sync.Mutex
+	writer  SeriesWriter
+	size    int
+	timeout time.Duration
+	batches map[batchKey]*batch
+
+	// MaxBatchBytes, if non-zero, also writes a batch once the estimated
+	// size of its points reaches this many bytes.
+	MaxBatchBytes int
+
+	// Stats, if set, records the number and size of batches written and the
+	// time their points waited.
+	Stats *influxdb.Stats
+
+	// Logger logs the batches which fail to write once their timeout has
+	// elapsed. Defaults to the standard logger.
+	Logger *log.Logger
+}
+
+// batchKey identifies the destination of a batch.
+type batchKey struct {
+	database        string
+	retentionPolicy string
+}
+
+// batch holds buffered points for a single destination.
+type batch struct {
+	points  []influxdb.Point
+	bytes   int
+	timer   *time.Timer
+	created time.Time
+}
+
+// NewBufferedSeriesWriter returns a BufferedSeriesWriter which writes to w in
+// batches of size points. If timeout is non-zero, partial batches are written
+// once they are that old.
+func NewBufferedSeriesWriter(w SeriesWriter, size int, timeout time.Duration) *BufferedSeriesWriter {
+	return &BufferedSeriesWriter{
+		writer:  w,
+		size:    size,
+		timeout: timeout,
+		batches: make(map[batchKey]*batch),
+	}
+}
+
+// WriteSeries buffers points. If this fills the batch, the batch is written
+// and the result of the underlying write is returned.
+func (b *BufferedSeriesWriter) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	k := batchKey{database, retentionPolicy}
+
+	b.mu.Lock()
+	bt := b.batches[k]
+	if bt == nil {
+		bt = &batch{created: time.Now()}
+		b.batches[k] = bt
+		if b.timeout > 0 {
+			bt.timer = time.AfterFunc(b.timeout, func() { b.flushBatch(k, bt) })
+		}
+	}
+	bt.points = append(bt.points, points...)
+	if b.MaxBatchBytes > 0 {
+		for _, p := range points {
+			bt.bytes += pointSize(p)
+		}
+	}
+	if len(bt.points) < b.size && (b.MaxBatchBytes <= 0 || bt.bytes < b.MaxBatchBytes) {
+		b.mu.Unlock()
+		return 0, nil
+	}
+	b.remove(k)
+	b.mu.Unlock()
+
+	return b.write(k, bt)
+}
+
+// Flush writes all buffered points. The first write error is returned.
+func (b *BufferedSeriesWriter) Flush() error {
+	b.mu.Lock()
+	batches := make(map[batchKey]*batch, len(b.batches))
+	for k, bt := range b.batches {
+		batches[k] = bt
+		b.remove(k)
+	}
+	b.mu.Unlock()
+
+	var err error
+	for k, bt := range batches {
+		if _, e := b.write(k, bt); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// flushBatch writes bt if it is still buffered under k.
+func (b *BufferedSeriesWriter) flushBatch(k batchKey, bt *batch) {
+	b.mu.Lock()
+	if b.batches[k] != bt {
+		b.mu.Unlock()
+		return
+	}
+	b.remove(k)
+	b.mu.Unlock()
+
+	if _, err := b.write(k, bt); err != nil {
+		logf(b.Logger, "failed to write data points to database %q: %s", k.database, err)
+	}
+}
+
+// write writes a batch which has been removed from the buffer.
+func (b *BufferedSeriesWriter) write(k batchKey, bt *batch) (uint64, error) {
+	if b.Stats != nil {
+		b.Stats.Inc("batchesWritten")
+		b.Stats.Add("batchPointsWritten", int64(len(bt.points)))
+		b.Stats.Add("batchWaitMicroseconds", int64(time.Since(bt.created)/time.Microsecond))
+	}
+	return b.writer.WriteSeries(k.database, k.retentionPolicy, bt.points)
+}
+
+// Buffered returns the number of buffered points. It is safe to call on a
+// nil writer.
+func (b *BufferedSeriesWriter) Buffered() int {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var n int
+	for _, bt := range b.batches {
+		n += len(bt.points)
+	}
+	return n
+}
+
+// pointSize returns an estimate of the size of p when serialized.
+func pointSize(p influxdb.Point) int {
+	n := len(p.Name) + 8 // timestamp
+	for k, v := range p.Tags {
+		n += len(k) + len(v) + 2
+	}
+	for k, v := range p.Fields {
+		n += len(k) + 1
+		if s, ok := v.(string); ok {
+			n += len(s)
+		} else {
+			n += 8
+		}
+	}
+	return n
+}
+
+// remove stops tracking the batch for k. Must be called with the lock held.
+func (b *BufferedSeriesWriter) remove(k batchKey) {
+	if bt := b.batches[k]; bt != nil && bt.timer != nil {
+		bt.timer.Stop()
+	}
+	delete(b.batches, k)
+}
@@ -0,0 +1,65 @@
+package ingest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// Ensure full batches are written per destination and the rest on Flush.
+func TestBufferedSeriesWriter(t *testing.T) {
+	var writes [][]string
+	w := writerFunc(func(database, _ string, points []influxdb.Point) (uint64, error) {
+		names := []string{database}
+		for _, p := range points {
+			names = append(names, p.Name)
+		}
+		writes = append(writes, names)
+		return 0, nil
+	})
+	b := ingest.NewBufferedSeriesWriter(w, 2, 0)
+	b.Stats = influxdb.NewStats("test")
+
+	b.WriteSeries("db0", "", points("a"))
+	b.WriteSeries("db1", "", points("b"))
+	if n := b.Buffered(); n != 2 || len(writes) != 0 {
+		t.Fatalf("exp 2 buffered and no writes, got %d and %v", n, writes)
+	}
+	b.WriteSeries("db0", "", points("c"))
+	if len(writes) != 1 || len(writes[0]) != 3 || writes[0][0] != "db0" {
+		t.Fatalf("unexpected writes: %v", writes)
+	}
+
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	} else if n := b.Buffered(); n != 0 {
+		t.Fatalf("exp nothing buffered, got %d", n)
+	} else if len(writes) != 2 || writes[1][0] != "db1" {
+		t.Fatalf("unexpected writes: %v", writes)
+	} else if n := b.Stats.Get("batchesWritten"); n != 2 {
+		t.Fatalf("batchesWritten: exp 2, got %d", n)
+	} else if n := b.Stats.Get("batchPointsWritten"); n != 3 {
+		t.Fatalf("batchPointsWritten: exp 3, got %d", n)
+	}
+}
+
+// Ensure a partial batch is written once its timeout elapses.
+func TestBufferedSeriesWriter_Timeout(t *testing.T) {
+	done := make(chan int, 1)
+	b := ingest.NewBufferedSeriesWriter(writerFunc(func(_, _ string, points []influxdb.Point) (uint64, error) {
+		done <- len(points)
+		return 0, nil
+	}), 100, 10*time.Millisecond)
+
+	b.WriteSeries("db", "", points("a", "b"))
+	select {
+	case n := <-done:
+		if n != 2 {
+			t.Fatalf("exp 2 points, got %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for batch")
+	}
+}
@@ -0,0 +1,43 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// Framer reads lines from a stream or datagram. A custom Framer allows
+// transports which delimit lines other than by newlines.
+type Framer interface {
+	// ReadLine returns the next line without its delimiter. It returns an
+	// error, such as io.EOF, once no more lines can be read.
+	ReadLine() ([]byte, error)
+}
+
+// NewLineFramer returns a Framer which reads newline delimited lines from r.
+// A trailing carriage return is removed from each line, and a final line
+// without a newline is returned before io.EOF. If r is a *bufio.Reader, it
+// is read from directly so that nothing beyond the current line is buffered.
+func NewLineFramer(r io.Reader) Framer {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &lineFramer{r: br}
+}
+
+type lineFramer struct {
+	r *bufio.Reader
+}
+
+// ReadLine returns the next line.
+func (f *lineFramer) ReadLine() ([]byte, error) {
+	line, err := f.r.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	} else if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
@@ -0,0 +1,25 @@
+package ingest_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// Ensure the line framer strips delimiters and returns a final unterminated line.
+func TestLineFramer(t *testing.T) {
+	f := ingest.NewLineFramer(strings.NewReader("a\r\nb\n\nc"))
+	for _, exp := range []string{"a", "b", "", "c"} {
+		line, err := f.ReadLine()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		} else if string(line) != exp {
+			t.Fatalf("line: exp %q, got %q", exp, line)
+		}
+	}
+	if _, err := f.ReadLine(); err != io.EOF {
+		t.Fatalf("exp io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+// Package ingest holds the write path shared by the plugins which accept
+// points over the network, such as the Graphite and OpenTSDB servers.
+package ingest
+
+import (
+	"sync"
+
+	"github.com/influxdb/influxdb"
+)
+
+// SeriesWriter defines the interface for the destination of the data.
+type SeriesWriter interface {
+	WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error)
+}
+
+// GaugeStats are the statistics which report a current level rather than a
+// count, and so are reported as they are by IntervalStats.
+var GaugeStats = []string{"activeConnections", "writesInFlight", "breakerState"}
+
+// IntervalStats reports the counts of a set of statistics for each interval
+// between successive calls to Next. The statistics themselves are not reset,
+// so that they remain monotonic for other readers, such as a Prometheus
+// collector.
+type IntervalStats struct {
+	mu   sync.Mutex
+	last *influxdb.Stats
+}
+
+// Next returns the change in each of stats since the previous call, so that
+// every addition is counted in exactly one interval. The statistics named in
+// gauges are returned at their current level instead.
+func (s *IntervalStats) Next(stats *influxdb.Stats, gauges ...string) *influxdb.Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := stats.Snapshot()
+	last := s.last
+	if last == nil {
+		last = influxdb.NewStats(snap.Name())
+	}
+	diff := snap.Diff(last)
+	snap.Walk(func(k string, v int64) {
+		for _, g := range gauges {
+			if k == g {
+				diff.Set(k, v)
+			}
+		}
+	})
+	s.last = snap
+	return diff
+}
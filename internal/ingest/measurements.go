@@ -0,0 +1,89 @@
+package ingest
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+
+	"github.com/influxdb/influxdb"
+)
+
+// DefaultMaxTrackedMeasurements is the default number of measurements for
+// which point counts are kept.
+const DefaultMaxTrackedMeasurements = 1000
+
+// MeasurementCounts counts points per measurement. When more measurements are
+// seen than are tracked, the least recently seen measurement is evicted.
+type MeasurementCounts struct {
+	mu sync.Mutex
+	ll *list.List
+	m  map[string]*list.Element
+}
+
+// Stats is a snapshot of a server's statistics together with the number of
+// points received for each tracked measurement.
+type Stats struct {
+	*influxdb.Stats
+	Measurements map[string]uint64
+}
+
+// String returns the statistics as a JSON object, with the measurement
+// counts as an object under "measurements". This allows Stats to be
+// published with expvar.
+func (s *Stats) String() string {
+	m := map[string]interface{}{"measurements": s.Measurements}
+	s.Walk(func(k string, v int64) {
+		m[k] = v
+	})
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+// measurementCount is the count for a single measurement.
+type measurementCount struct {
+	name string
+	n    uint64
+}
+
+// NewMeasurementCounts returns an empty MeasurementCounts.
+func NewMeasurementCounts() *MeasurementCounts {
+	return &MeasurementCounts{
+		ll: list.New(),
+		m:  make(map[string]*list.Element),
+	}
+}
+
+// Inc increments the count for name, tracking at most max measurements.
+func (c *MeasurementCounts) Inc(name string, max int) {
+	if max <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.m[name]; ok {
+		e.Value.(*measurementCount).n++
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	for c.ll.Len() >= max {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.m, e.Value.(*measurementCount).name)
+	}
+	c.m[name] = c.ll.PushFront(&measurementCount{name: name, n: 1})
+}
+
+// Snapshot returns a copy of the current counts.
+func (c *MeasurementCounts) Snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := make(map[string]uint64, len(c.m))
+	for name, e := range c.m {
+		m[name] = e.Value.(*measurementCount).n
+	}
+	return m
+}
@@ -0,0 +1,101 @@
+package ingest
+
+import (
+	"hash/crc32"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/influxdb/influxdb"
+)
+
+// ExceedsAbsValue returns true if any numeric field has an absolute value
+// greater than max.
+func ExceedsAbsValue(fields map[string]interface{}, max float64) bool {
+	for _, v := range fields {
+		switch v := v.(type) {
+		case float64:
+			if math.Abs(v) > max {
+				return true
+			}
+		case int64:
+			if math.Abs(float64(v)) > max {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SanitizeName replaces commas, spaces and control characters in a
+// measurement name with "_".
+func SanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ',' || r == ' ' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// MetricMatcher returns the value configured for a metric name, either
+// exactly or by the first glob pattern in sorted order matching it.
+type MetricMatcher struct {
+	m        map[string]string
+	patterns []string
+}
+
+// NewMetricMatcher returns a MetricMatcher for the names and glob patterns
+// in m, which must not be changed afterwards. The patterns are sorted once,
+// here, rather than for each name matched.
+func NewMetricMatcher(m map[string]string) *MetricMatcher {
+	patterns := make([]string, 0, len(m))
+	for pattern := range m {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return &MetricMatcher{m: m, patterns: patterns}
+}
+
+// Match returns the value for the metric name, or an empty string if none
+// matches. A nil MetricMatcher matches nothing.
+func (mm *MetricMatcher) Match(name string) string {
+	if mm == nil || len(mm.m) == 0 {
+		return ""
+	} else if v, ok := mm.m[name]; ok {
+		return v
+	}
+
+	for _, pattern := range mm.patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return mm.m[pattern]
+		}
+	}
+	return ""
+}
+
+// Sampled returns true if the series of p is selected by the sample rate.
+// Every point of a series is selected, or none are.
+func Sampled(p influxdb.Point, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	return float64(crc32.ChecksumIEEE([]byte(SeriesKey(p)))) < rate*math.MaxUint32
+}
+
+// SeriesKey returns the name and sorted tags of p as "name,k=v,k=v".
+func SeriesKey(p influxdb.Point) string {
+	keys := make([]string, 0, len(p.Tags))
+	for k := range p.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	key := p.Name
+	for _, k := range keys {
+		key += "," + k + "=" + p.Tags[k]
+	}
+	return key
+}
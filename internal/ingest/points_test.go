@@ -0,0 +1,58 @@
+package ingest_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// Ensure an exact match takes precedence over patterns, which are tried in sorted order.
+func TestMetricMatcher_Match(t *testing.T) {
+	mm := ingest.NewMetricMatcher(map[string]string{"cpu.*": "a", "cpu.l*": "b", "cpu.load": "c"})
+	for name, exp := range map[string]string{"cpu.load": "c", "cpu.load5": "a", "cpu.idle": "a", "mem.free": ""} {
+		if v := mm.Match(name); v != exp {
+			t.Errorf("%s: exp %q, got %q", name, exp, v)
+		}
+	}
+
+	var none *ingest.MetricMatcher
+	if v := none.Match("cpu.load"); v != "" {
+		t.Errorf("nil matcher: exp \"\", got %q", v)
+	}
+}
+
+// Ensure matching a pattern does not allocate.
+func TestMetricMatcher_Match_Allocs(t *testing.T) {
+	mm := ingest.NewMetricMatcher(map[string]string{"cpu.*": "a", "cpu.l*": "b", "mem.*": "c"})
+	if n := testing.AllocsPerRun(100, func() { mm.Match("mem.free") }); n != 0 {
+		t.Fatalf("unexpected allocations.  expected 0, got %v", n)
+	}
+}
+
+// Ensure separators and control characters are replaced in measurement names.
+func TestSanitizeName(t *testing.T) {
+	if v := ingest.SanitizeName("cpu load,a\tb"); v != "cpu_load_a_b" {
+		t.Fatalf("unexpected name: %q", v)
+	}
+}
+
+// Ensure only numeric fields are compared against the maximum.
+func TestExceedsAbsValue(t *testing.T) {
+	if ingest.ExceedsAbsValue(map[string]interface{}{"a": 10.0, "b": "1e9", "c": true}, 10) {
+		t.Fatal("unexpected excess")
+	} else if !ingest.ExceedsAbsValue(map[string]interface{}{"a": int64(-11)}, 10) {
+		t.Fatal("expected excess")
+	}
+}
+
+// Ensure the least recently seen measurement is evicted.
+func TestMeasurementCounts(t *testing.T) {
+	c := ingest.NewMeasurementCounts()
+	for _, name := range []string{"a", "b", "a", "c"} {
+		c.Inc(name, 2)
+	}
+	if m := c.Snapshot(); !reflect.DeepEqual(m, map[string]uint64{"a": 2, "c": 1}) {
+		t.Fatalf("unexpected counts: %v", m)
+	}
+}
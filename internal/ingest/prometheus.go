@@ -0,0 +1,68 @@
+//go:build prometheus
+// +build prometheus
+
+package ingest
+
+import (
+	"github.com/influxdb/influxdb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PromMetric maps a statistic to a Prometheus metric. Statistics with a
+// Reason are reported as the "reason" label of a metric shared between them.
+type PromMetric struct {
+	Stat   string
+	Name   string
+	Help   string
+	Reason string
+	Type   prometheus.ValueType
+}
+
+// statsCollector reports statistics as the metrics in its table.
+type statsCollector struct {
+	metrics []PromMetric
+	stats   []*influxdb.Stats
+	descs   map[string]*prometheus.Desc
+}
+
+// NewStatsCollector returns a prometheus.Collector reporting the sum of each
+// statistic in stats as the metrics in metrics.
+func NewStatsCollector(metrics []PromMetric, stats ...*influxdb.Stats) prometheus.Collector {
+	c := &statsCollector{metrics: metrics, stats: stats, descs: make(map[string]*prometheus.Desc)}
+	for _, m := range metrics {
+		if _, ok := c.descs[m.Name]; ok {
+			continue
+		}
+		var labels []string
+		if m.Reason != "" {
+			labels = []string{"reason"}
+		}
+		c.descs[m.Name] = prometheus.NewDesc(m.Name, m.Help, labels, nil)
+	}
+	return c
+}
+
+// Describe sends the descriptors of every reported metric to ch.
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
+}
+
+// Collect sends the current value of every reported metric to ch.
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	values := make(map[string]int64)
+	for _, s := range c.stats {
+		if s != nil {
+			s.Walk(func(k string, v int64) { values[k] += v })
+		}
+	}
+
+	for _, m := range c.metrics {
+		if m.Reason != "" {
+			ch <- prometheus.MustNewConstMetric(c.descs[m.Name], m.Type, float64(values[m.Stat]), m.Reason)
+		} else {
+			ch <- prometheus.MustNewConstMetric(c.descs[m.Name], m.Type, float64(values[m.Stat]))
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package ingest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdb/influxdb"
+)
+
+// DefaultMaxSpillBytes is the default maximum size of a spill file.
+const DefaultMaxSpillBytes = 64 << 20
+
+// replayBatchSize is the number of spilled points written at a time by replay.
+const replayBatchSize = 1000
+
+// errSpillFull is returned when points would grow the spill file beyond its limit.
+var errSpillFull = errors.New("spill file full")
+
+// SpillConfig configures a SpillWriter.
+type SpillConfig struct {
+	Retries  int
+	Interval time.Duration
+	Path     string
+	MaxBytes int64
+}
+
+// SpillWriter retries failed writes. Points whose writes still fail are
+// appended to a spill file, one point per line in line protocol, so that
+// they can be replayed once the writer recovers. Points rejected by a
+// PartialWriteError are neither retried nor spilled.
+type SpillWriter struct {
+	Writer SeriesWriter
+	Stats  *influxdb.Stats
+
+	// Config returns the retry and spill settings. A nil Config disables
+	// retries and spilling.
+	Config func() SpillConfig
+
+	mu sync.Mutex // serializes access to the spill file
+}
+
+// WriteSeries writes points, retrying and then spilling them on failure.
+// The error of the last attempt is returned even if the points were spilled.
+func (w *SpillWriter) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	var cfg SpillConfig
+	if w.Config != nil {
+		cfg = w.Config()
+	}
+
+	var index uint64
+	var err error
+	for i := 0; ; i++ {
+		index, err = w.Writer.WriteSeries(database, retentionPolicy, points)
+		if err == nil || IsPartialWriteError(err) || i >= cfg.Retries {
+			break
+		}
+		w.Stats.Inc("writeRetries")
+		time.Sleep(cfg.Interval)
+	}
+
+	if err != nil && !IsPartialWriteError(err) && cfg.Path != "" {
+		if serr := w.spill(cfg, database, retentionPolicy, points); serr != nil {
+			w.Stats.Add("pointsSpillFailed", int64(len(points)))
+			return index, fmt.Errorf("%s; unable to spill points: %s", err, serr)
+		}
+		w.Stats.Add("pointsSpilled", int64(len(points)))
+	}
+	return index, err
+}
+
+// spill appends points to the spill file, unless that would grow it beyond
+// the configured maximum size.
+func (w *SpillWriter) spill(cfg SpillConfig, database, retentionPolicy string, points []influxdb.Point) error {
+	var buf bytes.Buffer
+	for _, p := range points {
+		line, err := MarshalSpillLine(database, retentionPolicy, p)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(line + "\n")
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	} else if cfg.MaxBytes > 0 && fi.Size()+int64(buf.Len()) > cfg.MaxBytes {
+		return errSpillFull
+	}
+	_, err = f.Write(buf.Bytes())
+	return err
+}
+
+// Replay writes the points in the spill file to the underlying writer, in
+// batches without retries. Points which are written are removed from the
+// file; if a write fails, the remaining points are kept and the error is
+// returned. It returns the number of points written.
+func (w *SpillWriter) Replay(path string) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	var n int
+	for len(lines) > 0 {
+		// Batch consecutive points with the same destination.
+		database, retentionPolicy, p, err := UnmarshalSpillLine(lines[0])
+		if err != nil {
+			return n, fmt.Errorf("invalid spilled point %q: %s", lines[0], err)
+		}
+		batch := []influxdb.Point{p}
+		for len(batch) < replayBatchSize && len(batch) < len(lines) {
+			db, rp, p, err := UnmarshalSpillLine(lines[len(batch)])
+			if err != nil {
+				return n, fmt.Errorf("invalid spilled point %q: %s", lines[len(batch)], err)
+			} else if db != database || rp != retentionPolicy {
+				break
+			}
+			batch = append(batch, p)
+		}
+
+		if _, err := w.Writer.WriteSeries(database, retentionPolicy, batch); err != nil && !IsPartialWriteError(err) {
+			if werr := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); werr != nil {
+				return n, werr
+			}
+			return n, err
+		}
+		n += len(batch)
+		lines = lines[len(batch):]
+	}
+	return n, os.Remove(path)
+}
+
+// MarshalSpillLine returns a spill file line holding the point and its
+// database and retention policy.
+func MarshalSpillLine(database, retentionPolicy string, p influxdb.Point) (string, error) {
+	line, err := marshalPoint(p)
+	if err != nil {
+		return "", err
+	}
+	return escape(database, ` \`) + " " + escape(retentionPolicy, ` \`) + " " + line, nil
+}
+
+// UnmarshalSpillLine parses a spill file line into its database, retention
+// policy and point.
+func UnmarshalSpillLine(line string) (string, string, influxdb.Point, error) {
+	parts := splitUnescaped(line, ' ', 3)
+	if len(parts) != 3 {
+		return "", "", influxdb.Point{}, errors.New("missing database or retention policy")
+	}
+	p, err := unmarshalPoint(parts[2])
+	return unescape(parts[0]), unescape(parts[1]), p, err
+}
+
+// marshalPoint returns p in line protocol.
+func marshalPoint(p influxdb.Point) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString(escape(p.Name, ` ,="\`))
+
+	keys := make([]string, 0, len(p.Tags))
+	for k := range p.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		buf.WriteString("," + escape(k, ` ,="\`) + "=" + escape(p.Tags[k], ` ,="\`))
+	}
+
+	keys = keys[:0]
+	for k := range p.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i == 0 {
+			buf.WriteByte(' ')
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(escape(k, ` ,="\`) + "=")
+
+		switch v := p.Fields[k].(type) {
+		case float64:
+			buf.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+		case int64:
+			buf.WriteString(strconv.FormatInt(v, 10) + "i")
+		case int:
+			buf.WriteString(strconv.Itoa(v) + "i")
+		case bool:
+			buf.WriteString(strconv.FormatBool(v))
+		case string:
+			buf.WriteString(`"` + escape(v, `"\`) + `"`)
+		default:
+			return "", fmt.Errorf("unsupported type %T for field %q", v, k)
+		}
+	}
+
+	buf.WriteString(" " + strconv.FormatInt(p.Timestamp.UnixNano(), 10))
+	return buf.String(), nil
+}
+
+// unmarshalPoint parses a point in line protocol written by marshalPoint.
+func unmarshalPoint(line string) (influxdb.Point, error) {
+	parts := splitUnescaped(line, ' ', -1)
+	if len(parts) != 3 {
+		return influxdb.Point{}, errors.New("expected measurement, fields and timestamp")
+	}
+
+	key := splitUnescaped(parts[0], ',', -1)
+	p := influxdb.Point{
+		Name:   unescape(key[0]),
+		Tags:   make(map[string]string),
+		Fields: make(map[string]interface{}),
+	}
+	for _, tag := range key[1:] {
+		kv := splitUnescaped(tag, '=', 2)
+		if len(kv) != 2 {
+			return influxdb.Point{}, fmt.Errorf("invalid tag %q", tag)
+		}
+		p.Tags[unescape(kv[0])] = unescape(kv[1])
+	}
+
+	for _, field := range splitUnescaped(parts[1], ',', -1) {
+		kv := splitUnescaped(field, '=', 2)
+		if len(kv) != 2 {
+			return influxdb.Point{}, fmt.Errorf("invalid field %q", field)
+		}
+		k, v := unescape(kv[0]), kv[1]
+
+		var err error
+		switch {
+		case strings.HasPrefix(v, `"`) && strings.HasSuffix(v, `"`) && len(v) > 1:
+			p.Fields[k] = unescape(v[1 : len(v)-1])
+		case v == "true" || v == "false":
+			p.Fields[k] = v == "true"
+		case strings.HasSuffix(v, "i"):
+			p.Fields[k], err = strconv.ParseInt(strings.TrimSuffix(v, "i"), 10, 64)
+		default:
+			p.Fields[k], err = strconv.ParseFloat(v, 64)
+		}
+		if err != nil {
+			return influxdb.Point{}, fmt.Errorf("invalid field %q", field)
+		}
+	}
+
+	ns, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return influxdb.Point{}, fmt.Errorf("invalid timestamp %q", parts[2])
+	}
+	p.Timestamp = time.Unix(0, ns)
+	return p, nil
+}
+
+// escape returns s with a backslash before each character in chars.
+func escape(s, chars string) string {
+	if !strings.ContainsAny(s, chars) {
+		return s
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(chars, s[i]) >= 0 {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+// unescape removes the backslash before each escaped character in s.
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+// splitUnescaped splits s around each sep which is neither escaped nor
+// within double quotes, into at most n parts if n is positive.
+func splitUnescaped(s string, sep byte, n int) []string {
+	var parts []string
+	var quoted bool
+	start := 0
+	for i := 0; i < len(s) && (n <= 0 || len(parts) < n-1); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,85 @@
+package ingest_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// Ensure points are unchanged by a round trip through a spill line.
+func TestMarshalSpillLine(t *testing.T) {
+	p := influxdb.Point{
+		Name:      `cpu load,"1"`,
+		Tags:      map[string]string{"host name": `a=b,c\d`},
+		Timestamp: time.Unix(1419972457, 123456789),
+		Fields: map[string]interface{}{
+			"value": 1.5,
+			"count": int64(-3),
+			"ok":    true,
+			"raw":   `cpu.host.a 1 "x" \ y,z=w`,
+		},
+	}
+
+	line, err := ingest.MarshalSpillLine("my db", `rp\1`, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, rp, other, err := ingest.UnmarshalSpillLine(line)
+	if err != nil {
+		t.Fatalf("unable to unmarshal %q: %s", line, err)
+	} else if db != "my db" || rp != `rp\1` {
+		t.Fatalf("unexpected destination for %q: %q %q", line, db, rp)
+	}
+	if other.Name != p.Name || !reflect.DeepEqual(other.Tags, p.Tags) || !reflect.DeepEqual(other.Fields, p.Fields) || !other.Timestamp.Equal(p.Timestamp) {
+		t.Fatalf("unexpected point for %q.  expected %v, got %v", line, p, other)
+	}
+}
+
+// Ensure failed writes are spilled and replayed once the writer recovers.
+func TestSpillWriter_Replay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spill")
+
+	fail := true
+	var written []string
+	w := &ingest.SpillWriter{
+		Writer: writerFunc(func(database, _ string, points []influxdb.Point) (uint64, error) {
+			if fail {
+				return 0, errors.New("unavailable")
+			}
+			for _, p := range points {
+				written = append(written, database+" "+p.Name)
+			}
+			return 0, nil
+		}),
+		Stats:  influxdb.NewStats("test"),
+		Config: func() ingest.SpillConfig { return ingest.SpillConfig{Retries: 1, Path: path} },
+	}
+
+	if _, err := w.WriteSeries("db0", "", points("a", "b")); err == nil {
+		t.Fatal("expected the write error")
+	} else if _, err := w.WriteSeries("db1", "", points("c")); err == nil {
+		t.Fatal("expected the write error")
+	} else if n := w.Stats.Get("pointsSpilled"); n != 3 {
+		t.Fatalf("pointsSpilled: exp 3, got %d", n)
+	} else if n := w.Stats.Get("writeRetries"); n != 2 {
+		t.Fatalf("writeRetries: exp 2, got %d", n)
+	}
+
+	fail = false
+	n, err := w.Replay(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatalf("exp 3 points replayed, got %d", n)
+	} else if !reflect.DeepEqual(written, []string{"db0 a", "db0 b", "db1 c"}) {
+		t.Fatalf("unexpected writes: %v", written)
+	} else if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the spill file to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package ingest
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// TailFile calls fn with each complete line of the file at path, starting at
+// the byte offset held by offset and waiting poll for more to be appended,
+// until ctx is done, which is checked before each line. The offset is advanced atomically past each line read,
+// so that it can be loaded concurrently to resume tailing later. If the
+// starting offset is in the middle of a line, that line is skipped. Blank
+// lines are not passed to fn.
+func TailFile(ctx context.Context, path string, offset *int64, poll time.Duration, fn func(line string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := atomic.LoadInt64(offset)
+	skip := false
+	if start > 0 {
+		b := make([]byte, 1)
+		if _, err := f.ReadAt(b, start-1); err != nil {
+			return err
+		}
+		skip = b[0] != '\n'
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(f)
+	var partial []byte
+	for {
+		// Stop between lines too, so that a large backlog does not hold up
+		// cancellation until the end of the file is reached.
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		buf, err := reader.ReadBytes('\n')
+		partial = append(partial, buf...)
+		if err == io.EOF {
+			// Wait for the rest of the line, or for more lines, to be written.
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(poll):
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		line := strings.TrimSpace(string(partial))
+		atomic.AddInt64(offset, int64(len(partial)))
+		partial = nil
+
+		if skip {
+			skip = false
+			continue
+		} else if line == "" {
+			continue
+		}
+		fn(line)
+	}
+}
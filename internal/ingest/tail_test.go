@@ -0,0 +1,73 @@
+package ingest_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// Ensure a partial line at the starting offset is skipped and the offset is
+// advanced past each complete line.
+func TestTailFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lines")
+	if err := ioutil.WriteFile(path, []byte("first\nsecond\n\nthird\npart"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	var lines []string
+	offset := int64(2)
+	done := make(chan error)
+	go func() {
+		done <- ingest.TailFile(ctx, path, &offset, time.Millisecond, func(line string) {
+			mu.Lock()
+			lines = append(lines, line)
+			mu.Unlock()
+		})
+	}()
+
+	for atomic.LoadInt64(&offset) != 20 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(lines, []string{"second", "third"}) {
+		t.Fatalf("unexpected lines: %q", lines)
+	}
+}
+
+// Ensure tailing stops partway through a large file once ctx is done, rather
+// than at the end of the file.
+func TestTailFile_Cancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lines")
+	const lines = 100000
+	if err := ioutil.WriteFile(path, bytes.Repeat([]byte("line\n"), lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var n int
+	offset := int64(0)
+	err := ingest.TailFile(ctx, path, &offset, time.Hour, func(line string) {
+		if n++; n == 10 {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 10 {
+		t.Fatalf("unexpected lines read after cancel.  expected 10, got %d", n)
+	} else if offset != 50 {
+		t.Fatalf("unexpected offset.  expected 50, got %d", offset)
+	}
+}
@@ -0,0 +1,201 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/influxdb/influxdb"
+)
+
+// PartialWriteError may be returned by a SeriesWriter when only some of the
+// points in a write failed. Any other error fails the whole write.
+type PartialWriteError struct {
+	// Failed maps the index of each failed point to the reason it failed.
+	Failed map[int]error
+}
+
+// Error returns a string representation of the error.
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("%d points failed to write", len(e.Failed))
+}
+
+// IsPartialWriteError returns true if err is a PartialWriteError.
+func IsPartialWriteError(err error) bool {
+	var perr *PartialWriteError
+	return errors.As(err, &perr)
+}
+
+// StatsWriter counts written and failed points for a server.
+type StatsWriter struct {
+	Writer SeriesWriter
+	Stats  *influxdb.Stats
+
+	// Logger logs the points which fail in a partial write. Defaults to the
+	// standard logger.
+	Logger *log.Logger
+}
+
+// WriteSeries writes points to the underlying writer and records the outcome.
+func (w *StatsWriter) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	index, err := w.Writer.WriteSeries(database, retentionPolicy, points)
+
+	var perr *PartialWriteError
+	switch {
+	case err == nil:
+		w.Stats.Add("pointsWritten", int64(len(points)))
+	case errors.As(err, &perr):
+		w.Stats.Add("pointsWritten", int64(len(points)-len(perr.Failed)))
+		w.Stats.Add("pointsWriteFailed", int64(len(perr.Failed)))
+		for i, reason := range perr.Failed {
+			if i >= 0 && i < len(points) {
+				logf(w.Logger, "failed to write data point %q at %v to database %q: %s", points[i].Name, points[i].Timestamp, database, reason)
+			}
+		}
+	default:
+		w.Stats.Add("pointsWriteFailed", int64(len(points)))
+	}
+	return index, err
+}
+
+// LimitWriter bounds the number of concurrent writes to an underlying
+// writer, counting the writes in flight as "writesInFlight".
+type LimitWriter struct {
+	Writer SeriesWriter
+	Stats  *influxdb.Stats
+
+	// Limit returns the maximum number of concurrent writes. A nil Limit or
+	// a limit of zero leaves writes unbounded.
+	Limit func() int
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	n    int
+}
+
+// NewLimitWriter returns a LimitWriter which writes to w.
+func NewLimitWriter(w SeriesWriter, stats *influxdb.Stats) *LimitWriter {
+	lw := &LimitWriter{Writer: w, Stats: stats}
+	lw.cond = sync.NewCond(&lw.mu)
+	return lw
+}
+
+// WriteSeries waits until fewer than the limit of writes are in flight, then
+// writes points to the underlying writer.
+func (w *LimitWriter) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	var max int
+	if w.Limit != nil {
+		max = w.Limit()
+	}
+
+	w.mu.Lock()
+	for max > 0 && w.n >= max {
+		w.cond.Wait()
+	}
+	w.n++
+	w.Stats.Inc("writesInFlight")
+	w.mu.Unlock()
+
+	defer func() {
+		w.mu.Lock()
+		w.n--
+		w.Stats.Add("writesInFlight", -1)
+		w.cond.Signal()
+		w.mu.Unlock()
+	}()
+	return w.Writer.WriteSeries(database, retentionPolicy, points)
+}
+
+// RoutingWriter writes each point to the writer selected for it by Route,
+// or to Writer if Route is nil or selects no writer. Selected writers must
+// be comparable so that points for the same writer are written together.
+type RoutingWriter struct {
+	Writer SeriesWriter
+	Route  func(p influxdb.Point) SeriesWriter
+}
+
+// WriteSeries writes points, grouped by selected writer and in order within
+// each group. Failures are reported against the index of each point in points.
+func (w *RoutingWriter) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	if w.Route == nil {
+		return w.Writer.WriteSeries(database, retentionPolicy, points)
+	}
+
+	// Group the indexes of the points by the writer selected for them. The
+	// default writer is grouped under nil as it need not be comparable.
+	var (
+		writers []SeriesWriter
+		groups  [][]int
+	)
+	for i, p := range points {
+		sw := w.Route(p)
+
+		j := 0
+		for j < len(writers) && writers[j] != sw {
+			j++
+		}
+		if j == len(writers) {
+			writers = append(writers, sw)
+			groups = append(groups, nil)
+		}
+		groups[j] = append(groups[j], i)
+	}
+
+	// Avoid copying the points when they all go to the same writer.
+	for j := range writers {
+		if writers[j] == nil {
+			writers[j] = w.Writer
+		}
+	}
+	if len(writers) == 1 {
+		return writers[0].WriteSeries(database, retentionPolicy, points)
+	}
+
+	var (
+		index  uint64
+		failed = make(map[int]error)
+	)
+	for j, sw := range writers {
+		group := make([]influxdb.Point, len(groups[j]))
+		for k, i := range groups[j] {
+			group[k] = points[i]
+		}
+
+		n, err := sw.WriteSeries(database, retentionPolicy, group)
+		if n > index {
+			index = n
+		}
+
+		var perr *PartialWriteError
+		switch {
+		case err == nil:
+		case errors.As(err, &perr):
+			for k, reason := range perr.Failed {
+				if k >= 0 && k < len(group) {
+					failed[groups[j][k]] = reason
+				}
+			}
+		default:
+			for _, i := range groups[j] {
+				failed[i] = err
+			}
+		}
+	}
+
+	if len(failed) == len(points) {
+		return index, failed[0]
+	} else if len(failed) > 0 {
+		return index, &PartialWriteError{Failed: failed}
+	}
+	return index, nil
+}
+
+// logf logs to l, or to the standard logger if l is nil.
+func logf(l *log.Logger, format string, v ...interface{}) {
+	if l == nil {
+		log.Printf(format, v...)
+		return
+	}
+	l.Printf(format, v...)
+}
@@ -0,0 +1,126 @@
+package ingest_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// Ensure partial failures are counted per point and detected through wrapping.
+func TestStatsWriter_PartialWriteError(t *testing.T) {
+	perr := &ingest.PartialWriteError{Failed: map[int]error{1: errors.New("field type conflict")}}
+	stats := influxdb.NewStats("test")
+	w := &ingest.StatsWriter{
+		Writer: writerFunc(func(string, string, []influxdb.Point) (uint64, error) { return 0, perr }),
+		Stats:  stats,
+	}
+
+	_, err := w.WriteSeries("db", "", points("a", "b", "c"))
+	if !ingest.IsPartialWriteError(err) {
+		t.Fatalf("exp partial write error, got %v", err)
+	} else if n := stats.Get("pointsWritten"); n != 2 {
+		t.Fatalf("pointsWritten: exp 2, got %d", n)
+	} else if n := stats.Get("pointsWriteFailed"); n != 1 {
+		t.Fatalf("pointsWriteFailed: exp 1, got %d", n)
+	}
+}
+
+// Ensure no more than the limit of writes are in flight at once.
+func TestLimitWriter(t *testing.T) {
+	var mu sync.Mutex
+	var n, max int
+	w := ingest.NewLimitWriter(writerFunc(func(string, string, []influxdb.Point) (uint64, error) {
+		mu.Lock()
+		if n++; n > max {
+			max = n
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		n--
+		mu.Unlock()
+		return 0, nil
+	}), influxdb.NewStats("test"))
+	w.Limit = func() int { return 2 }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.WriteSeries("db", "", points("a"))
+		}()
+	}
+	wg.Wait()
+
+	if max != 2 {
+		t.Fatalf("max in flight: exp 2, got %d", max)
+	} else if n := w.Stats.Get("writesInFlight"); n != 0 {
+		t.Fatalf("writesInFlight: exp 0, got %d", n)
+	}
+}
+
+// Ensure routed writes report failures against the index of each point.
+func TestRoutingWriter(t *testing.T) {
+	var def, other []string
+	fail := errors.New("unavailable")
+	w := &ingest.RoutingWriter{
+		Writer: writerFunc(func(_, _ string, points []influxdb.Point) (uint64, error) {
+			for _, p := range points {
+				def = append(def, p.Name)
+			}
+			return 1, nil
+		}),
+		Route: func(p influxdb.Point) ingest.SeriesWriter {
+			if p.Name != "b" {
+				return nil
+			}
+			return &recordWriter{names: &other, err: fail}
+		},
+	}
+
+	_, err := w.WriteSeries("db", "", points("a", "b", "c"))
+	var perr *ingest.PartialWriteError
+	if !errors.As(err, &perr) {
+		t.Fatalf("exp partial write error, got %v", err)
+	} else if len(perr.Failed) != 1 || perr.Failed[1] != fail {
+		t.Fatalf("unexpected failures: %v", perr.Failed)
+	} else if len(def) != 2 || def[0] != "a" || def[1] != "c" {
+		t.Fatalf("unexpected default writes: %v", def)
+	} else if len(other) != 1 || other[0] != "b" {
+		t.Fatalf("unexpected routed writes: %v", other)
+	}
+}
+
+// writerFunc adapts a function to a SeriesWriter.
+type writerFunc func(database, retentionPolicy string, points []influxdb.Point) (uint64, error)
+
+func (f writerFunc) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	return f(database, retentionPolicy, points)
+}
+
+// recordWriter records the names of the points written to it and returns err.
+type recordWriter struct {
+	names *[]string
+	err   error
+}
+
+func (w *recordWriter) WriteSeries(_, _ string, points []influxdb.Point) (uint64, error) {
+	for _, p := range points {
+		*w.names = append(*w.names, p.Name)
+	}
+	return 0, w.err
+}
+
+// points returns a point for each name.
+func points(names ...string) []influxdb.Point {
+	a := make([]influxdb.Point, len(names))
+	for i, name := range names {
+		a[i] = influxdb.Point{Name: name, Fields: map[string]interface{}{"value": 1.0}}
+	}
+	return a
+}
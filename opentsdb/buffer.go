@@ -0,0 +1,18 @@
+package opentsdb
+
+import (
+	"time"
+
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// BufferedSeriesWriter buffers points and writes them to an underlying
+// SeriesWriter in batches, grouped by database and retention policy.
+type BufferedSeriesWriter = ingest.BufferedSeriesWriter
+
+// NewBufferedSeriesWriter returns a BufferedSeriesWriter which writes to w in
+// batches of size points. If timeout is non-zero, partial batches are written
+// once they are that old.
+func NewBufferedSeriesWriter(w SeriesWriter, size int, timeout time.Duration) *BufferedSeriesWriter {
+	return ingest.NewBufferedSeriesWriter(w, size, timeout)
+}
@@ -0,0 +1,84 @@
+package opentsdb
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// DefaultDuplicateWindow is the default number of recent points per connection
+// checked for duplicate timestamps.
+const DefaultDuplicateWindow = 1000
+
+// DuplicateTimestampPolicy determines how points with the same series and
+// timestamp as a recent point from the same connection are handled.
+type DuplicateTimestampPolicy int
+
+const (
+	// PassDuplicateTimestamps writes duplicate points unchanged.
+	PassDuplicateTimestamps DuplicateTimestampPolicy = iota
+
+	// DropDuplicateTimestamps drops duplicate points.
+	DropDuplicateTimestamps
+
+	// IncrementDuplicateTimestamps moves the timestamp of a duplicate point
+	// forward by a nanosecond at a time until it is unique.
+	IncrementDuplicateTimestamps
+)
+
+// recentPoints is a bounded set of recently seen point keys. The oldest key is
+// evicted once the set is full. It is not safe for concurrent use.
+type recentPoints struct {
+	keys []string
+	next int
+	set  map[string]struct{}
+}
+
+func newRecentPoints(n int) *recentPoints {
+	return &recentPoints{
+		keys: make([]string, n),
+		set:  make(map[string]struct{}, n),
+	}
+}
+
+// add records k, returning false if it is already present.
+func (r *recentPoints) add(k string) bool {
+	if _, ok := r.set[k]; ok {
+		return false
+	}
+
+	delete(r.set, r.keys[r.next])
+	r.keys[r.next] = k
+	r.set[k] = struct{}{}
+	r.next = (r.next + 1) % len(r.keys)
+	return true
+}
+
+// dedupe applies the duplicate timestamp policy to p. It returns false if the
+// point should be dropped.
+func (s *Server) dedupe(p *influxdb.Point, c *connection) bool {
+	if c.recent == nil {
+		return true
+	}
+
+	key := ingest.SeriesKey(*p)
+	if c.recent.add(key + "@" + strconv.FormatInt(p.Timestamp.UnixNano(), 10)) {
+		return true
+	}
+
+	if s.DuplicateTimestampPolicy == DropDuplicateTimestamps {
+		s.stats.Inc("duplicateTimestampDropped")
+		return false
+	}
+
+	for {
+		p.Timestamp = p.Timestamp.Add(time.Nanosecond)
+		if c.recent.add(key + "@" + strconv.FormatInt(p.Timestamp.UnixNano(), 10)) {
+			break
+		}
+	}
+	s.stats.Inc("duplicateTimestampIncremented")
+	return true
+}
@@ -0,0 +1,101 @@
+package opentsdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// Field types which can be used in Server.FieldTypes.
+const (
+	FloatFieldType = "float"
+	IntFieldType   = "int"
+	BoolFieldType  = "bool"
+)
+
+// ReadFileFieldTypes reads field types for Server.FieldTypes from the file at
+// path. See ReadFieldTypes for the format.
+func ReadFileFieldTypes(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadFieldTypes(f)
+}
+
+// ReadFieldTypes reads field types for Server.FieldTypes, one per line in the
+// form "metric type", where metric is a name or glob pattern and type is
+// "float", "int" or "bool". Blank lines and lines beginning with "#" are
+// ignored. An error is returned for any other line, including unknown types.
+func ReadFieldTypes(r io.Reader) (map[string]string, error) {
+	m := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected metric and type: %q", n, line)
+		}
+		metric, typ := fields[0], fields[1]
+		switch typ {
+		case FloatFieldType, IntFieldType, BoolFieldType:
+		default:
+			return nil, fmt.Errorf("line %d: unknown field type: %s", n, typ)
+		}
+		if _, err := path.Match(metric, ""); err != nil {
+			return nil, fmt.Errorf("line %d: invalid metric pattern %q: %s", n, metric, err)
+		}
+		m[metric] = typ
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// fieldType returns the configured field type for the metric name, or an
+// empty string if the value should be auto-detected. An exact match takes
+// precedence over glob patterns, which are tried in sorted order.
+func (s *Server) fieldType(name string) string {
+	return s.fieldTypes.match(s.FieldTypes, name)
+}
+
+// matcherOnce matches metric names against a map configured on the Server,
+// building its ingest.MetricMatcher the first time it is used.
+type matcherOnce struct {
+	once sync.Once
+	mm   *ingest.MetricMatcher
+}
+
+// match returns the value in m for the metric name, as MetricMatcher.Match
+// does. m must be the same map each time.
+func (o *matcherOnce) match(m map[string]string, name string) string {
+	o.once.Do(func() { o.mm = ingest.NewMetricMatcher(m) })
+	return o.mm.Match(name)
+}
+
+// coerceValue parses the value string v as the field type typ.
+func coerceValue(typ, v string) (interface{}, error) {
+	switch typ {
+	case FloatFieldType:
+		return strconv.ParseFloat(v, 64)
+	case IntFieldType:
+		return strconv.ParseInt(v, 10, 64)
+	case BoolFieldType:
+		return strconv.ParseBool(v)
+	default:
+		return nil, fmt.Errorf("unknown field type: %s", typ)
+	}
+}
@@ -0,0 +1,18 @@
+package opentsdb
+
+import (
+	"io"
+
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// Framer reads lines from a stream or datagram. A custom Framer allows
+// transports which delimit lines other than by newlines.
+type Framer = ingest.Framer
+
+// NewLineFramer returns a Framer which reads newline delimited lines from r.
+// A trailing carriage return is removed from each line, and a final line
+// without a newline is returned before io.EOF.
+func NewLineFramer(r io.Reader) Framer {
+	return ingest.NewLineFramer(r)
+}
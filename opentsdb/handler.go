@@ -0,0 +1,290 @@
+package opentsdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdb/influxdb"
+)
+
+const (
+	// DefaultSuggestMax is the default maximum number of results from /api/suggest.
+	DefaultSuggestMax = 25
+
+	// DefaultAnnotationMeasurement is the default measurement annotations are written to.
+	DefaultAnnotationMeasurement = "annotations"
+)
+
+// Handler serves the OpenTSDB HTTP API for a Server.
+type Handler struct {
+	// puts is first to ensure 64-bit alignment.
+	puts int64 // /api/put requests in progress, accessed atomically
+
+	server  *Server
+	version string
+	mux     *http.ServeMux
+
+	// AnnotationMeasurement is the measurement to which annotations posted
+	// to /api/annotation are written.
+	AnnotationMeasurement string
+
+	// MaxConcurrentHTTPRequests, if non-zero, is the maximum number of
+	// /api/put requests handled at once. Further requests are rejected with
+	// 429 Too Many Requests and counted as "httpRequestsThrottled".
+	MaxConcurrentHTTPRequests int
+
+	// MaxBodyBytes, if non-zero, is the maximum size of an /api/put request
+	// body. Larger requests are rejected with 413 Request Entity Too Large
+	// and counted as "httpRequestsTooLarge".
+	MaxBodyBytes int64
+}
+
+// NewHandler returns a new instance of Handler which writes to s and reports
+// version from /api/version.
+func NewHandler(s *Server, version string) *Handler {
+	h := &Handler{
+		server:  s,
+		version: version,
+		mux:     http.NewServeMux(),
+
+		AnnotationMeasurement: DefaultAnnotationMeasurement,
+	}
+	h.mux.HandleFunc("/api/put", h.servePut)
+	h.mux.HandleFunc("/api/annotation", h.serveAnnotation)
+	h.mux.HandleFunc("/api/version", h.serveVersion)
+	h.mux.HandleFunc("/api/suggest", h.serveSuggest)
+	h.mux.HandleFunc("/ws", h.serveWebSocket)
+	h.mux.HandleFunc("/metrics", h.serveLastValues)
+	return h
+}
+
+// ServeHTTP responds to HTTP requests to the handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// dataPoint is a single point in an /api/put request body.
+type dataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     json.Number       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// line returns the point as a telnet "put" line.
+func (dp *dataPoint) line() string {
+	keys := make([]string, 0, len(dp.Tags))
+	for k := range dp.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	line := fmt.Sprintf("put %s %d %s", dp.Metric, dp.Timestamp, dp.Value)
+	for _, k := range keys {
+		line += " " + k + "=" + dp.Tags[k]
+	}
+	return line
+}
+
+// servePut writes a single data point, or an array of data points, from the request body.
+func (h *Handler) servePut(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := atomic.AddInt64(&h.puts, 1)
+	defer atomic.AddInt64(&h.puts, -1)
+	if h.MaxConcurrentHTTPRequests > 0 && n > int64(h.MaxConcurrentHTTPRequests) {
+		h.server.stats.Inc("httpRequestsThrottled")
+		w.Header().Set("Retry-After", "1")
+		httpError(w, "too many concurrent requests", http.StatusTooManyRequests)
+		return
+	}
+	if h.MaxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.MaxBodyBytes)
+	}
+
+	var dps []dataPoint
+	body := bufio.NewReader(r.Body)
+	dec := json.NewDecoder(body)
+	var err error
+	if b, perr := body.Peek(1); perr == nil && b[0] == '[' {
+		err = dec.Decode(&dps)
+	} else {
+		var dp dataPoint
+		err = dec.Decode(&dp)
+		dps = append(dps, dp)
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		h.server.stats.Inc("httpRequestsTooLarge")
+		httpError(w, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		httpError(w, "unable to parse request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Points are converted to telnet lines so that they are parsed exactly as
+	// points received over a connection would be.
+	c := &connection{writer: h.server.writer}
+	var failed int
+	for i := range dps {
+		// Tag values may contain whitespace, which would split them in the line.
+		if h.server.SanitizeTags {
+			tags := make(map[string]string, len(dps[i].Tags))
+			for k, v := range dps[i].Tags {
+				tags[sanitizeTag(k)] = sanitizeTag(v)
+			}
+			dps[i].Tags = tags
+		}
+		if err := h.server.processLine(dps[i].line(), c); err != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		httpError(w, fmt.Sprintf("%d of %d data points failed", failed, len(dps)), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// annotation is an /api/annotation request body.
+type annotation struct {
+	StartTime   int64             `json:"startTime"`
+	EndTime     int64             `json:"endTime,omitempty"`
+	TSUID       string            `json:"tsuid,omitempty"`
+	Description string            `json:"description"`
+	Notes       string            `json:"notes,omitempty"`
+	Custom      map[string]string `json:"custom,omitempty"`
+}
+
+// point returns the annotation as a point in measurement. The TSUID and
+// custom values are tags, and the description, notes and end time are fields.
+func (a *annotation) point(measurement string) influxdb.Point {
+	tags := make(map[string]string)
+	for k, v := range a.Custom {
+		tags[k] = v
+	}
+	if a.TSUID != "" {
+		tags["tsuid"] = a.TSUID
+	}
+
+	fields := map[string]interface{}{"description": a.Description}
+	if a.Notes != "" {
+		fields["notes"] = a.Notes
+	}
+	if a.EndTime != 0 {
+		fields["endTime"] = a.EndTime
+	}
+
+	return influxdb.Point{
+		Name:      measurement,
+		Tags:      tags,
+		Timestamp: time.Unix(a.StartTime, 0),
+		Fields:    fields,
+	}
+}
+
+// serveAnnotation writes an annotation from the request body and returns it.
+func (h *Handler) serveAnnotation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var a annotation
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		httpError(w, "unable to parse request body: "+err.Error(), http.StatusBadRequest)
+		return
+	} else if a.StartTime == 0 {
+		httpError(w, "missing start time", http.StatusBadRequest)
+		return
+	}
+
+	s := h.server
+	if _, err := s.writer.WriteSeries(s.database, s.retentionpolicy, []influxdb.Point{a.point(h.AnnotationMeasurement)}); err != nil {
+		httpError(w, "unable to write annotation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, a)
+}
+
+// serveVersion returns the version of the server.
+func (h *Handler) serveVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"version": h.version})
+}
+
+// serveSuggest returns observed names matching the query prefix.
+func (h *Handler) serveSuggest(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	max := DefaultSuggestMax
+	if s := q.Get("max"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			httpError(w, "invalid max: "+s, http.StatusBadRequest)
+			return
+		}
+		max = n
+	}
+
+	typ, prefix := q.Get("type"), q.Get("q")
+	if typ != "metrics" && typ != "tagk" && typ != "tagv" {
+		httpError(w, "invalid type: "+typ, http.StatusBadRequest)
+		return
+	}
+	if h.server.Suggester != nil {
+		results := h.server.Suggester.Suggest(typ, prefix, max)
+		if results == nil {
+			results = []string{}
+		}
+		writeJSON(w, results)
+		return
+	}
+
+	// Without a Suggester only the tracked measurements are known.
+	var names []string
+	if typ == "metrics" {
+		for name := range h.server.measurements.Snapshot() {
+			names = append(names, name)
+		}
+	}
+
+	results := []string{}
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			results = append(results, name)
+		}
+	}
+	sort.Strings(results)
+	if len(results) > max {
+		results = results[:max]
+	}
+	writeJSON(w, results)
+}
+
+// writeJSON writes v to w as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// httpError writes an OpenTSDB style error response.
+func httpError(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": message},
+	})
+}
@@ -0,0 +1,25 @@
+//go:build http3
+// +build http3
+
+package opentsdb
+
+import (
+	"crypto/tls"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// NewHTTP3Server returns an HTTP/3 server for h, for clients on lossy
+// networks. tlsConfig must hold the server's certificate. The caller serves
+// it with ListenAndServe or Serve, alongside or instead of an HTTP server.
+//
+// 0-RTT is disabled as an early request can be replayed by an attacker,
+// which would write its points again.
+func NewHTTP3Server(h *Handler, tlsConfig *tls.Config) *http3.Server {
+	return &http3.Server{
+		Handler:    h,
+		TLSConfig:  http3.ConfigureTLSConfig(tlsConfig),
+		QUICConfig: &quic.Config{Allow0RTT: false},
+	}
+}
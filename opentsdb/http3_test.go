@@ -0,0 +1,49 @@
+//go:build http3
+// +build http3
+
+package opentsdb_test
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/opentsdb"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3Server(t *testing.T) {
+	w := &testWriter{}
+	srv := opentsdb.NewHTTP3Server(opentsdb.NewHandler(opentsdb.NewServer(w, "raw", "db"), "0.9.0"), &tls.Config{
+		Certificates: []tls.Certificate{selfSignedCert(t, "localhost")},
+	})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(conn)
+	defer srv.Close()
+
+	tr := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer tr.Close()
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+	body := `[{"metric":"sys.cpu.user","timestamp":1356998400,"value":1,"tags":{"host":"a"}},` +
+		`{"metric":"sys.cpu.user","timestamp":1356998401,"value":2,"tags":{"host":"a"}}]`
+	resp, err := client.Post("https://"+conn.LocalAddr().String()+"/api/put", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status.  expected %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if points := w.Points(); len(points) != 2 {
+		t.Fatalf("unexpected number of points.  expected 2, got %d", len(points))
+	}
+}
@@ -0,0 +1,100 @@
+package opentsdb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// ImportStats counts the lines read by an Importer.
+type ImportStats struct {
+	Lines    int // lines read, excluding blank lines and comments
+	Imported int // lines parsed and written
+	Failed   int // lines which could not be parsed or written
+}
+
+// ImportError is the error importing a single line.
+type ImportError struct {
+	Line int // line number, starting at 1
+	Text string
+	Err  error
+}
+
+// Error returns a string representation of the error.
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+// Importer reads "put" lines from a reader, such as stdin or a file, and
+// writes them through a Server exactly as if they were received on a
+// connection, for command line import tools.
+type Importer struct {
+	server *Server
+
+	// Progress, if set, is called with the counts so far after every
+	// ProgressInterval lines.
+	Progress         func(ImportStats)
+	ProgressInterval int
+
+	// OnError, if set, is called with each line which cannot be imported.
+	// Importing continues with the next line.
+	OnError func(err *ImportError)
+}
+
+// NewImporter returns an Importer which writes lines through s.
+func NewImporter(s *Server) *Importer {
+	return &Importer{server: s}
+}
+
+// Import reads and writes lines from r until EOF. Lines beginning with "#"
+// are ignored. Points are batched as configured on the server and written
+// before Import returns. It returns an error if r cannot be read or the
+// final batch cannot be written.
+func (im *Importer) Import(r io.Reader) (ImportStats, error) {
+	s := im.server
+	c := s.newConnection()
+	c.addr = "import"
+	var bw *BufferedSeriesWriter
+	if s.BatchSize > 0 {
+		bw = NewBufferedSeriesWriter(s.writer, s.BatchSize, s.BatchTimeout)
+		bw.MaxBatchBytes = s.MaxBatchBytes
+		bw.Stats = s.stats
+		c.writer = bw
+	}
+
+	var stats ImportStats
+	framer := s.framer(bufio.NewReader(r))
+	for n := 1; ; n++ {
+		b, err := framer.ReadLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return stats, err
+		}
+		if b = bytes.TrimSpace(b); len(b) == 0 || b[0] == '#' {
+			continue
+		}
+
+		stats.Lines++
+		line := string(b)
+		if err := s.processLine(line, c); err != nil {
+			stats.Failed++
+			if im.OnError != nil {
+				im.OnError(&ImportError{Line: n, Text: line, Err: err})
+			}
+		} else {
+			stats.Imported++
+		}
+		if im.Progress != nil && im.ProgressInterval > 0 && stats.Lines%im.ProgressInterval == 0 {
+			im.Progress(stats)
+		}
+	}
+
+	if bw != nil {
+		if err := bw.Flush(); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,160 @@
+package opentsdb
+
+// This file is run within the "opentsdb" package and allows for internal unit tests.
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/test"
+)
+
+// Ensure points left without fields are skipped and counted rather than written.
+func TestServer_processPoint_NoFields(t *testing.T) {
+	w := &test.MemWriter{}
+	s := NewServer(w, "raw", "db")
+
+	p := influxdb.Point{
+		Name:      "sys.cpu.user",
+		Tags:      map[string]string{"host": "a"},
+		Timestamp: time.Unix(1356998400, 0),
+		Fields:    map[string]interface{}{},
+	}
+	if err := s.processPoint(p, &connection{writer: s.writer}); err == nil || err.Error() != "point for sys.cpu.user has no fields, skipping" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n := len(w.Points()); n != 0 {
+		t.Fatalf("unexpected number of points written.  expected 0, got %d", n)
+	}
+	if n := s.Stats().Get("pointsWithoutFields"); n != 1 {
+		t.Fatalf("unexpected pointsWithoutFields count.  expected 1, got %d", n)
+	}
+	if n := s.Stats().Get("pointsWriteFailed"); n != 0 {
+		t.Fatalf("unexpected pointsWriteFailed count.  expected 0, got %d", n)
+	}
+}
+
+// Ensure timestamps are rounded to the configured precision before points are written.
+func TestServer_processPoint_Precision(t *testing.T) {
+	ts := time.Unix(1356998400, 987654321)
+	var tests = []struct {
+		precision string
+		exp       time.Time
+	}{
+		{"", ts},
+		{"n", ts},
+		{"u", time.Unix(1356998400, 987654000)},
+		{"ms", time.Unix(1356998400, 988000000)},
+		{"s", time.Unix(1356998401, 0)},
+	}
+
+	for _, tt := range tests {
+		w := &test.MemWriter{}
+		s := NewServer(w, "raw", "db")
+		s.Precision = tt.precision
+
+		p := influxdb.Point{
+			Name:      "sys.cpu.user",
+			Timestamp: ts,
+			Fields:    map[string]interface{}{"value": 1.0},
+		}
+		if err := s.processPoint(p, &connection{writer: s.writer}); err != nil {
+			t.Fatal(err)
+		}
+		if points := w.Points(); len(points) != 1 || !points[0].Timestamp.Equal(tt.exp) {
+			t.Fatalf("%q: unexpected points.  expected timestamp %v, got %v", tt.precision, tt.exp, points)
+		}
+	}
+}
+
+// Ensure IPv4-mapped IPv6 source addresses are normalized to IPv4.
+func TestConnection_setAddr(t *testing.T) {
+	for i, test := range []struct {
+		addr   string
+		source string
+	}{
+		{addr: "10.0.0.1:56324", source: "10.0.0.1"},
+		{addr: "[::ffff:10.0.0.1]:56324", source: "10.0.0.1"},
+		{addr: "[2001:db8::1]:56324", source: "2001:db8::1"},
+		{addr: "pipe", source: ""},
+	} {
+		var c connection
+		c.setAddr(test.addr)
+		if c.addr != test.addr {
+			t.Fatalf("%d. unexpected addr.  expected %q, got %q", i, test.addr, c.addr)
+		} else if c.source != test.source {
+			t.Fatalf("%d. unexpected source.  expected %q, got %q", i, test.source, c.source)
+		}
+	}
+}
+
+// Ensure no more than MaxConcurrentWrites writes are made at once.
+func TestServer_MaxConcurrentWrites(t *testing.T) {
+	w := &concurrencyWriter{duration: 5 * time.Millisecond}
+	s := NewServer(w, "raw", "db")
+	s.MaxConcurrentWrites = 2
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.writer.WriteSeries("db", "raw", []influxdb.Point{{Name: "sys.cpu.user"}})
+		}()
+	}
+	wg.Wait()
+
+	if w.max != 2 {
+		t.Fatalf("unexpected maximum concurrent writes.  expected 2, got %d", w.max)
+	} else if n := s.Stats().Get("writesInFlight"); n != 0 {
+		t.Fatalf("unexpected writesInFlight.  expected 0, got %d", n)
+	}
+}
+
+// concurrencyWriter records the maximum number of concurrent writes.
+type concurrencyWriter struct {
+	mu       sync.Mutex
+	n, max   int
+	duration time.Duration
+}
+
+func (w *concurrencyWriter) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	w.mu.Lock()
+	if w.n++; w.n > w.max {
+		w.max = w.n
+	}
+	w.mu.Unlock()
+
+	time.Sleep(w.duration)
+
+	w.mu.Lock()
+	w.n--
+	w.mu.Unlock()
+	return 0, nil
+}
+
+// Ensure the samples of each metric family are grouped under one TYPE line,
+// rather than interleaved by series.
+func Test_writeLastValues_Families(t *testing.T) {
+	ts := time.Unix(1356998400, 0)
+	var buf bytes.Buffer
+	writeLastValues(&buf, []influxdb.Point{
+		{Name: "cpu", Tags: map[string]string{"host": "a"}, Timestamp: ts, Fields: map[string]interface{}{"value": 1.0, "idle": 2.0}},
+		{Name: "cpu", Tags: map[string]string{"host": "b"}, Timestamp: ts, Fields: map[string]interface{}{"value": 3.0, "idle": 4.0}},
+	})
+
+	exp := `# TYPE cpu gauge
+cpu{host="a"} 1 1356998400000
+cpu{host="b"} 3 1356998400000
+# TYPE cpu_idle gauge
+cpu_idle{host="a"} 2 1356998400000
+cpu_idle{host="b"} 4 1356998400000
+`
+	if buf.String() != exp {
+		t.Fatalf("unexpected output.\nexpected:\n%s\ngot:\n%s", exp, buf.String())
+	}
+}
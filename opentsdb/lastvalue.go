@@ -0,0 +1,168 @@
+package opentsdb
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// lastValues holds the most recent point for each series. When more series
+// are seen than are kept, the least recently updated series is evicted.
+type lastValues struct {
+	mu sync.Mutex
+	ll *list.List
+	m  map[string]*list.Element
+}
+
+// lastValue is the most recent point of a single series.
+type lastValue struct {
+	key   string
+	point influxdb.Point
+}
+
+func newLastValues() *lastValues {
+	return &lastValues{
+		ll: list.New(),
+		m:  make(map[string]*list.Element),
+	}
+}
+
+// set records p as the last value of its series, keeping at most max series.
+func (c *lastValues) set(p influxdb.Point, max int) {
+	if max <= 0 {
+		return
+	}
+	key := ingest.SeriesKey(p)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.m[key]; ok {
+		e.Value.(*lastValue).point = p
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	for c.ll.Len() >= max {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.m, e.Value.(*lastValue).key)
+	}
+	c.m[key] = c.ll.PushFront(&lastValue{key: key, point: p})
+}
+
+// snapshot returns the cached points sorted by series key.
+func (c *lastValues) snapshot() []influxdb.Point {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.m))
+	for k := range c.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	points := make([]influxdb.Point, len(keys))
+	for i, k := range keys {
+		points[i] = c.m[k].Value.(*lastValue).point
+	}
+	return points
+}
+
+// serveLastValues renders the last value of each cached series in the
+// Prometheus text exposition format.
+func (h *Handler) serveLastValues(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeLastValues(w, h.server.lastValues.snapshot())
+}
+
+// writeLastValues writes points in the Prometheus text exposition format.
+// Fields other than the value field are written as separate metrics with the
+// field name appended. The samples of each metric family are written
+// together under a single TYPE line, as Prometheus requires, with families
+// in name order and samples in the order of points.
+func writeLastValues(w io.Writer, points []influxdb.Point) {
+	samples := make(map[string][]string)
+	for _, p := range points {
+		keys := make([]string, 0, len(p.Tags))
+		for k := range p.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		labels := make([]string, len(keys))
+		for i, k := range keys {
+			labels[i] = promName(k) + `="` + promEscaper.Replace(p.Tags[k]) + `"`
+		}
+
+		for f, v := range p.Fields {
+			value, ok := promValue(v)
+			if !ok {
+				continue
+			}
+			name := p.Name
+			if f != "value" {
+				name += "_" + f
+			}
+			name = promName(name)
+
+			sample := name
+			if len(labels) > 0 {
+				sample += "{" + strings.Join(labels, ",") + "}"
+			}
+			sample += fmt.Sprintf(" %s %d", value, p.Timestamp.UnixNano()/1e6)
+			samples[name] = append(samples[name], sample)
+		}
+	}
+
+	families := make([]string, 0, len(samples))
+	for name := range samples {
+		families = append(families, name)
+	}
+	sort.Strings(families)
+
+	for _, name := range families {
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		for _, sample := range samples[name] {
+			fmt.Fprintln(w, sample)
+		}
+	}
+}
+
+// promEscaper escapes Prometheus label values.
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promName replaces characters not allowed in Prometheus names with underscores.
+func promName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// promValue formats a field value as a Prometheus sample value.
+func promValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case bool:
+		if v {
+			return "1", true
+		}
+		return "0", true
+	default:
+		return "", false
+	}
+}
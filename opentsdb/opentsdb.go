@@ -2,14 +2,26 @@ package opentsdb
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
-	"net/textproto"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/client"
+	"github.com/influxdb/influxdb/internal/ingest"
 )
 
 const (
@@ -18,60 +30,824 @@ const (
 
 	// DefaultDatabaseName is the default OpenTSDB database if none is specified
 	DefaultDatabaseName = "opentsdb"
+
+	// DefaultMetricNameTag is the default tag holding the metric name of
+	// points written to a FixedMeasurement.
+	DefaultMetricNameTag = "metric"
+
+	// DefaultSelfMetricMeasurement is the default measurement of the
+	// heartbeat written every SelfMetricInterval.
+	DefaultSelfMetricMeasurement = "ingest.opentsdb.up"
+
+	// DefaultMaxSpillBytes is the default maximum size of a spill file.
+	DefaultMaxSpillBytes = ingest.DefaultMaxSpillBytes
+
+	// coarseTimestampLogEvery is how often points with coarse timestamps
+	// are logged by LogCoarseTimestamps.
+	coarseTimestampLogEvery = 1000
 )
 
-// SeriesWriter defines the interface for the destination of the data.
-type SeriesWriter interface {
-	WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error)
+var (
+	// ErrBindAddressRequired is returned when starting the Server
+	// without a listening address.
+	ErrBindAddressRequired = errors.New("bind address required")
+
+	// ErrServerClosed return when closing an already closed server.
+	ErrServerClosed = errors.New("server already closed")
+
+	// ErrServing is returned by ReplayWAL once the server has started
+	// serving, as writes then in flight are still pending in the log.
+	ErrServing = errors.New("server already serving")
+)
+
+// Categories of parse errors. Each is counted as "parseErrors" followed by
+// the category, such as "parseErrorsTimestamp", as well as in "parseErrors".
+const (
+	fieldCountError = "FieldCount"
+	timestampError  = "Timestamp"
+	valueError      = "Value"
+	tagError        = "Tag"
+	overLimitError  = "OverLimit"
+	nonFiniteError  = "NonFinite"
+)
+
+// parseError is an error parsing a line, with its category.
+type parseError struct {
+	category string
+	msg      string
 }
 
+// parseErrorf returns a parseError in category formatted as with fmt.Sprintf.
+func parseErrorf(category, format string, a ...interface{}) error {
+	return &parseError{category: category, msg: fmt.Sprintf(format, a...)}
+}
+
+// Error returns a string representation of the error.
+func (e *parseError) Error() string {
+	return e.msg
+}
+
+// isParseError returns true if err is a parseError.
+func isParseError(err error) bool {
+	var perr *parseError
+	return errors.As(err, &perr)
+}
+
+// TagValuePolicy determines how tag values longer than the configured limit are handled.
+type TagValuePolicy int
+
+const (
+	// TruncateTagValue truncates over-length tag values to the limit.
+	TruncateTagValue TagValuePolicy = iota
+
+	// DropTagValue drops any line containing an over-length tag value.
+	DropTagValue
+)
+
+// EmptyTagValuePolicy determines how tags with an empty value, such as
+// "host=", are handled.
+type EmptyTagValuePolicy int
+
+const (
+	// KeepEmptyTagValue stores the tag with an empty value.
+	KeepEmptyTagValue EmptyTagValuePolicy = iota
+
+	// DropEmptyTag drops the tag and keeps the rest of the line.
+	DropEmptyTag
+
+	// DropEmptyTagPoint drops any line containing a tag with an empty value.
+	DropEmptyTagPoint
+)
+
+// FieldLayout is the order of the timestamp, value and tag tokens of a "put" line.
+type FieldLayout int
+
+const (
+	// TimestampValueTags is the standard "put metric timestamp value tags..."
+	// layout.
+	TimestampValueTags FieldLayout = iota
+
+	// ValueTagsTimestamp is the "put metric value tags... timestamp" layout
+	// sent by some clients. The last token must be a timestamp.
+	ValueTagsTimestamp
+)
+
+// SeriesWriter defines the interface for the destination of the data.
+type SeriesWriter = ingest.SeriesWriter
+
 // An InfluxDB input class to accept OpenTSDB's telnet protocol
 // Each telnet command consists of a line of the form:
 //   put sys.cpu.user 1356998400 42.5 host=webserver01 cpu=0
 type Server struct {
+	wg   sync.WaitGroup
+	done chan struct{}
+
 	writer SeriesWriter
 
 	database        string
 	retentionpolicy string
 
-	listener *net.TCPListener
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]*connection
+	connsByIP map[string]int
+	connWg    sync.WaitGroup
+	draining  bool
+
+	// MaxTagValueLength is the maximum length of a tag value. Zero means no limit.
+	MaxTagValueLength int
+
+	// TagValuePolicy determines what happens to lines with over-length tag values.
+	TagValuePolicy TagValuePolicy
+
+	// EmptyTagValuePolicy determines what happens to tags with an empty
+	// value. Dropped tags are counted as "emptyTagValuesDropped" and
+	// dropped lines as "emptyTagValue".
+	EmptyTagValuePolicy EmptyTagValuePolicy
+
+	// LowercaseTagKeys and LowercaseTagValues lowercase tag keys and values
+	// respectively as they are parsed.
+	LowercaseTagKeys   bool
+	LowercaseTagValues bool
+
+	// SanitizeTags replaces the characters of tag keys and values which are
+	// significant in line protocol, whitespace, commas and "=", with "_".
+	SanitizeTags bool
+
+	// TagsToFields lists tag keys whose values are written as numeric fields
+	// rather than tags. Values which are not numeric are kept as tags.
+	TagsToFields []string
+
+	// AllowRFC3339Timestamps accepts RFC 3339 timestamps, such as
+	// "2013-01-01T00:00:00Z", in addition to Unix timestamps.
+	AllowRFC3339Timestamps bool
+
+	// FieldLayout is the order of the timestamp, value and tag tokens of
+	// each line.
+	FieldLayout FieldLayout
+
+	// AllowComments ignores a trailing comment, beginning with a token
+	// prefixed by "#", after the value of a "put" line rather than parsing it
+	// as tags.
+	AllowComments bool
+
+	// FieldTypes maps metric names, or glob patterns matched with path.Match,
+	// to the type of their value field: "float", "int" or "bool". Points whose
+	// value cannot be coerced are skipped. Values of unlisted metrics are
+	// parsed as floats. ReadFileFieldTypes loads field types from a file.
+	// The patterns are sorted when the first point is parsed, so the map
+	// must not be changed after that.
+	FieldTypes map[string]string
+
+	// ParseHexValues accepts values of metrics without a field type written
+	// as hexadecimal integers with a "0x" prefix.
+	ParseHexValues bool
+
+	// ValueUnits maps unit suffixes, such as "ms", to the multiplier which
+	// converts a value in that unit to its base unit. Values of metrics
+	// without a field type may be written with one of these suffixes. Use a
+	// multiplier of 1 to strip a suffix without converting the value. The
+	// suffixes are sorted when the first value is parsed, so ValueUnits must
+	// not be changed after that.
+	ValueUnits map[string]float64
+
+	// AddSourceTag, if set, is the tag key under which each point is tagged
+	// with the IP address of the client which sent it.
+	AddSourceTag string
+
+	// ConnTags, if set, is called once for each connection handled by
+	// HandleConnection, before it is read, to return tags added to every point
+	// read from it, such as the TLS server name or client certificate common
+	// name. Tags of the point take precedence. For a TLS connection ConnTags
+	// should complete the handshake before reading its state.
+	ConnTags func(conn net.Conn) map[string]string
+
+	// Banner, if set, is written to each connection, followed by a newline,
+	// before it is read. Some monitoring tools expect a greeting on connect.
+	Banner string
+
+	// EnableProxyProtocol requires each connection to begin with a PROXY
+	// protocol v1 header, whose source address is used in place of the
+	// connection's remote address. Connections with a malformed header are
+	// closed.
+	EnableProxyProtocol bool
+
+	// AllowStreamCompression allows clients to send a "compress gzip" line,
+	// after which the remainder of the connection is read as a gzip stream.
+	AllowStreamCompression bool
+
+	// AutoDetectCompression reads connections which begin with the gzip
+	// magic bytes as a gzip stream, without a "compress gzip" line.
+	AutoDetectCompression bool
+
+	// NewFramer, if set, returns the Framer used to read lines from a
+	// connection. Defaults to NewLineFramer. A custom Framer must not read
+	// beyond the line it returns if stream compression is enabled.
+	NewFramer func(r io.Reader) Framer
+
+	// EchoErrors writes a "put: <reason>" line back to the client for each
+	// rejected line. OpenTSDB itself does not reply to telnet "put" lines.
+	EchoErrors bool
+
+	// DisconnectOnMalformed closes a connection on the first line which
+	// cannot be parsed, rather than skipping it, to force senders to fix
+	// their output. The reason is written back first if EchoErrors is set.
+	// Points already received on the connection are written. Such
+	// connections are counted as "connectionsClosedMalformed".
+	DisconnectOnMalformed bool
+
+	// BatchSize is the number of points buffered per connection before they
+	// are written. Zero disables batching.
+	BatchSize int
+
+	// BatchTimeout is the maximum time a partial batch is buffered before it
+	// is written. Zero means partial batches wait for the connection to close.
+	BatchTimeout time.Duration
+
+	// MaxBatchBytes, if non-zero, writes a batch early once the estimated
+	// size of its points reaches this many bytes.
+	MaxBatchBytes int
+
+	// SharedBatching batches points from all connections together, rather
+	// than per connection, so that many connections produce large batches.
+	// The shared batch is written by Drain and Close, and when full or
+	// timed out.
+	SharedBatching bool
+
+	// MaxConnectionsPerIP, if non-zero, is the maximum number of connections
+	// open at once from a single source IP. Further connections from that IP
+	// are closed as soon as they are accepted. With EnableProxyProtocol, the
+	// source IP is the one in the PROXY header, and connections are closed
+	// once it is read.
+	MaxConnectionsPerIP int
+
+	// MaxIdle, if non-zero, closes connections which have not sent a line
+	// for this long. Connections are checked every ReapInterval, or every
+	// MaxIdle/2 if it is zero, whether or not a read is in progress.
+	MaxIdle      time.Duration
+	ReapInterval time.Duration
+
+	// SelfMetricInterval, if non-zero, writes a heartbeat point with the
+	// field value=1 to SelfMetricMeasurement at this interval, from when the
+	// server starts listening until it is closed, so that its liveness can be
+	// monitored in the database it writes to.
+	SelfMetricInterval    time.Duration
+	SelfMetricMeasurement string
+
+	// MaxPendingPerConn, if non-zero, pauses reading from a connection while
+	// this many of its batched points are being written, so that slow writes
+	// apply backpressure to the client rather than accumulating in memory.
+	// It has no effect with SharedBatching.
+	MaxPendingPerConn int
+
+	// BreakerThreshold is the number of consecutive failed writes after which
+	// points are dropped, rather than written, for BreakerCooldown. A single
+	// write then tests whether writes succeed again. Zero disables the breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// MaxConcurrentWrites, if non-zero, is the maximum number of writes made
+	// to the writer at once, however many connections are open. Further
+	// writes wait for one to complete.
+	MaxConcurrentWrites int
+
+	// WriteRetries is the number of times a failed write is retried, waiting
+	// WriteRetryInterval between attempts.
+	WriteRetries       int
+	WriteRetryInterval time.Duration
+
+	// SpillPath, if set, is a file to which points are appended when their
+	// write still fails after retrying, so that they can be written later by
+	// ReplaySpill. Points are dropped once the file would grow beyond
+	// MaxSpillBytes.
+	SpillPath     string
+	MaxSpillBytes int64
+
+	// WALPath, if set, is a write-ahead log to which each write is appended
+	// before it is made, and marked done once the write returns, so that
+	// writes in flight when the process exits are not lost. A write which
+	// fails is retried and spilled as configured, rather than kept in the
+	// log. Pending writes are replayed when the server starts serving, or by
+	// ReplayWAL. Points buffered for a batch are not logged until the batch
+	// is written. The log is compacted to the pending writes as others
+	// complete, and writes are made without being logged only once the
+	// pending writes would grow it beyond MaxWALBytes.
+	WALPath     string
+	MaxWALBytes int64
+
+	// WALSyncPolicy determines when appends to the write-ahead log are
+	// synced to disk.
+	WALSyncPolicy WALSyncPolicy
+
+	// ReadBufferSize is the size of the operating system's receive buffer for
+	// each TCP connection. Zero leaves the system default.
+	ReadBufferSize int
+
+	// ReaderBufferSize is the size of the buffer used to read lines from each
+	// connection. Zero uses the bufio default.
+	ReaderBufferSize int
+
+	// MaxTrackedMeasurements is the number of measurements for which point
+	// counts are kept, evicting the least recently seen. Zero disables
+	// per-measurement counts.
+	MaxTrackedMeasurements int
+
+	// DuplicateTimestampPolicy determines how a point with the same series and
+	// timestamp as a recent point on the same connection is handled.
+	DuplicateTimestampPolicy DuplicateTimestampPolicy
+
+	// DuplicateWindow is the number of recent points per connection checked
+	// for duplicate timestamps.
+	DuplicateWindow int
+
+	// CaptureRecentLines is the number of recent raw lines kept per connection
+	// for debugging, retrievable with RecentLines. Zero disables capture.
+	CaptureRecentLines int
+
+	// SampleRate is the fraction of series, between 0 and 1, whose points are
+	// written. Series are selected by a hash of the series key so that every
+	// point of a selected series is written. Defaults to 1.
+	SampleRate float64
+
+	// MetricSampleRates overrides SampleRate for the metrics it contains.
+	MetricSampleRates map[string]float64
+
+	// Precision, if set, is the precision to which timestamps are rounded
+	// before points are written: "n", "u", "ms", "s", "m" or "h".
+	Precision string
+
+	// SanitizeName replaces the characters of measurement names which are
+	// significant in line protocol or may corrupt storage, commas, spaces
+	// and control characters such as newlines, with "_" before points are
+	// written. NameSanitizer, if set, is used instead. Changed names are
+	// counted as "namesSanitized".
+	SanitizeName  bool
+	NameSanitizer func(name string) string
+
+	// MaxAbsValue, if non-zero, drops points with a numeric field whose
+	// absolute value exceeds it, which usually indicates a parse or unit
+	// bug. Dropped points are counted as "pointsValueOverLimit".
+	MaxAbsValue float64
+
+	// OverrideTimestampWithNow replaces the timestamp of every point with
+	// the time it is received, for senders whose clocks are unreliable.
+	OverrideTimestampWithNow bool
+
+	// WarnCoarseTimestamps counts points, as "coarseTimestamps", whose
+	// timestamp has no sub-second component, to help find senders which
+	// send seconds when milliseconds are expected. LogCoarseTimestamps also
+	// logs the first such point and every coarseTimestampLogEvery after it.
+	// Points are written either way.
+	WarnCoarseTimestamps bool
+	LogCoarseTimestamps  bool
+
+	// RenameRules, if set, renames metrics before they are filtered and written.
+	RenameRules *RenameRules
+
+	// FixedMeasurement, if set, is the measurement all points are written
+	// to, with the metric name stored in the MetricNameTag tag. Defaults to
+	// "metric".
+	FixedMeasurement string
+	MetricNameTag    string
+
+	// FirstSegmentAsMeasurement writes points to the measurement named by
+	// the first dotted segment of their metric name, with the rest of the
+	// name stored in the "subpath" tag, so that sys.cpu.user is written to
+	// sys with subpath=cpu.user. Metric names without a dot are written
+	// unchanged. It has no effect with FixedMeasurement.
+	FirstSegmentAsMeasurement bool
+
+	// AllowMetrics, if non-empty, is the set of metric names which are
+	// accepted. Metric names in DenyMetrics are rejected.
+	AllowMetrics map[string]struct{}
+	DenyMetrics  map[string]struct{}
+
+	// Suggester, if set, records the metric names, tag keys and tag values
+	// of received points to answer /api/suggest, such as one returned by
+	// NewSuggester. Otherwise only metric names are suggested, from those
+	// tracked by MaxTrackedMeasurements.
+	Suggester Suggester
+
+	// LastValueCacheSize is the number of series whose most recent point is
+	// kept for scraping from the handler's /metrics endpoint. Zero disables
+	// the cache.
+	LastValueCacheSize int
+
+	// RetentionPolicyForMetric maps metric names, exactly or by glob pattern
+	// as matched by path.Match, to the retention policy their points are
+	// written to. An exact match is preferred, then the first matching
+	// pattern in sorted order. Other points are written to the server's
+	// retention policy. The patterns are sorted when the first point is
+	// written, so the map must not be changed after that.
+	RetentionPolicyForMetric map[string]string
+
+	// Processors are applied in order to each point, after its tags are
+	// added, and may drop, modify or split it before it is written. Dropped
+	// points are counted as "pointsDroppedByProcessor".
+	Processors []influxdb.PointProcessor
+
+	// WriterRouter, if set, selects the writer for each point, such as by
+	// tenant. Points for which it returns nil are written to the server's
+	// writer.
+	WriterRouter func(p influxdb.Point) SeriesWriter
+
+	stats        *influxdb.Stats
+	interval     ingest.IntervalStats
+	coarse       *uint64 // coarse timestamps seen, accessed atomically
+	measurements *ingest.MeasurementCounts
+	lastValues   *lastValues
+	shared       *BufferedSeriesWriter
+	spill        *ingest.SpillWriter
+	wal          *walWriter
+	walReplay    sync.Once
+	serving      bool // set once a listener is added, guarded by mu
+	reaper       sync.Once
+	heartbeat    sync.Once
+	units        sync.Once
+	sortedUnits  []string // ValueUnits suffixes, longest first
+	fieldTypes   matcherOnce
+	policies     matcherOnce
 }
 
 func NewServer(w SeriesWriter, retpol string, db string) *Server {
 	s := &Server{}
 
-	s.writer = w
 	s.retentionpolicy = retpol
 	s.database = db
+	s.done = make(chan struct{})
+	s.conns = make(map[net.Conn]*connection)
+	s.connsByIP = make(map[string]int)
+	s.MaxTrackedMeasurements = DefaultMaxTrackedMeasurements
+	s.DuplicateWindow = DefaultDuplicateWindow
+	s.SampleRate = 1
+	s.MetricNameTag = DefaultMetricNameTag
+	s.SelfMetricMeasurement = DefaultSelfMetricMeasurement
+	s.MaxSpillBytes = DefaultMaxSpillBytes
+	s.MaxWALBytes = DefaultMaxWALBytes
+	s.stats = influxdb.NewStats("opentsdb")
+	s.coarse = new(uint64)
+	s.measurements = ingest.NewMeasurementCounts()
+	s.lastValues = newLastValues()
+	limit := ingest.NewLimitWriter(&ingest.RoutingWriter{Writer: w, Route: s.route}, s.stats)
+	limit.Limit = func() int { return s.MaxConcurrentWrites }
+	s.spill = &ingest.SpillWriter{
+		Writer: limit,
+		Stats:  s.stats,
+		Config: func() ingest.SpillConfig {
+			return ingest.SpillConfig{Retries: s.WriteRetries, Interval: s.WriteRetryInterval, Path: s.SpillPath, MaxBytes: s.MaxSpillBytes}
+		},
+	}
+	s.wal = &walWriter{
+		writer: &ingest.CircuitBreaker{
+			Writer: &ingest.StatsWriter{Writer: s.spill, Stats: s.stats},
+			Stats:  s.stats,
+			Config: func() (int, time.Duration) { return s.BreakerThreshold, s.BreakerCooldown },
+		},
+		stats:  s.stats,
+		config: func() walConfig { return walConfig{s.WALPath, s.MaxWALBytes, s.WALSyncPolicy} },
+	}
+	s.writer = s.wal
 
 	return s
 }
 
-func (s *Server) ListenAndServe(listenAddress string) {
-	var err error
+// Stats returns a snapshot of the server's statistics, including the number
+// of points received for each tracked measurement.
+func (s *Server) Stats() *Stats {
+	return &Stats{Stats: s.stats.Snapshot(), Measurements: s.measurements.Snapshot()}
+}
 
-	addr, err := net.ResolveTCPAddr("tcp4", listenAddress)
-	if err != nil {
-		log.Println("TSDBServer: ResolveTCPAddr: ", err)
-		return
+// SnapshotAndReset returns the server's statistics counted since the
+// previous call, so that successive snapshots hold the counts for each
+// interval between them. Gauges, such as activeConnections, are returned at
+// their current level. The totals returned by Stats and reported by the
+// Prometheus collector are not reset.
+func (s *Server) SnapshotAndReset() *influxdb.Stats {
+	return s.interval.Next(s.stats, ingest.GaugeStats...)
+}
+
+// Publish makes the server's live statistics available through expvar under
+// name. Each name is registered with expvar once per process. Publishing it
+// again, such as from a second server, reports that server's statistics
+// under the name instead.
+func (s *Server) Publish(name string) {
+	published.mu.Lock()
+	defer published.mu.Unlock()
+
+	v, ok := published.vars[name]
+	if !ok {
+		v = &statsVar{}
+		expvar.Publish(name, v)
+		published.vars[name] = v
 	}
+	v.set(s)
+}
 
-	s.listener, err = net.ListenTCP("tcp", addr)
-	if err != nil {
-		log.Println("TSDBServer: Listen: ", err)
-		return
+// published holds the expvar variables registered by Publish, by name.
+var published = struct {
+	mu   sync.Mutex
+	vars map[string]*statsVar
+}{vars: make(map[string]*statsVar)}
+
+// statsVar is an expvar variable reporting the statistics of the server most
+// recently published under its name.
+type statsVar struct {
+	mu     sync.Mutex
+	server *Server
+}
+
+func (v *statsVar) set(s *Server) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.server = s
+}
+
+// String returns the statistics, including the per-measurement counts, as a
+// JSON object.
+func (v *statsVar) String() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.server.Stats().String()
+}
+
+// ReplayWAL writes the writes pending in the write-ahead log and removes
+// it. It returns the number of points written. Each write is retried and
+// spilled as configured; the first error of a write which still fails is
+// returned once all have been attempted. ErrServing is returned once the
+// server has started serving, which replays the log itself.
+func (s *Server) ReplayWAL() (int, error) {
+	s.mu.Lock()
+	serving := s.serving
+	s.mu.Unlock()
+	if serving {
+		return 0, ErrServing
+	}
+	return s.replayWAL()
+}
+
+// replayWAL replays the write-ahead log, if one is configured.
+func (s *Server) replayWAL() (int, error) {
+	if s.WALPath == "" {
+		return 0, nil
+	}
+	return s.wal.replay(s.WALPath)
+}
+
+// replayWALOnce replays the write-ahead log the first time the server
+// starts serving, logging the outcome.
+func (s *Server) replayWALOnce() {
+	s.walReplay.Do(func() {
+		if n, err := s.replayWAL(); err != nil {
+			log.Printf("TSDBServer: replayed %d points from write-ahead log, then failed: %s", n, err)
+		} else if n > 0 {
+			log.Printf("TSDBServer: replayed %d points from write-ahead log", n)
+		}
+	})
+}
+
+// ReplaySpill writes the points in the spill file and removes them from it.
+// It returns the number of points written. If a write fails, the points not
+// yet written are kept for a later replay and the error is returned.
+func (s *Server) ReplaySpill() (int, error) {
+	if s.SpillPath == "" {
+		return 0, nil
+	}
+	return s.spill.Replay(s.SpillPath)
+}
+
+// ListenAndServe binds the server to the given address and serves connections
+// in the background. Multiple addresses may be given separated by commas.
+func (s *Server) ListenAndServe(listenAddress string) error {
+	return s.ListenAndServeAll(strings.Split(listenAddress, ","))
+}
+
+// ListenAndServeAll binds a listener for each address and serves connections
+// from all of them in the background. If any address cannot be bound then no
+// listeners are started.
+func (s *Server) ListenAndServeAll(listenAddresses []string) error {
+	var listeners []net.Listener
+	for _, a := range listenAddresses {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+
+		addr, err := net.ResolveTCPAddr("tcp4", a)
+		if err != nil {
+			closeListeners(listeners)
+			return err
+		}
+
+		l, err := net.ListenTCP("tcp", addr)
+		if err != nil {
+			closeListeners(listeners)
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return ErrBindAddressRequired
+	}
+	s.replayWALOnce()
+
+	for i, l := range listeners {
+		if err := s.addListener(l); err != nil {
+			closeListeners(listeners[i:])
+			return err
+		}
+		go s.serve(l)
+	}
+	return nil
+}
+
+// Serve accepts connections on l until the server is closed, at which point
+// l is closed and Serve returns nil. This allows an already bound listener,
+// such as one passed in by socket activation, to be used.
+func (s *Server) Serve(l net.Listener) error {
+	if err := s.addListener(l); err != nil {
+		return err
+	}
+	s.replayWALOnce()
+	s.serve(l)
+	return nil
+}
+
+// addListener registers l with the server so that it is closed with the server.
+func (s *Server) addListener(l net.Listener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return ErrServerClosed
+	default:
+	}
+	s.listeners = append(s.listeners, l)
+	s.serving = true
+	s.wg.Add(1)
+	if s.SelfMetricInterval > 0 {
+		s.heartbeat.Do(s.startHeartbeat)
 	}
+	return nil
+}
+
+// startHeartbeat starts writing a heartbeat every SelfMetricInterval in the
+// background until the server is closed. Heartbeats are written directly to
+// the writer, rather than batched, so that they arrive on time. Must be
+// called with the lock held.
+func (s *Server) startHeartbeat() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.SelfMetricInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case now := <-ticker.C:
+				p := influxdb.Point{
+					Name:      s.SelfMetricMeasurement,
+					Fields:    map[string]interface{}{"value": 1.0},
+					Timestamp: now,
+				}
+				if _, err := s.writer.WriteSeries(s.database, s.retentionPolicy(p.Name), []influxdb.Point{p}); err != nil {
+					log.Printf("TSDBServer: failed to write heartbeat: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// serve runs the accept loop for a listener registered with addListener.
+func (s *Server) serve(l net.Listener) {
+	defer s.wg.Done()
+	s.HandleListener(l)
+}
 
-	defer s.listener.Close()
-	s.HandleListener(s.listener)
+// Addr returns the address of the server's first listener, or nil if the
+// server is not listening. Listeners are bound before ListenAndServe returns,
+// so Addr may be called immediately afterwards.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
+
+// Addrs returns the addresses of all of the server's listeners.
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var a []net.Addr
+	for _, l := range s.listeners {
+		a = append(a, l.Addr())
+	}
+	return a
 }
 
-func (s *Server) HandleListener(socket *net.TCPListener) {
+// Close shuts down all of the server's listeners and closes its active
+// connections. It waits for each connection's buffered points to be written,
+// then writes the shared batch. Points not yet read from a connection are
+// lost; call Drain first to read them.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return ErrServerClosed
+	default:
+	}
+	close(s.done)
+	closeListeners(s.listeners)
+	s.listeners = nil
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	s.connWg.Wait()
+	s.flushShared()
+	return nil
+}
+
+// Drain stops the server accepting new connections and reading from existing
+// ones, then waits for any buffered points to be written. It returns early
+// with the context's error if ctx is done first. Drain is intended to be
+// called before Close when shutting down.
+func (s *Server) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	closeListeners(s.listeners)
+	s.listeners = nil
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	// Each connection writes its buffered points as it finishes.
+	done := make(chan struct{})
+	go func() {
+		s.connWg.Wait()
+		s.flushShared()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sharedBatch returns the batch shared by all connections, creating it if necessary.
+func (s *Server) sharedBatch() *BufferedSeriesWriter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shared == nil {
+		s.shared = NewBufferedSeriesWriter(s.writer, s.BatchSize, s.BatchTimeout)
+		s.shared.MaxBatchBytes = s.MaxBatchBytes
+		s.shared.Stats = s.stats
+	}
+	return s.shared
+}
+
+// flushShared writes the points buffered in the shared batch, if any.
+func (s *Server) flushShared() {
+	s.mu.Lock()
+	bw := s.shared
+	s.mu.Unlock()
+
+	if bw == nil {
+		return
+	}
+	if err := bw.Flush(); err != nil {
+		log.Println("TSDB cannot write data: ", err)
+	}
+}
+
+func (s *Server) HandleListener(socket net.Listener) {
 	for {
 		// Listen for an incoming connection.
 		conn, err := socket.Accept()
 		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Println("Error accepting: ", err.Error())
+			continue
 		}
 		// Handle connections in a new goroutine.
 		go s.HandleConnection(conn)
@@ -79,82 +855,716 @@ func (s *Server) HandleListener(socket *net.TCPListener) {
 }
 
 func (s *Server) HandleConnection(conn net.Conn) {
-	reader := bufio.NewReader(conn)
-	tp := textproto.NewReader(reader)
-
 	defer conn.Close()
 
-	for {
-		line, err := tp.ReadLine()
+	c := s.newConnection()
+	c.setAddr(conn.RemoteAddr().String())
+	c.connectedAt = time.Now()
+	c.lastActivity = c.connectedAt.UnixNano()
+	c.awaitingProxy = s.EnableProxyProtocol
+	if !s.trackConn(conn, c) {
+		return
+	}
+	defer s.untrackConn(conn)
+	if s.ConnTags != nil {
+		c.tags = s.ConnTags(conn)
+	}
+	if s.Banner != "" {
+		if _, err := io.WriteString(conn, s.Banner+"\n"); err != nil {
+			log.Printf("TSDBServer: %s: unable to write banner: %s", c.addr, err)
+			return
+		}
+	}
+
+	// A client may half-close the connection once it has sent its lines and
+	// keep reading responses. After the connection's points are written, the
+	// write side is closed too so the client reads every response followed
+	// by EOF, rather than a reset if the connection were closed outright.
+	var eof bool
+	defer func() {
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok && eof {
+			cw.CloseWrite()
+		}
+	}()
+
+	var pending *pendingWriter
+	if s.BatchSize > 0 && s.SharedBatching {
+		c.writer = s.sharedBatch()
+	} else if s.BatchSize > 0 {
+		pending = newPendingWriter(s.writer)
+		bw := NewBufferedSeriesWriter(pending, s.BatchSize, s.BatchTimeout)
+		bw.MaxBatchBytes = s.MaxBatchBytes
+		bw.Stats = s.stats
+		defer func() {
+			if err := bw.Flush(); err != nil {
+				log.Println("TSDB cannot write data: ", err)
+			}
+		}()
+		c.writer = bw
+	}
+
+	if s.ReadBufferSize > 0 {
+		if tc, ok := conn.(interface{ SetReadBuffer(int) error }); ok {
+			if err := tc.SetReadBuffer(s.ReadBufferSize); err != nil {
+				log.Println("TSDBServer: unable to set read buffer size: ", err)
+			}
+		}
+	}
+
+	var reader *bufio.Reader
+	if s.ReaderBufferSize > 0 {
+		reader = bufio.NewReaderSize(&countingReader{r: conn, stats: s.stats}, s.ReaderBufferSize)
+	} else {
+		reader = bufio.NewReader(&countingReader{r: conn, stats: s.stats})
+	}
+	framer := s.framer(reader)
+
+	if s.EnableProxyProtocol {
+		line, err := framer.ReadLine()
+		if err != nil {
+			return
+		}
+		addr, err := parseProxyHeader(string(line))
 		if err != nil {
+			s.stats.Inc("proxyHeaderRejected")
+			log.Printf("TSDBServer: %s: %s", c.addr, err)
 			return
 		}
 
-		inputStrs := strings.Fields(line)
+		// The connection is counted per IP against the client, rather than
+		// the proxy it connected through.
+		s.mu.Lock()
+		if addr != "" {
+			c.setAddr(addr)
+		}
+		c.awaitingProxy = false
+		ok := s.countConn(c)
+		s.mu.Unlock()
+		if !ok {
+			return
+		}
+	}
+
+	if s.AutoDetectCompression {
+		if b, err := reader.Peek(2); err == nil && b[0] == 0x1f && b[1] == 0x8b {
+			gz, err := gzip.NewReader(reader)
+			if err != nil {
+				log.Println("TSDBServer: unable to read gzip stream: ", err)
+				return
+			}
+			defer gz.Close()
+			framer = s.framer(gz)
+		}
+	}
 
-		if len(inputStrs) == 1 && inputStrs[0] == "version" {
+	for {
+		if pending != nil && s.MaxPendingPerConn > 0 && pending.wait(s.MaxPendingPerConn) {
+			s.stats.Inc("connectionReadsPaused")
+		}
+
+		b, err := framer.ReadLine()
+		if err != nil {
+			eof = err == io.EOF
+			return
+		}
+		line := string(b)
+		atomic.AddUint64(&c.linesRead, 1)
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+		if c.lines != nil {
+			c.lines.add(line)
+		}
+
+		// Each command is counted, such as "commandsPut", so that probes can
+		// be told apart from ingest.
+		cmd := strings.ToLower(strings.TrimSpace(line))
+		switch cmd {
+		case "version":
+			s.stats.Inc("commandsVersion")
 			conn.Write([]byte("InfluxDB TSDB proxy"))
 			continue
+		case "stats":
+			s.stats.Inc("commandsStats")
+			s.writeStats(conn)
+			continue
+		case "compress gzip":
+			if !s.AllowStreamCompression {
+				break
+			}
+			s.stats.Inc("commandsCompress")
+			gz, err := gzip.NewReader(reader)
+			if err != nil {
+				log.Println("TSDBServer: unable to read gzip stream: ", err)
+				return
+			}
+			defer gz.Close()
+			framer = s.framer(gz)
+			continue
+		}
+		if strings.HasPrefix(cmd, "put ") || strings.HasPrefix(cmd, "put\t") {
+			s.stats.Inc("commandsPut")
+		} else {
+			s.stats.Inc("commandsUnknown")
 		}
 
-		if len(inputStrs) < 4 || inputStrs[0] != "put" {
-			log.Println("TSDBServer: malformed line, skipping: ", line)
+		if err := s.processLine(line, c); err != nil {
+			log.Printf("TSDBServer: %s: %s", c.addr, err)
+			if s.EchoErrors {
+				fmt.Fprintf(conn, "put: %s\n", err)
+			}
+			if s.DisconnectOnMalformed && isParseError(err) {
+				s.stats.Inc("connectionsClosedMalformed")
+				log.Printf("TSDBServer: %s: closing connection after malformed line", c.addr)
+				return
+			}
 			continue
 		}
+	}
+}
+
+// framer returns a Framer reading lines from r.
+func (s *Server) framer(r io.Reader) Framer {
+	if s.NewFramer != nil {
+		return s.NewFramer(r)
+	}
+	return NewLineFramer(r)
+}
 
-		name := inputStrs[1]
-		tsStr := inputStrs[2]
-		valueStr := inputStrs[3]
-		tagStrs := inputStrs[4:]
+// writeStats writes the server's statistics to w in OpenTSDB's "stats" format.
+func (s *Server) writeStats(w io.Writer) {
+	now := time.Now().Unix()
+	stats := make(map[string]int64)
+	s.stats.Walk(func(k string, v int64) {
+		stats[k] = v
+	})
 
-		var t time.Time
-		ts, err := strconv.ParseInt(tsStr, 10, 64)
-		if err != nil {
-			log.Println("TSDBServer: malformed timestamp, skipping: ", tsStr)
+	keys := make([]string, 0, len(stats))
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "opentsdb.%s %d %d\n", k, now, stats[k])
+	}
+	w.Write(buf.Bytes())
+}
+
+// connection holds the state of a single client connection.
+type connection struct {
+	// linesRead and lastActivity are first to ensure 64-bit alignment.
+	linesRead    uint64 // accessed atomically
+	lastActivity int64  // unix nanoseconds, accessed atomically
+
+	writer SeriesWriter
+	recent *recentPoints
+	lines  *lineRing
+
+	// addr is the client's address, and source is its IP address. When
+	// the connection is tracked they may only be set with the server lock held.
+	addr   string
+	source string
+
+	// awaitingProxy is set until the PROXY header gives the client's source
+	// address, and counted once the connection is counted against it for
+	// MaxConnectionsPerIP. Both are guarded by the server lock.
+	awaitingProxy bool
+	counted       bool
+
+	// tags are added to every point read from the connection.
+	tags map[string]string
+
+	connectedAt time.Time
+
+	// reaped is set, with the server lock held, once the connection has
+	// been closed for being idle.
+	reaped bool
+}
+
+// ConnInfo describes an active client connection.
+type ConnInfo struct {
+	RemoteAddr    string
+	ConnectedAt   time.Time
+	LinesReceived uint64
+	LastActivity  time.Time
+}
+
+// Connections returns information about the active client connections,
+// ordered by connection time.
+func (s *Server) Connections() []ConnInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := make([]ConnInfo, 0, len(s.conns))
+	for _, c := range s.conns {
+		a = append(a, ConnInfo{
+			RemoteAddr:    c.addr,
+			ConnectedAt:   c.connectedAt,
+			LinesReceived: atomic.LoadUint64(&c.linesRead),
+			LastActivity:  time.Unix(0, atomic.LoadInt64(&c.lastActivity)),
+		})
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].ConnectedAt.Before(a[j].ConnectedAt) })
+	return a
+}
+
+// setAddr sets the client's address.
+func (c *connection) setAddr(addr string) {
+	c.addr = addr
+	c.source = sourceIP(addr)
+}
+
+// sourceIP returns the host of addr, or an empty string if it has none.
+// IPv4-mapped IPv6 addresses are returned in their IPv4 form so they match
+// clients connecting over IPv4.
+func sourceIP(addr string) string {
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		return ip.To4().String()
+	}
+	return host
+}
+
+// newConnection returns the state for a new connection.
+func (s *Server) newConnection() *connection {
+	c := &connection{writer: s.writer}
+	if s.DuplicateTimestampPolicy != PassDuplicateTimestamps && s.DuplicateWindow > 0 {
+		c.recent = newRecentPoints(s.DuplicateWindow)
+	}
+	if s.CaptureRecentLines > 0 {
+		c.lines = newLineRing(s.CaptureRecentLines)
+	}
+	return c
+}
+
+// trackConn registers an active connection. It returns false if the server
+// is draining or closed, or the connection's source IP has
+// MaxConnectionsPerIP open, and the connection should not be served. A
+// connection awaiting its PROXY header is counted per IP once it is read.
+func (s *Server) trackConn(conn net.Conn, c *connection) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return false
+	}
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	if !c.awaitingProxy && !s.countConn(c) {
+		return false
+	}
+	s.conns[conn] = c
+	if s.MaxIdle > 0 {
+		s.reaper.Do(s.startReaper)
+	}
+	s.connWg.Add(1)
+	s.stats.Add("activeConnections", 1)
+	return true
+}
+
+// countConn counts a connection against its source IP. It returns false if
+// the IP has MaxConnectionsPerIP open, and the connection should not be
+// served. Must be called with the lock held.
+func (s *Server) countConn(c *connection) bool {
+	ip := c.source
+	if ip == "" {
+		return true
+	}
+	if s.MaxConnectionsPerIP > 0 && s.connsByIP[ip] >= s.MaxConnectionsPerIP {
+		log.Printf("TSDBServer: %s: closing connection, %d connections already open from %s", c.addr, s.connsByIP[ip], ip)
+		s.stats.Inc("connectionsRejectedPerIP")
+		return false
+	}
+	s.connsByIP[ip]++
+	c.counted = true
+	return true
+}
+
+// untrackConn removes a connection registered with trackConn.
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	if c := s.conns[conn]; c != nil && c.counted {
+		if s.connsByIP[c.source]--; s.connsByIP[c.source] <= 0 {
+			delete(s.connsByIP, c.source)
+		}
+	}
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.stats.Add("activeConnections", -1)
+	s.connWg.Done()
+}
+
+// startReaper starts closing idle connections in the background until the
+// server is closed. Must be called with the lock held.
+func (s *Server) startReaper() {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	interval := s.ReapInterval
+	if interval <= 0 {
+		interval = s.MaxIdle / 2
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case now := <-ticker.C:
+				s.reapIdle(now)
+			}
+		}
+	}()
+}
+
+// reapIdle closes connections which have been idle for longer than MaxIdle
+// at now, by setting a read deadline which interrupts any blocked read.
+func (s *Server) reapIdle(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn, c := range s.conns {
+		if c.reaped || now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastActivity))) <= s.MaxIdle {
+			continue
+		}
+		log.Printf("TSDBServer: %s: closing connection idle for more than %s", c.addr, s.MaxIdle)
+		conn.SetReadDeadline(now)
+		c.reaped = true
+		s.stats.Inc("connectionsReaped")
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r     io.Reader
+	stats *influxdb.Stats
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.stats.Add("bytesRead", int64(n))
+	return n, err
+}
+
+// ProcessLine parses a single "put" line and writes the resulting point.
+func (s *Server) ProcessLine(line string) error {
+	return s.processLine(line, &connection{writer: s.writer})
+}
+
+// processLine parses a single "put" line received on c and writes the resulting point.
+func (s *Server) processLine(line string, c *connection) error {
+	p, err := s.ParsePoint(line)
+	if err != nil {
+		s.stats.Inc("parseErrors")
+		var perr *parseError
+		if errors.As(err, &perr) {
+			s.stats.Inc("parseErrors" + perr.category)
+		}
+		return err
+	}
+	s.stats.Inc("pointsReceived")
+	return s.processPoint(p, c)
+}
+
+// processPoint applies renaming, filtering, tagging and Processors to a point
+// received on c and writes the resulting points.
+func (s *Server) processPoint(p influxdb.Point, c *connection) error {
+	if s.MaxAbsValue > 0 && ingest.ExceedsAbsValue(p.Fields, s.MaxAbsValue) {
+		s.stats.Inc("pointsValueOverLimit")
+		return fmt.Errorf("value of %s exceeds maximum magnitude %g, skipping", p.Name, s.MaxAbsValue)
+	}
+	if s.OverrideTimestampWithNow {
+		p.Timestamp = time.Now()
+	}
+	if s.WarnCoarseTimestamps && p.Timestamp.Nanosecond() == 0 {
+		s.stats.Inc("coarseTimestamps")
+		if n := atomic.AddUint64(s.coarse, 1); s.LogCoarseTimestamps && n%coarseTimestampLogEvery == 1 {
+			log.Printf("TSDBServer: %s: timestamp of %q has no sub-second component: %s (%d seen)", c.addr, p.Name, p.Timestamp, n)
+		}
+	}
+	p.Timestamp = client.SetPrecision(p.Timestamp, s.Precision)
+	if s.RenameRules != nil {
+		p.Name = s.RenameRules.Rename(p.Name)
+	}
+	if !s.allowed(p.Name) {
+		s.stats.Inc("pointsFiltered")
+		return nil
+	}
+	if s.AddSourceTag != "" && c.source != "" {
+		p.Tags[s.AddSourceTag] = c.source
+	}
+	for k, v := range c.tags {
+		if _, ok := p.Tags[k]; !ok {
+			p.Tags[k] = v
+		}
+	}
+
+	if len(s.Processors) == 0 {
+		return s.writePoint(p, c)
+	}
+	processed := influxdb.ProcessPoint(s.Processors, p)
+	if len(processed) == 0 {
+		s.stats.Inc("pointsDroppedByProcessor")
+	}
+	var err error
+	for _, p := range processed {
+		if perr := s.writePoint(p, c); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// writePoint applies deduplication and sampling to a processed point received
+// on c and writes it.
+func (s *Server) writePoint(p influxdb.Point, c *connection) error {
+	if s.SanitizeName {
+		p.Name = s.sanitizeName(p.Name)
+	}
+	s.measurements.Inc(p.Name, s.MaxTrackedMeasurements)
+	if s.Suggester != nil {
+		s.Suggester.Observe(p)
+	}
+
+	if !s.dedupe(&p, c) {
+		return nil
+	}
+
+	rate := s.SampleRate
+	if r, ok := s.MetricSampleRates[p.Name]; ok {
+		rate = r
+	}
+	if !ingest.Sampled(p, rate) {
+		s.stats.Inc("pointsSampledOut")
+		return nil
+	}
+
+	// Points without fields are rejected by the database, so skip them here.
+	if len(p.Fields) == 0 {
+		s.stats.Inc("pointsWithoutFields")
+		return fmt.Errorf("point for %s has no fields, skipping", p.Name)
+	}
+
+	rp := s.retentionPolicy(p.Name)
+	if s.FixedMeasurement != "" {
+		if p.Tags == nil {
+			p.Tags = make(map[string]string)
+		}
+		p.Tags[s.MetricNameTag] = p.Name
+		p.Name = s.FixedMeasurement
+	} else if s.FirstSegmentAsMeasurement {
+		if i := strings.IndexByte(p.Name, '.'); i > 0 && i < len(p.Name)-1 {
+			if p.Tags == nil {
+				p.Tags = make(map[string]string)
+			}
+			p.Tags["subpath"] = p.Name[i+1:]
+			p.Name = p.Name[:i]
+		}
+	}
+
+	if _, err := c.writer.WriteSeries(s.database, rp, []influxdb.Point{p}); err != nil {
+		return fmt.Errorf("cannot write data: %s", err)
+	}
+	s.lastValues.set(p, s.LastValueCacheSize)
+	return nil
+}
+
+// retentionPolicy returns the retention policy for points of the metric name.
+func (s *Server) retentionPolicy(name string) string {
+	if rp := s.policies.match(s.RetentionPolicyForMetric, name); rp != "" {
+		return rp
+	}
+	return s.retentionpolicy
+}
+
+// route returns the writer selected for p by WriterRouter, if any.
+func (s *Server) route(p influxdb.Point) SeriesWriter {
+	if s.WriterRouter == nil {
+		return nil
+	}
+	return s.WriterRouter(p)
+}
+
+// ParsePoint parses a single "put" line into a point.
+func (s *Server) ParsePoint(line string) (influxdb.Point, error) {
+	inputStrs := strings.Fields(line)
+
+	if len(inputStrs) < 4 || !strings.EqualFold(inputStrs[0], "put") {
+		return influxdb.Point{}, parseErrorf(fieldCountError, "malformed line, skipping: %s", line)
+	}
+
+	if s.AllowComments {
+		for i := 4; i < len(inputStrs); i++ {
+			if strings.HasPrefix(inputStrs[i], "#") {
+				inputStrs = inputStrs[:i]
+				break
+			}
 		}
+	}
+
+	name := inputStrs[1]
+	tsStr := inputStrs[2]
+	valueStr := inputStrs[3]
+	tagStrs := inputStrs[4:]
+	if s.FieldLayout == ValueTagsTimestamp {
+		valueStr = inputStrs[2]
+		tsStr = inputStrs[len(inputStrs)-1]
+		tagStrs = inputStrs[3 : len(inputStrs)-1]
+		if strings.Contains(tsStr, "=") {
+			return influxdb.Point{}, parseErrorf(timestampError, "line must end with a timestamp, skipping: %s", line)
+		}
+	}
 
+	var t time.Time
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil && s.AllowRFC3339Timestamps {
+		if t, err = time.Parse(time.RFC3339, tsStr); err != nil {
+			return influxdb.Point{}, parseErrorf(timestampError, "malformed timestamp, skipping: %s", tsStr)
+		}
+	} else if err != nil {
+		return influxdb.Point{}, parseErrorf(timestampError, "malformed timestamp, skipping: %s", tsStr)
+	} else {
 		switch len(tsStr) {
 		case 10:
 			t = time.Unix(ts, 0)
-			break
 		case 13:
 			t = time.Unix(ts/1000, (ts%1000)*1000)
-			break
 		default:
-			log.Println("TSDBServer: timestamp must be 10 or 13 chars, skipping: ", tsStr)
-			continue
+			return influxdb.Point{}, parseErrorf(timestampError, "timestamp must be 10 or 13 chars, skipping: %s", tsStr)
 		}
+	}
 
-		tags := make(map[string]string)
-		for t := range tagStrs {
-			parts := strings.SplitN(tagStrs[t], "=", 2)
-			if len(parts) != 2 {
-				log.Println("TSDBServer: malformed tag data", tagStrs[t])
+	tags := make(map[string]string)
+	fields := make(map[string]interface{})
+	for t := range tagStrs {
+		// Split on the first "=" only, as values may contain "=".
+		parts := strings.SplitN(tagStrs[t], "=", 2)
+		if len(parts) != 2 {
+			log.Println("TSDBServer: malformed tag data", tagStrs[t])
+			continue
+		}
+		k, v := parts[0], parts[1]
+		if k == "" {
+			return influxdb.Point{}, parseErrorf(tagError, "tag key is empty, skipping: %s", line)
+		}
+		if v == "" {
+			switch s.EmptyTagValuePolicy {
+			case DropEmptyTag:
+				s.stats.Inc("emptyTagValuesDropped")
 				continue
+			case DropEmptyTagPoint:
+				s.stats.Inc("emptyTagValue")
+				return influxdb.Point{}, parseErrorf(tagError, "tag value of %s is empty, skipping: %s", k, line)
 			}
-			k := parts[0]
+		}
+		if s.LowercaseTagKeys {
+			k = strings.ToLower(k)
+		}
+		if s.LowercaseTagValues {
+			v = strings.ToLower(v)
+		}
+		if s.SanitizeTags {
+			k, v = sanitizeTag(k), sanitizeTag(v)
+		}
 
-			tags[k] = parts[1]
+		if s.MaxTagValueLength > 0 && len(v) > s.MaxTagValueLength {
+			if s.TagValuePolicy == DropTagValue {
+				s.stats.Inc("tagValueTooLong")
+				return influxdb.Point{}, parseErrorf(overLimitError, "tag value exceeds maximum length, skipping: %s", line)
+			}
+			s.stats.Inc("tagValueTruncated")
+			v = v[:s.MaxTagValueLength]
 		}
 
-		fields := make(map[string]interface{})
-		fields["value"], err = strconv.ParseFloat(valueStr, 64)
+		if s.isFieldTag(k) {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				fields[k] = f
+				continue
+			}
+		}
+
+		tags[k] = v
+	}
+
+	if typ := s.fieldType(name); typ != "" {
+		fields["value"], err = coerceValue(typ, valueStr)
 		if err != nil {
-			log.Println("TSDBServer: could not parse value as float: ", valueStr)
-			continue
+			s.stats.Inc("fieldTypeCoercionFailed")
+			return influxdb.Point{}, parseErrorf(valueError, "could not parse value as %s: %s", typ, valueStr)
+		}
+	} else {
+		fields["value"], err = s.parseFloatValue(valueStr)
+		if err != nil {
+			return influxdb.Point{}, parseErrorf(valueError, "could not parse value as float: %s", valueStr)
 		}
+	}
+	if f, ok := fields["value"].(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return influxdb.Point{}, parseErrorf(nonFiniteError, "value is not a finite number, skipping: %s", valueStr)
+	}
+
+	return influxdb.Point{
+		Name:      name,
+		Tags:      tags,
+		Timestamp: t,
+		Fields:    fields,
+	}, nil
+}
+
+// sanitizeName returns the measurement name sanitized by NameSanitizer, or by
+// ingest.SanitizeName if it is not set.
+func (s *Server) sanitizeName(name string) string {
+	sanitized := ingest.SanitizeName
+	if s.NameSanitizer != nil {
+		sanitized = s.NameSanitizer
+	}
+	if v := sanitized(name); v != name {
+		s.stats.Inc("namesSanitized")
+		return v
+	}
+	return name
+}
+
+// tagReplacer replaces the characters removed by sanitizeTag.
+var tagReplacer = strings.NewReplacer(" ", "_", "\t", "_", ",", "_", "=", "_")
 
-		p := influxdb.Point{
-			Name:      name,
-			Tags:      tags,
-			Timestamp: t,
-			Fields:    fields,
+// sanitizeTag replaces whitespace, commas and "=" in a tag key or value with "_".
+func sanitizeTag(s string) string {
+	return tagReplacer.Replace(s)
+}
+
+// allowed returns true if points for the metric name should be accepted.
+func (s *Server) allowed(name string) bool {
+	if len(s.AllowMetrics) > 0 {
+		if _, ok := s.AllowMetrics[name]; !ok {
+			return false
 		}
+	}
+	_, denied := s.DenyMetrics[name]
+	return !denied
+}
 
-		_, err = s.writer.WriteSeries(s.database, s.retentionpolicy, []influxdb.Point{p})
-		if err != nil {
-			log.Println("TSDB cannot write data: ", err)
-			continue
+// isFieldTag returns true if the tag key k should be written as a field.
+func (s *Server) isFieldTag(k string) bool {
+	for _, f := range s.TagsToFields {
+		if f == k {
+			return true
 		}
 	}
+	return false
+}
+
+// closeListeners closes every listener in a.
+func closeListeners(a []net.Listener) {
+	for _, l := range a {
+		l.Close()
+	}
 }
@@ -0,0 +1,3164 @@
+package opentsdb_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/opentsdb"
+	"github.com/influxdb/influxdb/test"
+)
+
+func TestServer_HandleConnection_CaseInsensitiveCommands(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.HandleConnection(server)
+
+	client.Write([]byte("PUT sys.cpu.user 1356998400 1 host=a\nPut sys.cpu.user 1356998401 2 host=a\n"))
+	if _, err := w.WaitPoints(2); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Write([]byte("VERSION\n"))
+	if b := readN(t, client, 19); string(b) != "InfluxDB TSDB proxy" {
+		t.Fatalf("unexpected version: %q", b)
+	}
+
+	client.Write([]byte("Stats\n"))
+	br := bufio.NewReader(client)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(line, "opentsdb.") {
+		t.Fatalf("unexpected stats line: %q", line)
+	}
+}
+
+func TestServer_HandleConnection_EchoErrors(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.EchoErrors = true
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.HandleConnection(server)
+
+	go client.Write([]byte("put sys.cpu.user 1356998400\nput sys.cpu.user 1356998400 1 host=a\n"))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := "put: malformed line, skipping: put sys.cpu.user 1356998400\n"; line != exp {
+		t.Fatalf("unexpected reply.  expected %q, got %q", exp, line)
+	}
+
+	if _, err := w.WaitPoints(1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_HandleConnection_DisconnectOnMalformed(t *testing.T) {
+	lines := []byte("put sys.cpu.user 1356998400 1 host=a\nput sys.cpu.user 1356998401\nput sys.cpu.user 1356998402 3 host=a\n")
+
+	// By default, malformed lines are skipped.
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.HandleConnection(server)
+		close(done)
+	}()
+	client.Write(lines)
+	client.Close()
+	<-done
+	if n := len(w.Points()); n != 2 {
+		t.Fatalf("unexpected points written.  expected 2, got %d", n)
+	}
+
+	// Otherwise the connection is closed, after replying, on the first.
+	w = &testWriter{}
+	s = opentsdb.NewServer(w, "raw", "db")
+	s.DisconnectOnMalformed = true
+	s.EchoErrors = true
+	client, server = net.Pipe()
+	defer client.Close()
+	done = make(chan struct{})
+	go func() {
+		s.HandleConnection(server)
+		close(done)
+	}()
+	go client.Write(lines)
+
+	r := bufio.NewReader(client)
+	if line, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	} else if exp := "put: malformed line, skipping: put sys.cpu.user 1356998401\n"; line != exp {
+		t.Fatalf("unexpected reply.  expected %q, got %q", exp, line)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+	<-done
+	if n := len(w.Points()); n != 1 {
+		t.Fatalf("unexpected points written.  expected 1, got %d", n)
+	} else if n := s.Stats().Get("connectionsClosedMalformed"); n != 1 {
+		t.Fatalf("unexpected connectionsClosedMalformed.  expected 1, got %d", n)
+	}
+}
+
+func TestServer_HandleConnection_MaxTagValueLength(t *testing.T) {
+	var tests = []struct {
+		test   string
+		policy opentsdb.TagValuePolicy
+		points int
+		host   string
+		stat   string
+	}{
+		{test: "truncate", policy: opentsdb.TruncateTagValue, points: 1, host: "serv", stat: "tagValueTruncated"},
+		{test: "drop", policy: opentsdb.DropTagValue, points: 0, stat: "tagValueTooLong"},
+	}
+
+	for _, test := range tests {
+		t.Logf("testing %q...", test.test)
+
+		w := &testWriter{}
+		s := opentsdb.NewServer(w, "raw", "db")
+		s.MaxTagValueLength = 4
+		s.TagValuePolicy = test.policy
+
+		handleLines(s, "put sys.cpu.user 1356998400 42.5 host=server01 cpu=0")
+
+		points := w.Points()
+		if len(points) != test.points {
+			t.Fatalf("unexpected number of points.  expected %d, got %d", test.points, len(points))
+		}
+		if test.points > 0 && points[0].Tags["host"] != test.host {
+			t.Fatalf("unexpected host tag.  expected %q, got %q", test.host, points[0].Tags["host"])
+		}
+		if n := s.Stats().Get(test.stat); n != 1 {
+			t.Fatalf("unexpected %s count.  expected 1, got %d", test.stat, n)
+		}
+	}
+}
+
+func TestServer_HandleConnection_TagsToFields(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.TagsToFields = []string{"count"}
+
+	handleLines(s,
+		"put sys.cpu.user 1356998400 42.5 host=a count=10",
+		"put sys.cpu.user 1356998401 42.5 host=a count=many",
+	)
+
+	points := w.Points()
+	if len(points) != 2 {
+		t.Fatalf("unexpected number of points.  expected 2, got %d", len(points))
+	}
+
+	// A numeric value is moved to the fields.
+	if v, ok := points[0].Fields["count"]; !ok || v != float64(10) {
+		t.Fatalf("expected count field of 10, got %v", points[0].Fields)
+	}
+	if _, ok := points[0].Tags["count"]; ok {
+		t.Fatalf("unexpected count tag: %v", points[0].Tags)
+	}
+
+	// A non-numeric value is kept as a tag.
+	if _, ok := points[1].Fields["count"]; ok {
+		t.Fatalf("unexpected count field: %v", points[1].Fields)
+	}
+	if points[1].Tags["count"] != "many" {
+		t.Fatalf("expected count tag of \"many\", got %v", points[1].Tags)
+	}
+}
+
+func TestServer_ParsePoint_LowercaseTags(t *testing.T) {
+	var tests = []struct {
+		keys   bool
+		values bool
+		exp    map[string]string
+	}{
+		{exp: map[string]string{"Host": "WebServer01"}},
+		{keys: true, exp: map[string]string{"host": "WebServer01"}},
+		{values: true, exp: map[string]string{"Host": "webserver01"}},
+		{keys: true, values: true, exp: map[string]string{"host": "webserver01"}},
+	}
+
+	for i, test := range tests {
+		s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+		s.LowercaseTagKeys = test.keys
+		s.LowercaseTagValues = test.values
+
+		p, err := s.ParsePoint("put sys.cpu.user 1356998400 42 Host=WebServer01")
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(p.Tags, test.exp) {
+			t.Fatalf("%d. unexpected tags.  expected %v, got %v", i, test.exp, p.Tags)
+		}
+	}
+}
+
+func TestServer_ParsePoint_TagValueContainsEquals(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	p, err := s.ParsePoint("put http.requests 1356998400 1 url=a=b query=x==y")
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := map[string]string{"url": "a=b", "query": "x==y"}; !reflect.DeepEqual(p.Tags, exp) {
+		t.Fatalf("unexpected tags.  expected %v, got %v", exp, p.Tags)
+	}
+}
+
+func TestServer_ParsePoint_AllowRFC3339Timestamps(t *testing.T) {
+	var tests = []struct {
+		allow bool
+		ts    string
+		exp   time.Time
+		err   string
+	}{
+		{allow: true, ts: "2013-01-01T00:00:00Z", exp: time.Unix(1356998400, 0)},
+		{allow: true, ts: "2013-01-01T01:30:00+01:30", exp: time.Unix(1356998400, 0)},
+		{allow: true, ts: "1356998400", exp: time.Unix(1356998400, 0)},
+		{allow: true, ts: "yesterday", err: "malformed timestamp, skipping: yesterday"},
+		{ts: "2013-01-01T00:00:00Z", err: "malformed timestamp, skipping: 2013-01-01T00:00:00Z"},
+	}
+
+	for i, test := range tests {
+		s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+		s.AllowRFC3339Timestamps = test.allow
+
+		p, err := s.ParsePoint("put sys.cpu.user " + test.ts + " 42 host=a")
+		if errstr(err) != test.err {
+			t.Fatalf("%d. unexpected error.  expected %q, got %q", i, test.err, errstr(err))
+		} else if err == nil && !p.Timestamp.Equal(test.exp) {
+			t.Fatalf("%d. unexpected timestamp.  expected %v, got %v", i, test.exp, p.Timestamp)
+		}
+	}
+}
+
+func TestServer_ParsePoint_AllowComments(t *testing.T) {
+	var tests = []struct {
+		allow bool
+		exp   map[string]string
+	}{
+		{exp: map[string]string{"host": "server01", "note": "x"}},
+		{allow: true, exp: map[string]string{"host": "server01"}},
+	}
+
+	for i, test := range tests {
+		s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+		s.AllowComments = test.allow
+
+		p, err := s.ParsePoint("put sys.cpu.user 1356998400 42 host=server01 #exported by collector note=x")
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(p.Tags, test.exp) {
+			t.Fatalf("%d. unexpected tags.  expected %v, got %v", i, test.exp, p.Tags)
+		}
+	}
+}
+
+func TestServer_ParsePoint_FieldLayout(t *testing.T) {
+	var tests = []struct {
+		line string
+		tags map[string]string
+		err  string
+	}{
+		{line: "put sys.cpu.user 42 host=server01 cpu=0 1356998400", tags: map[string]string{"host": "server01", "cpu": "0"}},
+		{line: "put sys.cpu.user 42 1356998400", tags: map[string]string{}},
+		{line: "put sys.cpu.user 42 host=server01 1356998400 #exported", tags: map[string]string{"host": "server01"}},
+		{line: "put sys.cpu.user 42 host=server01 cpu=0", err: "line must end with a timestamp, skipping: put sys.cpu.user 42 host=server01 cpu=0"},
+		{line: "put sys.cpu.user 42 host=server01 later", err: "malformed timestamp, skipping: later"},
+	}
+
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	s.FieldLayout = opentsdb.ValueTagsTimestamp
+	s.AllowComments = true
+	for i, test := range tests {
+		p, err := s.ParsePoint(test.line)
+		if errstr(err) != test.err {
+			t.Fatalf("%d. unexpected error.  expected %q, got %v", i, test.err, err)
+		} else if err != nil {
+			continue
+		}
+		if !p.Timestamp.Equal(time.Unix(1356998400, 0)) {
+			t.Fatalf("%d. unexpected timestamp: %s", i, p.Timestamp)
+		} else if p.Fields["value"] != 42.0 {
+			t.Fatalf("%d. unexpected value: %v", i, p.Fields["value"])
+		} else if !reflect.DeepEqual(p.Tags, test.tags) {
+			t.Fatalf("%d. unexpected tags.  expected %v, got %v", i, test.tags, p.Tags)
+		}
+	}
+}
+
+func TestServer_ParsePoint_ValueExtensions(t *testing.T) {
+	var tests = []struct {
+		hex   bool
+		units map[string]float64
+		value string
+		exp   float64
+		err   bool
+	}{
+		{value: "0x1F", err: true},
+		{value: "42ms", err: true},
+		{hex: true, value: "0x1F", exp: 31},
+		{hex: true, value: "0XFF", exp: 255},
+		{hex: true, value: "0xZZ", err: true},
+		{units: map[string]float64{"ms": 0.001, "s": 1}, value: "42ms", exp: 0.042},
+		{units: map[string]float64{"ms": 0.001, "s": 1}, value: "42s", exp: 42},
+		{units: map[string]float64{"ms": 0.001, "s": 1}, value: "42", exp: 42},
+		{units: map[string]float64{"%": 1}, value: "97.5%", exp: 97.5},
+		{units: map[string]float64{"ms": 0.001}, value: "42us", err: true},
+	}
+
+	for i, test := range tests {
+		s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+		s.ParseHexValues = test.hex
+		s.ValueUnits = test.units
+
+		p, err := s.ParsePoint("put sys.latency 1356998400 " + test.value + " host=a")
+		if test.err {
+			if err == nil {
+				t.Fatalf("%d. expected error parsing %q", i, test.value)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("%d. %s", i, err)
+		} else if v := p.Fields["value"]; v != test.exp {
+			t.Fatalf("%d. unexpected value.  expected %v, got %v", i, test.exp, v)
+		}
+	}
+}
+
+func TestServer_ProcessLine_ParseErrorCategories(t *testing.T) {
+	var tests = []struct {
+		line string
+		stat string
+	}{
+		{line: "put sys.cpu.user 1356998400", stat: "parseErrorsFieldCount"},
+		{line: "get sys.cpu.user 1356998400 1 host=a", stat: "parseErrorsFieldCount"},
+		{line: "put sys.cpu.user yesterday 1 host=a", stat: "parseErrorsTimestamp"},
+		{line: "put sys.cpu.user 135699840 1 host=a", stat: "parseErrorsTimestamp"},
+		{line: "put sys.cpu.user 1356998400 one host=a", stat: "parseErrorsValue"},
+		{line: "put sys.cpu.user 1356998400 1 host=", stat: "parseErrorsTag"},
+		{line: "put sys.cpu.user 1356998400 1 =a", stat: "parseErrorsTag"},
+		{line: "put sys.cpu.user 1356998400 1 host=abcdefghijk", stat: "parseErrorsOverLimit"},
+		{line: "put sys.cpu.user 1356998400 NaN host=a", stat: "parseErrorsNonFinite"},
+		{line: "put sys.cpu.user 1356998400 +Inf host=a", stat: "parseErrorsNonFinite"},
+	}
+
+	for i, test := range tests {
+		s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+		s.MaxTagValueLength = 10
+		s.TagValuePolicy = opentsdb.DropTagValue
+		s.EmptyTagValuePolicy = opentsdb.DropEmptyTagPoint
+
+		if err := s.ProcessLine(test.line); err == nil {
+			t.Fatalf("%d. expected error for %q", i, test.line)
+		}
+		stats := s.Stats()
+		if n := stats.Get(test.stat); n != 1 {
+			t.Fatalf("%d. unexpected %s for %q.  expected 1, got %d", i, test.stat, test.line, n)
+		} else if n := stats.Get("parseErrors"); n != 1 {
+			t.Fatalf("%d. unexpected parseErrors for %q.  expected 1, got %d", i, test.line, n)
+		}
+	}
+}
+
+func TestServer_EmptyTagValuePolicy(t *testing.T) {
+	var tests = []struct {
+		policy opentsdb.EmptyTagValuePolicy
+		tags   map[string]string // nil if the point is dropped
+		stat   string
+	}{
+		{policy: opentsdb.KeepEmptyTagValue, tags: map[string]string{"host": "", "cpu": "0"}},
+		{policy: opentsdb.DropEmptyTag, tags: map[string]string{"cpu": "0"}, stat: "emptyTagValuesDropped"},
+		{policy: opentsdb.DropEmptyTagPoint, stat: "emptyTagValue"},
+	}
+
+	for i, test := range tests {
+		w := &testWriter{}
+		s := opentsdb.NewServer(w, "raw", "db")
+		s.EmptyTagValuePolicy = test.policy
+
+		err := s.ProcessLine("put sys.cpu.user 1356998400 1 host= cpu=0")
+		if test.tags == nil {
+			if err == nil {
+				t.Fatalf("%d. expected error", i)
+			} else if points := w.Points(); len(points) != 0 {
+				t.Fatalf("%d. expected point to be dropped, got %v", i, points)
+			}
+		} else if err != nil {
+			t.Fatalf("%d. %s", i, err)
+		} else if points := w.Points(); len(points) != 1 || !reflect.DeepEqual(points[0].Tags, test.tags) {
+			t.Fatalf("%d. unexpected points.  expected tags %v, got %v", i, test.tags, points)
+		}
+		if test.stat != "" {
+			if n := s.Stats().Get(test.stat); n != 1 {
+				t.Fatalf("%d. unexpected %s.  expected 1, got %d", i, test.stat, n)
+			}
+		}
+	}
+}
+
+func TestServer_OverrideTimestampWithNow(t *testing.T) {
+	sent := time.Unix(1356998400, 0)
+	for _, override := range []bool{false, true} {
+		w := &testWriter{}
+		s := opentsdb.NewServer(w, "raw", "db")
+		s.OverrideTimestampWithNow = override
+
+		before := time.Now()
+		if err := s.ProcessLine("put sys.cpu.user 1356998400 1"); err != nil {
+			t.Fatal(err)
+		}
+		after := time.Now()
+
+		ts := w.Points()[0].Timestamp
+		if !override && !ts.Equal(sent) {
+			t.Fatalf("expected sent timestamp %s by default, got %s", sent, ts)
+		} else if override && (ts.Before(before) || ts.After(after)) {
+			t.Fatalf("expected timestamp between %s and %s, got %s", before, after, ts)
+		}
+	}
+}
+
+func TestServer_WarnCoarseTimestamps(t *testing.T) {
+	for _, warn := range []bool{false, true} {
+		s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+		s.WarnCoarseTimestamps = warn
+		s.LogCoarseTimestamps = true
+		s.AllowRFC3339Timestamps = true
+
+		handleLines(s,
+			"put sys.cpu.user 1356998400 1 host=a",
+			"put sys.cpu.user 1356998400500 1 host=a",
+			"put sys.cpu.user 2013-01-01T00:00:01Z 1 host=a",
+			"put sys.cpu.user 2013-01-01T00:00:01.25Z 1 host=a",
+		)
+
+		stats := s.Stats()
+		if n, exp := stats.Get("coarseTimestamps"), map[bool]int64{false: 0, true: 2}[warn]; n != exp {
+			t.Fatalf("warn=%v: unexpected coarseTimestamps.  expected %d, got %d", warn, exp, n)
+		} else if n := stats.Get("pointsWritten"); n != 4 {
+			t.Fatalf("warn=%v: unexpected pointsWritten.  expected 4, got %d", warn, n)
+		}
+	}
+}
+
+func TestServer_SanitizeTags(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	p, err := s.ParsePoint("put sys.cpu.user 1356998400 1 host=web01,web02 dc=us=east")
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := map[string]string{"host": "web01,web02", "dc": "us=east"}; !reflect.DeepEqual(p.Tags, exp) {
+		t.Fatalf("unexpected tags without sanitizing.  expected %v, got %v", exp, p.Tags)
+	}
+
+	s.SanitizeTags = true
+	p, err = s.ParsePoint("put sys.cpu.user 1356998400 1 host=web01,web02 dc=us=east a,b=1")
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := map[string]string{"host": "web01_web02", "dc": "us_east", "a_b": "1"}; !reflect.DeepEqual(p.Tags, exp) {
+		t.Fatalf("unexpected tags.  expected %v, got %v", exp, p.Tags)
+	}
+}
+
+func TestHandler_SanitizeTags(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.SanitizeTags = true
+	h := opentsdb.NewHandler(s, "0.9.0")
+
+	body := `{"metric":"sys.cpu.user","timestamp":1356998400,"value":1,"tags":{"host":"web 01, rack 2","data center":"us"}}`
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/put", strings.NewReader(body)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status.  expected %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+
+	points := w.Points()
+	if len(points) != 1 {
+		t.Fatalf("unexpected number of points.  expected 1, got %d", len(points))
+	} else if exp := map[string]string{"host": "web_01__rack_2", "data_center": "us"}; !reflect.DeepEqual(points[0].Tags, exp) {
+		t.Fatalf("unexpected tags.  expected %v, got %v", exp, points[0].Tags)
+	}
+}
+
+func TestReadFileFieldTypes(t *testing.T) {
+	f, err := ioutil.TempFile("", "opentsdb-types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# metric types\nsys.up bool\n\nsys.procs.*   int\n")
+	f.Close()
+
+	types, err := opentsdb.ReadFileFieldTypes(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := map[string]string{"sys.up": "bool", "sys.procs.*": "int"}; !reflect.DeepEqual(types, exp) {
+		t.Fatalf("unexpected types.  expected %v, got %v", exp, types)
+	}
+
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	s.FieldTypes = types
+	if p, err := s.ParsePoint("put sys.procs.running 1356998400 42"); err != nil {
+		t.Fatal(err)
+	} else if v := p.Fields["value"]; v != int64(42) {
+		t.Fatalf("unexpected value.  expected int64(42), got %#v", v)
+	}
+	if p, err := s.ParsePoint("put sys.up 1356998400 true"); err != nil {
+		t.Fatal(err)
+	} else if v := p.Fields["value"]; v != true {
+		t.Fatalf("unexpected value.  expected true, got %#v", v)
+	}
+}
+
+func TestReadFieldTypes_Invalid(t *testing.T) {
+	for i, test := range []struct {
+		text string
+		err  string
+	}{
+		{text: "sys.up boolean", err: "line 1: unknown field type: boolean"},
+		{text: "sys.up\n", err: `line 1: expected metric and type: "sys.up"`},
+		{text: "sys.up bool\nsys.[ int", err: `line 2: invalid metric pattern "sys.[": syntax error in pattern`},
+	} {
+		if _, err := opentsdb.ReadFieldTypes(strings.NewReader(test.text)); errstr(err) != test.err {
+			t.Fatalf("%d. unexpected error.  expected %q, got %q", i, test.err, errstr(err))
+		}
+	}
+}
+
+func TestServer_ParsePoint_FieldTypes(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	s.FieldTypes = map[string]string{
+		"sys.up":      "bool",
+		"sys.procs.*": "int",
+		"sys.load":    "float",
+	}
+
+	var tests = []struct {
+		line  string
+		value interface{}
+		err   string
+	}{
+		{line: "put sys.up 1356998400 1", value: true},
+		{line: "put sys.up 1356998400 false", value: false},
+		{line: "put sys.procs.running 1356998400 42", value: int64(42)},
+		{line: "put sys.load 1356998400 1", value: float64(1)},
+		{line: "put sys.cpu.user 1356998400 42", value: float64(42)},
+		{line: "put sys.up 1356998400 yes", err: "could not parse value as bool: yes"},
+		{line: "put sys.procs.running 1356998400 4.2", err: "could not parse value as int: 4.2"},
+	}
+
+	for i, test := range tests {
+		p, err := s.ParsePoint(test.line)
+		if errstr(err) != test.err {
+			t.Fatalf("%d. unexpected error.  expected %q, got %q", i, test.err, errstr(err))
+		} else if err == nil && p.Fields["value"] != test.value {
+			t.Fatalf("%d. unexpected value.  expected %#v, got %#v", i, test.value, p.Fields["value"])
+		}
+	}
+
+	if n := s.Stats().Get("fieldTypeCoercionFailed"); n != 2 {
+		t.Fatalf("unexpected fieldTypeCoercionFailed count.  expected 2, got %d", n)
+	}
+}
+
+func TestServer_RenameRules(t *testing.T) {
+	rules, err := opentsdb.ParseRenameRules([]string{
+		"old.cpu.user -> sys.cpu.user",
+		"legacy.* -> sys.*",
+		"legacy.mem.* -> sys.memory.*",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.RenameRules = rules
+	handleLines(s,
+		"put old.cpu.user 1356998400 1 host=a",
+		"put legacy.disk.used 1356998400 1 host=a",
+		"put legacy.mem.free 1356998400 1 host=a",
+		"put sys.load 1356998400 1 host=a",
+	)
+
+	var names []string
+	for _, p := range w.Points() {
+		names = append(names, p.Name)
+	}
+	if exp := []string{"sys.cpu.user", "sys.disk.used", "sys.memory.free", "sys.load"}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("unexpected names.  expected %v, got %v", exp, names)
+	}
+}
+
+func TestServer_FixedMeasurement(t *testing.T) {
+	var tests = []struct {
+		tag string
+		exp map[string]string
+	}{
+		{exp: map[string]string{"metric": "sys.cpu.user", "host": "a"}},
+		{tag: "name", exp: map[string]string{"name": "sys.cpu.user", "host": "a"}},
+	}
+
+	for i, test := range tests {
+		w := &testWriter{}
+		s := opentsdb.NewServer(w, "raw", "db")
+		s.FixedMeasurement = "opentsdb"
+		if test.tag != "" {
+			s.MetricNameTag = test.tag
+		}
+		handleLines(s, "put sys.cpu.user 1356998400 1 host=a")
+
+		points := w.Points()
+		if len(points) != 1 {
+			t.Fatalf("%d. unexpected number of points.  expected 1, got %d", i, len(points))
+		} else if points[0].Name != "opentsdb" {
+			t.Fatalf("%d. unexpected measurement.  expected %q, got %q", i, "opentsdb", points[0].Name)
+		} else if !reflect.DeepEqual(points[0].Tags, test.exp) {
+			t.Fatalf("%d. unexpected tags.  expected %v, got %v", i, test.exp, points[0].Tags)
+		}
+	}
+}
+
+func TestServer_FirstSegmentAsMeasurement(t *testing.T) {
+	var tests = []struct {
+		line string
+		name string
+		tags map[string]string
+	}{
+		{line: "put sys.cpu.user 1356998400 1 host=a", name: "sys", tags: map[string]string{"subpath": "cpu.user", "host": "a"}},
+		{line: "put uptime 1356998400 1 host=a", name: "uptime", tags: map[string]string{"host": "a"}},
+	}
+
+	for i, test := range tests {
+		w := &testWriter{}
+		s := opentsdb.NewServer(w, "raw", "db")
+		s.FirstSegmentAsMeasurement = true
+		handleLines(s, test.line)
+
+		points := w.Points()
+		if len(points) != 1 {
+			t.Fatalf("%d. unexpected number of points.  expected 1, got %d", i, len(points))
+		} else if points[0].Name != test.name {
+			t.Fatalf("%d. unexpected measurement.  expected %q, got %q", i, test.name, points[0].Name)
+		} else if !reflect.DeepEqual(points[0].Tags, test.tags) {
+			t.Fatalf("%d. unexpected tags.  expected %v, got %v", i, test.tags, points[0].Tags)
+		}
+	}
+}
+
+func TestServer_WriterRouter(t *testing.T) {
+	def, acme, globex := &testWriter{}, &testWriter{}, &testWriter{}
+	s := opentsdb.NewServer(def, "raw", "db")
+	s.BatchSize = 4
+	s.WriterRouter = func(p influxdb.Point) opentsdb.SeriesWriter {
+		switch p.Tags["tenant"] {
+		case "acme":
+			return acme
+		case "globex":
+			return globex
+		}
+		return nil
+	}
+	handleLines(s,
+		"put cpu 1356998400 1 tenant=acme",
+		"put cpu 1356998400 2 tenant=globex",
+		"put cpu 1356998400 3 tenant=acme",
+		"put cpu 1356998400 4 host=a",
+	)
+
+	for _, tt := range []struct {
+		name   string
+		w      *testWriter
+		values []float64
+	}{
+		{"acme", acme, []float64{1, 3}},
+		{"globex", globex, []float64{2}},
+		{"default", def, []float64{4}},
+	} {
+		var values []float64
+		for _, p := range tt.w.Points() {
+			values = append(values, p.Fields["value"].(float64))
+		}
+		if !reflect.DeepEqual(values, tt.values) {
+			t.Fatalf("%s: unexpected values.  expected %v, got %v", tt.name, tt.values, values)
+		} else if n := len(tt.w.Calls()); n != 1 {
+			t.Fatalf("%s: unexpected write count.  expected 1, got %d", tt.name, n)
+		}
+	}
+}
+
+func TestParseRenameRules_Invalid(t *testing.T) {
+	for _, rule := range []string{"old.cpu", "old.cpu -> ", "old.* -> new", "a -> b -> c"} {
+		if _, err := opentsdb.ParseRenameRules([]string{rule}); err == nil {
+			t.Fatalf("expected error for rule %q", rule)
+		}
+	}
+}
+
+func TestServer_AllowDenyMetrics(t *testing.T) {
+	var tests = []struct {
+		allow []string
+		deny  []string
+		exp   []string
+	}{
+		{allow: []string{"sys.cpu.user", "sys.mem.free"}, exp: []string{"sys.cpu.user", "sys.mem.free"}},
+		{deny: []string{"sys.cpu.user"}, exp: []string{"sys.mem.free", "sys.disk.used"}},
+		{allow: []string{"sys.cpu.user", "sys.mem.free"}, deny: []string{"sys.mem.free"}, exp: []string{"sys.cpu.user"}},
+	}
+
+	for i, test := range tests {
+		w := &testWriter{}
+		s := opentsdb.NewServer(w, "raw", "db")
+		s.AllowMetrics = make(map[string]struct{})
+		for _, name := range test.allow {
+			s.AllowMetrics[name] = struct{}{}
+		}
+		s.DenyMetrics = make(map[string]struct{})
+		for _, name := range test.deny {
+			s.DenyMetrics[name] = struct{}{}
+		}
+
+		handleLines(s,
+			"put sys.cpu.user 1356998400 1 host=a",
+			"put sys.mem.free 1356998400 1 host=a",
+			"put sys.disk.used 1356998400 1 host=a",
+		)
+
+		var names []string
+		for _, p := range w.Points() {
+			names = append(names, p.Name)
+		}
+		if !reflect.DeepEqual(names, test.exp) {
+			t.Fatalf("%d. unexpected metrics.  expected %v, got %v", i, test.exp, names)
+		}
+		if n := s.Stats().Get("pointsFiltered"); n != int64(3-len(test.exp)) {
+			t.Fatalf("%d. unexpected pointsFiltered count.  expected %d, got %d", i, 3-len(test.exp), n)
+		}
+	}
+}
+
+func TestServer_Stats_Measurements(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	handleLines(s,
+		"put cpu 1356998400 1",
+		"put mem 1356998400 1",
+		"put cpu 1356998401 1",
+		"put mem 1356998401 1",
+		"put cpu 1356998402 1",
+	)
+	if exp, got := map[string]uint64{"cpu": 3, "mem": 2}, s.Stats().Measurements; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("unexpected measurement stats.  expected %v, got %v", exp, got)
+	}
+
+	// The least recently seen measurement is evicted when the cap is reached.
+	s = opentsdb.NewServer(&testWriter{}, "raw", "db")
+	s.MaxTrackedMeasurements = 2
+	handleLines(s,
+		"put cpu 1356998400 1",
+		"put mem 1356998400 1",
+		"put cpu 1356998401 1",
+		"put disk 1356998400 1",
+	)
+	if exp, got := map[string]uint64{"cpu": 2, "disk": 1}, s.Stats().Measurements; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("unexpected measurement stats.  expected %v, got %v", exp, got)
+	}
+}
+
+func TestServer_HandleConnection_DuplicateTimestampPolicy(t *testing.T) {
+	lines := []string{
+		"put sys.cpu.user 1356998400 1 host=a",
+		"put sys.cpu.user 1356998400 2 host=a",
+		"put sys.cpu.user 1356998400 3 host=b",
+		"put sys.cpu.user 1356998400 4 host=a",
+	}
+	ts := time.Unix(1356998400, 0)
+
+	var tests = []struct {
+		test       string
+		policy     opentsdb.DuplicateTimestampPolicy
+		timestamps []time.Time
+		stat       string
+	}{
+		{
+			test:       "pass",
+			policy:     opentsdb.PassDuplicateTimestamps,
+			timestamps: []time.Time{ts, ts, ts, ts},
+		},
+		{
+			test:       "drop",
+			policy:     opentsdb.DropDuplicateTimestamps,
+			timestamps: []time.Time{ts, ts},
+			stat:       "duplicateTimestampDropped",
+		},
+		{
+			test:       "increment",
+			policy:     opentsdb.IncrementDuplicateTimestamps,
+			timestamps: []time.Time{ts, ts.Add(time.Nanosecond), ts, ts.Add(2 * time.Nanosecond)},
+			stat:       "duplicateTimestampIncremented",
+		},
+	}
+
+	for _, test := range tests {
+		t.Logf("testing %q...", test.test)
+
+		w := &testWriter{}
+		s := opentsdb.NewServer(w, "raw", "db")
+		s.DuplicateTimestampPolicy = test.policy
+		handleLines(s, lines...)
+
+		points := w.Points()
+		if len(points) != len(test.timestamps) {
+			t.Fatalf("unexpected number of points.  expected %d, got %d", len(test.timestamps), len(points))
+		}
+		for i, p := range points {
+			if !p.Timestamp.Equal(test.timestamps[i]) {
+				t.Fatalf("unexpected timestamp for point %d.  expected %v, got %v", i, test.timestamps[i], p.Timestamp)
+			}
+		}
+		if test.stat != "" {
+			if n := s.Stats().Get(test.stat); n != 2 {
+				t.Fatalf("unexpected %s count.  expected 2, got %d", test.stat, n)
+			}
+		}
+	}
+}
+
+func TestServer_PartialWriteError(t *testing.T) {
+	var tests = []struct {
+		test    string
+		err     error
+		written int64
+		failed  int64
+	}{
+		{test: "success", written: 3},
+		{test: "partial failure", err: &opentsdb.PartialWriteError{Failed: map[int]error{1: errors.New("field type conflict")}}, written: 2, failed: 1},
+		{test: "whole batch failure", err: errors.New("write failed"), failed: 3},
+	}
+
+	for _, test := range tests {
+		t.Logf("testing %q...", test.test)
+
+		w := &errWriter{err: test.err}
+		s := opentsdb.NewServer(w, "raw", "db")
+		s.BatchSize = 3
+		handleLines(s,
+			"put sys.cpu.user 1356998400 1 host=a",
+			"put sys.cpu.user 1356998401 2 host=a",
+			"put sys.cpu.user 1356998402 3 host=a",
+		)
+
+		if n := s.Stats().Get("pointsWritten"); n != test.written {
+			t.Fatalf("unexpected pointsWritten count.  expected %d, got %d", test.written, n)
+		}
+		if n := s.Stats().Get("pointsWriteFailed"); n != test.failed {
+			t.Fatalf("unexpected pointsWriteFailed count.  expected %d, got %d", test.failed, n)
+		}
+	}
+}
+
+func TestServer_HandleConnection_ProxyProtocol(t *testing.T) {
+	var tests = []struct {
+		header string
+		source string
+		err    bool
+	}{
+		{header: "PROXY TCP4 10.0.0.1 10.0.0.2 56324 4242", source: "10.0.0.1"},
+		{header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 4242", source: "2001:db8::1"},
+		{header: "PROXY TCP6 ::ffff:10.0.0.1 2001:db8::2 56324 4242", source: "10.0.0.1"},
+		{header: "PROXY UNKNOWN"},
+		{header: "PROXY TCP4 10.0.0.1 56324 4242", err: true},
+		{header: "PROXY TCP4 2001:db8::1 10.0.0.2 56324 4242", err: true},
+		{header: "PROXY TCP4 10.0.0.1 ::ffff:10.0.0.2 56324 4242", err: true},
+		{header: "PROXY TCP6 10.0.0.1 2001:db8::2 56324 4242", err: true},
+		{header: "put sys.cpu.user 1356998400 1 host=a", err: true},
+	}
+
+	for i, test := range tests {
+		w := &testWriter{}
+		s := opentsdb.NewServer(w, "raw", "db")
+		s.EnableProxyProtocol = true
+		s.AddSourceTag = "source"
+
+		handleLines(s, test.header, "put sys.cpu.user 1356998400 1 host=a")
+
+		points := w.Points()
+		if test.err {
+			if len(points) != 0 {
+				t.Fatalf("%d. expected connection to be rejected, got %d points", i, len(points))
+			} else if n := s.Stats().Get("proxyHeaderRejected"); n != 1 {
+				t.Fatalf("%d. unexpected proxyHeaderRejected count.  expected 1, got %d", i, n)
+			}
+			continue
+		}
+
+		if len(points) != 1 {
+			t.Fatalf("%d. unexpected point count.  expected 1, got %d", i, len(points))
+		} else if source, ok := points[0].Tags["source"]; source != test.source || ok != (test.source != "") {
+			t.Fatalf("%d. unexpected source tag.  expected %q, got %q", i, test.source, source)
+		}
+	}
+}
+
+// Ensure a client behind a proxy sending an IPv4-mapped source address
+// under TCP6 is tagged with its IPv4 address.
+func TestServer_ProxyProtocol_MappedSource(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.EnableProxyProtocol = true
+	s.AddSourceTag = "source"
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP6 ::ffff:10.0.0.1 ::ffff:10.0.0.2 56324 4242\r\nput sys.cpu.user 1356998400 1 host=a\n"))
+
+	points, err := w.WaitPoints(1)
+	if err != nil {
+		t.Fatal(err)
+	} else if source := points[0].Tags["source"]; source != "10.0.0.1" {
+		t.Fatalf("unexpected source tag.  expected %q, got %q", "10.0.0.1", source)
+	}
+}
+
+func TestServer_MaxConnectionsPerIP(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	s.MaxConnectionsPerIP = 2
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// waitConns waits for n connections to be open.
+	waitConns := func(n int) {
+		for deadline := time.Now().Add(time.Second); len(s.Connections()) != n; {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d connections, got %d", n, len(s.Connections()))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	waitConns(2)
+
+	// A third connection from the same IP is closed.
+	rejected, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	rejected.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+
+	// Once a connection is closed another is accepted.
+	conns[0].Close()
+	waitConns(1)
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("version\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 64)); err != nil {
+		t.Fatalf("expected connection to be served, got %v", err)
+	}
+}
+
+// Ensure clients behind a proxy are counted per IP by the source address in
+// their PROXY header, rather than by the proxy's address.
+func TestServer_MaxConnectionsPerIP_ProxyProtocol(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.EnableProxyProtocol = true
+	s.MaxConnectionsPerIP = 1
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Two clients connecting through the same proxy are both served.
+	for i, source := range []string{"10.0.0.1", "10.0.0.2"} {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "PROXY TCP4 %s 10.0.0.9 56324 4242\r\nput sys.cpu.user 1356998400 1 host=%s\n", source, source)
+		if _, err := w.WaitPoints(i + 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A second connection from the same client is closed.
+	rejected, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	rejected.Write([]byte("PROXY TCP4 10.0.0.1 10.0.0.9 56325 4242\r\n"))
+	rejected.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+
+	// The stats are read once the connections are done with them.
+	s.Close()
+	if n := s.Stats().Get("connectionsRejectedPerIP"); n != 1 {
+		t.Fatalf("unexpected connectionsRejectedPerIP.  expected 1, got %d", n)
+	}
+}
+
+func TestServer_MaxIdle(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	s.MaxIdle = 50 * time.Millisecond
+	s.ReapInterval = 10 * time.Millisecond
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A connection which sends nothing is closed once idle.
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected idle connection to be closed, got %v", err)
+	}
+
+	// Wait for the connection and the reaper to stop before reading stats.
+	s.Drain(context.Background())
+	s.Close()
+	if n := s.Stats().Get("connectionsReaped"); n != 1 {
+		t.Fatalf("unexpected connectionsReaped: %d", n)
+	}
+}
+
+func TestServer_SelfMetricInterval(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.SelfMetricInterval = 50 * time.Millisecond
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	points, err := w.WaitPoints(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	for i, p := range points {
+		if p.Name != opentsdb.DefaultSelfMetricMeasurement || p.Fields["value"] != 1.0 {
+			t.Fatalf("unexpected heartbeat: %v", p)
+		}
+		if i > 0 {
+			if d := p.Timestamp.Sub(points[i-1].Timestamp); d < 40*time.Millisecond {
+				t.Fatalf("heartbeats written %s apart, expected %s", d, s.SelfMetricInterval)
+			}
+		}
+	}
+
+	// No heartbeats are written once the server is closed.
+	n := len(w.Points())
+	time.Sleep(3 * s.SelfMetricInterval)
+	if len(w.Points()) != n {
+		t.Fatal("heartbeat written after close")
+	}
+}
+
+func TestServer_CommandStats(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.HandleConnection(server)
+		close(done)
+	}()
+	go io.Copy(ioutil.Discard, client)
+
+	client.Write([]byte("version\nput sys.cpu.user 1356998400 1\nVERSION\nstats\nPUT sys.cpu.user 1356998401 2\nput sys.cpu.user 1356998402 3\nget sys.cpu.user\n"))
+	client.Close()
+	<-done
+
+	stats := s.Stats()
+	for k, exp := range map[string]int64{"commandsPut": 3, "commandsVersion": 2, "commandsStats": 1, "commandsUnknown": 1} {
+		if n := stats.Get(k); n != exp {
+			t.Fatalf("unexpected %s.  expected %d, got %d", k, exp, n)
+		}
+	}
+}
+
+func TestServer_HalfClose(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.BatchSize = 10
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("put sys.cpu.user 1356998400 1\nversion\n"))
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The response is read in full, followed by EOF once the batch is written.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("unexpected read error: %s", err)
+	} else if string(b) != "InfluxDB TSDB proxy" {
+		t.Fatalf("unexpected response: %q", b)
+	} else if points := w.Points(); len(points) != 1 {
+		t.Fatalf("expected batch to be written before EOF, got %d points", len(points))
+	}
+}
+
+func TestServer_Banner(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.Banner = "InfluxDB TSDB ready"
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.HandleConnection(server)
+		close(done)
+	}()
+
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	} else if line != "InfluxDB TSDB ready\n" {
+		t.Fatalf("unexpected banner: %q", line)
+	}
+
+	client.Write([]byte("put sys.cpu.user 1356998400 1 host=a\n"))
+	client.Close()
+	<-done
+
+	if points := w.Points(); len(points) != 1 {
+		t.Fatalf("unexpected number of points.  expected 1, got %d", len(points))
+	}
+}
+
+func TestServer_ConnTags(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.ConnTags = func(conn net.Conn) map[string]string {
+		tc := conn.(*tls.Conn)
+		if err := tc.Handshake(); err != nil {
+			t.Errorf("handshake: %s", err)
+			return nil
+		}
+		return map[string]string{"cn": tc.ConnectionState().PeerCertificates[0].Subject.CommonName}
+	}
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.HandleConnection(tls.Server(server, &tls.Config{
+			Certificates: []tls.Certificate{selfSignedCert(t, "server")},
+			ClientAuth:   tls.RequireAnyClientCert,
+		}))
+		close(done)
+	}()
+
+	conn := tls.Client(client, &tls.Config{
+		Certificates:       []tls.Certificate{selfSignedCert(t, "agent01")},
+		InsecureSkipVerify: true,
+	})
+	conn.Write([]byte("put sys.cpu.user 1356998400 1 host=a\nput sys.cpu.user 1356998401 2 host=a cn=override\n"))
+	conn.Close()
+	<-done
+
+	points := w.Points()
+	if len(points) != 2 {
+		t.Fatalf("unexpected number of points.  expected 2, got %d", len(points))
+	} else if cn := points[0].Tags["cn"]; cn != "agent01" {
+		t.Fatalf("unexpected cn tag.  expected agent01, got %q", cn)
+	} else if cn := points[1].Tags["cn"]; cn != "override" {
+		t.Fatalf("unexpected cn tag for point with the tag.  expected override, got %q", cn)
+	}
+}
+
+func TestServer_RetentionPolicyForMetric(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.RetentionPolicyForMetric = map[string]string{
+		"sys.cpu.user": "short",
+		"sys.*":        "medium",
+		"agg.*":        "long",
+	}
+
+	for _, line := range []string{
+		"put sys.cpu.user 1356998400 1",
+		"put sys.mem.free 1356998400 2",
+		"put agg.requests.p99 1356998400 3",
+		"put app.requests 1356998400 4",
+	} {
+		if err := s.ProcessLine(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var rps []string
+	for _, c := range w.Calls() {
+		rps = append(rps, c.RetentionPolicy)
+	}
+	if exp := []string{"short", "medium", "long", "raw"}; !reflect.DeepEqual(rps, exp) {
+		t.Fatalf("unexpected retention policies.  expected %v, got %v", exp, rps)
+	}
+}
+
+func TestServer_SnapshotAndReset(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	for _, line := range []string{"put sys.cpu.user 1356998400 1", "put sys.cpu.user 1356998401 2", "garbage"} {
+		s.ProcessLine(line)
+	}
+
+	snap := s.SnapshotAndReset()
+	if n := snap.Get("pointsReceived"); n != 2 {
+		t.Fatalf("unexpected pointsReceived in snapshot.  expected 2, got %d", n)
+	} else if n := snap.Get("parseErrors"); n != 1 {
+		t.Fatalf("unexpected parseErrors in snapshot.  expected 1, got %d", n)
+	}
+
+	// The next snapshot holds only the counts since the last, while the
+	// totals are kept.
+	s.ProcessLine("put sys.cpu.user 1356998402 3")
+	if n := s.SnapshotAndReset().Get("pointsReceived"); n != 1 {
+		t.Fatalf("unexpected pointsReceived in second snapshot.  expected 1, got %d", n)
+	} else if n := s.Stats().Get("pointsReceived"); n != 3 {
+		t.Fatalf("unexpected pointsReceived total.  expected 3, got %d", n)
+	}
+}
+
+func TestServer_SanitizeName(t *testing.T) {
+	var tests = []struct {
+		sanitize  bool
+		sanitizer func(string) string
+		exp       string
+	}{
+		{exp: "sys.cpu,user\x01total"},
+		{sanitize: true, exp: "sys.cpu_user_total"},
+		{sanitize: true, sanitizer: func(name string) string {
+			return strings.Map(func(r rune) rune {
+				if r == ',' || r < ' ' {
+					return -1
+				}
+				return r
+			}, name)
+		}, exp: "sys.cpuusertotal"},
+	}
+
+	for i, test := range tests {
+		w := &testWriter{}
+		s := opentsdb.NewServer(w, "raw", "db")
+		s.SanitizeName = test.sanitize
+		s.NameSanitizer = test.sanitizer
+
+		if err := s.ProcessLine("put sys.cpu,user\x01total 1356998400 1"); err != nil {
+			t.Fatal(err)
+		} else if name := w.Points()[0].Name; name != test.exp {
+			t.Fatalf("%d. unexpected name.  expected %q, got %q", i, test.exp, name)
+		}
+	}
+}
+
+func TestImporter_Import(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.BatchSize = 2
+
+	var errs []string
+	var progress []opentsdb.ImportStats
+	im := opentsdb.NewImporter(s)
+	im.OnError = func(err *opentsdb.ImportError) { errs = append(errs, err.Error()) }
+	im.Progress = func(stats opentsdb.ImportStats) { progress = append(progress, stats) }
+	im.ProgressInterval = 2
+
+	stats, err := im.Import(strings.NewReader(`# exported from tsdb01
+put sys.cpu.user 1356998400 1 host=a
+put sys.cpu.user 1356998401 x host=a
+
+put sys.cpu.user 1356998402 3 host=a
+sys.cpu.user 1356998403 4
+put sys.cpu.user 1356998404 5 host=a
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := (opentsdb.ImportStats{Lines: 5, Imported: 3, Failed: 2}); stats != exp {
+		t.Fatalf("unexpected stats.  expected %+v, got %+v", exp, stats)
+	} else if points := w.Points(); len(points) != 3 {
+		t.Fatalf("unexpected number of points.  expected 3, got %d", len(points))
+	}
+	if exp := []string{
+		"line 3: could not parse value as float: x",
+		"line 6: malformed line, skipping: sys.cpu.user 1356998403 4",
+	}; !reflect.DeepEqual(errs, exp) {
+		t.Fatalf("unexpected errors.  expected %q, got %q", exp, errs)
+	}
+	if exp := []opentsdb.ImportStats{{Lines: 2, Imported: 1, Failed: 1}, {Lines: 4, Imported: 2, Failed: 2}}; !reflect.DeepEqual(progress, exp) {
+		t.Fatalf("unexpected progress.  expected %+v, got %+v", exp, progress)
+	}
+}
+
+func TestServer_MaxAbsValue(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.MaxAbsValue = 1e12
+
+	for _, line := range []string{"put sys.cpu.user 1356998400 1e308", "put sys.cpu.user 1356998401 -1e13", "put sys.cpu.user 1356998402 1e12"} {
+		s.ProcessLine(line)
+	}
+	if points := w.Points(); len(points) != 1 || points[0].Fields["value"] != 1e12 {
+		t.Fatalf("expected only the value within the limit to be written, got %v", points)
+	} else if n := s.Stats().Get("pointsValueOverLimit"); n != 2 {
+		t.Fatalf("unexpected pointsValueOverLimit.  expected 2, got %d", n)
+	}
+
+	if err := s.ProcessLine("put sys.cpu.user 1356998400 1e308"); errstr(err) != "value of sys.cpu.user exceeds maximum magnitude 1e+12, skipping" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestServer_Processors(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.Processors = []influxdb.PointProcessor{
+		// Drop debug points.
+		influxdb.PointProcessorFunc(func(p influxdb.Point) ([]influxdb.Point, bool) {
+			return []influxdb.Point{p}, p.Tags["level"] != "debug"
+		}),
+		// Rename points.
+		influxdb.PointProcessorFunc(func(p influxdb.Point) ([]influxdb.Point, bool) {
+			p.Name = strings.Replace(p.Name, ".", "_", -1)
+			return []influxdb.Point{p}, true
+		}),
+		// Split the field of each point into a gauge and a counter.
+		influxdb.PointProcessorFunc(func(p influxdb.Point) ([]influxdb.Point, bool) {
+			gauge, counter := p, p
+			gauge.Name += "_gauge"
+			counter.Name += "_counter"
+			return []influxdb.Point{gauge, counter}, true
+		}),
+	}
+
+	for _, line := range []string{"put sys.cpu.user 1356998400 1 level=debug", "put sys.cpu.user 1356998400 2 host=a"} {
+		if err := s.ProcessLine(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	for _, p := range w.Points() {
+		names = append(names, p.Name)
+	}
+	if exp := []string{"sys_cpu_user_gauge", "sys_cpu_user_counter"}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("unexpected points.  expected %v, got %v", exp, names)
+	} else if n := s.Stats().Get("pointsDroppedByProcessor"); n != 1 {
+		t.Fatalf("unexpected pointsDroppedByProcessor: %d", n)
+	}
+}
+
+func TestServer_RecentLines(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	s.CaptureRecentLines = 3
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The version reply shows the preceding lines have been read.
+	lines := []string{
+		"put sys.cpu.user 1356998400 1 host=a",
+		"garbage",
+		"put sys.cpu.user 1356998401 2 host=a",
+		"version",
+	}
+	for _, line := range lines {
+		conn.Write([]byte(line + "\n"))
+	}
+	if _, err := conn.Read(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := lines[1:], s.RecentLines(conn.LocalAddr().String()); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("unexpected recent lines.  expected %q, got %q", exp, got)
+	}
+	if got := s.RecentLines("127.0.0.1:1"); got != nil {
+		t.Fatalf("unexpected recent lines for unknown address: %q", got)
+	}
+}
+
+func TestServer_ListenAndServeAll(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	if err := s.ListenAndServeAll([]string{"127.0.0.1:0", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	addrs := s.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("unexpected number of listeners.  expected 2, got %d", len(addrs))
+	}
+
+	for _, addr := range addrs {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("put sys.cpu.user 1356998400 42.5 host=" + addr.String() + "\n"))
+		conn.Close()
+	}
+
+	points, err := w.WaitPoints(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := map[string]bool{points[0].Tags["host"]: true, points[1].Tags["host"]: true}
+	for _, addr := range addrs {
+		if !hosts[addr.String()] {
+			t.Fatalf("no point received via %s", addr)
+		}
+	}
+}
+
+func TestServer_Connections(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// Send lines and wait for the server to read them.
+		for j := 0; j <= i; j++ {
+			conn.Write([]byte("put sys.cpu.user 1356998400 1 host=a\n"))
+		}
+		conn.Write([]byte("version\n"))
+		conn.Read(make([]byte, 64))
+		conns = append(conns, conn)
+	}
+
+	infos := s.Connections()
+	if len(infos) != 2 {
+		t.Fatalf("unexpected number of connections.  expected 2, got %d", len(infos))
+	}
+	for i, info := range infos {
+		if info.RemoteAddr != conns[i].LocalAddr().String() {
+			t.Fatalf("%d. unexpected remote address.  expected %s, got %s", i, conns[i].LocalAddr(), info.RemoteAddr)
+		} else if info.LinesReceived != uint64(i+2) {
+			t.Fatalf("%d. unexpected lines received.  expected %d, got %d", i, i+2, info.LinesReceived)
+		} else if info.LastActivity.Before(info.ConnectedAt) {
+			t.Fatalf("%d. last activity %s before connect time %s", i, info.LastActivity, info.ConnectedAt)
+		}
+	}
+
+	// Ensure connections are removed once closed.
+	conns[0].Close()
+	timeout := time.After(time.Second)
+	for len(s.Connections()) != 1 {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for connection to be removed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestServer_Serve(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	done := make(chan error)
+	go func() { done <- s.Serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("put sys.cpu.user 1356998400 42.5 host=a\n"))
+	conn.Close()
+
+	if _, err := w.WaitPoints(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error from Serve: %s", err)
+	}
+}
+
+func TestServer_Addr(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	if addr := s.Addr(); addr != nil {
+		t.Fatalf("expected nil address before listening, got %v", addr)
+	}
+
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	addr, ok := s.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("unexpected address: %v", s.Addr())
+	}
+}
+
+func TestServer_ListenAndServe_ErrBindAddressRequired(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	if err := s.ListenAndServe(""); err != opentsdb.ErrBindAddressRequired {
+		t.Fatalf("unexpected error.  expected %v, got %v", opentsdb.ErrBindAddressRequired, err)
+	}
+}
+
+func TestServer_HandleConnection_StreamCompression(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("compress gzip\n")
+	gz := gzip.NewWriter(&buf)
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(gz, "put sys.cpu.user %d %d host=a\n", 1356998400+i, i)
+	}
+	gz.Close()
+
+	for _, allow := range []bool{false, true} {
+		w := &testWriter{}
+		s := opentsdb.NewServer(w, "raw", "db")
+		s.AllowStreamCompression = allow
+		handleData(s, buf.Bytes())
+
+		exp := 0
+		if allow {
+			exp = 100
+		}
+		if n := len(w.Points()); n != exp {
+			t.Fatalf("unexpected number of points with compression allowed=%v.  expected %d, got %d", allow, exp, n)
+		}
+	}
+}
+
+// Ensure servers opened in the same process can publish under one name.
+func TestServer_Publish(t *testing.T) {
+	var servers []*opentsdb.Server
+	for i := 0; i < 2; i++ {
+		s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+		s.Publish("opentsdb_publish_test")
+		if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		servers = append(servers, s)
+	}
+
+	if err := servers[1].ProcessLine("put sys.cpu.user 1356998400 1 host=a"); err != nil {
+		t.Fatal(err)
+	}
+	if v := expvar.Get("opentsdb_publish_test"); v == nil {
+		t.Fatal("expected stats to be published")
+	} else if str := v.String(); !strings.Contains(str, `"pointsReceived":1`) {
+		t.Fatalf("expected the most recently published server's stats, got %s", str)
+	} else if !strings.Contains(str, `"measurements":{"sys.cpu.user":1}`) {
+		t.Fatalf("expected the measurement counts to be published, got %s", str)
+	}
+}
+
+func TestServer_HandleConnection_ConnectionStats(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+
+	var clients []net.Conn
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			s.HandleConnection(server)
+			done <- struct{}{}
+		}()
+
+		// Wait for the connection to be served.
+		client.Write([]byte("version\n"))
+		client.Read(make([]byte, 64))
+		clients = append(clients, client)
+	}
+
+	if n := s.Stats().Get("activeConnections"); n != 2 {
+		t.Fatalf("unexpected activeConnections.  expected 2, got %d", n)
+	} else if n := s.Stats().Get("bytesRead"); n != 16 {
+		t.Fatalf("unexpected bytesRead.  expected 16, got %d", n)
+	}
+
+	for _, client := range clients {
+		client.Close()
+		<-done
+	}
+	if n := s.Stats().Get("activeConnections"); n != 0 {
+		t.Fatalf("unexpected activeConnections after close.  expected 0, got %d", n)
+	}
+}
+
+func TestHandler_WebSocket(t *testing.T) {
+	w := &testWriter{}
+	ts := httptest.NewServer(opentsdb.NewHandler(opentsdb.NewServer(w, "raw", "db"), "0.9.0"))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	} else if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected accept key: %s", accept)
+	}
+
+	// Send two lines in one message and a third split across two frames.
+	conn.Write(wsFrame(true, 0x1, "put sys.cpu.user 1356998400 1 host=a\nput sys.cpu.user 1356998401 2 host=a"))
+	conn.Write(wsFrame(false, 0x1, "put sys.cpu.user "))
+	conn.Write(wsFrame(true, 0x0, "1356998402 3 host=a"))
+
+	// Ensure pings are answered.
+	conn.Write(wsFrame(true, 0x9, "ping"))
+	if b := readN(t, br, 6); string(b) != "\x8a\x04ping" {
+		t.Fatalf("unexpected pong: %q", b)
+	}
+
+	points, err := w.WaitPoints(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range points {
+		if v := p.Fields["value"]; v != float64(i+1) {
+			t.Fatalf("%d. unexpected value: %v", i, v)
+		}
+	}
+
+	// Ensure the closing handshake is completed.
+	conn.Write(wsFrame(true, 0x8, "\x03\xe8"))
+	if b := readN(t, br, 4); string(b) != "\x88\x02\x03\xe8" {
+		t.Fatalf("unexpected close frame: %q", b)
+	}
+}
+
+// Ensure unmasked client frames are rejected with a protocol error.
+func TestHandler_WebSocket_Unmasked(t *testing.T) {
+	w := &testWriter{}
+	ts := httptest.NewServer(opentsdb.NewHandler(opentsdb.NewServer(w, "raw", "db"), "0.9.0"))
+	defer ts.Close()
+
+	conn, br := dialWebSocket(t, ts.Listener.Addr().String())
+	defer conn.Close()
+
+	payload := "put sys.cpu.user 1356998400 1 host=a"
+	conn.Write(append([]byte{0x81, byte(len(payload))}, payload...))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if b := readN(t, br, 4); string(b) != "\x88\x02\x03\xea" {
+		t.Fatalf("unexpected close frame: %q", b)
+	} else if points := w.Points(); len(points) != 0 {
+		t.Fatalf("unexpected points: %v", points)
+	}
+}
+
+// Ensure closing the server closes its WebSocket connections and waits for
+// them, as it does for its other connections.
+func TestHandler_WebSocket_ServerClose(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	ts := httptest.NewServer(opentsdb.NewHandler(s, "0.9.0"))
+	defer ts.Close()
+
+	conn, br := dialWebSocket(t, ts.Listener.Addr().String())
+	defer conn.Close()
+	conn.Write(wsFrame(true, 0x1, "put sys.cpu.user 1356998400 1 host=a"))
+	if _, err := w.WaitPoints(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	} else if n := s.Stats().Get("activeConnections"); n != 0 {
+		t.Fatalf("unexpected activeConnections after close.  expected 0, got %d", n)
+	}
+
+	// The connection was closed by the server, so the client reads EOF
+	// rather than blocking.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected EOF after close, got %v", err)
+	}
+}
+
+func TestServer_HandleConnection_BatchTimeout(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.BatchSize = 10
+	s.BatchTimeout = 50 * time.Millisecond
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.HandleConnection(server)
+
+	// Send a single point then leave the connection idle.
+	client.Write([]byte("put sys.cpu.user 1356998400 1 host=a\nversion\n"))
+	client.Read(make([]byte, 64))
+	if n := len(w.Points()); n != 0 {
+		t.Fatalf("point written before batch timeout.  expected 0, got %d", n)
+	}
+
+	if _, err := w.WaitPoints(1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_HandleConnection_MaxBatchBytes(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.BatchSize = 100
+	s.MaxBatchBytes = 1000
+
+	// Each point is estimated at about 290 bytes.
+	var lines []string
+	for i := 0; i < 10; i++ {
+		lines = append(lines, fmt.Sprintf("put sys.cpu.user %d 1 host=%s", 1356998400+i, strings.Repeat("x", 250)))
+	}
+	handleLines(s, lines...)
+
+	calls := w.Calls()
+	if len(calls) != 3 {
+		t.Fatalf("unexpected number of writes.  expected 3, got %d", len(calls))
+	}
+	for i, n := range []int{4, 4, 2} {
+		if len(calls[i].Points) != n {
+			t.Fatalf("%d. unexpected batch size.  expected %d, got %d", i, n, len(calls[i].Points))
+		}
+	}
+}
+
+func TestServer_HandleConnection_MaxPendingPerConn(t *testing.T) {
+	var mu sync.Mutex
+	var n int
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	w := writerFunc(func(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+		select {
+		case entered <- struct{}{}:
+		default:
+		}
+		<-release
+		mu.Lock()
+		n += len(points)
+		mu.Unlock()
+		return 0, nil
+	})
+
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.BatchSize = 100
+	s.BatchTimeout = 5 * time.Millisecond
+	s.MaxPendingPerConn = 1
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.HandleConnection(server)
+		close(done)
+	}()
+
+	// The first point is being written when the second line is read, so
+	// reading pauses before the third line.
+	client.Write([]byte("put sys.cpu.user 1356998400 1 host=a\n"))
+	<-entered
+	client.Write([]byte("put sys.cpu.user 1356998401 2 host=a\n"))
+
+	written := make(chan struct{})
+	go func() {
+		client.Write([]byte("put sys.cpu.user 1356998402 3 host=a\n"))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("expected reads to pause while the write is pending")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Reading resumes once the write completes.
+	close(release)
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("expected reads to resume once the write completed")
+	}
+	client.Close()
+	<-done
+
+	// A timed out batch may still be being written once the connection is done.
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		written := n
+		mu.Unlock()
+		if written == 3 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("unexpected number of points written.  expected 3, got %d", written)
+		}
+	}
+	if v := s.Stats().Get("connectionReadsPaused"); v != 1 {
+		t.Fatalf("unexpected connectionReadsPaused.  expected 1, got %d", v)
+	}
+}
+
+func TestServer_HandleConnection_NewFramer(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.NewFramer = func(r io.Reader) opentsdb.Framer { return &lengthFramer{r: r} }
+
+	handleData(s, lengthPrefixed("put sys.cpu.user 1356998400 1 host=a", "put sys.cpu.user 1356998401 2 host=a"))
+
+	points := w.Points()
+	if len(points) != 2 {
+		t.Fatalf("unexpected number of points.  expected 2, got %d", len(points))
+	} else if points[0].Fields["value"] != 1.0 || points[1].Fields["value"] != 2.0 {
+		t.Fatalf("unexpected points: %v", points)
+	}
+}
+
+func TestServer_SpillPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opentsdb-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var attempts int
+	fail := true
+	w := &testWriter{}
+	s := opentsdb.NewServer(writerFunc(func(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if fail {
+			return 0, errors.New("database unavailable")
+		}
+		return w.WriteSeries(database, retentionPolicy, points)
+	}), "raw", "db")
+	s.WriteRetries = 2
+	s.WriteRetryInterval = time.Millisecond
+	s.SpillPath = dir + "/spill"
+
+	// Each write is attempted three times, then spilled.
+	handleLines(s, "put sys.cpu.user 1356998400 1 host=a", "put sys.cpu.user 1356998401 2 host=b")
+	if attempts != 6 {
+		t.Fatalf("unexpected number of write attempts.  expected 6, got %d", attempts)
+	} else if n := s.Stats().Get("pointsSpilled"); n != 2 {
+		t.Fatalf("unexpected pointsSpilled.  expected 2, got %d", n)
+	}
+
+	// Replaying after the writer recovers writes the spilled points and removes the file.
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	if n, err := s.ReplaySpill(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("unexpected number of replayed points.  expected 2, got %d", n)
+	}
+
+	points := w.Points()
+	if len(points) != 2 {
+		t.Fatalf("unexpected number of points.  expected 2, got %d", len(points))
+	}
+	for i, exp := range []influxdb.Point{
+		{Name: "sys.cpu.user", Tags: map[string]string{"host": "a"}, Timestamp: time.Unix(1356998400, 0), Fields: map[string]interface{}{"value": 1.0}},
+		{Name: "sys.cpu.user", Tags: map[string]string{"host": "b"}, Timestamp: time.Unix(1356998401, 0), Fields: map[string]interface{}{"value": 2.0}},
+	} {
+		p := points[i]
+		if p.Name != exp.Name || !reflect.DeepEqual(p.Tags, exp.Tags) || !reflect.DeepEqual(p.Fields, exp.Fields) || !p.Timestamp.Equal(exp.Timestamp) {
+			t.Fatalf("%d. unexpected point.  expected %v, got %v", i, exp, p)
+		}
+	}
+	if _, err := os.Stat(s.SpillPath); !os.IsNotExist(err) {
+		t.Fatalf("expected spill file to be removed, got %v", err)
+	}
+}
+
+func TestServer_WALPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opentsdb-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/wal"
+
+	var blocking int32
+	entered, release := make(chan struct{}), make(chan struct{})
+	s := opentsdb.NewServer(writerFunc(func(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+		if atomic.LoadInt32(&blocking) != 0 {
+			entered <- struct{}{}
+			<-release
+		}
+		return 0, nil
+	}), "raw", "db")
+	s.WALPath = path
+
+	// Once a write returns and none are pending the log is emptied.
+	s.ProcessLine("put sys.cpu.user 1356998400 1 host=a")
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != 0 {
+		t.Fatalf("unexpected log size.  expected 0, got %d", fi.Size())
+	}
+
+	// Writes in flight, as when the process exits, stay pending.
+	atomic.StoreInt32(&blocking, 1)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(release)
+	processInFlight(s, entered, &wg, "put sys.cpu.user 1356998401 2 host=a", "put sys.cpu.user 1356998402 3 host=b")
+
+	// A new server replays the pending writes.
+	w := &testWriter{}
+	other := opentsdb.NewServer(w, "raw", "db")
+	other.WALPath = path
+	if n, err := other.ReplayWAL(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("unexpected number of replayed points.  expected 2, got %d", n)
+	}
+	points := w.Points()
+	if len(points) != 2 {
+		t.Fatalf("unexpected number of points.  expected 2, got %d", len(points))
+	} else if points[0].Fields["value"] != 2.0 || points[1].Tags["host"] != "b" || !points[1].Timestamp.Equal(time.Unix(1356998402, 0)) {
+		t.Fatalf("unexpected points: %v", points)
+	} else if c := w.Calls()[0]; c.Database != "db" || c.RetentionPolicy != "raw" {
+		t.Fatalf("unexpected destination: %s.%s", c.Database, c.RetentionPolicy)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected log to be removed, got %v", err)
+	}
+}
+
+// Ensure a failed write is handed to the spill file rather than kept in the
+// log, so that it is not replayed twice.
+func TestServer_WALPath_Failed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opentsdb-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := opentsdb.NewServer(&errWriter{err: errors.New("database unavailable")}, "raw", "db")
+	s.WALPath = dir + "/wal"
+	s.SpillPath = dir + "/spill"
+	s.ProcessLine("put sys.cpu.user 1356998400 1 host=a")
+	s.ProcessLine("put sys.cpu.user 1356998401 2 host=a")
+
+	if fi, err := os.Stat(s.WALPath); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != 0 {
+		t.Fatalf("unexpected log size.  expected 0, got %d", fi.Size())
+	} else if n := s.Stats().Get("pointsSpilled"); n != 2 {
+		t.Fatalf("unexpected pointsSpilled.  expected 2, got %d", n)
+	}
+
+	w := &testWriter{}
+	other := opentsdb.NewServer(w, "raw", "db")
+	other.WALPath = s.WALPath
+	if n, err := other.ReplayWAL(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 || len(w.Points()) != 0 {
+		t.Fatalf("unexpected replay of failed writes: %d points", n)
+	}
+}
+
+// Ensure a write whose replay fails is not kept in the log.
+func TestServer_WALPath_ReplayFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opentsdb-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/wal"
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	s := opentsdb.NewServer(writerFunc(func(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+		entered <- struct{}{}
+		<-release
+		return 0, nil
+	}), "raw", "db")
+	s.WALPath = path
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(release)
+	processInFlight(s, entered, &wg, "put sys.cpu.user 1356998400 1 host=a", "put sys.cpu.user 1356998401 2 host=a")
+
+	other := opentsdb.NewServer(&errWriter{err: errors.New("database unavailable")}, "raw", "db")
+	other.WALPath = path
+	if n, err := other.ReplayWAL(); err == nil || err.Error() != "database unavailable" {
+		t.Fatalf("unexpected error: %v", err)
+	} else if n != 0 {
+		t.Fatalf("unexpected number of replayed points.  expected 0, got %d", n)
+	} else if n := other.Stats().Get("walReplayFailed"); n != 2 {
+		t.Fatalf("unexpected walReplayFailed.  expected 2, got %d", n)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected log to be removed, got %v", err)
+	}
+}
+
+func TestServer_WALPath_Truncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opentsdb-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/wal"
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	s := opentsdb.NewServer(writerFunc(func(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+		entered <- struct{}{}
+		<-release
+		return 0, nil
+	}), "raw", "db")
+	s.WALPath = path
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(release)
+	processInFlight(s, entered, &wg, "put sys.cpu.user 1356998400 1 host=a", "put sys.cpu.user 1356998401 2 host=a")
+
+	// Cut the last record short, as if the process exited while writing it.
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := os.Truncate(path, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &testWriter{}
+	other := opentsdb.NewServer(w, "raw", "db")
+	other.WALPath = path
+	if n, err := other.ReplayWAL(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("unexpected number of replayed points.  expected 1, got %d", n)
+	} else if n := other.Stats().Get("walCorruptRecords"); n != 1 {
+		t.Fatalf("unexpected walCorruptRecords.  expected 1, got %d", n)
+	}
+	if points := w.Points(); len(points) != 1 || points[0].Fields["value"] != 1.0 {
+		t.Fatalf("unexpected points: %v", points)
+	}
+}
+
+func TestServer_MaxWALBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opentsdb-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/wal"
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	s := opentsdb.NewServer(writerFunc(func(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+		entered <- struct{}{}
+		<-release
+		return 0, nil
+	}), "raw", "db")
+	s.WALPath = path
+	s.MaxWALBytes = 100
+	s.WALSyncPolicy = opentsdb.SyncWALNever
+	var wg sync.WaitGroup
+	processInFlight(s, entered, &wg, "put sys.cpu.user 1356998400 1 host=a", "put sys.cpu.user 1356998401 2 host=a")
+	close(release)
+	wg.Wait()
+
+	if n := s.Stats().Get("walAppendFailed"); n != 1 {
+		t.Fatalf("unexpected walAppendFailed.  expected 1, got %d", n)
+	} else if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() > 100 {
+		t.Fatalf("log grew beyond MaxWALBytes: %d", fi.Size())
+	}
+}
+
+// Ensure writes stay logged under sustained concurrent load, when some write
+// is always pending, as the log is compacted to the pending writes.
+func TestServer_MaxWALBytes_Compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opentsdb-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/wal"
+
+	// The first write stays in flight throughout, so the log is never empty.
+	var blocking int32 = 1
+	entered, release := make(chan struct{}), make(chan struct{})
+	s := opentsdb.NewServer(writerFunc(func(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+		if atomic.CompareAndSwapInt32(&blocking, 1, 0) {
+			entered <- struct{}{}
+			<-release
+		}
+		return 0, nil
+	}), "raw", "db")
+	s.WALPath = path
+	s.MaxWALBytes = 4096
+	s.WALSyncPolicy = opentsdb.SyncWALNever
+	var inFlight sync.WaitGroup
+	defer inFlight.Wait()
+	defer close(release)
+	processInFlight(s, entered, &inFlight, "put sys.cpu.user 1356998400 1 host=a")
+
+	// Many times the maximum size of the log is written concurrently.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				s.ProcessLine(fmt.Sprintf("put sys.cpu.user %d %d host=b%d", 1356998401+j, j, i))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := s.Stats().Get("walAppendFailed"); n != 0 {
+		t.Fatalf("unexpected walAppendFailed.  expected 0, got %d", n)
+	} else if n := s.Stats().Get("walCompactions"); n == 0 {
+		t.Fatal("expected the log to be compacted")
+	} else if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() > 4096 {
+		t.Fatalf("log grew beyond MaxWALBytes: %d", fi.Size())
+	}
+
+	// The compacted log still holds the write in flight.
+	w := &testWriter{}
+	other := opentsdb.NewServer(w, "raw", "db")
+	other.WALPath = path
+	if n, err := other.ReplayWAL(); err != nil {
+		t.Fatal(err)
+	} else if points := w.Points(); n != 1 || points[0].Tags["host"] != "a" {
+		t.Fatalf("unexpected replayed points: %v", points)
+	}
+}
+
+// Ensure the log cannot be replayed while the server may have writes in flight.
+func TestServer_ReplayWAL_Serving(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opentsdb-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	s.WALPath = dir + "/wal"
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.ReplayWAL(); err != opentsdb.ErrServing {
+		t.Fatalf("unexpected error.  expected %v, got %v", opentsdb.ErrServing, err)
+	}
+}
+
+// processInFlight processes each line in the background, waiting for its
+// write to be entered, so that the writes are in flight when it returns.
+func processInFlight(s *opentsdb.Server, entered <-chan struct{}, wg *sync.WaitGroup, lines ...string) {
+	for _, line := range lines {
+		wg.Add(1)
+		go func(line string) {
+			defer wg.Done()
+			s.ProcessLine(line)
+		}(line)
+		<-entered
+	}
+}
+
+func TestServer_SharedBatching(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.BatchSize = 100
+	s.SharedBatching = true
+
+	// Each connection sends fewer points than a batch, with increasing timestamps.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var lines []string
+			for j := 0; j < 20; j++ {
+				lines = append(lines, fmt.Sprintf("put sys.cpu.user %d %d host=server%d", 1356998400+j, j, i))
+			}
+			handleLines(s, lines...)
+		}(i)
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := w.Calls(); len(calls) != 2 {
+		t.Fatalf("unexpected number of writes.  expected 2, got %d", len(calls))
+	}
+	if n := s.Stats().Get("batchPointsWritten"); n != 200 {
+		t.Fatalf("unexpected batchPointsWritten.  expected 200, got %d", n)
+	}
+
+	// Ensure no points were lost and each series is in timestamp order.
+	last := make(map[string]time.Time)
+	points := w.Points()
+	if len(points) != 200 {
+		t.Fatalf("unexpected number of points.  expected 200, got %d", len(points))
+	}
+	for _, p := range points {
+		host := p.Tags["host"]
+		if !p.Timestamp.After(last[host]) {
+			t.Fatalf("series %s out of order at %s", host, p.Timestamp)
+		}
+		last[host] = p.Timestamp
+	}
+}
+
+func TestServer_CircuitBreaker(t *testing.T) {
+	var (
+		s          *opentsdb.Server
+		fail       = true
+		calls      int
+		writeState int64
+	)
+	s = opentsdb.NewServer(writerFunc(func(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+		calls++
+		writeState = s.Stats().Get("breakerState")
+		if fail {
+			return 0, errors.New("database unavailable")
+		}
+		return 0, nil
+	}), "raw", "db")
+	s.BreakerThreshold = 2
+	s.BreakerCooldown = 50 * time.Millisecond
+
+	put := func() error { return s.ProcessLine("put sys.cpu.user 1356998400 1 host=a") }
+	check := func(step string, expCalls int, state, trips, dropped int64) {
+		if calls != expCalls {
+			t.Fatalf("%s: unexpected number of writes.  expected %d, got %d", step, expCalls, calls)
+		} else if n := s.Stats().Get("breakerState"); n != state {
+			t.Fatalf("%s: unexpected breakerState.  expected %d, got %d", step, state, n)
+		} else if n := s.Stats().Get("breakerTrips"); n != trips {
+			t.Fatalf("%s: unexpected breakerTrips.  expected %d, got %d", step, trips, n)
+		} else if n := s.Stats().Get("pointsDroppedBreakerOpen"); n != dropped {
+			t.Fatalf("%s: unexpected pointsDroppedBreakerOpen.  expected %d, got %d", step, dropped, n)
+		}
+	}
+
+	// Consecutive failures open the breaker, after which points are dropped.
+	put()
+	put()
+	check("open", 2, 1, 1, 0)
+	if err := put(); err != nil {
+		t.Fatal(err)
+	}
+	check("dropped", 2, 1, 1, 1)
+
+	// After the cooldown a single half-open write is tried, and its failure reopens the breaker.
+	time.Sleep(60 * time.Millisecond)
+	put()
+	check("reopen", 3, 1, 2, 1)
+	if writeState != 2 {
+		t.Fatalf("unexpected breakerState during probe.  expected 2, got %d", writeState)
+	}
+
+	// A successful half-open write closes the breaker.
+	time.Sleep(60 * time.Millisecond)
+	fail = false
+	if err := put(); err != nil {
+		t.Fatal(err)
+	}
+	check("closed", 4, 0, 2, 1)
+	if writeState != 2 {
+		t.Fatalf("unexpected breakerState during probe.  expected 2, got %d", writeState)
+	}
+	put()
+	check("closed", 5, 0, 2, 1)
+}
+
+func TestServer_HandleConnection_AutoDetectCompression(t *testing.T) {
+	lines := "put sys.cpu.user 1356998400 1 host=a\nput sys.cpu.user 1356998401 2 host=a\n"
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(lines))
+	gz.Close()
+
+	for i, data := range [][]byte{compressed.Bytes(), []byte(lines)} {
+		w := &testWriter{}
+		s := opentsdb.NewServer(w, "raw", "db")
+		s.AutoDetectCompression = true
+		handleData(s, data)
+
+		if points := w.Points(); len(points) != 2 {
+			t.Fatalf("%d. unexpected number of points.  expected 2, got %d", i, len(points))
+		} else if v := points[1].Fields["value"]; v != float64(2) {
+			t.Fatalf("%d. unexpected value.  expected 2, got %v", i, v)
+		}
+	}
+}
+
+// Ensure concurrent calls to Close close the server once.
+func TestServer_Close_Concurrent(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- s.Close() }()
+	}
+	var closed int
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err == nil {
+			closed++
+		} else if err != opentsdb.ErrServerClosed {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if closed != 1 {
+		t.Fatalf("expected one Close to succeed, got %d", closed)
+	}
+}
+
+// Ensure Close closes active connections and writes their buffered points
+// before returning.
+func TestServer_Close_Connections(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.BatchSize = 10
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The version reply shows the preceding line has been buffered.
+	conn.Write([]byte("put sys.cpu.user 1356998400 1 host=a\nversion\n"))
+	if _, err := conn.Read(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	} else if n := len(w.Points()); n != 1 {
+		t.Fatalf("unexpected points written by Close.  expected 1, got %d", n)
+	} else if n := len(s.Connections()); n != 0 {
+		t.Fatalf("unexpected open connections after Close: %d", n)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 64)); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+}
+
+func TestServer_Drain(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.BatchSize = 10
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The version reply shows the preceding lines have been buffered.
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(conn, "put sys.cpu.user %d %d host=a\n", 1356998400+i, i)
+	}
+	conn.Write([]byte("version\n"))
+	if _, err := conn.Read(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(w.Points()); n != 0 {
+		t.Fatalf("points written before batch was full.  expected 0, got %d", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(w.Points()); n != 3 {
+		t.Fatalf("unexpected number of points after drain.  expected 3, got %d", n)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileTailer_Tail(t *testing.T) {
+	f, err := ioutil.TempFile("", "opentsdb-tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// The tailer starts in the middle of the first line, so it is skipped.
+	f.WriteString("put skipped 1356998400 1\nput sys.cpu.user 1356998400 2 host=a\n")
+
+	w := &testWriter{}
+	tailer := opentsdb.NewFileTailer(f.Name(), 3, opentsdb.NewServer(w, "raw", "db"))
+	tailer.PollInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- tailer.Tail(ctx) }()
+
+	if _, err := w.WaitPoints(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lines are only processed once they are complete.
+	f.WriteString("put sys.mem.free 1356998400 ")
+	time.Sleep(50 * time.Millisecond)
+	if n := len(w.Points()); n != 1 {
+		t.Fatalf("partial line was processed.  expected 1 point, got %d", n)
+	}
+	f.WriteString("3 host=a\n")
+
+	points, err := w.WaitPoints(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if points[0].Name != "sys.cpu.user" || points[1].Name != "sys.mem.free" {
+		t.Fatalf("unexpected points: %v", points)
+	}
+	if fi, _ := f.Stat(); tailer.Offset() != fi.Size() {
+		t.Fatalf("unexpected offset.  expected %d, got %d", fi.Size(), tailer.Offset())
+	}
+}
+
+func TestServer_SampleRate(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.SampleRate = 0.25
+
+	// Send each series twice so per-series consistency can be checked.
+	var lines []string
+	for i := 0; i < 2000; i++ {
+		lines = append(lines, fmt.Sprintf("put sys.cpu.user 1356998400 %d host=server%d", i, i%1000))
+	}
+	handleLines(s, lines...)
+
+	counts := make(map[string]int)
+	for _, p := range w.Points() {
+		counts[p.Tags["host"]]++
+	}
+	if len(counts) < 200 || len(counts) > 300 {
+		t.Fatalf("unexpected number of sampled series.  expected ~250, got %d", len(counts))
+	}
+	for host, n := range counts {
+		if n != 2 {
+			t.Fatalf("series %s was not consistently sampled.  expected 2 points, got %d", host, n)
+		}
+	}
+	if n := s.Stats().Get("pointsSampledOut"); n != int64(2000-2*len(counts)) {
+		t.Fatalf("unexpected pointsSampledOut count.  expected %d, got %d", 2000-2*len(counts), n)
+	}
+}
+
+func TestServer_MetricSampleRates(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	s.SampleRate = 0.5
+	s.MetricSampleRates = map[string]float64{"sys.cpu.user": 0.1, "sys.mem.free": 1}
+
+	var lines []string
+	for i := 0; i < 1000; i++ {
+		lines = append(lines,
+			fmt.Sprintf("put sys.cpu.user 1356998400 %d host=server%d", i, i),
+			fmt.Sprintf("put sys.mem.free 1356998400 %d host=server%d", i, i),
+			fmt.Sprintf("put sys.load 1356998400 %d host=server%d", i, i),
+		)
+	}
+	handleLines(s, lines...)
+
+	counts := make(map[string]int)
+	for _, p := range w.Points() {
+		counts[p.Name]++
+	}
+	for _, tt := range []struct {
+		name     string
+		min, max int
+	}{
+		{"sys.cpu.user", 50, 150},
+		{"sys.mem.free", 1000, 1000},
+		{"sys.load", 400, 600},
+	} {
+		if n := counts[tt.name]; n < tt.min || n > tt.max {
+			t.Fatalf("unexpected number of %s points.  expected %d-%d, got %d", tt.name, tt.min, tt.max, n)
+		}
+	}
+}
+
+func TestHandler_Version(t *testing.T) {
+	h := opentsdb.NewHandler(opentsdb.NewServer(&testWriter{}, "raw", "db"), "0.9.0")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/version", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if body := strings.TrimSpace(w.Body.String()); body != `{"version":"0.9.0"}` {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+func TestHandler_Put_MaxBodyBytes(t *testing.T) {
+	w := &testWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	h := opentsdb.NewHandler(s, "0.9.0")
+	h.MaxBodyBytes = 100
+
+	body := `{"metric":"sys.cpu.user","timestamp":1356998400,"value":1}`
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/put", strings.NewReader(body)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status.  expected %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+
+	body = "[" + strings.Repeat(body+",", 3) + body + "]"
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/put", strings.NewReader(body)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("unexpected status.  expected %d, got %d: %s", http.StatusRequestEntityTooLarge, rec.Code, rec.Body.String())
+	} else if points := w.Points(); len(points) != 1 {
+		t.Fatalf("expected no points from the large request, got %d", len(points)-1)
+	} else if n := s.Stats().Get("httpRequestsTooLarge"); n != 1 {
+		t.Fatalf("unexpected httpRequestsTooLarge: %d", n)
+	}
+}
+
+func TestHandler_Put_MaxConcurrentHTTPRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s := opentsdb.NewServer(writerFunc(func(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+		close(started)
+		<-release
+		return 0, nil
+	}), "raw", "db")
+	h := opentsdb.NewHandler(s, "0.9.0")
+	h.MaxConcurrentHTTPRequests = 1
+
+	body := `{"metric":"sys.cpu.user","timestamp":1356998400,"value":1}`
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/put", strings.NewReader(body)))
+		done <- rec.Code
+	}()
+	<-started
+
+	// A second request while the first is writing is rejected.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/put", strings.NewReader(body)))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status.  expected %d, got %d: %s", http.StatusTooManyRequests, rec.Code, rec.Body.String())
+	} else if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After header")
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusNoContent {
+		t.Fatalf("unexpected status of first request.  expected %d, got %d", http.StatusNoContent, code)
+	}
+}
+
+func TestHandler_Suggest(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	handleLines(s,
+		"put sys.cpu.user 1356998400 1 host=a",
+		"put sys.cpu.system 1356998400 1 host=a",
+		"put sys.mem.free 1356998400 1 host=a",
+		"put app.requests 1356998400 1 host=a",
+	)
+	h := opentsdb.NewHandler(s, "0.9.0")
+
+	var tests = []struct {
+		url  string
+		code int
+		body string
+	}{
+		{url: "/api/suggest?type=metrics&q=sys.cpu", code: http.StatusOK, body: `["sys.cpu.system","sys.cpu.user"]`},
+		{url: "/api/suggest?type=metrics&q=sys&max=2", code: http.StatusOK, body: `["sys.cpu.system","sys.cpu.user"]`},
+		{url: "/api/suggest?type=metrics", code: http.StatusOK, body: `["app.requests","sys.cpu.system","sys.cpu.user","sys.mem.free"]`},
+		{url: "/api/suggest?type=metrics&q=disk", code: http.StatusOK, body: `[]`},
+		{url: "/api/suggest?type=tagk&q=h", code: http.StatusOK, body: `[]`},
+		{url: "/api/suggest?type=bad", code: http.StatusBadRequest},
+		{url: "/api/suggest?type=metrics&max=x", code: http.StatusBadRequest},
+	}
+
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.code {
+			t.Fatalf("%d. unexpected status.  expected %d, got %d", i, test.code, w.Code)
+		} else if body := strings.TrimSpace(w.Body.String()); test.body != "" && body != test.body {
+			t.Fatalf("%d. unexpected body.  expected %s, got %s", i, test.body, body)
+		}
+	}
+}
+
+func TestHandler_Suggest_Suggester(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	s.Suggester = opentsdb.NewSuggester(opentsdb.DefaultMaxSuggestNames)
+	handleLines(s,
+		"put sys.cpu.user 1356998400 1 host=web01 dc=us-east",
+		"put sys.cpu.system 1356998400 1 host=web02",
+		"put sys.mem.free 1356998400 1 host=db01 disk=sda",
+	)
+	h := opentsdb.NewHandler(s, "0.9.0")
+
+	var tests = []struct {
+		url  string
+		body string
+	}{
+		{url: "/api/suggest?type=metrics&q=sys.c", body: `["sys.cpu.system","sys.cpu.user"]`},
+		{url: "/api/suggest?type=metrics&q=sys&max=1", body: `["sys.cpu.system"]`},
+		{url: "/api/suggest?type=metrics&q=disk", body: `[]`},
+		{url: "/api/suggest?type=tagk&q=d", body: `["dc","disk"]`},
+		{url: "/api/suggest?type=tagk", body: `["dc","disk","host"]`},
+		{url: "/api/suggest?type=tagv&q=web", body: `["web01","web02"]`},
+		{url: "/api/suggest?type=tagv&q=us", body: `["us-east"]`},
+	}
+
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%d. unexpected status: %d", i, w.Code)
+		} else if body := strings.TrimSpace(w.Body.String()); body != test.body {
+			t.Fatalf("%d. unexpected body.  expected %s, got %s", i, test.body, body)
+		}
+	}
+}
+
+// Ensure the least recently observed names are evicted once the limit is reached.
+func TestNewSuggester_MaxNames(t *testing.T) {
+	sg := opentsdb.NewSuggester(2)
+	sg.Observe(influxdb.Point{Name: "sys.cpu"})
+	sg.Observe(influxdb.Point{Name: "sys.cpu.user"})
+	sg.Observe(influxdb.Point{Name: "sys.cpu"})
+	sg.Observe(influxdb.Point{Name: "sys.mem"})
+
+	if names := sg.Suggest("metrics", "sys", 10); !reflect.DeepEqual(names, []string{"sys.cpu", "sys.mem"}) {
+		t.Fatalf("unexpected names: %v", names)
+	}
+	sg.Observe(influxdb.Point{Name: "app"})
+	if names := sg.Suggest("metrics", "", 10); !reflect.DeepEqual(names, []string{"app", "sys.mem"}) {
+		t.Fatalf("unexpected names after eviction: %v", names)
+	}
+}
+
+func TestHandler_LastValues(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	s.LastValueCacheSize = 2
+	s.FieldTypes = map[string]string{"sys.up": "bool"}
+	handleLines(s,
+		"put sys.mem.free 1356998400 5 host=a",
+		"put sys.cpu.user 1356998400 1 host=a cpu=0",
+		"put sys.cpu.user 1356998401 2 host=a cpu=0",
+		"put sys.up 1356998402 true host=web-1",
+	)
+	h := opentsdb.NewHandler(s, "0.9.0")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	// The least recently updated series is evicted.
+	exp := `# TYPE sys_cpu_user gauge
+sys_cpu_user{cpu="0",host="a"} 2 1356998401000
+# TYPE sys_up gauge
+sys_up{host="web-1"} 1 1356998402000
+`
+	if body := w.Body.String(); body != exp {
+		t.Fatalf("unexpected body.\nexpected:\n%s\ngot:\n%s", exp, body)
+	}
+}
+
+func TestHandler_Put(t *testing.T) {
+	w := &testWriter{}
+	h := opentsdb.NewHandler(opentsdb.NewServer(w, "raw", "db"), "0.9.0")
+
+	var tests = []struct {
+		body   string
+		code   int
+		points int
+	}{
+		{body: `{"metric":"sys.cpu.user","timestamp":1356998400,"value":42.5,"tags":{"host":"a"}}`, code: http.StatusNoContent, points: 1},
+		{body: `[{"metric":"sys.cpu.user","timestamp":1356998400000,"value":"1","tags":{"host":"a"}},{"metric":"sys.cpu.user","timestamp":1356998401,"value":2,"tags":{"host":"b"}}]`, code: http.StatusNoContent, points: 3},
+		{body: `{"metric":"sys.cpu.user","timestamp":123,"value":1,"tags":{"host":"a"}}`, code: http.StatusBadRequest, points: 3},
+		{body: `{"metric":`, code: http.StatusBadRequest, points: 3},
+	}
+
+	for i, test := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/put", strings.NewReader(test.body)))
+		if rec.Code != test.code {
+			t.Fatalf("%d. unexpected status.  expected %d, got %d: %s", i, test.code, rec.Code, rec.Body.String())
+		} else if n := len(w.Points()); n != test.points {
+			t.Fatalf("%d. unexpected point count.  expected %d, got %d", i, test.points, n)
+		}
+	}
+
+	if p := w.Points()[0]; p.Fields["value"] != 42.5 || p.Tags["host"] != "a" {
+		t.Fatalf("unexpected point: %v", p)
+	}
+}
+
+func TestHandler_Annotation(t *testing.T) {
+	w := &testWriter{}
+	h := opentsdb.NewHandler(opentsdb.NewServer(w, "raw", "db"), "0.9.0")
+	h.AnnotationMeasurement = "events"
+
+	body := `{"startTime":1356998400,"endTime":1356998460,"tsuid":"000001","description":"deploy","notes":"v1.2","custom":{"owner":"jdoe"}}`
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/annotation", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status.  expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	points := w.Points()
+	if len(points) != 1 {
+		t.Fatalf("unexpected number of points.  expected 1, got %d", len(points))
+	}
+	exp := influxdb.Point{
+		Name:      "events",
+		Tags:      map[string]string{"owner": "jdoe", "tsuid": "000001"},
+		Timestamp: time.Unix(1356998400, 0),
+		Fields:    map[string]interface{}{"description": "deploy", "notes": "v1.2", "endTime": int64(1356998460)},
+	}
+	if !reflect.DeepEqual(points[0], exp) {
+		t.Fatalf("unexpected point.  expected %v, got %v", exp, points[0])
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/annotation", strings.NewReader(`{"description":"deploy"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status for missing start time.  expected %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func BenchmarkServer_HandleConnection_BufferSize(b *testing.B) {
+	for _, size := range []int{0, 1 << 20} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			w := &countWriter{}
+			s := opentsdb.NewServer(w, "raw", "db")
+			s.ReadBufferSize = size
+			s.ReaderBufferSize = size
+			if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+
+			conn, err := net.Dial("tcp", s.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			line := []byte("put sys.cpu.user 1356998400 42.5 host=webserver01 cpu=0\n")
+			b.SetBytes(int64(len(line)))
+			b.ResetTimer()
+
+			bw := bufio.NewWriterSize(conn, 1<<16)
+			for i := 0; i < b.N; i++ {
+				bw.Write(line)
+			}
+			bw.Flush()
+			for w.Count() < int64(b.N) {
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+// benchLine is a realistic "put" line with several tags.
+const benchLine = "put sys.cpu.user 1356998400 42.5 host=webserver01 cpu=0 dc=us-east-1 env=prod"
+
+// Baselines for benchLine with the default configuration, measured on an
+// x86-64 Xeon. TestServer_Allocs fails if allocations per line exceed them,
+// so that features added to the hot path don't regress it unnoticed.
+// Timings are for reference only; compare the BenchmarkServer_ParsePoint,
+// BenchmarkServer_ProcessLine and BenchmarkServer_HandleConnection results
+// before and after a change.
+const (
+	parsePointAllocs  = 10
+	processLineAllocs = 13
+
+	parsePointNsPerOp       = 980
+	processLineNsPerOp      = 1600
+	handleConnectionNsPerOp = 1800
+)
+
+func TestServer_Allocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("race detector allocates")
+	}
+	s := opentsdb.NewServer(&countWriter{}, "raw", "db")
+	if n := testing.AllocsPerRun(100, func() {
+		if _, err := s.ParsePoint(benchLine); err != nil {
+			t.Fatal(err)
+		}
+	}); n > parsePointAllocs {
+		t.Fatalf("ParsePoint allocations regressed.  expected at most %d, got %v", parsePointAllocs, n)
+	}
+	if n := testing.AllocsPerRun(100, func() {
+		if err := s.ProcessLine(benchLine); err != nil {
+			t.Fatal(err)
+		}
+	}); n > processLineAllocs {
+		t.Fatalf("ProcessLine allocations regressed.  expected at most %d, got %v", processLineAllocs, n)
+	}
+
+	// Unit suffixes are sorted once, not for every value.
+	s = opentsdb.NewServer(&countWriter{}, "raw", "db")
+	s.ValueUnits = map[string]float64{"ms": 0.001, "s": 1, "us": 0.000001}
+	line := strings.Replace(benchLine, " 42.5 ", " 42.5ms ", 1)
+	if n := testing.AllocsPerRun(100, func() {
+		if _, err := s.ParsePoint(line); err != nil {
+			t.Fatal(err)
+		}
+	}); n > parsePointAllocs {
+		t.Fatalf("ParsePoint allocations with ValueUnits regressed.  expected at most %d, got %v", parsePointAllocs, n)
+	}
+
+	// Field type and retention policy patterns are sorted once, not for
+	// every point.
+	s = opentsdb.NewServer(&countWriter{}, "raw", "db")
+	s.FieldTypes = map[string]string{"app.*": "int", "sys.*": "float"}
+	s.RetentionPolicyForMetric = map[string]string{"app.*": "short", "sys.*": "long"}
+	if n := testing.AllocsPerRun(100, func() {
+		if err := s.ProcessLine(benchLine); err != nil {
+			t.Fatal(err)
+		}
+	}); n > processLineAllocs {
+		t.Fatalf("ProcessLine allocations with patterns regressed.  expected at most %d, got %v", processLineAllocs, n)
+	}
+}
+
+func BenchmarkServer_ParsePoint(b *testing.B) {
+	s := opentsdb.NewServer(&countWriter{}, "raw", "db")
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchLine)))
+	for i := 0; i < b.N; i++ {
+		if _, err := s.ParsePoint(benchLine); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkServer_ProcessLine(b *testing.B) {
+	s := opentsdb.NewServer(&countWriter{}, "raw", "db")
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchLine)))
+	for i := 0; i < b.N; i++ {
+		if err := s.ProcessLine(benchLine); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkServer_HandleConnection(b *testing.B) {
+	w := &countWriter{}
+	s := opentsdb.NewServer(w, "raw", "db")
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.HandleConnection(server)
+		close(done)
+	}()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchLine) + 1))
+	b.ResetTimer()
+
+	// Each line has a new timestamp so that none are dropped as duplicates.
+	bw := bufio.NewWriterSize(client, 1<<16)
+	prefix, suffix := benchLine[:len("put sys.cpu.user ")], benchLine[len("put sys.cpu.user 1356998400"):]
+	buf := make([]byte, 0, len(benchLine)+16)
+	for i := 0; i < b.N; i++ {
+		buf = append(buf[:0], prefix...)
+		buf = strconv.AppendInt(buf, 1356998400+int64(i), 10)
+		buf = append(buf, suffix...)
+		buf = append(buf, '\n')
+		bw.Write(buf)
+	}
+	bw.Flush()
+	client.Close()
+	<-done
+	if n := w.Count(); n != int64(b.N) {
+		b.Fatalf("unexpected points written.  expected %d, got %d", b.N, n)
+	}
+}
+
+// Test Helpers
+
+// testWriter records all points written to it.
+type testWriter = test.MemWriter
+
+// countWriter counts the points written to it.
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	atomic.AddInt64(&w.n, int64(len(points)))
+	return 0, nil
+}
+
+// Count returns the number of points written so far.
+func (w *countWriter) Count() int64 { return atomic.LoadInt64(&w.n) }
+
+// writerFunc is a function which implements SeriesWriter.
+// lengthFramer reads lines prefixed by their length as a big endian uint16.
+type lengthFramer struct {
+	r io.Reader
+}
+
+func (f *lengthFramer) ReadLine() ([]byte, error) {
+	var n uint16
+	if err := binary.Read(f.r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	line := make([]byte, n)
+	if _, err := io.ReadFull(f.r, line); err != nil {
+		return nil, err
+	}
+	return line, nil
+}
+
+// lengthPrefixed returns lines framed for lengthFramer.
+func lengthPrefixed(lines ...string) []byte {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		binary.Write(&buf, binary.BigEndian, uint16(len(line)))
+		buf.WriteString(line)
+	}
+	return buf.Bytes()
+}
+
+type writerFunc func(database, retentionPolicy string, points []influxdb.Point) (uint64, error)
+
+func (f writerFunc) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	return f(database, retentionPolicy, points)
+}
+
+// errWriter returns err from every write.
+type errWriter struct {
+	err error
+}
+
+func (w *errWriter) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	return 0, w.err
+}
+
+// wsFrame returns a masked client WebSocket frame.
+func wsFrame(fin bool, opcode byte, payload string) []byte {
+	b := []byte{opcode, 0x80 | byte(len(payload)), 1, 2, 3, 4}
+	if fin {
+		b[0] |= 0x80
+	}
+	for i := 0; i < len(payload); i++ {
+		b = append(b, payload[i]^b[2+i%4])
+	}
+	return b
+}
+
+// dialWebSocket connects to the /ws endpoint at addr and completes the
+// upgrade, returning the connection and a reader over it.
+func dialWebSocket(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	if resp, err := http.ReadResponse(br, nil); err != nil {
+		conn.Close()
+		t.Fatal(err)
+	} else if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	return conn, br
+}
+
+// readN reads exactly n bytes from r.
+func readN(t *testing.T, r io.Reader, n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// handleLines sends lines over a single connection and waits for the server to finish with it.
+func handleLines(s *opentsdb.Server, lines ...string) {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line + "\n")
+	}
+	handleData(s, buf.Bytes())
+}
+
+// handleData sends data over a single connection and waits for the server to finish with it.
+func handleData(s *opentsdb.Server, data []byte) {
+	client, server := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		s.HandleConnection(server)
+		close(done)
+	}()
+
+	client.Write(data)
+	client.Close()
+	<-done
+}
+
+// selfSignedCert returns a certificate for 127.0.0.1 with the common name cn.
+func selfSignedCert(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func errstr(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
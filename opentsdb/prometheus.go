@@ -0,0 +1,33 @@
+//go:build prometheus
+// +build prometheus
+
+package opentsdb
+
+import (
+	"github.com/influxdb/influxdb/internal/ingest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// promMetrics maps statistics to Prometheus metrics. Statistics with a reason
+// are reported as the "reason" label of a shared metric.
+var promMetrics = []ingest.PromMetric{
+	{Stat: "pointsReceived", Name: "opentsdb_points_received_total", Help: "Points parsed from received lines.", Type: prometheus.CounterValue},
+	{Stat: "parseErrors", Name: "opentsdb_parse_errors_total", Help: "Received lines which could not be parsed.", Type: prometheus.CounterValue},
+	{Stat: "pointsWritten", Name: "opentsdb_points_written_total", Help: "Points written.", Type: prometheus.CounterValue},
+	{Stat: "pointsWriteFailed", Name: "opentsdb_points_write_failed_total", Help: "Points which failed to write.", Type: prometheus.CounterValue},
+	{Stat: "pointsFiltered", Name: "opentsdb_points_dropped_total", Help: "Points dropped rather than written.", Reason: "filtered", Type: prometheus.CounterValue},
+	{Stat: "pointsSampledOut", Name: "opentsdb_points_dropped_total", Help: "Points dropped rather than written.", Reason: "sampled_out", Type: prometheus.CounterValue},
+	{Stat: "pointsValueOverLimit", Name: "opentsdb_points_dropped_total", Help: "Points dropped rather than written.", Reason: "value_over_limit", Type: prometheus.CounterValue},
+	{Stat: "pointsDroppedByProcessor", Name: "opentsdb_points_dropped_total", Help: "Points dropped rather than written.", Reason: "processor", Type: prometheus.CounterValue},
+	{Stat: "duplicateTimestampDropped", Name: "opentsdb_points_dropped_total", Help: "Points dropped rather than written.", Reason: "duplicate", Type: prometheus.CounterValue},
+	{Stat: "pointsWithoutFields", Name: "opentsdb_points_dropped_total", Help: "Points dropped rather than written.", Reason: "no_fields", Type: prometheus.CounterValue},
+	{Stat: "pointsDroppedBreakerOpen", Name: "opentsdb_points_dropped_total", Help: "Points dropped rather than written.", Reason: "breaker_open", Type: prometheus.CounterValue},
+	{Stat: "bytesRead", Name: "opentsdb_read_bytes_total", Help: "Bytes read from connections.", Type: prometheus.CounterValue},
+	{Stat: "activeConnections", Name: "opentsdb_active_connections", Help: "Open connections.", Type: prometheus.GaugeValue},
+	{Stat: "writesInFlight", Name: "opentsdb_writes_in_flight", Help: "Writes in progress.", Type: prometheus.GaugeValue},
+}
+
+// Collector returns a prometheus.Collector reporting the server's statistics.
+func (s *Server) Collector() prometheus.Collector {
+	return ingest.NewStatsCollector(promMetrics, s.stats)
+}
@@ -0,0 +1,60 @@
+//go:build prometheus
+// +build prometheus
+
+package opentsdb_test
+
+import (
+	"testing"
+
+	"github.com/influxdb/influxdb/opentsdb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestServer_Collector(t *testing.T) {
+	s := opentsdb.NewServer(&testWriter{}, "raw", "db")
+	s.DenyMetrics = map[string]struct{}{"sys.mem": {}}
+
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(s.Collector()); err != nil {
+		t.Fatal(err)
+	}
+
+	handleLines(s,
+		"put sys.cpu.user 1356998400 1 host=a",
+		"put sys.cpu.user 1356998401 2 host=a",
+		"put sys.mem 1356998400 1 host=a",
+		"put sys.cpu.user",
+	)
+
+	// Counters are monotonic, so they are not reset by interval snapshots.
+	s.SnapshotAndReset()
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			name := mf.GetName()
+			for _, l := range m.GetLabel() {
+				name += "," + l.GetName() + "=" + l.GetValue()
+			}
+			values[name] = m.GetCounter().GetValue() + m.GetGauge().GetValue()
+		}
+	}
+
+	for name, exp := range map[string]float64{
+		"opentsdb_points_received_total":                3,
+		"opentsdb_parse_errors_total":                   1,
+		"opentsdb_points_written_total":                 2,
+		"opentsdb_points_dropped_total,reason=filtered": 1,
+		"opentsdb_active_connections":                   0,
+	} {
+		if v, ok := values[name]; !ok {
+			t.Fatalf("missing metric %s", name)
+		} else if v != exp {
+			t.Fatalf("unexpected %s.  expected %v, got %v", name, exp, v)
+		}
+	}
+}
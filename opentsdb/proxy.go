@@ -0,0 +1,46 @@
+package opentsdb
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// parseProxyHeader parses a PROXY protocol v1 header line and returns the
+// client's source address in host:port form. An empty address is returned
+// for "PROXY UNKNOWN" headers, meaning the connection's own address is used.
+func parseProxyHeader(line string) (string, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return "", fmt.Errorf("malformed PROXY header: %q", line)
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return "", nil
+	case "TCP4", "TCP6":
+	default:
+		return "", fmt.Errorf("unsupported PROXY protocol %q", fields[1])
+	}
+
+	if len(fields) != 6 {
+		return "", fmt.Errorf("malformed PROXY header: %q", line)
+	}
+	// The family is decided by the form of each address, rather than by what
+	// it parses to, so that IPv4-mapped addresses such as "::ffff:10.0.0.1"
+	// are accepted under TCP6.
+	ipv6 := fields[1] == "TCP6"
+	for _, addr := range fields[2:4] {
+		if net.ParseIP(addr) == nil || strings.Contains(addr, ":") != ipv6 {
+			return "", fmt.Errorf("malformed PROXY header addresses: %q", line)
+		}
+	}
+	for _, port := range fields[4:] {
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+			return "", fmt.Errorf("malformed PROXY header ports: %q", line)
+		}
+	}
+
+	return net.JoinHostPort(fields[2], fields[4]), nil
+}
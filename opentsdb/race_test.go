@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package opentsdb_test
+
+// raceEnabled is true when tests are run with the race detector, which
+// allocates on its own account.
+const raceEnabled = true
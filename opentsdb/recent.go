@@ -0,0 +1,63 @@
+package opentsdb
+
+import (
+	"sync"
+)
+
+// maxRecentLineLength is the maximum number of bytes of each captured line kept.
+const maxRecentLineLength = 1024
+
+// lineRing holds the most recent lines received on a connection.
+type lineRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func newLineRing(n int) *lineRing {
+	return &lineRing{lines: make([]string, n)}
+}
+
+// add records line, evicting the oldest line once the ring is full.
+func (r *lineRing) add(line string) {
+	if len(line) > maxRecentLineLength {
+		line = line[:maxRecentLineLength]
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// snapshot returns the captured lines, oldest first.
+func (r *lineRing) snapshot() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]string(nil), r.lines[:r.next]...)
+	}
+	return append(append([]string(nil), r.lines[r.next:]...), r.lines[:r.next]...)
+}
+
+// RecentLines returns the most recent raw lines received from the connected
+// client at remoteAddr, oldest first. When the PROXY protocol is enabled this
+// is the address from the PROXY header. It returns nil if line capture is
+// disabled or no such client is connected.
+func (s *Server) RecentLines(remoteAddr string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.conns {
+		if c.lines != nil && c.addr == remoteAddr {
+			return c.lines.snapshot()
+		}
+	}
+	return nil
+}
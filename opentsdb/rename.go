@@ -0,0 +1,63 @@
+package opentsdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RenameRules renames metrics. Rules are either exact, renaming a single
+// metric, or prefix rules, rewriting the start of every metric name which
+// begins with the prefix. Exact rules take precedence, then the longest
+// matching prefix.
+type RenameRules struct {
+	exact    map[string]string
+	prefixes []prefixRule
+}
+
+// prefixRule rewrites names starting with from to start with to instead.
+type prefixRule struct {
+	from, to string
+}
+
+// ParseRenameRules compiles rules of the form "old.metric -> new.metric". A
+// rule whose sides both end in "*", such as "old.* -> new.*", is a prefix rule.
+func ParseRenameRules(rules []string) (*RenameRules, error) {
+	r := &RenameRules{exact: make(map[string]string)}
+	for _, rule := range rules {
+		parts := strings.Split(rule, "->")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rename rule %q: expected old -> new", rule)
+		}
+		from, to := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("invalid rename rule %q: expected old -> new", rule)
+		}
+
+		fromPrefix, toPrefix := strings.HasSuffix(from, "*"), strings.HasSuffix(to, "*")
+		switch {
+		case fromPrefix && toPrefix:
+			r.prefixes = append(r.prefixes, prefixRule{from: strings.TrimSuffix(from, "*"), to: strings.TrimSuffix(to, "*")})
+		case fromPrefix || toPrefix:
+			return nil, fmt.Errorf("invalid rename rule %q: both sides of a prefix rule must end in *", rule)
+		default:
+			r.exact[from] = to
+		}
+	}
+
+	sort.SliceStable(r.prefixes, func(i, j int) bool { return len(r.prefixes[i].from) > len(r.prefixes[j].from) })
+	return r, nil
+}
+
+// Rename returns the new name for a metric, or name if no rule matches.
+func (r *RenameRules) Rename(name string) string {
+	if to, ok := r.exact[name]; ok {
+		return to
+	}
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(name, p.from) {
+			return p.to + name[len(p.from):]
+		}
+	}
+	return name
+}
@@ -0,0 +1,177 @@
+package opentsdb
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+
+	"github.com/influxdb/influxdb"
+)
+
+// DefaultMaxSuggestNames is the default number of names of each type kept
+// by a Suggester returned by NewSuggester.
+const DefaultMaxSuggestNames = 10000
+
+// Suggester indexes the names observed in received points so /api/suggest
+// can return those matching a prefix.
+type Suggester interface {
+	// Observe records the metric name, tag keys and tag values of p.
+	Observe(p influxdb.Point)
+
+	// Suggest returns up to max names of the type, "metrics", "tagk" or
+	// "tagv", beginning with prefix, in sorted order.
+	Suggest(typ, prefix string, max int) []string
+}
+
+// NewSuggester returns a Suggester which keeps, for each type, the maxNames
+// most recently observed names in memory, evicting the least recently seen.
+// Names are held in a trie so that a query visits only matching names.
+func NewSuggester(maxNames int) Suggester {
+	return &trieSuggester{
+		max: maxNames,
+		indexes: map[string]*nameIndex{
+			"metrics": newNameIndex(),
+			"tagk":    newNameIndex(),
+			"tagv":    newNameIndex(),
+		},
+	}
+}
+
+// trieSuggester is the Suggester returned by NewSuggester.
+type trieSuggester struct {
+	mu      sync.Mutex
+	max     int
+	indexes map[string]*nameIndex
+}
+
+// Observe records the metric name, tag keys and tag values of p.
+func (s *trieSuggester) Observe(p influxdb.Point) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.indexes["metrics"].add(p.Name, s.max)
+	for k, v := range p.Tags {
+		s.indexes["tagk"].add(k, s.max)
+		s.indexes["tagv"].add(v, s.max)
+	}
+}
+
+// Suggest returns up to max names of the type beginning with prefix.
+func (s *trieSuggester) Suggest(typ, prefix string, max int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx, ok := s.indexes[typ]
+	if !ok {
+		return nil
+	}
+	return idx.root.find(prefix, max)
+}
+
+// nameIndex holds a bounded set of names in a trie.
+type nameIndex struct {
+	root *trieNode
+	ll   *list.List // names, most recently observed first
+	m    map[string]*list.Element
+}
+
+func newNameIndex() *nameIndex {
+	return &nameIndex{root: &trieNode{}, ll: list.New(), m: make(map[string]*list.Element)}
+}
+
+// add records name, keeping at most max names.
+func (idx *nameIndex) add(name string, max int) {
+	if max <= 0 || name == "" {
+		return
+	}
+	if e, ok := idx.m[name]; ok {
+		idx.ll.MoveToFront(e)
+		return
+	}
+
+	for idx.ll.Len() >= max {
+		e := idx.ll.Back()
+		idx.ll.Remove(e)
+		delete(idx.m, e.Value.(string))
+		idx.root.remove(e.Value.(string))
+	}
+	idx.m[name] = idx.ll.PushFront(name)
+	idx.root.insert(name)
+}
+
+// trieNode is a node of a trie of names, keyed by byte.
+type trieNode struct {
+	children map[byte]*trieNode
+	name     bool // a name ends at this node
+}
+
+// insert adds name beneath n.
+func (n *trieNode) insert(name string) {
+	for i := 0; i < len(name); i++ {
+		if n.children == nil {
+			n.children = make(map[byte]*trieNode)
+		}
+		child, ok := n.children[name[i]]
+		if !ok {
+			child = &trieNode{}
+			n.children[name[i]] = child
+		}
+		n = child
+	}
+	n.name = true
+}
+
+// remove removes name from beneath n, pruning nodes left without names.
+func (n *trieNode) remove(name string) {
+	path := []*trieNode{n}
+	for i := 0; i < len(name); i++ {
+		n = n.children[name[i]]
+		if n == nil {
+			return
+		}
+		path = append(path, n)
+	}
+	n.name = false
+
+	for i := len(name); i > 0 && !path[i].name && len(path[i].children) == 0; i-- {
+		delete(path[i-1].children, name[i-1])
+	}
+}
+
+// find returns up to max names beneath n beginning with prefix, in sorted order.
+func (n *trieNode) find(prefix string, max int) []string {
+	for i := 0; i < len(prefix) && n != nil; i++ {
+		n = n.children[prefix[i]]
+	}
+	if n == nil || max <= 0 {
+		return nil
+	}
+
+	var names []string
+	n.walk(prefix, func(name string) bool {
+		names = append(names, name)
+		return len(names) < max
+	})
+	return names
+}
+
+// walk calls fn with each name beneath n, whose name is prefix, in sorted
+// order until fn returns false. It returns false if walking was stopped.
+func (n *trieNode) walk(prefix string, fn func(name string) bool) bool {
+	if n.name && !fn(prefix) {
+		return false
+	}
+
+	keys := make([]int, 0, len(n.children))
+	for b := range n.children {
+		keys = append(keys, int(b))
+	}
+	sort.Ints(keys)
+
+	for _, b := range keys {
+		if !n.children[byte(b)].walk(prefix+string([]byte{byte(b)}), fn) {
+			return false
+		}
+	}
+	return true
+}
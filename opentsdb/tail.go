@@ -0,0 +1,52 @@
+package opentsdb
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// DefaultTailPollInterval is the default time to wait for new data at the end of a file.
+const DefaultTailPollInterval = 250 * time.Millisecond
+
+// FileTailer replays OpenTSDB "put" lines from a file, such as a log of
+// received metrics, through a Server's line processing.
+type FileTailer struct {
+	path   string
+	offset int64
+	server *Server
+
+	// PollInterval is the time to wait for new data once the end of the file is reached.
+	PollInterval time.Duration
+}
+
+// NewFileTailer returns a new instance of a FileTailer which starts reading
+// path at the given byte offset and processes lines with s.
+func NewFileTailer(path string, offset int64, s *Server) *FileTailer {
+	return &FileTailer{
+		path:         path,
+		offset:       offset,
+		server:       s,
+		PollInterval: DefaultTailPollInterval,
+	}
+}
+
+// Offset returns the byte offset just past the last complete line read. It can
+// be passed to NewFileTailer to resume tailing.
+func (t *FileTailer) Offset() int64 {
+	return atomic.LoadInt64(&t.offset)
+}
+
+// Tail processes complete lines from the file, waiting for more to be appended,
+// until ctx is done. If the starting offset is in the middle of a line, that
+// line is skipped.
+func (t *FileTailer) Tail(ctx context.Context) error {
+	return ingest.TailFile(ctx, t.path, &t.offset, t.PollInterval, func(line string) {
+		if err := t.server.ProcessLine(line); err != nil {
+			log.Println("TSDBServer:", err)
+		}
+	})
+}
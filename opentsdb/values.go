@@ -0,0 +1,44 @@
+package opentsdb
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseFloatValue parses an auto-detected value, applying the optional hex
+// and unit suffix extensions.
+func (s *Server) parseFloatValue(v string) (float64, error) {
+	if s.ParseHexValues && (strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X")) {
+		n, err := strconv.ParseUint(v[2:], 16, 64)
+		return float64(n), err
+	}
+
+	s.units.Do(s.sortUnits)
+	for _, u := range s.sortedUnits {
+		if strings.HasSuffix(v, u) {
+			f, err := strconv.ParseFloat(strings.TrimSuffix(v, u), 64)
+			return f * s.ValueUnits[u], err
+		}
+	}
+
+	return strconv.ParseFloat(v, 64)
+}
+
+// sortUnits sorts the non-empty ValueUnits suffixes longest first, so that
+// "ms" is preferred over "s", and alphabetically among those of one length.
+func (s *Server) sortUnits() {
+	units := make([]string, 0, len(s.ValueUnits))
+	for u := range s.ValueUnits {
+		if u != "" {
+			units = append(units, u)
+		}
+	}
+	sort.Slice(units, func(i, j int) bool {
+		if len(units[i]) != len(units[j]) {
+			return len(units[i]) > len(units[j])
+		}
+		return units[i] < units[j]
+	})
+	s.sortedUnits = units
+}
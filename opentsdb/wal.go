@@ -0,0 +1,432 @@
+package opentsdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// DefaultMaxWALBytes is the default maximum size of the write-ahead log.
+const DefaultMaxWALBytes = 64 << 20
+
+// walCompactBytes is the size beyond which the write-ahead log is compacted
+// once the records of completed writes outweigh those of pending ones. A
+// smaller maximum size lowers it to half that size.
+const walCompactBytes = 1 << 20
+
+// WALSyncPolicy determines when appends to the write-ahead log are synced to disk.
+type WALSyncPolicy int
+
+const (
+	// SyncWALEachWrite syncs the log after each append, before the write is
+	// made, so that logged writes survive the machine crashing.
+	SyncWALEachWrite WALSyncPolicy = iota
+
+	// SyncWALNever leaves syncing the log to the operating system. Logged
+	// writes survive the process exiting, but not the machine crashing.
+	SyncWALNever
+)
+
+// errWALFull is returned when a write would grow the write-ahead log beyond
+// its maximum size.
+var errWALFull = errors.New("write-ahead log full")
+
+// Kinds of write-ahead log record. An append record holds the points of a
+// write, and a done record marks the write with the same ID as complete.
+const (
+	walAppend = 'a'
+	walDone   = 'd'
+)
+
+// walHeaderSize is the size of a record's header: the length of its payload
+// followed by the CRC-32 of the payload.
+const walHeaderSize = 8
+
+// walEntry is a write held in the write-ahead log.
+type walEntry struct {
+	id              uint64
+	database        string
+	retentionPolicy string
+	points          []influxdb.Point
+}
+
+// walConfig configures a walWriter.
+type walConfig struct {
+	path     string
+	maxBytes int64
+	sync     WALSyncPolicy
+}
+
+// walWriter appends each write to a write-ahead log before writing it to an
+// underlying writer, marking it done once the write returns, so that writes
+// in flight when the process exits can be replayed when it restarts. The log
+// is emptied when no writes are pending, and compacted to the pending writes
+// when completed ones make up most of it, so that it does not fill up under
+// sustained load. Writes
+// which fail are left to the underlying writer to retry or spill, so that
+// they are neither kept in the log nor replayed twice.
+type walWriter struct {
+	writer SeriesWriter
+	stats  *influxdb.Stats
+
+	// config returns the log settings. A nil config or an empty path
+	// disables the log.
+	config func() walConfig
+
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	size    int64
+	nextID  uint64
+	pending map[uint64][]byte // append records of pending writes, by ID
+	live    int64             // total size of the pending append records
+}
+
+// WriteSeries appends points to the log, writes them to the underlying
+// writer and marks them done once the write returns. Points are still
+// written if they cannot be appended to the log.
+func (w *walWriter) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	var cfg walConfig
+	if w.config != nil {
+		cfg = w.config()
+	}
+	if cfg.path == "" {
+		return w.writer.WriteSeries(database, retentionPolicy, points)
+	}
+
+	id, err := w.append(cfg, database, retentionPolicy, points)
+	if err != nil {
+		w.stats.Inc("walAppendFailed")
+		log.Println("TSDB cannot append to write-ahead log: ", err)
+	}
+
+	index, err := w.writer.WriteSeries(database, retentionPolicy, points)
+	if id != 0 {
+		if err := w.done(cfg, id); err != nil {
+			log.Println("TSDB cannot update write-ahead log: ", err)
+		}
+	}
+	return index, err
+}
+
+// append adds a write to the log and returns its ID, syncing the log as
+// configured. The ID is returned even if the sync fails, as the write is
+// then in the log and must still be marked done.
+func (w *walWriter) append(cfg walConfig, database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.open(cfg.path); err != nil {
+		return 0, err
+	}
+
+	e := walEntry{id: w.nextID, database: database, retentionPolicy: retentionPolicy, points: points}
+	rec, err := e.record()
+	if err != nil {
+		return 0, err
+	} else if cfg.maxBytes > 0 && w.size+int64(len(rec)) > cfg.maxBytes {
+		return 0, errWALFull
+	}
+	if _, err := w.f.Write(rec); err != nil {
+		return 0, err
+	}
+	w.size += int64(len(rec))
+	w.nextID++
+	w.pending[e.id] = rec
+	w.live += int64(len(rec))
+
+	if cfg.sync == SyncWALEachWrite {
+		if err := w.f.Sync(); err != nil {
+			return e.id, err
+		}
+	}
+	return e.id, nil
+}
+
+// done marks the write with the ID as complete. The log is emptied once no
+// writes are pending, and compacted once it has grown beyond the compaction
+// size and the records of completed writes outweigh the pending ones.
+func (w *walWriter) done(cfg walConfig, id uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	rec, ok := w.pending[id]
+	if w.f == nil || !ok {
+		return nil
+	}
+	delete(w.pending, id)
+	w.live -= int64(len(rec))
+	if len(w.pending) == 0 {
+		if err := w.f.Truncate(0); err != nil {
+			return err
+		}
+		w.size = 0
+		_, err := w.f.Seek(0, io.SeekStart)
+		return err
+	}
+
+	rec = walRecord(walDone, id, nil)
+	if _, err := w.f.Write(rec); err != nil {
+		return err
+	}
+	w.size += int64(len(rec))
+
+	limit := int64(walCompactBytes)
+	if cfg.maxBytes > 0 && cfg.maxBytes/2 < limit {
+		limit = cfg.maxBytes / 2
+	}
+	if w.size >= limit && w.size-w.live > w.live {
+		return w.compact(cfg)
+	}
+	return nil
+}
+
+// compact replaces the log with one holding only the pending writes, in the
+// order they were appended. The new log is written beside the old one and
+// renamed over it, so that a crash while compacting leaves one or the other.
+// Must be called with the lock held.
+func (w *walWriter) compact(cfg walConfig) error {
+	ids := make([]uint64, 0, len(w.pending))
+	for id := range w.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	tmp := w.path + ".compact"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, id := range ids {
+		n, err := f.Write(w.pending[id])
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+		size += int64(n)
+	}
+	if cfg.sync == SyncWALEachWrite {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	w.f.Close()
+	w.f, w.size = f, size
+	w.stats.Inc("walCompactions")
+	return nil
+}
+
+// open opens the log at path, if it isn't already open, keeping any writes
+// it holds pending until they are replayed. A corrupt tail is truncated.
+// Must be called with the lock held.
+func (w *walWriter) open(path string) error {
+	if w.f != nil {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	entries, size, corrupt := readWAL(data)
+	if corrupt {
+		w.stats.Inc("walCorruptRecords")
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	pending := make(map[uint64][]byte)
+	var live int64
+	for _, e := range entries {
+		rec, err := e.record()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		pending[e.id] = rec
+		live += int64(len(rec))
+	}
+
+	w.path, w.f, w.size, w.nextID = path, f, size, 1
+	w.pending, w.live = pending, live
+	for id := range pending {
+		if id >= w.nextID {
+			w.nextID = id + 1
+		}
+	}
+	return nil
+}
+
+// replay writes the pending writes in the log at path to the underlying
+// writer and removes the log. Each write is attempted once, like any other,
+// so that one which fails is retried or spilled by the underlying writer
+// rather than kept in the log; the first such error is returned. A corrupt
+// tail, such as a record partly written when the process exited, is
+// discarded. It returns the number of points written. The log must not be
+// replayed while writes are in flight, as they are pending in it too.
+func (w *walWriter) replay(path string) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	entries, _, corrupt := readWAL(data)
+	if corrupt {
+		w.stats.Inc("walCorruptRecords")
+	}
+
+	var n int
+	var first error
+	for _, e := range entries {
+		_, err := w.writer.WriteSeries(e.database, e.retentionPolicy, e.points)
+		if err != nil && !ingest.IsPartialWriteError(err) {
+			w.stats.Add("walReplayFailed", int64(len(e.points)))
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		n += len(e.points)
+	}
+	if err := os.Remove(path); err != nil {
+		return n, err
+	}
+	return n, first
+}
+
+// record returns the append record of the entry.
+func (e *walEntry) record() ([]byte, error) {
+	var buf bytes.Buffer
+	for _, p := range e.points {
+		line, err := ingest.MarshalSpillLine(e.database, e.retentionPolicy, p)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(line + "\n")
+	}
+	return walRecord(walAppend, e.id, buf.Bytes()), nil
+}
+
+// walRecord returns a record of the kind for the ID followed by data.
+func walRecord(kind byte, id uint64, data []byte) []byte {
+	payload := make([]byte, 9+len(data))
+	payload[0] = kind
+	binary.BigEndian.PutUint64(payload[1:9], id)
+	copy(payload[9:], data)
+
+	rec := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(payload))
+	copy(rec[walHeaderSize:], payload)
+	return rec
+}
+
+// readWAL returns the writes in data which are not marked done, in the order
+// they were appended, and the size of the valid records. Reading stops at
+// the first incomplete or corrupt record, in which case corrupt is true.
+func readWAL(data []byte) (entries []walEntry, size int64, corrupt bool) {
+	done := make(map[uint64]bool)
+	for len(data) > 0 {
+		e, n, err := readWALRecord(data)
+		if err != nil {
+			corrupt = true
+			break
+		}
+		if e.points != nil {
+			entries = append(entries, e)
+		} else {
+			done[e.id] = true
+		}
+		data = data[n:]
+		size += int64(n)
+	}
+
+	pending := entries[:0]
+	for _, e := range entries {
+		if !done[e.id] {
+			pending = append(pending, e)
+		}
+	}
+	return pending, size, corrupt
+}
+
+// readWALRecord parses the record at the start of data, returning it as an
+// entry, with nil points for a done record, and its size.
+func readWALRecord(data []byte) (walEntry, int, error) {
+	if len(data) < walHeaderSize {
+		return walEntry{}, 0, errors.New("incomplete record header")
+	}
+	n := int(binary.BigEndian.Uint32(data[0:4]))
+	if n < 9 || len(data)-walHeaderSize < n {
+		return walEntry{}, 0, errors.New("incomplete record")
+	}
+	payload := data[walHeaderSize : walHeaderSize+n]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[4:8]) {
+		return walEntry{}, 0, errors.New("record checksum mismatch")
+	}
+
+	e := walEntry{id: binary.BigEndian.Uint64(payload[1:9])}
+	switch payload[0] {
+	case walDone:
+	case walAppend:
+		e.points = []influxdb.Point{}
+		for _, line := range strings.Split(string(payload[9:]), "\n") {
+			if line == "" {
+				continue
+			}
+			db, rp, p, err := ingest.UnmarshalSpillLine(line)
+			if err != nil {
+				return walEntry{}, 0, fmt.Errorf("invalid point %q: %s", line, err)
+			}
+			e.database, e.retentionPolicy = db, rp
+			e.points = append(e.points, p)
+		}
+	default:
+		return walEntry{}, 0, fmt.Errorf("unknown record kind %q", payload[0])
+	}
+	return e, walHeaderSize + n, nil
+}
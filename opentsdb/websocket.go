@@ -0,0 +1,228 @@
+package opentsdb
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// websocketGUID is appended to the client key to compute the handshake accept key.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebSocketMessageSize is the maximum size of a single WebSocket message.
+const maxWebSocketMessageSize = 1 << 20
+
+// WebSocket frame opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// wsStatusProtocolError is the close status sent when a client breaks the protocol.
+const wsStatusProtocolError = 1002
+
+var (
+	// errWebSocketMessageTooLarge is returned when a message exceeds maxWebSocketMessageSize.
+	errWebSocketMessageTooLarge = errors.New("websocket message too large")
+
+	// errWebSocketUnmasked is returned when a client sends an unmasked
+	// frame, which RFC 6455 section 5.1 requires the server to reject.
+	errWebSocketUnmasked = errors.New("websocket frame not masked")
+)
+
+// serveWebSocket upgrades the request to a WebSocket connection and processes
+// "put" lines, one or more per text message, until the client closes it.
+func (h *Handler) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!headerContains(r.Header.Get("Connection"), "upgrade") {
+		httpError(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		httpError(w, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		log.Println("TSDBServer: unable to upgrade websocket: ", err)
+		return
+	}
+	defer conn.Close()
+
+	// Track the connection like those served by HandleConnection, so that
+	// Drain and Close stop it and it is counted as active.
+	c := h.server.newConnection()
+	c.setAddr(r.RemoteAddr)
+	c.connectedAt = time.Now()
+	c.lastActivity = c.connectedAt.UnixNano()
+	if !h.server.trackConn(conn, c) {
+		return
+	}
+	defer h.server.untrackConn(conn)
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	var message []byte
+	for {
+		fin, opcode, payload, err := readFrame(rw.Reader)
+		if err == errWebSocketUnmasked {
+			log.Println("TSDBServer:", err)
+			var status [2]byte
+			binary.BigEndian.PutUint16(status[:], wsStatusProtocolError)
+			writeFrame(rw.Writer, wsClose, status[:])
+			return
+		} else if err != nil {
+			// Connections closed by Drain, Close or the idle reaper end
+			// with a read error, which is not worth logging.
+			if err == errWebSocketMessageTooLarge {
+				log.Println("TSDBServer:", err)
+			}
+			return
+		}
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+
+		switch opcode {
+		case wsPing:
+			if err := writeFrame(rw.Writer, wsPong, payload); err != nil {
+				return
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			// Echo the status code back to complete the closing handshake.
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			writeFrame(rw.Writer, wsClose, payload)
+			return
+		case wsText, wsBinary, wsContinuation:
+		default:
+			log.Println("TSDBServer: unknown websocket opcode: ", opcode)
+			return
+		}
+
+		message = append(message, payload...)
+		if len(message) > maxWebSocketMessageSize {
+			log.Println("TSDBServer:", errWebSocketMessageTooLarge)
+			return
+		}
+		if !fin {
+			continue
+		}
+
+		for _, line := range strings.Split(string(message), "\n") {
+			if line = strings.TrimSpace(line); line == "" {
+				continue
+			}
+			if err := h.server.processLine(line, c); err != nil {
+				log.Println("TSDBServer:", err)
+			}
+		}
+		message = message[:0]
+	}
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept value for a client key.
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains returns true if the comma-separated header value contains token.
+func headerContains(value, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// readFrame reads a single WebSocket frame, unmasking the payload. Frames
+// sent by a client must be masked, so an unmasked frame is an error.
+func readFrame(r *bufio.Reader) (fin bool, opcode byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	fin = hdr[0]&0x80 != 0
+	opcode = hdr[0] & 0x0F
+	if hdr[1]&0x80 == 0 {
+		err = errWebSocketUnmasked
+		return
+	}
+
+	n := uint64(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(r, b[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(r, b[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if n > maxWebSocketMessageSize {
+		err = errWebSocketMessageTooLarge
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(r, mask[:]); err != nil {
+		return
+	}
+
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// writeFrame writes a single unmasked WebSocket frame and flushes w.
+func writeFrame(w *bufio.Writer, opcode byte, payload []byte) error {
+	w.WriteByte(0x80 | opcode)
+	switch n := len(payload); {
+	case n < 126:
+		w.WriteByte(byte(n))
+	case n <= 0xFFFF:
+		w.WriteByte(126)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		w.WriteByte(127)
+		binary.Write(w, binary.BigEndian, uint64(n))
+	}
+	w.Write(payload)
+	return w.Flush()
+}
@@ -0,0 +1,57 @@
+package opentsdb
+
+import (
+	"sync"
+
+	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/internal/ingest"
+)
+
+// PartialWriteError may be returned by a SeriesWriter when only some of the
+// points in a write failed. Any other error fails the whole write.
+type PartialWriteError = ingest.PartialWriteError
+
+// pendingWriter counts the points being written to an underlying writer, so
+// that a reader can wait for slow writes to complete.
+type pendingWriter struct {
+	writer SeriesWriter
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	n    int
+}
+
+func newPendingWriter(w SeriesWriter) *pendingWriter {
+	pw := &pendingWriter{writer: w}
+	pw.cond = sync.NewCond(&pw.mu)
+	return pw
+}
+
+// WriteSeries writes points to the underlying writer.
+func (w *pendingWriter) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	w.mu.Lock()
+	w.n += len(points)
+	w.mu.Unlock()
+
+	defer func() {
+		w.mu.Lock()
+		w.n -= len(points)
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	}()
+	return w.writer.WriteSeries(database, retentionPolicy, points)
+}
+
+// wait blocks while at least max points are being written. It returns true
+// if it had to wait.
+func (w *pendingWriter) wait(max int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var waited bool
+	for w.n >= max {
+		waited = true
+		w.cond.Wait()
+	}
+	return waited
+}
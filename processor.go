@@ -0,0 +1,35 @@
+package influxdb
+
+// PointProcessor transforms points received by an input plugin before they
+// are written. Process returns the points to write in place of p, which may
+// be p itself, a modified copy or several points, or false to drop p.
+// Points returned together share p's Tags map unless the processor copies it.
+type PointProcessor interface {
+	Process(p Point) ([]Point, bool)
+}
+
+// PointProcessorFunc adapts a function to a PointProcessor.
+type PointProcessorFunc func(p Point) ([]Point, bool)
+
+// Process calls f(p).
+func (f PointProcessorFunc) Process(p Point) ([]Point, bool) { return f(p) }
+
+// ProcessPoint applies processors to p in order, each to every point returned
+// by the one before, and returns the points remaining. It returns no points if
+// p is dropped.
+func ProcessPoint(processors []PointProcessor, p Point) []Point {
+	points := []Point{p}
+	for _, proc := range processors {
+		var next []Point
+		for _, p := range points {
+			if a, ok := proc.Process(p); ok {
+				next = append(next, a...)
+			}
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		points = next
+	}
+	return points
+}
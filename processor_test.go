@@ -0,0 +1,38 @@
+package influxdb_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/influxdb/influxdb"
+)
+
+func TestProcessPoint(t *testing.T) {
+	processors := []influxdb.PointProcessor{
+		// Drop debug points.
+		influxdb.PointProcessorFunc(func(p influxdb.Point) ([]influxdb.Point, bool) {
+			return []influxdb.Point{p}, p.Name != "debug"
+		}),
+		// Split a point with two fields into one per field.
+		influxdb.PointProcessorFunc(func(p influxdb.Point) ([]influxdb.Point, bool) {
+			var a []influxdb.Point
+			for k, v := range p.Fields {
+				a = append(a, influxdb.Point{Name: p.Name + "_" + k, Fields: map[string]interface{}{"value": v}})
+			}
+			return a, true
+		}),
+	}
+
+	if points := influxdb.ProcessPoint(processors, influxdb.Point{Name: "debug", Fields: map[string]interface{}{"value": 1.0}}); len(points) != 0 {
+		t.Fatalf("expected point to be dropped, got %v", points)
+	}
+
+	points := influxdb.ProcessPoint(processors, influxdb.Point{Name: "cpu", Fields: map[string]interface{}{"user": 1.0}})
+	if exp := []influxdb.Point{{Name: "cpu_user", Fields: map[string]interface{}{"value": 1.0}}}; !reflect.DeepEqual(points, exp) {
+		t.Fatalf("unexpected points.  expected %v, got %v", exp, points)
+	}
+
+	if points := influxdb.ProcessPoint(nil, influxdb.Point{Name: "cpu"}); len(points) != 1 || points[0].Name != "cpu" {
+		t.Fatalf("expected point to be unchanged without processors, got %v", points)
+	}
+}
@@ -1,6 +1,7 @@
 package influxdb
 
 import (
+	"encoding/json"
 	"sync"
 )
 
@@ -62,11 +63,15 @@ func (s *Stats) Inc(key string) {
 	s.Add(key, 1)
 }
 
-// Get returns a value for a given key.
+// Get returns a value for a given key. Zero is returned for unknown keys.
 func (s *Stats) Get(key string) int64 {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.m[key].i
+	i, ok := s.m[key]
+	if !ok {
+		return 0
+	}
+	return i.i
 }
 
 // Set sets a value for the given key.
@@ -112,3 +117,43 @@ func (s *Stats) Snapshot() *Stats {
 	})
 	return snap
 }
+
+// SnapshotAndReset returns a copy of the stats object, zeroing each entry as
+// it is copied so that every addition is counted in exactly one snapshot.
+// Entries named in keep, such as gauges, are copied but not zeroed.
+func (s *Stats) SnapshotAndReset(keep ...string) *Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snap := NewStats(s.name)
+	for k, v := range s.m {
+		v.mu.Lock()
+		snap.m[k] = NewInt(v.i)
+		if !containsString(keep, k) {
+			v.i = 0
+		}
+		v.mu.Unlock()
+	}
+	return snap
+}
+
+// containsString returns true if a contains s.
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the stats as a JSON object. This allows Stats to be
+// published with expvar.
+func (s *Stats) String() string {
+	m := make(map[string]int64)
+	s.Walk(func(k string, v int64) {
+		m[k] = v
+	})
+	b, _ := json.Marshal(m)
+	return string(b)
+}
@@ -1,6 +1,7 @@
 package influxdb_test
 
 import (
+	"sync"
 	"testing"
 
 	"github.com/influxdb/influxdb"
@@ -24,6 +25,47 @@ func TestStats_Add(t *testing.T) {
 	}
 }
 
+func TestStats_SnapshotAndReset(t *testing.T) {
+	s := influxdb.NewStats("foo")
+	s.Add("a", 100)
+	s.Add("b", 5)
+
+	snap := s.SnapshotAndReset("b")
+	if snap.Get("a") != 100 || snap.Get("b") != 5 {
+		t.Fatalf("unexpected snapshot: %s", snap)
+	} else if s.Get("a") != 0 {
+		t.Fatalf("stats SnapshotAndReset failed, expected 0, got %d", s.Get("a"))
+	} else if s.Get("b") != 5 {
+		t.Fatalf("stats SnapshotAndReset reset kept key, expected 5, got %d", s.Get("b"))
+	}
+}
+
+// Ensure no additions are lost between successive snapshots.
+func TestStats_SnapshotAndReset_Concurrent(t *testing.T) {
+	s := influxdb.NewStats("foo")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.Inc("a")
+			}
+		}()
+	}
+
+	var total int64
+	for i := 0; i < 100; i++ {
+		total += s.SnapshotAndReset().Get("a")
+	}
+	wg.Wait()
+	total += s.SnapshotAndReset().Get("a")
+	if total != 4000 {
+		t.Fatalf("unexpected total of snapshots, expected 4000, got %d", total)
+	}
+}
+
 func TestStats_Inc(t *testing.T) {
 	s := influxdb.NewStats("foo")
 
@@ -86,3 +128,21 @@ func TestStats_Snapshot(t *testing.T) {
 		t.Fatalf("stats snapshot returned unexpected result: %#v", bar)
 	}
 }
+
+func TestStats_GetUnknown(t *testing.T) {
+	s := influxdb.NewStats("foo")
+
+	if s.Get("a") != 0 {
+		t.Fatalf("stats get failed, expected 0, got %d", s.Get("a"))
+	}
+}
+
+func TestStats_String(t *testing.T) {
+	s := influxdb.NewStats("foo")
+	s.Set("a", 100)
+	s.Inc("b")
+
+	if str := s.String(); str != `{"a":100,"b":1}` {
+		t.Fatalf("unexpected string: %s", str)
+	}
+}
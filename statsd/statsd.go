@@ -0,0 +1,211 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdb/influxdb"
+)
+
+const (
+	// DefaultPort is the default port StatsD listens on.
+	DefaultPort = 8125
+
+	// DefaultFlushInterval is the default interval between writes of the
+	// aggregated timers.
+	DefaultFlushInterval = 10 * time.Second
+)
+
+// SeriesWriter defines the interface for the destination of the data.
+type SeriesWriter interface {
+	WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error)
+}
+
+// Server represents a UDP server which receives StatsD timers, aggregates
+// them and writes one point per timer each flush interval. Other StatsD
+// metric types are ignored.
+type Server struct {
+	wg   sync.WaitGroup
+	done chan struct{}
+
+	mu   sync.Mutex
+	conn *net.UDPConn
+
+	writer SeriesWriter
+
+	// Database and RetentionPolicy are where the timer points are written.
+	Database        string
+	RetentionPolicy string
+
+	// FlushInterval is the interval between writes of the aggregated
+	// timers. Defaults to DefaultFlushInterval.
+	FlushInterval time.Duration
+
+	// Timers aggregates the received timers between flushes.
+	Timers *Timers
+}
+
+// NewServer constructs a new Server.
+func NewServer(w SeriesWriter) *Server {
+	return &Server{
+		done:          make(chan struct{}),
+		writer:        w,
+		FlushInterval: DefaultFlushInterval,
+		Timers:        NewTimers(),
+	}
+}
+
+// ListenAndServe starts receiving StatsD metrics via UDP on iface. The
+// serving goroutines are only stopped when s.Close() is called, but
+// ListenAndServe returns immediately.
+func (s *Server) ListenAndServe(iface string) error {
+	if iface == "" {
+		return errors.New("bind address required")
+	} else if s.Database == "" {
+		return errors.New("database was not specified in config")
+	}
+	for _, p := range s.Timers.Percentiles {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("invalid percentile %v: must be between 0 and 100", p)
+		}
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", iface)
+	if err != nil {
+		return fmt.Errorf("unable to resolve UDP address: %v", err)
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on UDP: %v", err)
+	}
+
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	interval := s.FlushInterval
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+
+	s.wg.Add(2)
+	go s.serve(conn)
+	go s.flushEvery(interval)
+
+	return nil
+}
+
+// Addr returns the address the server is listening on, or nil if it is not
+// listening.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+func (s *Server) serve(conn *net.UDPConn) {
+	defer s.wg.Done()
+
+	// StatsD clients keep packets below the network MTU, but allow for the
+	// largest UDP payload in case they do not.
+	buffer := make([]byte, 65536)
+
+	for {
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-s.done:
+				// We closed the connection, time to go.
+				return
+			default:
+			}
+			log.Printf("StatsD ReadFromUDP error: %s", err)
+			continue
+		}
+		s.handleMessage(string(buffer[:n]))
+	}
+}
+
+// handleMessage adds each timer line of a packet to the timers.
+func (s *Server) handleMessage(msg string) {
+	for _, line := range strings.Split(msg, "\n") {
+		line = strings.TrimSpace(line)
+		if !isTimer(line) {
+			continue
+		}
+		if err := s.Timers.AddLine(line); err != nil {
+			log.Printf("StatsD parse error: %s", err)
+		}
+	}
+}
+
+// isTimer returns true if line has the "ms" type of a StatsD timer.
+func isTimer(line string) bool {
+	i := strings.LastIndex(line, ":")
+	if i < 0 {
+		return false
+	}
+	parts := strings.SplitN(line[i+1:], "|", 3)
+	return len(parts) >= 2 && parts[1] == "ms"
+}
+
+// flushEvery writes the aggregated timers every interval until the server
+// is closed.
+func (s *Server) flushEvery(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+// flush writes a point for each timer received since the last flush.
+func (s *Server) flush() {
+	points := s.Timers.Flush(time.Now())
+	if len(points) == 0 {
+		return
+	}
+	if _, err := s.writer.WriteSeries(s.Database, s.RetentionPolicy, points); err != nil {
+		log.Printf("StatsD cannot write data: %s", err)
+	}
+}
+
+// Close shuts down the server's listener and writes the timers received
+// since the last flush.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	conn := s.conn
+	s.conn = nil
+	s.mu.Unlock()
+	if conn == nil {
+		return errors.New("server already closed")
+	}
+
+	// Close the connection, and wait for the goroutines to exit.
+	conn.Close()
+	close(s.done)
+	s.wg.Wait()
+
+	// Nothing can add to the timers now, so write what is left.
+	s.flush()
+
+	log.Println("StatsD UDP closed")
+	return nil
+}
@@ -0,0 +1,83 @@
+package statsd_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/statsd"
+	"github.com/influxdb/influxdb/test"
+)
+
+// Ensure the server writes received timers each flush interval and ignores
+// other metric types.
+func TestServer_Flush(t *testing.T) {
+	var w test.MemWriter
+	s := statsd.NewServer(&w)
+	s.Database, s.RetentionPolicy = "db", "rp"
+	s.FlushInterval = 10 * time.Millisecond
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("api.latency:320|ms\napi.hits:1|c\napi.latency:100|ms|@0.5\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	points, err := w.WaitPoints(1)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(points) != 1 || points[0].Name != "api.latency" {
+		t.Fatalf("unexpected points: %v", points)
+	} else if n := points[0].Fields["count"]; n != 3.0 {
+		t.Fatalf("unexpected count.  expected 3, got %v", n)
+	} else if c := w.Calls()[0]; c.Database != "db" || c.RetentionPolicy != "rp" {
+		t.Fatalf("unexpected write target: %s.%s", c.Database, c.RetentionPolicy)
+	}
+}
+
+// Ensure closing the server writes the timers received since the last flush.
+func TestServer_Close(t *testing.T) {
+	var w test.MemWriter
+	s := statsd.NewServer(&w)
+	s.Database = "db"
+	s.FlushInterval = time.Hour
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Timers.Add("api.latency", 320, 1)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	} else if points := w.Points(); len(points) != 1 || points[0].Name != "api.latency" {
+		t.Fatalf("unexpected points: %v", points)
+	} else if s.Addr() != nil {
+		t.Fatalf("unexpected address after close: %v", s.Addr())
+	}
+
+	if err := s.Close(); err == nil {
+		t.Fatal("expected error closing twice")
+	}
+}
+
+func TestServer_ListenAndServe_NoDatabase(t *testing.T) {
+	s := statsd.NewServer(&test.MemWriter{})
+	if err := s.ListenAndServe("127.0.0.1:0"); err == nil || err.Error() != "database was not specified in config" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestServer_ListenAndServe_InvalidPercentile(t *testing.T) {
+	s := statsd.NewServer(&test.MemWriter{})
+	s.Database = "db"
+	s.Timers.Percentiles = []float64{90, 150}
+	if err := s.ListenAndServe("127.0.0.1:0"); err == nil || err.Error() != "invalid percentile 150: must be between 0 and 100" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdb/influxdb"
+)
+
+// DefaultPercentiles are the percentiles reported for each timer by default.
+var DefaultPercentiles = []float64{50, 90, 99}
+
+const (
+	// DefaultRelativeAccuracy is the default relative accuracy of the
+	// reported percentiles.
+	DefaultRelativeAccuracy = 0.01
+
+	// DefaultMaxBuckets is the default maximum number of buckets held for
+	// each timer between flushes.
+	DefaultMaxBuckets = 2048
+)
+
+// Timers aggregates StatsD timer values, such as "api.latency:320|ms|@0.1",
+// into one point per timer each flush interval. Each point has count, min,
+// max and mean fields and a field for each percentile, named "p" followed by
+// the percentile with any "." replaced by "_", such as "p99" or "p99_9".
+//
+// Values are counted in exponentially sized buckets rather than kept, so the
+// memory used by a timer is bounded by MaxBuckets however many values it
+// receives. Percentiles are approximated from the buckets; min, max and mean
+// are exact.
+type Timers struct {
+	// Percentiles are the percentiles, between 0 and 100, reported for each
+	// timer. Defaults to DefaultPercentiles.
+	Percentiles []float64
+
+	// RelativeAccuracy bounds the relative error of a reported percentile,
+	// so 0.01 reports a value within 1% of the exact one. Each bucket spans
+	// values up to (1+a)/(1-a) times its lower bound. Changes apply to
+	// timers created after the next flush. Defaults to
+	// DefaultRelativeAccuracy.
+	RelativeAccuracy float64
+
+	// MaxBuckets is the maximum number of buckets held for a timer. Once a
+	// timer holds more, its lowest buckets are merged, which loses accuracy
+	// only for the lowest percentiles. Defaults to DefaultMaxBuckets.
+	MaxBuckets int
+
+	mu     sync.Mutex
+	timers map[string]*timer
+}
+
+// timer holds the buckets of the values received for a single timer since
+// the last flush. Values at or below zero are counted in a separate bucket.
+type timer struct {
+	logGamma float64
+	buckets  map[int]int
+	zeros    int
+
+	n             int
+	count         float64
+	min, max, sum float64
+}
+
+// NewTimers returns a new instance of Timers.
+func NewTimers() *Timers {
+	return &Timers{
+		Percentiles:      DefaultPercentiles,
+		RelativeAccuracy: DefaultRelativeAccuracy,
+		MaxBuckets:       DefaultMaxBuckets,
+		timers:           make(map[string]*timer),
+	}
+}
+
+// ParseTimer parses a StatsD timer line of the form "name:value|ms", with an
+// optional "|@rate" sample rate. The sample rate is 1 if it is not given.
+func ParseTimer(line string) (name string, value, sampleRate float64, err error) {
+	i := strings.LastIndex(line, ":")
+	if i <= 0 {
+		return "", 0, 0, fmt.Errorf("received %q which has no name", line)
+	}
+	name = line[:i]
+
+	parts := strings.Split(line[i+1:], "|")
+	if len(parts) < 2 || len(parts) > 3 || parts[1] != "ms" {
+		return "", 0, 0, fmt.Errorf("received %q which is not a timer", line)
+	}
+	if value, err = strconv.ParseFloat(parts[0], 64); err != nil {
+		return "", 0, 0, fmt.Errorf("received %q whose value is invalid: %s", line, err)
+	}
+
+	sampleRate = 1
+	if len(parts) == 3 {
+		if !strings.HasPrefix(parts[2], "@") {
+			return "", 0, 0, fmt.Errorf("received %q whose sample rate is invalid", line)
+		}
+		sampleRate, err = strconv.ParseFloat(parts[2][1:], 64)
+		if err != nil || sampleRate <= 0 || sampleRate > 1 {
+			return "", 0, 0, fmt.Errorf("received %q whose sample rate is invalid", line)
+		}
+	}
+	return name, value, sampleRate, nil
+}
+
+// Add records a value for the timer name, sent at sampleRate. The count of
+// the timer is scaled by the sample rate, so a value sent at a rate of 0.1
+// counts as ten. Rates outside (0, 1] are treated as 1.
+func (t *Timers) Add(name string, value, sampleRate float64) {
+	if sampleRate <= 0 || sampleRate > 1 {
+		sampleRate = 1
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tm := t.timers[name]
+	if tm == nil {
+		tm = newTimer(t.RelativeAccuracy)
+		t.timers[name] = tm
+	}
+	tm.add(value, t.MaxBuckets)
+	tm.count += 1 / sampleRate
+}
+
+// AddLine parses a timer line with ParseTimer and records its value.
+func (t *Timers) AddLine(line string) error {
+	name, value, sampleRate, err := ParseTimer(line)
+	if err != nil {
+		return err
+	}
+	t.Add(name, value, sampleRate)
+	return nil
+}
+
+// Flush returns a point for each timer with values added since the last
+// flush, timestamped now and ordered by name, and resets the timers.
+func (t *Timers) Flush(now time.Time) []influxdb.Point {
+	t.mu.Lock()
+	timers := t.timers
+	t.timers = make(map[string]*timer)
+	t.mu.Unlock()
+
+	names := make([]string, 0, len(timers))
+	for name := range timers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	points := make([]influxdb.Point, 0, len(names))
+	for _, name := range names {
+		points = append(points, influxdb.Point{
+			Name:      name,
+			Timestamp: now,
+			Fields:    timers[name].fields(t.Percentiles),
+		})
+	}
+	return points
+}
+
+// newTimer returns a timer whose buckets give the relative accuracy a. An a
+// outside (0, 1) is treated as DefaultRelativeAccuracy.
+func newTimer(a float64) *timer {
+	if a <= 0 || a >= 1 {
+		a = DefaultRelativeAccuracy
+	}
+	return &timer{
+		logGamma: math.Log((1 + a) / (1 - a)),
+		buckets:  make(map[int]int),
+	}
+}
+
+// add counts v in its bucket, merging the lowest buckets while the timer
+// holds more than maxBuckets.
+func (tm *timer) add(v float64, maxBuckets int) {
+	if tm.n == 0 || v < tm.min {
+		tm.min = v
+	}
+	if tm.n == 0 || v > tm.max {
+		tm.max = v
+	}
+	tm.n++
+	tm.sum += v
+
+	if v <= 0 {
+		tm.zeros++
+		return
+	}
+	tm.buckets[int(math.Ceil(math.Log(v)/tm.logGamma))]++
+
+	if maxBuckets <= 0 {
+		maxBuckets = DefaultMaxBuckets
+	}
+	for len(tm.buckets) > maxBuckets {
+		lowest, next := tm.lowestBuckets()
+		tm.buckets[next] += tm.buckets[lowest]
+		delete(tm.buckets, lowest)
+	}
+}
+
+// lowestBuckets returns the indexes of the two lowest buckets.
+func (tm *timer) lowestBuckets() (lowest, next int) {
+	lowest, next = math.MaxInt32, math.MaxInt32
+	for i := range tm.buckets {
+		if i < lowest {
+			lowest, next = i, lowest
+		} else if i < next {
+			next = i
+		}
+	}
+	return lowest, next
+}
+
+// fields returns the summary fields of the timer's values.
+func (tm *timer) fields(percentiles []float64) map[string]interface{} {
+	indexes := make([]int, 0, len(tm.buckets))
+	for i := range tm.buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	fields := map[string]interface{}{
+		"count": tm.count,
+		"min":   tm.min,
+		"max":   tm.max,
+		"mean":  tm.sum / float64(tm.n),
+	}
+	for _, p := range percentiles {
+		fields[percentileField(p)] = tm.percentile(indexes, p)
+	}
+	return fields
+}
+
+// percentile returns the nearest-rank percentile p of the timer's values,
+// approximated by the value its bucket represents. The buckets are walked
+// in the order of indexes, which must be sorted.
+func (tm *timer) percentile(indexes []int, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(tm.n)))
+	if rank < 1 {
+		rank = 1
+	} else if rank > tm.n {
+		rank = tm.n
+	}
+
+	v := tm.max
+	if rank <= tm.zeros {
+		v = 0
+	} else {
+		seen := tm.zeros
+		for _, i := range indexes {
+			if seen += tm.buckets[i]; seen >= rank {
+				// A bucket holds values in (g^(i-1), g^i], and this value
+				// is within the relative accuracy of all of them.
+				gamma := math.Exp(tm.logGamma)
+				v = 2 * math.Pow(gamma, float64(i)) / (gamma + 1)
+				break
+			}
+		}
+	}
+
+	// The exact bounds are known, so never report a value outside them.
+	if v < tm.min {
+		v = tm.min
+	} else if v > tm.max {
+		v = tm.max
+	}
+	return v
+}
+
+// percentileField returns the field name for percentile p.
+func percentileField(p float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", -1)
+}
@@ -0,0 +1,144 @@
+package statsd_test
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/statsd"
+)
+
+func TestTimers_Flush(t *testing.T) {
+	timers := statsd.NewTimers()
+	timers.Percentiles = []float64{50, 90, 99, 99.9}
+
+	// Values 1 to 100 give known percentiles.
+	for i := 1; i <= 100; i++ {
+		timers.Add("api.latency", float64(i), 1)
+	}
+	timers.Add("db.latency", 5, 1)
+
+	now := time.Unix(1419972457, 0)
+	points := timers.Flush(now)
+	if len(points) != 2 {
+		t.Fatalf("unexpected number of points.  expected 2, got %d", len(points))
+	}
+
+	// Count, min, max and mean are exact. Percentiles are approximated from
+	// the buckets, within the relative accuracy.
+	if p := points[0]; p.Name != "api.latency" || !p.Timestamp.Equal(now) {
+		t.Fatalf("unexpected point: %v", p)
+	} else if exp := map[string]interface{}{
+		"count": 100.0, "min": 1.0, "max": 100.0, "mean": 50.5,
+	}; !reflect.DeepEqual(exactFields(p.Fields), exp) {
+		t.Fatalf("unexpected fields.  expected %v, got %v", exp, p.Fields)
+	} else {
+		for field, exp := range map[string]float64{"p50": 50, "p90": 90, "p99": 99, "p99_9": 100} {
+			if v := p.Fields[field].(float64); !approx(v, exp, statsd.DefaultRelativeAccuracy) {
+				t.Fatalf("unexpected %s.  expected %v, got %v", field, exp, v)
+			}
+		}
+	}
+
+	// A single value is reported exactly, since percentiles never fall
+	// outside the min and max.
+	if p := points[1]; p.Name != "db.latency" {
+		t.Fatalf("unexpected point: %v", p)
+	} else if exp := map[string]interface{}{
+		"count": 1.0, "min": 5.0, "max": 5.0, "mean": 5.0,
+		"p50": 5.0, "p90": 5.0, "p99": 5.0, "p99_9": 5.0,
+	}; !reflect.DeepEqual(p.Fields, exp) {
+		t.Fatalf("unexpected fields.  expected %v, got %v", exp, p.Fields)
+	}
+
+	// Flushing resets the timers.
+	if points := timers.Flush(now); len(points) != 0 {
+		t.Fatalf("unexpected points after flush: %v", points)
+	}
+}
+
+func TestTimers_AddLine_SampleRate(t *testing.T) {
+	timers := statsd.NewTimers()
+	for _, line := range []string{"api.latency:320|ms|@0.1", "api.latency:100|ms|@0.5", "api.latency:200|ms"} {
+		if err := timers.AddLine(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	points := timers.Flush(time.Unix(1419972457, 0))
+	if len(points) != 1 {
+		t.Fatalf("unexpected number of points.  expected 1, got %d", len(points))
+	} else if n := points[0].Fields["count"]; n != 13.0 {
+		t.Fatalf("unexpected count.  expected 13, got %v", n)
+	} else if v := points[0].Fields["p50"].(float64); !approx(v, 200, statsd.DefaultRelativeAccuracy) {
+		t.Fatalf("unexpected p50.  expected 200, got %v", v)
+	}
+}
+
+func TestTimers_Flush_Zero(t *testing.T) {
+	timers := statsd.NewTimers()
+	for _, v := range []float64{0, 0, 0, 10} {
+		timers.Add("api.latency", v, 1)
+	}
+
+	p := timers.Flush(time.Unix(1419972457, 0))[0]
+	if v := p.Fields["p50"]; v != 0.0 {
+		t.Fatalf("unexpected p50.  expected 0, got %v", v)
+	} else if v := p.Fields["p99"]; v != 10.0 {
+		t.Fatalf("unexpected p99.  expected 10, got %v", v)
+	}
+}
+
+// Ensure a timer's lowest buckets are merged once it holds MaxBuckets, and
+// that the high percentiles keep their accuracy.
+func TestTimers_MaxBuckets(t *testing.T) {
+	timers := statsd.NewTimers()
+	timers.MaxBuckets = 16
+
+	// Values spread over many more buckets than the timer may hold.
+	for i := 1; i <= 100000; i++ {
+		timers.Add("api.latency", float64(i), 1)
+	}
+
+	p := timers.Flush(time.Unix(1419972457, 0))[0]
+	if exp := map[string]interface{}{
+		"count": 100000.0, "min": 1.0, "max": 100000.0, "mean": 50000.5,
+	}; !reflect.DeepEqual(exactFields(p.Fields), exp) {
+		t.Fatalf("unexpected fields.  expected %v, got %v", exp, p.Fields)
+	} else if v := p.Fields["p99"].(float64); !approx(v, 99000, statsd.DefaultRelativeAccuracy) {
+		t.Fatalf("unexpected p99.  expected 99000, got %v", v)
+	} else if v := p.Fields["p50"].(float64); v > 99000 {
+		t.Fatalf("unexpected p50.  expected at most 99000, got %v", v)
+	}
+}
+
+func TestParseTimer_Invalid(t *testing.T) {
+	for _, line := range []string{
+		"api.latency",
+		":320|ms",
+		"api.latency:320|c",
+		"api.latency:abc|ms",
+		"api.latency:320|ms|0.1",
+		"api.latency:320|ms|@0",
+		"api.latency:320|ms|@1.5",
+	} {
+		if _, _, _, err := statsd.ParseTimer(line); err == nil {
+			t.Fatalf("expected error for %q", line)
+		}
+	}
+}
+
+// exactFields returns the fields of a timer point that are not approximated.
+func exactFields(fields map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{})
+	for _, k := range []string{"count", "min", "max", "mean"} {
+		m[k] = fields[k]
+	}
+	return m
+}
+
+// approx returns true if v is within the relative accuracy a of exp.
+func approx(v, exp, a float64) bool {
+	return math.Abs(v-exp) <= a*exp
+}
@@ -0,0 +1,77 @@
+package test
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/influxdb/influxdb"
+)
+
+// WriteSeriesCall records the arguments of a single call to MemWriter.WriteSeries.
+type WriteSeriesCall struct {
+	Database        string
+	RetentionPolicy string
+	Points          []influxdb.Point
+}
+
+// MemWriter is a series writer which records every write in memory. It
+// satisfies the SeriesWriter interfaces of the input plugins. The zero value
+// is ready to use.
+type MemWriter struct {
+	mu    sync.Mutex
+	calls []WriteSeriesCall
+}
+
+// WriteSeries records the write and always succeeds.
+func (w *MemWriter) WriteSeries(database, retentionPolicy string, points []influxdb.Point) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.calls = append(w.calls, WriteSeriesCall{
+		Database:        database,
+		RetentionPolicy: retentionPolicy,
+		Points:          append([]influxdb.Point(nil), points...),
+	})
+	return 0, nil
+}
+
+// Calls returns a copy of the writes recorded so far.
+func (w *MemWriter) Calls() []WriteSeriesCall {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]WriteSeriesCall(nil), w.calls...)
+}
+
+// Points returns the points of every write recorded so far, in order.
+func (w *MemWriter) Points() []influxdb.Point {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var points []influxdb.Point
+	for _, c := range w.calls {
+		points = append(points, c.Points...)
+	}
+	return points
+}
+
+// WaitPoints waits up to a second for at least n points to be written and returns them.
+func (w *MemWriter) WaitPoints(n int) ([]influxdb.Point, error) {
+	timeout := time.After(time.Second)
+	for {
+		if points := w.Points(); len(points) >= n {
+			return points, nil
+		}
+		select {
+		case <-timeout:
+			return nil, fmt.Errorf("unexpected point count: expected: %d, actual: %d", n, len(w.Points()))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Reset discards all recorded writes.
+func (w *MemWriter) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.calls = nil
+}
@@ -0,0 +1,60 @@
+package test_test
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/test"
+)
+
+// Ensure the writer records each call and its points.
+func TestMemWriter_WriteSeries(t *testing.T) {
+	var w test.MemWriter
+	p1 := influxdb.Point{Name: "cpu", Timestamp: time.Unix(1, 0), Fields: map[string]interface{}{"value": 1.0}}
+	p2 := influxdb.Point{Name: "mem", Timestamp: time.Unix(2, 0), Fields: map[string]interface{}{"value": 2.0}}
+
+	w.WriteSeries("db0", "rp0", []influxdb.Point{p1})
+	w.WriteSeries("db1", "rp1", []influxdb.Point{p2})
+
+	exp := []test.WriteSeriesCall{
+		{Database: "db0", RetentionPolicy: "rp0", Points: []influxdb.Point{p1}},
+		{Database: "db1", RetentionPolicy: "rp1", Points: []influxdb.Point{p2}},
+	}
+	if calls := w.Calls(); !reflect.DeepEqual(calls, exp) {
+		t.Fatalf("unexpected calls: %v", calls)
+	}
+	if points := w.Points(); !reflect.DeepEqual(points, []influxdb.Point{p1, p2}) {
+		t.Fatalf("unexpected points: %v", points)
+	}
+
+	w.Reset()
+	if calls := w.Calls(); len(calls) != 0 {
+		t.Fatalf("unexpected calls after reset: %v", calls)
+	}
+}
+
+// Ensure the writer can be written to concurrently and waited on.
+func TestMemWriter_WaitPoints(t *testing.T) {
+	var w test.MemWriter
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.WriteSeries("db", "rp", []influxdb.Point{{Name: "cpu"}})
+		}()
+	}
+
+	if _, err := w.WaitPoints(10); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if _, err := w.WaitPoints(11); err == nil {
+		t.Fatal("expected timeout waiting for points")
+	}
+}